@@ -0,0 +1,452 @@
+package omniscient
+
+// NoteRole is what a principal a note is shared with can do to it.
+type NoteRole string
+
+const (
+	// NoteReader can read a note.
+	NoteReader NoteRole = "reader"
+	// NoteEditor can read and change the content of a note.
+	NoteEditor NoteRole = "editor"
+)
+
+// noteAccess is what a principal can do to a note. Each level allows
+// everything the levels below it do.
+type noteAccess int
+
+const (
+	noteAccessNone noteAccess = iota
+	noteAccessRead
+	noteAccessEdit
+	// noteAccessOwn allows deleting the note and changing who it is
+	// shared with.
+	noteAccessOwn
+)
+
+// ErrNoteForbidden is returned when a principal can see a note, but was not
+// given the role needed to change it.
+var ErrNoteForbidden = &NoteError{Code: CodeForbidden, Message: "note was not shared with you for this"}
+
+// accessTo returns what p can do to n. Admins can do anything to any note.
+// Notes without an owner were created before authentication was enabled,
+// so only admins can access them.
+func accessTo(p *Principal, n *Note) noteAccess {
+	switch {
+	case p.HasScope(ScopeAdmin):
+		return noteAccessOwn
+	case n.Owner != "" && n.Owner == p.ID:
+		return noteAccessOwn
+	}
+
+	switch n.Shares[p.ID] {
+	case NoteEditor:
+		return noteAccessEdit
+	case NoteReader:
+		return noteAccessRead
+	}
+
+	return noteAccessNone
+}
+
+// ACLNoteRepository is a NoteRepository which only lets a principal see
+// the notes they own or which were shared with them, and change them as
+// their role allows. Notes a principal can't see are not found, so their
+// ids aren't leaked.
+type ACLNoteRepository struct {
+	nr NoteRepository
+	p  *Principal
+}
+
+var _ NoteRepository = (*ACLNoteRepository)(nil)
+
+// NewACLNoteRepository creates an instance of ACLNoteRepository for
+// requests made by p.
+func NewACLNoteRepository(nr NoteRepository, p *Principal) *ACLNoteRepository {
+	return &ACLNoteRepository{nr: nr, p: p}
+}
+
+// Create creates a note owned by the principal. If the principal chose an
+// id which is taken by a note they can't read, ErrNoteForbidden is returned
+// rather than ErrNoteExists, the same as for changing a note they can't.
+func (ar *ACLNoteRepository) Create(content string, opts ...NoteOption) (*Note, error) {
+	n, err := ar.nr.Create(content, append(opts, NoteOwner(ar.p.ID))...)
+	if err != ErrNoteExists {
+		return n, err
+	}
+
+	var chosen Note
+	for _, opt := range opts {
+		opt(&chosen)
+	}
+
+	existing, rerr := ar.nr.Retrieve(chosen.ID)
+	switch {
+	case rerr == ErrNoteNotFound:
+	case rerr != nil:
+		return nil, rerr
+	case !ar.canRead(existing):
+		return nil, ErrNoteForbidden
+	}
+
+	return nil, err
+}
+
+// Retrieve retrieves a note the principal can read.
+func (ar *ACLNoteRepository) Retrieve(id string) (*Note, error) {
+	return ar.check(ar.nr.Retrieve(id))
+}
+
+// RetrieveBySlug retrieves a note the principal can read by its slug.
+func (ar *ACLNoteRepository) RetrieveBySlug(slug string) (*Note, error) {
+	return ar.check(ar.nr.RetrieveBySlug(slug))
+}
+
+// RetrieveMany retrieves the notes with ids. Notes the principal can't
+// read are nil, as if they didn't exist.
+func (ar *ACLNoteRepository) RetrieveMany(ids []string) ([]*Note, error) {
+	notes, err := ar.nr.RetrieveMany(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range notes {
+		if n != nil && !ar.canRead(n) {
+			notes[i] = nil
+		}
+	}
+
+	return notes, nil
+}
+
+// Update updates a note the principal can edit. Only the owner can change
+// who the note is shared with. The update is made as a patch, so access
+// can't change between the check and the update.
+func (ar *ACLNoteRepository) Update(id, content string, opts ...NoteOption) (*Note, error) {
+	return ar.Patch(id, func(n *Note) error {
+		n.Content = content
+		for _, opt := range opts {
+			opt(n)
+		}
+
+		return nil
+	})
+}
+
+// Patch atomically applies fn to a note the principal can edit. Access is
+// checked against the note fn is applied to, so it can't change between
+// the check and the patch.
+func (ar *ACLNoteRepository) Patch(id string, fn func(*Note) error) (*Note, error) {
+	return ar.nr.Patch(id, func(n *Note) error {
+		before := *n
+		if err := fn(n); err != nil {
+			return err
+		}
+
+		return ar.checkChange(&before, n)
+	})
+}
+
+// Delete deletes a note the principal owns.
+func (ar *ACLNoteRepository) Delete(id string) error {
+	n, err := ar.Retrieve(id)
+	if err != nil {
+		return err
+	}
+
+	if accessTo(ar.p, n) < noteAccessOwn {
+		return ErrNoteForbidden
+	}
+
+	return ar.nr.Delete(id)
+}
+
+// List lists the notes the principal can read.
+func (ar *ACLNoteRepository) List() ([]Note, error) {
+	notes, err := ar.nr.List()
+	if err != nil || ar.p.HasScope(ScopeAdmin) {
+		return notes, err
+	}
+
+	return ar.filter(notes), nil
+}
+
+// ListPage lists up to limit of the notes the principal can read, starting
+// at offset among them. Offsets count only those notes, so the catalog is
+// walked to find the page.
+func (ar *ACLNoteRepository) ListPage(offset, limit int64) ([]Note, bool, error) {
+	if ar.p.HasScope(ScopeAdmin) {
+		return ar.nr.ListPage(offset, limit)
+	}
+
+	notes := []Note{}
+	more := false
+	seen := int64(0)
+
+	err := ar.Walk(func(n *Note) error {
+		seen++
+		switch {
+		case seen <= offset:
+			return nil
+		case int64(len(notes)) == limit:
+			more = true
+			return errStopWalk
+		}
+
+		notes = append(notes, *n)
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, false, err
+	}
+
+	return notes, more, nil
+}
+
+// Walk calls fn for each note the principal can read.
+func (ar *ACLNoteRepository) Walk(fn func(*Note) error) error {
+	return ar.nr.Walk(func(n *Note) error {
+		if !ar.canRead(n) {
+			return nil
+		}
+
+		return fn(n)
+	})
+}
+
+// Import imports a note owned by the principal. Only admins can import
+// notes as they are, with their owner; anyone else can only overwrite the
+// notes they own.
+func (ar *ACLNoteRepository) Import(note *Note, overwrite bool) (bool, error) {
+	if ar.p.HasScope(ScopeAdmin) {
+		return ar.nr.Import(note, overwrite)
+	}
+
+	if note.ID != "" {
+		n, err := ar.nr.Retrieve(note.ID)
+		switch {
+		case err == ErrNoteNotFound:
+		case err != nil:
+			return false, err
+		case !overwrite:
+			return false, ErrNoteExists
+		case accessTo(ar.p, n) < noteAccessOwn:
+			return false, ErrNoteForbidden
+		}
+	}
+
+	note.Owner = ar.p.ID
+	return ar.nr.Import(note, overwrite)
+}
+
+// Transact runs ops atomically if the principal is allowed to run each of
+// them. The first operation on each existing note is made to expect the
+// version access was checked against, so access can't change before the
+// transaction runs.
+func (ar *ACLNoteRepository) Transact(ops []NoteOp) ([]*Note, error) {
+	checked := make([]NoteOp, len(ops))
+	created := map[string]bool{}
+	versioned := map[string]bool{}
+
+	for i, op := range ops {
+		if op.Kind == NoteOpCreate {
+			var n Note
+			for _, opt := range op.Options {
+				opt(&n)
+			}
+			if n.ID != "" {
+				created[n.ID] = true
+			}
+
+			op.Options = append(op.Options, NoteOwner(ar.p.ID))
+			checked[i] = op
+			continue
+		}
+
+		// the principal owns the notes it creates.
+		if created[op.ID] {
+			checked[i] = op
+			continue
+		}
+
+		n, err := ar.Retrieve(op.ID)
+		if err != nil {
+			return nil, &OpError{Index: i, Err: err}
+		}
+
+		switch op.Kind {
+		case NoteOpUpdate:
+			updated := *n
+			for _, opt := range op.Options {
+				opt(&updated)
+			}
+			err = ar.checkChange(n, &updated)
+		case NoteOpDelete:
+			if accessTo(ar.p, n) < noteAccessOwn {
+				err = ErrNoteForbidden
+			}
+		}
+		if err != nil {
+			return nil, &OpError{Index: i, Err: err}
+		}
+
+		if op.Kind != NoteOpRetrieve && !versioned[op.ID] {
+			versioned[op.ID] = true
+			if op.Version == 0 {
+				op.Version = n.Version
+			}
+		}
+		checked[i] = op
+	}
+
+	return ar.nr.Transact(checked)
+}
+
+// ChangeSeq returns the current position in the change sequence.
+func (ar *ACLNoteRepository) ChangeSeq() (int64, error) {
+	return ar.nr.ChangeSeq()
+}
+
+// Changes returns the changes since since to the notes the principal can
+// read. Notes which were deleted, or which the principal can no longer
+// read, are returned as deleted to the principals who could read them.
+func (ar *ACLNoteRepository) Changes(since, limit int64) (*NoteChanges, error) {
+	changes, err := ar.nr.Changes(since, limit)
+	if err != nil || ar.p.HasScope(ScopeAdmin) {
+		return changes, err
+	}
+
+	gone := changes.Deleted
+	visible := []Note{}
+	for i := range changes.Notes {
+		if ar.canRead(&changes.Notes[i]) {
+			visible = append(visible, changes.Notes[i])
+		} else {
+			gone = append(gone, changes.Notes[i].ID)
+		}
+	}
+
+	deleted, err := ar.lost(gone)
+	if err != nil {
+		return nil, err
+	}
+
+	changes.Notes = visible
+	changes.Deleted = deleted
+	return changes, nil
+}
+
+// Readers returns who has been able to read the notes with ids.
+func (ar *ACLNoteRepository) Readers(ids []string) ([][]string, error) {
+	return ar.nr.Readers(ids)
+}
+
+// lost returns the ids of the notes the principal could read before. ids
+// are notes which are gone, or which the principal can't read now.
+func (ar *ACLNoteRepository) lost(ids []string) ([]string, error) {
+	lost := []string{}
+	if len(ids) == 0 {
+		return lost, nil
+	}
+
+	readers, err := ar.nr.Readers(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		for _, r := range readers[i] {
+			if r == ar.p.ID {
+				lost = append(lost, id)
+				break
+			}
+		}
+	}
+
+	return lost, nil
+}
+
+// lostAccess returns true if the principal could read the note with id
+// before, but it was deleted or they can't read it anymore.
+func (ar *ACLNoteRepository) lostAccess(id string) (bool, error) {
+	lost, err := ar.lost([]string{id})
+	return len(lost) > 0, err
+}
+
+// SnapshotList snapshots every note for listing. The notes are filtered as
+// the snapshot is listed.
+func (ar *ACLNoteRepository) SnapshotList() (string, error) {
+	return ar.nr.SnapshotList()
+}
+
+// ListSnapshot lists the notes the principal can read in a page of the
+// snapshot. Offsets count every note in the snapshot, so pages can have
+// fewer than limit notes, even when there are more.
+func (ar *ACLNoteRepository) ListSnapshot(snapshot string, offset, limit int64) ([]Note, bool, error) {
+	notes, more, err := ar.nr.ListSnapshot(snapshot, offset, limit)
+	if err != nil || ar.p.HasScope(ScopeAdmin) {
+		return notes, more, err
+	}
+
+	return ar.filter(notes), more, nil
+}
+
+func (ar *ACLNoteRepository) canRead(n *Note) bool {
+	return accessTo(ar.p, n) >= noteAccessRead
+}
+
+// check passes on n if the principal can read it.
+func (ar *ACLNoteRepository) check(n *Note, err error) (*Note, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if !ar.canRead(n) {
+		return nil, ErrNoteNotFound
+	}
+
+	return n, nil
+}
+
+// checkChange returns an error if the principal can't change before into
+// after.
+func (ar *ACLNoteRepository) checkChange(before, after *Note) error {
+	access := accessTo(ar.p, before)
+	switch {
+	case access == noteAccessNone:
+		return ErrNoteNotFound
+	case access < noteAccessEdit:
+		return ErrNoteForbidden
+	case access < noteAccessOwn &&
+		(after.Owner != before.Owner || !sameShares(after.Shares, before.Shares)):
+		return ErrNoteForbidden
+	case after.Owner == "" && before.Owner != "":
+		return ErrNoteForbidden
+	}
+
+	return nil
+}
+
+func (ar *ACLNoteRepository) filter(notes []Note) []Note {
+	visible := []Note{}
+	for i := range notes {
+		if ar.canRead(&notes[i]) {
+			visible = append(visible, notes[i])
+		}
+	}
+
+	return visible
+}
+
+func sameShares(a, b map[string]NoteRole) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for id, role := range a {
+		if b[id] != role {
+			return false
+		}
+	}
+
+	return true
+}
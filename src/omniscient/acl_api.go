@@ -0,0 +1,64 @@
+package omniscient
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+// maxNoteShares is how many principals a note can be shared with.
+const maxNoteShares = 100
+
+type shareNoteReq struct {
+	// Shares are the roles principals have on the note, by principal id.
+	// They replace the shares the note had.
+	Shares map[string]NoteRole `json:"shares"`
+}
+
+func (snr *shareNoteReq) validate(v *validation, prefix string) {
+	field := fieldName(prefix, "shares")
+	if len(snr.Shares) > maxNoteShares {
+		v.add(field, CodeTooLong, "a note can be shared with at most %d principals", maxNoteShares)
+		return
+	}
+
+	// sorted, so the first invalid share reported is always the same.
+	ids := make([]string, 0, len(snr.Shares))
+	for id := range snr.Shares {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		switch {
+		case id == "":
+			v.add(field, CodeInvalidValue, "shares must be keyed by principal id")
+			return
+		case snr.Shares[id] != NoteReader && snr.Shares[id] != NoteEditor:
+			v.add(fieldName(field, id), CodeInvalidValue, "role must be %s or %s", NoteReader, NoteEditor)
+			return
+		}
+	}
+}
+
+// shareNote sets who a note is shared with. Only the owner of a note can
+// share it.
+func (a *App) shareNote() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		snr := &shareNoteReq{}
+		if err := a.bind(c, snr); err != nil {
+			return err
+		}
+
+		note, err := a.notes(c).Patch(c.Param("id"), func(n *Note) error {
+			n.Shares = snr.Shares
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, note)
+	}
+}
@@ -0,0 +1,309 @@
+package omniscient
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var (
+	aclOwner  = &Principal{ID: "owner", Scopes: []string{ScopeNotesWrite}}
+	aclEditor = &Principal{ID: "editor", Scopes: []string{ScopeNotesWrite}}
+	aclReader = &Principal{ID: "reader", Scopes: []string{ScopeNotesWrite}}
+	aclOther  = &Principal{ID: "other", Scopes: []string{ScopeNotesWrite}}
+	aclAdmin  = &Principal{ID: "admin", Scopes: []string{ScopeAdmin}}
+)
+
+func sharedNote(id string) *Note {
+	return &Note{
+		ID:      id,
+		Owner:   "owner",
+		Version: 3,
+		Shares:  map[string]NoteRole{"editor": NoteEditor, "reader": NoteReader},
+	}
+}
+
+func TestAccessTo(t *testing.T) {
+	n := sharedNote("1")
+
+	assert.Equal(t, noteAccessOwn, accessTo(aclOwner, n))
+	assert.Equal(t, noteAccessEdit, accessTo(aclEditor, n))
+	assert.Equal(t, noteAccessRead, accessTo(aclReader, n))
+	assert.Equal(t, noteAccessNone, accessTo(aclOther, n))
+	assert.Equal(t, noteAccessOwn, accessTo(aclAdmin, n))
+
+	// notes from before authentication are only for admins.
+	legacy := &Note{ID: "2"}
+	assert.Equal(t, noteAccessNone, accessTo(&Principal{}, legacy))
+	assert.Equal(t, noteAccessOwn, accessTo(aclAdmin, legacy))
+}
+
+func TestNoteFromMapShares(t *testing.T) {
+	n := noteFromMap(map[string]string{
+		fieldNoteID:     "1",
+		fieldNoteOwner:  "owner",
+		fieldNoteShares: `{"editor":"editor"}`,
+	})
+
+	assert.Equal(t, "owner", n.Owner)
+	assert.Equal(t, map[string]NoteRole{"editor": NoteEditor}, n.Shares)
+}
+
+func TestACLNoteRepositoryRetrieve(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Retrieve", "1").Return(sharedNote("1"), nil)
+
+	n, err := NewACLNoteRepository(mnr, aclReader).Retrieve("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", n.ID)
+
+	_, err = NewACLNoteRepository(mnr, aclOther).Retrieve("1")
+	assert.Equal(t, ErrNoteNotFound, err)
+
+	mnr.On("RetrieveMany", []string{"1", "2"}).Return([]*Note{sharedNote("1"), nil}, nil)
+
+	notes, err := NewACLNoteRepository(mnr, aclOther).RetrieveMany([]string{"1", "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []*Note{nil, nil}, notes)
+}
+
+func TestACLNoteRepositoryCreate(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Create", "content", mock.AnythingOfType("[]omniscient.NoteOption")).Return(
+		func(content string, opts ...NoteOption) *Note {
+			n := &Note{Content: content}
+			for _, opt := range opts {
+				opt(n)
+			}
+			return n
+		}, nil)
+
+	// the creator owns the note, whatever it asked for.
+	n, err := NewACLNoteRepository(mnr, aclEditor).Create("content", NoteOwner("owner"))
+	assert.NoError(t, err)
+	assert.Equal(t, "editor", n.Owner)
+}
+
+func TestACLNoteRepositoryUpdate(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Patch", "1", mock.Anything).Return(
+		func(id string, fn func(*Note) error) *Note {
+			n := sharedNote(id)
+			if fn(n) != nil {
+				return nil
+			}
+			return n
+		},
+		func(id string, fn func(*Note) error) error {
+			return fn(sharedNote(id))
+		})
+
+	// access is checked against the note the update is applied to.
+	n, err := NewACLNoteRepository(mnr, aclEditor).Update("1", "new")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "new", n.Content)
+	}
+
+	_, err = NewACLNoteRepository(mnr, aclReader).Update("1", "new")
+	assert.Equal(t, ErrNoteForbidden, err)
+
+	_, err = NewACLNoteRepository(mnr, aclOther).Update("1", "new")
+	assert.Equal(t, ErrNoteNotFound, err)
+
+	// only the owner can change who the note is shared with.
+	_, err = NewACLNoteRepository(mnr, aclEditor).Update("1", "new", NoteShares(nil))
+	assert.Equal(t, ErrNoteForbidden, err)
+
+	_, err = NewACLNoteRepository(mnr, aclOwner).Update("1", "new", NoteShares(nil))
+	assert.NoError(t, err)
+
+	mnr.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestACLNoteRepositoryPatch(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Patch", "1", mock.Anything).Return(nil,
+		func(id string, fn func(*Note) error) error {
+			return fn(sharedNote(id))
+		})
+
+	share := func(n *Note) error {
+		n.Shares = map[string]NoteRole{"other": NoteEditor}
+		return nil
+	}
+
+	_, err := NewACLNoteRepository(mnr, aclOwner).Patch("1", share)
+	assert.NoError(t, err)
+
+	_, err = NewACLNoteRepository(mnr, aclEditor).Patch("1", share)
+	assert.Equal(t, ErrNoteForbidden, err)
+
+	_, err = NewACLNoteRepository(mnr, aclOther).Patch("1", func(*Note) error { return nil })
+	assert.Equal(t, ErrNoteNotFound, err)
+}
+
+func TestACLNoteRepositoryDelete(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Retrieve", "1").Return(sharedNote("1"), nil)
+	mnr.On("Delete", "1").Return(nil)
+
+	assert.Equal(t, ErrNoteForbidden, NewACLNoteRepository(mnr, aclEditor).Delete("1"))
+	assert.Equal(t, ErrNoteNotFound, NewACLNoteRepository(mnr, aclOther).Delete("1"))
+	assert.NoError(t, NewACLNoteRepository(mnr, aclOwner).Delete("1"))
+
+	mnr.AssertNumberOfCalls(t, "Delete", 1)
+}
+
+func TestACLNoteRepositoryListPage(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Walk", mock.Anything).Return(func(fn func(*Note) error) error {
+		for _, n := range []*Note{
+			{ID: "1", Owner: "reader"},
+			{ID: "2", Owner: "owner"},
+			sharedNote("3"),
+			{ID: "4", Owner: "reader"},
+			{ID: "5"},
+		} {
+			if err := fn(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	ar := NewACLNoteRepository(mnr, aclReader)
+
+	notes, more, err := ar.ListPage(0, 2)
+	assert.NoError(t, err)
+	assert.True(t, more)
+	if assert.Len(t, notes, 2) {
+		assert.Equal(t, "1", notes[0].ID)
+		assert.Equal(t, "3", notes[1].ID)
+	}
+
+	notes, more, err = ar.ListPage(2, 2)
+	assert.NoError(t, err)
+	assert.False(t, more)
+	if assert.Len(t, notes, 1) {
+		assert.Equal(t, "4", notes[0].ID)
+	}
+}
+
+func TestACLNoteRepositoryTransact(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Retrieve", "1").Return(sharedNote("1"), nil)
+	mnr.On("Transact", mock.Anything).Return([]*Note{nil, nil}, nil)
+
+	ops := []NoteOp{
+		{Kind: NoteOpRetrieve, ID: "1"},
+		{Kind: NoteOpDelete, ID: "1"},
+	}
+
+	_, err := NewACLNoteRepository(mnr, aclEditor).Transact(ops)
+	if oe, ok := err.(*OpError); assert.True(t, ok) {
+		assert.Equal(t, 1, oe.Index)
+		assert.Equal(t, ErrNoteForbidden, oe.Err)
+	}
+
+	_, err = NewACLNoteRepository(mnr, aclOwner).Transact(ops)
+	assert.NoError(t, err)
+
+	// the delete only runs if the note is still at the version access was
+	// checked against.
+	checked := mnr.Calls[len(mnr.Calls)-1].Arguments.Get(0).([]NoteOp)
+	assert.Equal(t, int64(0), checked[0].Version)
+	assert.Equal(t, int64(3), checked[1].Version)
+}
+
+func TestAppShareNote(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expectAPIKey(mrc, "editor", ScopeNotesWrite)
+
+	ak, err := NewAPIKeys(mrc)
+	assert.NoError(t, err)
+
+	withAppOptions(t, nil, []AppOption{AppAPIKeys(ak)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Patch", "1", mock.Anything).Return(nil,
+			func(id string, fn func(*Note) error) error {
+				return fn(sharedNote(id))
+			})
+		u.Path = "/v1/notes/1/shares"
+
+		share := func(body string) *http.Response {
+			req, err := http.NewRequest("PUT", u.String(), strings.NewReader(body))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(HeaderAPIKey, apiKeyPrefix+"editor")
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			return res
+		}
+
+		res := share(`{"shares": {"other": "owner"}}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+		// editors can't reshare a note.
+		res = share(`{"shares": {"other": "reader"}}`)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	})
+}
+
+func TestACLNoteRepositoryCreateTaken(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Create", "content", mock.AnythingOfType("[]omniscient.NoteOption")).Return(nil, ErrNoteExists)
+	mnr.On("Retrieve", "1").Return(sharedNote("1"), nil)
+
+	// the id of a note the principal can't see isn't confirmed as taken.
+	_, err := NewACLNoteRepository(mnr, aclOther).Create("content", NoteID("1"))
+	assert.Equal(t, ErrNoteForbidden, err)
+
+	_, err = NewACLNoteRepository(mnr, aclReader).Create("content", NoteID("1"))
+	assert.Equal(t, ErrNoteExists, err)
+}
+
+func TestACLNoteRepositoryChanges(t *testing.T) {
+	unshared := sharedNote("2")
+	unshared.Shares = nil
+
+	mnr := &MockNoteRepository{}
+	mnr.On("Changes", int64(4), int64(10)).Return(func(since, limit int64) *NoteChanges {
+		return &NoteChanges{Notes: []Note{*sharedNote("1"), *unshared}, Deleted: []string{"3", "4"}, Seq: 8}
+	}, nil)
+	mnr.On("Readers", []string{"3", "4", "2"}).Return([][]string{
+		{"owner", "reader"},
+		{"other"},
+		{"owner", "editor", "reader"},
+	}, nil)
+	mnr.On("Readers", []string{"3", "4", "1", "2"}).Return([][]string{
+		{"owner", "reader"},
+		{"other"},
+		{"owner", "editor", "reader"},
+		{"owner", "editor", "reader"},
+	}, nil)
+
+	// notes are deleted for the principals who could read them, including
+	// the ones they can no longer read.
+	changes, err := NewACLNoteRepository(mnr, aclReader).Changes(4, 10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Note{*sharedNote("1")}, changes.Notes)
+		assert.Equal(t, []string{"3", "2"}, changes.Deleted)
+	}
+
+	changes, err = NewACLNoteRepository(mnr, aclOther).Changes(4, 10)
+	if assert.NoError(t, err) {
+		assert.Empty(t, changes.Notes)
+		assert.Equal(t, []string{"4"}, changes.Deleted)
+	}
+
+	changes, err = NewACLNoteRepository(mnr, aclAdmin).Changes(4, 10)
+	if assert.NoError(t, err) {
+		assert.Len(t, changes.Notes, 2)
+		assert.Equal(t, []string{"3", "4"}, changes.Deleted)
+	}
+}
@@ -0,0 +1,143 @@
+package omniscient
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// apiRoutes is where a version of the API registers its routes. Both
+// *echo.Echo and *echo.Group implement it, so a version can be mounted at
+// any prefix, e.g. /v1 and a future /v2 side by side.
+type apiRoutes interface {
+	Get(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc)
+	Post(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc)
+	Put(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc)
+	Patch(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc)
+	Delete(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc)
+}
+
+// v1 registers version 1 of the notes API.
+func (a *App) v1(r apiRoutes) {
+	limitBody := a.limitBody(a.contentTypes)
+	read, write, admin := a.requireScope(ScopeNotesRead), a.requireScope(ScopeNotesWrite), a.requireScope(ScopeAdmin)
+
+	createMiddleware := []echo.MiddlewareFunc{write, limitBody}
+	if a.idempotent != nil {
+		createMiddleware = append(createMiddleware, a.idempotent)
+	}
+
+	r.Post("/notes", a.createNote(), createMiddleware...)
+	r.Get("/notes", a.retrieveNotes(), read)
+	r.Get("/notes/watch", a.watchNotes(), read)
+	r.Get("/notes/:id", a.retrieveNote(), read)
+	r.Get("/notes/by-slug/:slug", a.retrieveNoteBySlug(), read)
+	r.Put("/notes/:id", a.updateNote(), write, limitBody)
+	r.Patch("/notes/:id", a.patchNote(), write, a.limitBody(nil))
+	r.Delete("/notes/:id", a.deleteNote(), write)
+	r.Put("/notes/:id/shares", a.shareNote(), write, a.limitBody([]string{echo.MIMEApplicationJSON}))
+	r.Post("/notes/:id/share", a.createShareLink(), write, a.shareLinksEnabled, a.limitBody([]string{echo.MIMEApplicationJSON}))
+	r.Get("/notes/:id/share", a.listShareLinks(), read, a.shareLinksEnabled)
+	r.Delete("/notes/:id/share", a.revokeShareLinks(), write, a.shareLinksEnabled)
+	r.Delete("/notes/:id/share/:link", a.revokeShareLink(), write, a.shareLinksEnabled)
+	r.Post("/notes:method", a.notesMethod(map[string]echo.HandlerFunc{
+		"import": a.importNotes(),
+	}), write)
+	r.Get("/notes:method", a.notesMethod(map[string]echo.HandlerFunc{
+		"export": a.exportNotes(),
+	}), read)
+
+	r.Post("/batch", a.batch(), write, limitBody)
+
+	r.Get("/sync", a.syncNotes(), read)
+	r.Post("/sync", a.pushChanges(), write, limitBody)
+
+	r.Post("/webhooks", a.createWebhook(), admin, a.webhooksEnabled, a.limitBody([]string{echo.MIMEApplicationJSON}))
+	r.Get("/webhooks", a.listWebhooks(), admin, a.webhooksEnabled)
+	r.Get("/webhooks/:id", a.retrieveWebhook(), admin, a.webhooksEnabled)
+	r.Delete("/webhooks/:id", a.deleteWebhook(), admin, a.webhooksEnabled)
+	r.Get("/webhooks/:id/deliveries", a.listWebhookDeliveries(), admin, a.webhooksEnabled)
+	r.Post("/webhooks/:id/deliveries/:delivery/redeliver", a.redeliverWebhook(), admin, a.webhooksEnabled)
+
+	r.Post("/api-keys", a.createAPIKey(), a.apiKeysEnabled, admin, a.limitBody([]string{echo.MIMEApplicationJSON}))
+	r.Get("/api-keys", a.listAPIKeys(), a.apiKeysEnabled, admin)
+	r.Get("/api-keys/:id", a.retrieveAPIKey(), a.apiKeysEnabled, admin)
+	r.Delete("/api-keys/:id", a.deleteAPIKey(), a.apiKeysEnabled, admin)
+
+	r.Post("/tenants", a.createTenant(), a.tenantsEnabled, admin, a.limitBody([]string{echo.MIMEApplicationJSON}))
+	r.Get("/tenants", a.listTenants(), a.tenantsEnabled, admin)
+	r.Get("/tenants/:id", a.retrieveTenant(), a.tenantsEnabled, admin)
+	r.Delete("/tenants/:id", a.deleteTenant(), a.tenantsEnabled, admin)
+}
+
+// legacyRoutes are the routes which were served before /v1, by method and
+// path. Routes added since are only served under /v1.
+var legacyRoutes = map[string]bool{
+	"POST /notes":    true,
+	"GET /notes":     true,
+	"GET /notes/:id": true,
+	"PUT /notes/:id": true,
+}
+
+// deprecatedRoutes registers the legacy routes registered through it, with m
+// in front of them, and ignores the others.
+type deprecatedRoutes struct {
+	apiRoutes
+	m echo.MiddlewareFunc
+}
+
+func (d *deprecatedRoutes) with(m []echo.MiddlewareFunc) []echo.MiddlewareFunc {
+	return append([]echo.MiddlewareFunc{d.m}, m...)
+}
+
+func (d *deprecatedRoutes) Get(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) {
+	if legacyRoutes["GET "+path] {
+		d.apiRoutes.Get(path, h, d.with(m)...)
+	}
+}
+
+func (d *deprecatedRoutes) Post(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) {
+	if legacyRoutes["POST "+path] {
+		d.apiRoutes.Post(path, h, d.with(m)...)
+	}
+}
+
+func (d *deprecatedRoutes) Put(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) {
+	if legacyRoutes["PUT "+path] {
+		d.apiRoutes.Put(path, h, d.with(m)...)
+	}
+}
+
+func (d *deprecatedRoutes) Patch(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) {
+	if legacyRoutes["PATCH "+path] {
+		d.apiRoutes.Patch(path, h, d.with(m)...)
+	}
+}
+
+func (d *deprecatedRoutes) Delete(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) {
+	if legacyRoutes["DELETE "+path] {
+		d.apiRoutes.Delete(path, h, d.with(m)...)
+	}
+}
+
+// Deprecated marks responses as coming from a deprecated route with the
+// Deprecation header and a link to the same route under successor. If sunset
+// is set, it is sent as the Sunset header. Uses are counted by route.
+func Deprecated(successor string, sunset time.Time) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			h := c.Response().Header()
+			h.Set("Deprecation", "true")
+			h.Set("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, successor, c.Request().URL().Path()))
+			if !sunset.IsZero() {
+				h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			}
+
+			deprecatedRequestsCounter.WithLabelValues(c.Request().Method(), c.Path()).Inc()
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package omniscient
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppV1Routes(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(&Note{ID: "1", Content: "test"}, nil)
+
+		u.Path = "/v1/notes/1"
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Empty(t, res.Header.Get("Deprecation"))
+		assert.Empty(t, res.Header.Get("Sunset"))
+
+		u.Path = "/v1/missing"
+		res, err = http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
+
+func TestAppUnversionedRoutesAreDeprecated(t *testing.T) {
+	sunset := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := []AppOption{AppLegacySunset(sunset)}
+
+	withAppOptions(t, nil, opts, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(&Note{ID: "1", Content: "test"}, nil)
+
+		u.Path = "/notes/1"
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "true", res.Header.Get("Deprecation"))
+		assert.Equal(t, "Fri, 01 Jan 2027 00:00:00 GMT", res.Header.Get("Sunset"))
+		assert.Equal(t, `</v1/notes/1>; rel="successor-version"`, res.Header.Get("Link"))
+
+		u.Path = "/healthz"
+		res, err = http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Empty(t, res.Header.Get("Deprecation"))
+	})
+}
+
+func TestAppDeprecatedRoutesKeepPageLinks(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("ListPage", int64(0), int64(2)).Return([]Note{{ID: "1"}, {ID: "2"}}, true, nil)
+
+		u.Path = "/notes"
+		u.RawQuery = "limit=2"
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []string{
+			`</v1/notes>; rel="successor-version"`,
+			`</notes?cursor=2&limit=2>; rel="next"`,
+		}, res.Header["Link"])
+	})
+}
@@ -0,0 +1,345 @@
+package omniscient
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scopes are the permissions granted to an API key.
+const (
+	// ScopeNotesRead allows reading notes.
+	ScopeNotesRead = "notes:read"
+	// ScopeNotesWrite allows creating, changing and deleting notes.
+	ScopeNotesWrite = "notes:write"
+	// ScopeAdmin allows everything, including managing API keys and
+	// webhooks.
+	ScopeAdmin = "admin"
+
+	// apiKeyPrefix starts every API key, so leaked keys are easy to spot.
+	apiKeyPrefix     = "omni_"
+	apiKeySecretSize = 32
+	// apiKeyShownSize is how much of a key is kept to tell keys apart.
+	apiKeyShownSize = len(apiKeyPrefix) + 6
+
+	// apiKeyLastUsedResolution is how stale the last use of a key can be
+	// before it is updated, so every request doesn't write to Redis.
+	apiKeyLastUsedResolution = time.Minute
+
+	apiKeysKey        = "keys"
+	apiKeyHashesKey   = "hashes"
+	apiKeyLastUsedKey = "lastused"
+)
+
+var (
+	apiKeyScopes = []string{ScopeNotesRead, ScopeNotesWrite, ScopeAdmin}
+
+	// ErrAPIKeyNotFound is returned when an API key does not exist.
+	ErrAPIKeyNotFound = &NoteError{Code: CodeAPIKeyNotFound, Message: "api key not found"}
+	// ErrInvalidAPIKey is returned when authenticating with a key which
+	// does not exist or has been revoked.
+	ErrInvalidAPIKey = &NoteError{Code: CodeUnauthorized, Message: "api key is not valid"}
+)
+
+// APIKey is a key clients authenticate with. Only a hash of the key is
+// stored.
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Tenant is the tenant the key can only access the notes of, if any.
+	Tenant string `json:"tenant,omitempty"`
+	// Key is the key itself. It is only returned when the key is created.
+	Key string `json:"key,omitempty"`
+	// Prefix is the start of the key, to tell keys apart.
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// storedAPIKey is an API key as it is stored.
+type storedAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+// Ways a principal can be authenticated.
+const (
+	AuthAPIKey = "api_key"
+	AuthJWT    = "jwt"
+)
+
+// Principal is who a request is made by, and what they are allowed to do.
+type Principal struct {
+	// ID is the id of the API key the request was made with, or the
+	// subject of its token.
+	ID     string
+	Name   string
+	Scopes []string
+	// Method is how the principal was authenticated.
+	Method string
+	// Tenant is the tenant the principal is tied to. Principals without
+	// one can choose a tenant with the X-Tenant header if they are admins.
+	Tenant string
+}
+
+// HasScope returns true if the principal was granted scope. The admin
+// scope grants every scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// APIKeyOption is an option for creating an API key.
+type APIKeyOption func(*APIKey)
+
+// APIKeyTenant ties an API key to a tenant.
+func APIKeyTenant(tenant string) APIKeyOption {
+	return func(k *APIKey) {
+		k.Tenant = tenant
+	}
+}
+
+// APIKeys stores API keys in Redis.
+type APIKeys struct {
+	redisClient RedisClient
+	base        string
+	idGen       idGenFn
+}
+
+// APIKeysOption is an option for configuring APIKeys.
+type APIKeysOption func(*APIKeys) error
+
+// NewAPIKeys creates an instance of APIKeys.
+func NewAPIKeys(rc RedisClient, opts ...APIKeysOption) (*APIKeys, error) {
+	ak := &APIKeys{
+		redisClient: rc,
+		base:        "apikeys",
+		idGen:       newUUID,
+	}
+
+	for _, opt := range opts {
+		if err := opt(ak); err != nil {
+			return nil, err
+		}
+	}
+
+	return ak, nil
+}
+
+// APIKeysBase sets the base string for the API key keys.
+func APIKeysBase(base string) APIKeysOption {
+	return func(ak *APIKeys) error {
+		ak.base = base
+		return nil
+	}
+}
+
+// Create creates an API key with scopes. The returned key is the only
+// time the key itself is available.
+func (ak *APIKeys) Create(name string, scopes []string, opts ...APIKeyOption) (*APIKey, error) {
+	b := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	k := storedAPIKey{
+		APIKey: APIKey{
+			ID:        ak.idGen(),
+			Name:      name,
+			Scopes:    scopes,
+			Prefix:    key[:apiKeyShownSize],
+			CreatedAt: time.Now().UTC(),
+		},
+		Hash: hashAPIKey(key),
+	}
+
+	for _, opt := range opts {
+		opt(&k.APIKey)
+	}
+
+	s, err := json.Marshal(&k)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := ak.redisClient.HSet(ak.key(apiKeysKey), k.ID, string(s)); err != nil {
+		return nil, err
+	}
+
+	// the key can only be used once it is indexed by its hash.
+	if _, err := ak.redisClient.HSet(ak.key(apiKeyHashesKey), k.Hash, k.ID); err != nil {
+		return nil, err
+	}
+
+	created := k.APIKey
+	created.Key = key
+	return &created, nil
+}
+
+// Retrieve retrieves an API key.
+func (ak *APIKeys) Retrieve(id string) (*APIKey, error) {
+	k, err := ak.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.LastUsedAt, err = ak.lastUsed(id); err != nil {
+		return nil, err
+	}
+
+	return &k.APIKey, nil
+}
+
+// List lists the API keys, oldest first.
+func (ak *APIKeys) List() ([]*APIKey, error) {
+	m, err := ak.redisClient.HGetAllMap(ak.key(apiKeysKey))
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := ak.redisClient.HGetAllMap(ak.key(apiKeyLastUsedKey))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*APIKey, 0, len(m))
+	for id, s := range m {
+		var k storedAPIKey
+		if err := json.Unmarshal([]byte(s), &k); err != nil {
+			return nil, err
+		}
+
+		k.LastUsedAt = parseLastUsed(used[id])
+		keys = append(keys, &k.APIKey)
+	}
+
+	sort.Sort(apiKeysByCreated(keys))
+
+	return keys, nil
+}
+
+// Delete revokes an API key.
+func (ak *APIKeys) Delete(id string) error {
+	k, err := ak.load(id)
+	if err != nil {
+		return err
+	}
+
+	// the key stops working as soon as its hash is no longer indexed.
+	if _, err := ak.redisClient.HDel(ak.key(apiKeyHashesKey), k.Hash); err != nil {
+		return err
+	}
+
+	if _, err := ak.redisClient.HDel(ak.key(apiKeysKey), id); err != nil {
+		return err
+	}
+
+	_, err = ak.redisClient.HDel(ak.key(apiKeyLastUsedKey), id)
+	return err
+}
+
+// Authenticate returns the principal for key, and records that the key was
+// used. ErrInvalidAPIKey is returned if the key doesn't exist.
+func (ak *APIKeys) Authenticate(key string) (*Principal, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	id, err := ak.redisClient.HGet(ak.key(apiKeyHashesKey), hashAPIKey(key))
+	if err == ErrKeyNotFound {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := ak.load(id)
+	if err == ErrAPIKeyNotFound {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	last, err := ak.lastUsed(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if last == nil || now.Sub(*last) >= apiKeyLastUsedResolution {
+		if _, err := ak.redisClient.HSet(ak.key(apiKeyLastUsedKey), id, now.Format(time.RFC3339)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Principal{ID: k.ID, Name: k.Name, Scopes: k.Scopes, Method: AuthAPIKey, Tenant: k.Tenant}, nil
+}
+
+func (ak *APIKeys) load(id string) (*storedAPIKey, error) {
+	s, err := ak.redisClient.HGet(ak.key(apiKeysKey), id)
+	if err == ErrKeyNotFound {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var k storedAPIKey
+	if err := json.Unmarshal([]byte(s), &k); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+func (ak *APIKeys) lastUsed(id string) (*time.Time, error) {
+	s, err := ak.redisClient.HGet(ak.key(apiKeyLastUsedKey), id)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLastUsed(s), nil
+}
+
+func (ak *APIKeys) key(parts ...string) string {
+	return strings.Join(append([]string{ak.base}, parts...), ":")
+}
+
+func parseLastUsed(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+
+	return &t
+}
+
+// hashAPIKey hashes a key for storing. Keys are long and random, so they
+// don't need a slow, salted hash like passwords do.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeysByCreated sorts API keys by when they were created.
+type apiKeysByCreated []*APIKey
+
+func (s apiKeysByCreated) Len() int           { return len(s) }
+func (s apiKeysByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s apiKeysByCreated) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
@@ -0,0 +1,124 @@
+package omniscient
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+const maxAPIKeyNameLength = 100
+
+type createAPIKeyReq struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Tenant ties the key to a tenant.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func (car *createAPIKeyReq) validate(v *validation, prefix string) {
+	switch {
+	case car.Name == "":
+		v.add(fieldName(prefix, "name"), CodeRequired, "name is required")
+	case len(car.Name) > maxAPIKeyNameLength:
+		v.add(fieldName(prefix, "name"), CodeTooLong, "name must be at most %d characters", maxAPIKeyNameLength)
+	}
+
+	if len(car.Scopes) == 0 {
+		v.add(fieldName(prefix, "scopes"), CodeRequired, "scopes are required")
+	}
+
+	for _, s := range car.Scopes {
+		if !ValidScope(s) {
+			v.add(fieldName(prefix, "scopes"), CodeInvalidValue, "scopes must be some of %v", apiKeyScopes)
+			break
+		}
+	}
+
+	if car.Tenant != "" && ValidateTenantID(car.Tenant) != nil {
+		v.add(fieldName(prefix, "tenant"), CodeInvalidValue, "tenant is not a valid tenant id")
+	}
+}
+
+// ValidScope returns true if scope is a scope API keys can be granted.
+func ValidScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiKeysEnabled rejects requests to the API key routes if API keys aren't
+// configured.
+func (a *App) apiKeysEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.apiKeys == nil {
+			return NewProblem(CodeNotFound, "api keys are not enabled")
+		}
+
+		return next(c)
+	}
+}
+
+func (a *App) createAPIKey() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		car := &createAPIKeyReq{}
+		if err := a.bind(c, car); err != nil {
+			return err
+		}
+
+		var opts []APIKeyOption
+		if car.Tenant != "" {
+			if a.tenants == nil {
+				return NewProblem(CodeInvalidRequest, "tenants are not enabled")
+			}
+
+			if _, err := a.tenants.Retrieve(car.Tenant); err != nil {
+				return err
+			}
+
+			opts = append(opts, APIKeyTenant(car.Tenant))
+		}
+
+		k, err := a.apiKeys.Create(car.Name, car.Scopes, opts...)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, k)
+	}
+}
+
+func (a *App) listAPIKeys() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		keys, err := a.apiKeys.List()
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, keys)
+	}
+}
+
+func (a *App) retrieveAPIKey() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		k, err := a.apiKeys.Retrieve(c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, k)
+	}
+}
+
+func (a *App) deleteAPIKey() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := a.apiKeys.Delete(c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
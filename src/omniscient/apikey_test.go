@@ -0,0 +1,104 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPrincipalHasScope(t *testing.T) {
+	p := &Principal{Scopes: []string{ScopeNotesRead}}
+	assert.True(t, p.HasScope(ScopeNotesRead))
+	assert.False(t, p.HasScope(ScopeNotesWrite))
+
+	admin := &Principal{Scopes: []string{ScopeAdmin}}
+	assert.True(t, admin.HasScope(ScopeNotesWrite))
+}
+
+func TestAPIKeysCreate(t *testing.T) {
+	var stored storedAPIKey
+	mrc := &MockRedisClient{}
+	mrc.On("HSet", "apikeys:keys", "k1", mock.AnythingOfType("string")).
+		Run(func(args mock.Arguments) {
+			assert.NoError(t, json.Unmarshal([]byte(args.String(2)), &stored))
+		}).Return(true, nil)
+	mrc.On("HSet", "apikeys:hashes", mock.AnythingOfType("string"), "k1").Return(true, nil)
+
+	ak, err := NewAPIKeys(mrc)
+	assert.NoError(t, err)
+	ak.idGen = func() string { return "k1" }
+
+	k, err := ak.Create("ci", []string{ScopeNotesRead})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(k.Key, apiKeyPrefix))
+	assert.True(t, strings.HasPrefix(k.Key, k.Prefix))
+
+	// only the hash of the key is stored.
+	assert.Empty(t, stored.Key)
+	assert.Equal(t, hashAPIKey(k.Key), stored.Hash)
+
+	mrc.AssertExpectations(t)
+}
+
+// expectAPIKey expects key to be looked up, and to have scopes.
+func expectAPIKey(mrc *MockRedisClient, key string, scopes ...string) {
+	b, _ := json.Marshal(&storedAPIKey{
+		APIKey: APIKey{ID: key, Name: key, Scopes: scopes},
+		Hash:   hashAPIKey(apiKeyPrefix + key),
+	})
+
+	mrc.On("HGet", "apikeys:hashes", hashAPIKey(apiKeyPrefix+key)).Return(key, nil)
+	mrc.On("HGet", "apikeys:keys", key).Return(string(b), nil)
+	mrc.On("HGet", "apikeys:lastused", key).Return(time.Now().UTC().Format(time.RFC3339), nil)
+}
+
+func TestAppRequiresAPIKey(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expectAPIKey(mrc, "reader", ScopeNotesRead)
+	mrc.On("HGet", "apikeys:hashes", hashAPIKey(apiKeyPrefix+"revoked")).Return("", ErrKeyNotFound)
+
+	ak, err := NewAPIKeys(mrc)
+	assert.NoError(t, err)
+
+	withAppOptions(t, nil, []AppOption{AppAPIKeys(ak)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(&Note{ID: "1", Owner: "reader"}, nil)
+		u.Path = "/v1/notes/1"
+
+		do := func(method, key string) *http.Response {
+			req, err := http.NewRequest(method, u.String(), nil)
+			assert.NoError(t, err)
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+apiKeyPrefix+key)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			return res
+		}
+
+		res := do("GET", "")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		assert.NotEmpty(t, res.Header.Get("WWW-Authenticate"))
+
+		res = do("GET", "revoked")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		res = do("GET", "reader")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		res = do("DELETE", "reader")
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+		// health checks don't need a key.
+		u.Path = "/healthz"
+		res = do("GET", "")
+		assert.NotEqual(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
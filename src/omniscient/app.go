@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"pkg/echologger"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -16,6 +18,11 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
 var (
 	defaultNoteRepository NoteRepository
 	defaultHealth         *Health
@@ -42,8 +49,32 @@ func init() {
 // App is the application.
 type App struct {
 	Mux      http.Handler
+	router   *echo.Echo
 	noteRepo NoteRepository
 	health   *Health
+
+	redisClient       RedisClient
+	maxBatchSize      int
+	idempotencyWindow time.Duration
+
+	maxBodyBytes     int64
+	maxContentLength int
+	contentTypes     []string
+
+	idempotent   echo.MiddlewareFunc
+	legacySunset time.Time
+
+	feed     *NoteFeed
+	webhooks *Webhooks
+	apiKeys  *APIKeys
+	jwt      *JWTVerifier
+	tenants  *Tenants
+
+	shareLinks  *ShareLinks
+	rateLimiter *RateLimiter
+
+	graphQLMaxDepth      int
+	graphQLMaxComplexity int
 }
 
 // AppOption is an option for configuring App.
@@ -52,14 +83,27 @@ type AppOption func(*App) error
 // NewApp creates an instance of App.
 func NewApp(opts ...AppOption) (*App, error) {
 	e := echo.New()
+	e.SetHTTPErrorHandler(handleError)
 
 	std := standard.WithConfig(engine.Config{})
 	std.SetHandler(e)
 
 	a := &App{
 		Mux:      std,
+		router:   e,
 		noteRepo: defaultNoteRepository,
 		health:   defaultHealth,
+
+		redisClient:       defaultRedisClient,
+		maxBatchSize:      defaultMaxBatchSize,
+		idempotencyWindow: defaultIdempotencyWindow,
+
+		maxBodyBytes:     defaultMaxBodyBytes,
+		maxContentLength: defaultMaxContentLength,
+		contentTypes:     defaultContentTypes,
+
+		graphQLMaxDepth:      defaultGraphQLMaxDepth,
+		graphQLMaxComplexity: defaultGraphQLMaxComplexity,
 	}
 
 	for _, opt := range opts {
@@ -68,6 +112,12 @@ func NewApp(opts ...AppOption) (*App, error) {
 		}
 	}
 
+	if a.tenants != nil {
+		if _, ok := a.noteRepo.(TenantNoteRepository); !ok {
+			return nil, errors.New("tenants need a note repository which supports them")
+		}
+	}
+
 	if err := initMetrics(); err != nil {
 		return nil, err
 	}
@@ -76,12 +126,13 @@ func NewApp(opts ...AppOption) (*App, error) {
 	e.Use(HitCounter())
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			reqID := c.Request().Header().Get("X-Request-Id")
+			reqID := c.Request().Header().Get(HeaderRequestID)
 			if reqID == "" {
 				reqID = uuid.NewV4().String()
-				c.Request().Header().Set("X-Request-Id", reqID)
+				c.Request().Header().Set(HeaderRequestID, reqID)
 
 			}
+			c.Response().Header().Set(HeaderRequestID, reqID)
 
 			return next(c)
 		}
@@ -96,12 +147,31 @@ func NewApp(opts ...AppOption) (*App, error) {
 	// 	StackSize: 1 << 10, // 1 KB
 	// }))
 
+	// idempotency keys need somewhere to store responses.
+	if a.redisClient != nil {
+		idempotent, err := Idempotency(a.redisClient,
+			IdempotencyWindow(a.idempotencyWindow))
+		if err != nil {
+			return nil, err
+		}
+
+		a.idempotent = idempotent
+	}
+
 	// routes
-	e.Post("/notes", a.createNote())
-	e.Get("/notes", a.retrieveNotes())
-	e.Get("/notes/:id", a.retrieveNote())
-	e.Put("/notes/:id", a.updateNote())
-	// e.Delete("/notes/:id", a.deleteNote())
+	a.v1(e.Group("/v1"))
+
+	// the legacy routes predate /v1 and are kept as aliases for it.
+	a.v1(&deprecatedRoutes{
+		apiRoutes: e,
+		m:         Deprecated("/v1", a.legacySunset),
+	})
+
+	e.Get("/graphql", a.graphQL(), a.requireScope(ScopeNotesRead))
+	e.Post("/graphql", a.graphQL(), a.requireScope(ScopeNotesRead), a.limitBody([]string{echo.MIMEApplicationJSON}))
+	e.Get("/graphql/schema", a.graphQLSchema(), a.rateLimit)
+
+	e.Get("/s/:token", a.viewShareLink(), a.shareLinksEnabled, a.rateLimit)
 
 	e.Get("/healthz", a.healthz())
 	e.Get("/app/info", a.appInfo())
@@ -111,6 +181,9 @@ func NewApp(opts ...AppOption) (*App, error) {
 
 	e.Get("/metrics", standard.WrapHandler(prometheus.Handler()))
 
+	e.Get("/openapi.json", a.serveOpenAPI(), a.rateLimit)
+	e.Get("/docs", a.serveDocs(), a.rateLimit)
+
 	if a.health == nil {
 		return nil, errors.New("no health checker")
 	}
@@ -139,27 +212,269 @@ func AppHealth(h *Health) AppOption {
 	}
 }
 
+// AppRedisClient sets the Redis client used for storing idempotent responses.
+func AppRedisClient(rc RedisClient) AppOption {
+	return func(a *App) error {
+		a.redisClient = rc
+		return nil
+	}
+}
+
+// AppIdempotencyWindow sets how long responses to requests with an
+// idempotency key are kept.
+func AppIdempotencyWindow(d time.Duration) AppOption {
+	return func(a *App) error {
+		if d <= 0 {
+			return errors.New("idempotency window must be positive")
+		}
+
+		a.idempotencyWindow = d
+		return nil
+	}
+}
+
+// AppMaxBatchSize sets the maximum number of operations in a batch.
+func AppMaxBatchSize(n int) AppOption {
+	return func(a *App) error {
+		if n < 1 {
+			return errors.New("max batch size must be at least 1")
+		}
+
+		a.maxBatchSize = n
+		return nil
+	}
+}
+
+// AppMaxBodyBytes sets the maximum size of a request body.
+func AppMaxBodyBytes(n int64) AppOption {
+	return func(a *App) error {
+		if n < 1 {
+			return errors.New("max body bytes must be at least 1")
+		}
+
+		a.maxBodyBytes = n
+		return nil
+	}
+}
+
+// AppMaxContentLength sets the maximum number of characters in a note.
+func AppMaxContentLength(n int) AppOption {
+	return func(a *App) error {
+		if n < 1 {
+			return errors.New("max content length must be at least 1")
+		}
+
+		a.maxContentLength = n
+		return nil
+	}
+}
+
+// AppContentTypes sets the content types accepted for note payloads.
+func AppContentTypes(types ...string) AppOption {
+	return func(a *App) error {
+		if len(types) == 0 {
+			return errors.New("at least one content type is required")
+		}
+
+		a.contentTypes = types
+		return nil
+	}
+}
+
+// AppLegacySunset sets when the unversioned routes will be removed. It is
+// advertised in the Sunset header of their responses.
+func AppLegacySunset(t time.Time) AppOption {
+	return func(a *App) error {
+		a.legacySunset = t
+		return nil
+	}
+}
+
+// AppNoteFeed sets the feed of note changes served by /notes/watch. It
+// should be the feed the note repository publishes to.
+func AppNoteFeed(f *NoteFeed) AppOption {
+	return func(a *App) error {
+		a.feed = f
+		return nil
+	}
+}
+
+// AppWebhooks sets where the webhooks served by /webhooks are stored. Its
+// worker is started separately.
+func AppWebhooks(wh *Webhooks) AppOption {
+	return func(a *App) error {
+		a.webhooks = wh
+		return nil
+	}
+}
+
+// AppAPIKeys makes the notes API require an API key, and sets where the
+// keys managed by /api-keys are stored. Without it, the API is open.
+func AppAPIKeys(ak *APIKeys) AppOption {
+	return func(a *App) error {
+		a.apiKeys = ak
+		return nil
+	}
+}
+
+// AppJWTVerifier makes the notes API require a bearer token verified by v,
+// or an API key if API keys are configured too.
+func AppJWTVerifier(v *JWTVerifier) AppOption {
+	return func(a *App) error {
+		a.jwt = v
+		return nil
+	}
+}
+
+// AppTenants sets where the tenants managed by /tenants are stored, and lets
+// requests be made in them. The note repository must be a
+// TenantNoteRepository.
+func AppTenants(ts *Tenants) AppOption {
+	return func(a *App) error {
+		a.tenants = ts
+		return nil
+	}
+}
+
+// AppShareLinks sets where the public share links to notes are stored, and
+// serves them at /s/:token.
+func AppShareLinks(sl *ShareLinks) AppOption {
+	return func(a *App) error {
+		a.shareLinks = sl
+		return nil
+	}
+}
+
+// AppRateLimiter limits how many requests each client can make to the API
+// and the share links. Without it, requests aren't limited.
+func AppRateLimiter(rl *RateLimiter) AppOption {
+	return func(a *App) error {
+		a.rateLimiter = rl
+		return nil
+	}
+}
+
+// AppGraphQLMaxDepth sets how deeply a GraphQL query can nest fields.
+func AppGraphQLMaxDepth(n int) AppOption {
+	return func(a *App) error {
+		if n < 1 {
+			return errors.New("graphql max depth must be at least 1")
+		}
+
+		a.graphQLMaxDepth = n
+		return nil
+	}
+}
+
+// AppGraphQLMaxComplexity sets how many fields a GraphQL query can resolve,
+// counting the fields of every note a page can have.
+func AppGraphQLMaxComplexity(n int) AppOption {
+	return func(a *App) error {
+		if n < 1 {
+			return errors.New("graphql max complexity must be at least 1")
+		}
+
+		a.graphQLMaxComplexity = n
+		return nil
+	}
+}
+
+// noteExpiry is the optional expiry of a note. It can either be an absolute
+// time or a time to live in seconds.
+type noteExpiry struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
+}
+
+func (ne *noteExpiry) validate(v *validation, prefix string) {
+	switch {
+	case ne.ExpiresAt != nil && ne.TTL != 0:
+		v.add(fieldName(prefix, "ttl"), CodeInvalidValue, "only one of expires_at and ttl can be set")
+	case ne.TTL < 0:
+		v.add(fieldName(prefix, "ttl"), CodeInvalidValue, "ttl must be positive")
+	case ne.ExpiresAt != nil && !ne.ExpiresAt.After(v.now):
+		v.add(fieldName(prefix, "expires_at"), CodeInvalidValue, "expires_at must be in the future")
+	}
+}
+
+func (ne *noteExpiry) options(now time.Time) []NoteOption {
+	if t := ne.at(now); t != nil {
+		return []NoteOption{NoteExpiresAt(*t)}
+	}
+
+	return nil
+}
+
+// at returns when something created at now with the expiry expires, or nil
+// if it doesn't.
+func (ne *noteExpiry) at(now time.Time) *time.Time {
+	switch {
+	case ne.TTL > 0:
+		t := now.Add(time.Duration(ne.TTL) * time.Second)
+		return &t
+	case ne.ExpiresAt != nil:
+		return ne.ExpiresAt
+	}
+
+	return nil
+}
+
+// noteAttrs are the optional attributes which can be set when a note is
+// created or updated.
+type noteAttrs struct {
+	Slug string `json:"slug,omitempty"`
+	noteExpiry
+}
+
+func (na *noteAttrs) validate(v *validation, prefix string) {
+	na.noteExpiry.validate(v, prefix)
+
+	if na.Slug != "" {
+		if err := ValidateNoteSlug(na.Slug); err != nil {
+			v.add(fieldName(prefix, "slug"), CodeInvalidNoteSlug, "%s", err.Error())
+		}
+	}
+}
+
+func (na *noteAttrs) options(now time.Time) []NoteOption {
+	opts := na.noteExpiry.options(now)
+	if na.Slug != "" {
+		opts = append(opts, NoteSlug(na.Slug))
+	}
+
+	return opts
+}
+
 type createNoteReq struct {
 	Content string `json:"content"`
+	noteAttrs
+}
+
+func (cnr *createNoteReq) validate(v *validation, prefix string) {
+	v.content(fieldName(prefix, "content"), cnr.Content)
+	cnr.noteAttrs.validate(v, prefix)
 }
 
 type updateNoteReq struct {
 	Content string `json:"content"`
+	noteAttrs
+}
+
+func (unr *updateNoteReq) validate(v *validation, prefix string) {
+	v.content(fieldName(prefix, "content"), unr.Content)
+	unr.noteAttrs.validate(v, prefix)
 }
 
 func (a *App) createNote() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cnr := &createNoteReq{}
-		if err := c.Bind(cnr); err != nil {
+		if err := a.bind(c, cnr); err != nil {
 			return err
 		}
 
-		note, err := a.noteRepo.Create(cnr.Content)
+		note, err := a.notes(c).Create(cnr.Content, cnr.options(time.Now())...)
 		if err != nil {
-			msg := map[string]interface{}{
-				"error": "unable to create note",
-			}
-			return c.JSON(http.StatusInternalServerError, msg)
+			return err
 		}
 
 		return c.JSON(http.StatusCreated, note)
@@ -169,26 +484,77 @@ func (a *App) createNote() echo.HandlerFunc {
 func (a *App) retrieveNote() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id := c.Param("id")
-		note, err := a.noteRepo.Retrieve(id)
+		note, err := a.notes(c).Retrieve(id)
 		if err != nil {
-			msg := map[string]interface{}{
-				"error": "note not found",
-			}
-			return c.JSON(http.StatusNotFound, msg)
+			return err
 		}
 
 		return c.JSON(http.StatusOK, note)
 	}
 }
 
-func (a *App) retrieveNotes() echo.HandlerFunc {
+func (a *App) retrieveNoteBySlug() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		notes, err := a.noteRepo.List()
+		slug := c.Param("slug")
+		note, err := a.notes(c).RetrieveBySlug(slug)
 		if err != nil {
-			msg := map[string]interface{}{
-				"error": "unable to retrieve notes",
+			return err
+		}
+
+		return c.JSON(http.StatusOK, note)
+	}
+}
+
+// retrieveNotes lists notes. If limit or cursor is set, a page of notes is
+// listed and the next page is linked in the Link header.
+func (a *App) retrieveNotes() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limitParam, cursor := c.QueryParam("limit"), c.QueryParam("cursor")
+		if limitParam == "" && cursor == "" {
+			notes, err := a.notes(c).List()
+			if err != nil {
+				return err
+			}
+
+			return c.JSON(http.StatusOK, notes)
+		}
+
+		v := a.newValidation()
+
+		limit := int64(defaultPageSize)
+		if limitParam != "" {
+			n, err := strconv.ParseInt(limitParam, 10, 64)
+			if err != nil || n < 1 || n > maxPageSize {
+				v.add("limit", CodeInvalidValue, "limit must be between 1 and %d", maxPageSize)
 			}
-			return c.JSON(http.StatusInternalServerError, msg)
+			limit = n
+		}
+
+		var offset int64
+		if cursor != "" {
+			n, err := strconv.ParseInt(cursor, 10, 64)
+			if err != nil || n < 0 {
+				v.add("cursor", CodeInvalidValue, "cursor is not valid")
+			}
+			offset = n
+		}
+
+		if err := v.err(); err != nil {
+			return err
+		}
+
+		notes, more, err := a.notes(c).ListPage(offset, limit)
+		if err != nil {
+			return err
+		}
+
+		if more {
+			next := url.Values{}
+			next.Set("cursor", strconv.FormatInt(offset+limit, 10))
+			next.Set("limit", strconv.FormatInt(limit, 10))
+			// added, as deprecated routes link to their successor too.
+			c.Response().Header().Add("Link",
+				fmt.Sprintf(`<%s?%s>; rel="next"`, c.Request().URL().Path(), next.Encode()))
 		}
 
 		return c.JSON(http.StatusOK, notes)
@@ -199,38 +565,41 @@ func (a *App) updateNote() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id := c.Param("id")
 
-		cnr := &createNoteReq{}
-		if err := c.Bind(cnr); err != nil {
+		unr := &updateNoteReq{}
+		if err := a.bind(c, unr); err != nil {
 			return err
 		}
 
-		note, err := a.noteRepo.Update(id, cnr.Content)
+		opts := unr.options(time.Now())
+		nr := a.notes(c)
+
+		status := http.StatusOK
+		note, err := nr.Update(id, unr.Content, opts...)
+		if err == ErrNoteNotFound {
+			// create the note with the client's choice of id.
+			status = http.StatusCreated
+			note, err = nr.Create(unr.Content, append(opts, NoteID(id))...)
+		}
+
 		if err != nil {
-			msg := map[string]interface{}{
-				"error": "unable to update note",
-			}
-			return c.JSON(http.StatusNotFound, msg)
+			return err
 		}
 
-		return c.JSON(http.StatusOK, note)
+		return c.JSON(status, note)
 	}
 }
 
-// func (a *App) deleteNote() echo.HandlerFunc {
-// 	return func(c *echo.Context) error {
-// 		id := c.Param("id")
+func (a *App) deleteNote() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
 
-// 		err := a.noteRepo.Delete(id)
-// 		if err != nil {
-// 			msg := map[string]interface{}{
-// 				"error": "unable to delete note",
-// 			}
-// 			return c.JSON(http.StatusBadRequest, msg)
-// 		}
+		if err := a.notes(c).Delete(id); err != nil {
+			return err
+		}
 
-// 		return c.NoContent(http.StatusNoContent)
-// 	}
-// }
+		return c.NoContent(http.StatusNoContent)
+	}
+}
 
 func (a *App) healthz() echo.HandlerFunc {
 	return func(c echo.Context) error {
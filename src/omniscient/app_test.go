@@ -8,14 +8,20 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 type appTestFn func(u *url.URL, mnr *MockNoteRepository, h *Health)
 
 func withApp(t *testing.T, healthOpts []HealthOption, fn appTestFn) {
+	withAppOptions(t, healthOpts, nil, fn)
+}
+
+func withAppOptions(t *testing.T, healthOpts []HealthOption, appOpts []AppOption, fn appTestFn) {
 	for _, c := range metricsCollectors {
 		prometheus.Unregister(c)
 	}
@@ -25,9 +31,9 @@ func withApp(t *testing.T, healthOpts []HealthOption, fn appTestFn) {
 
 	mnr := &MockNoteRepository{}
 
-	app, err := NewApp(
+	app, err := NewApp(append([]AppOption{
 		AppNoteRepository(mnr),
-		AppHealth(health))
+		AppHealth(health)}, appOpts...)...)
 	assert.NoError(t, err)
 
 	ts := httptest.NewServer(app.Mux)
@@ -50,7 +56,7 @@ func TestAppCreate(t *testing.T) {
 		newNote := &Note{
 			ID: "1",
 		}
-		mnr.On("Create", "new note").Return(newNote, nil)
+		mnr.On("Create", "new note", []NoteOption(nil)).Return(newNote, nil)
 
 		var buf bytes.Buffer
 		err := json.NewEncoder(&buf).Encode(&createNoteReq{Content: "new note"})
@@ -72,6 +78,56 @@ func TestAppCreate(t *testing.T) {
 
 }
 
+func TestAppCreateWithTTL(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		expiresAt := time.Now().Add(time.Hour)
+		newNote := &Note{
+			ID:        "1",
+			ExpiresAt: &expiresAt,
+		}
+		mnr.On("Create", "new note", mock.AnythingOfType("[]omniscient.NoteOption")).Return(newNote, nil)
+
+		var buf bytes.Buffer
+		cnr := &createNoteReq{Content: "new note"}
+		cnr.TTL = 3600
+		err := json.NewEncoder(&buf).Encode(cnr)
+		assert.NoError(t, err)
+
+		u.Path = "/notes"
+
+		res, err := http.Post(u.String(), "application/json", &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+		defer res.Body.Close()
+		var note Note
+		err = json.NewDecoder(res.Body).Decode(&note)
+		assert.NoError(t, err)
+
+		assert.NotNil(t, note.ExpiresAt)
+	})
+}
+
+func TestAppCreateWithInvalidExpiry(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		expiresAt := time.Now().Add(-time.Hour)
+
+		var buf bytes.Buffer
+		cnr := &createNoteReq{Content: "new note"}
+		cnr.ExpiresAt = &expiresAt
+		err := json.NewEncoder(&buf).Encode(cnr)
+		assert.NoError(t, err)
+
+		u.Path = "/notes"
+
+		res, err := http.Post(u.String(), "application/json", &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+		mnr.AssertNotCalled(t, "Create", "new note", mock.Anything)
+	})
+}
+
 func TestAppRetrieveSingleNote(t *testing.T) {
 	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
 		existingNote := &Note{
@@ -94,6 +150,18 @@ func TestAppRetrieveSingleNote(t *testing.T) {
 	})
 }
 
+func TestAppRetrieveExpiredNote(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(nil, ErrNoteNotFound)
+
+		u.Path = "/notes/1"
+
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
+
 func TestAppRetrieveAllNotes(t *testing.T) {
 	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
 		existingNote := Note{
@@ -122,7 +190,7 @@ func TestAppUpdateNote(t *testing.T) {
 			ID:      "1",
 			Content: "new content",
 		}
-		mnr.On("Update", "1", "new content").Return(existingNote, nil)
+		mnr.On("Update", "1", "new content", []NoteOption(nil)).Return(existingNote, nil)
 
 		u.Path = "/notes/1"
 
@@ -148,11 +216,145 @@ func TestAppUpdateNote(t *testing.T) {
 	})
 }
 
+func TestAppUpsertNote(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Update", "my-note", "new content", []NoteOption(nil)).Return(nil, ErrNoteNotFound)
+		mnr.On("Create", "new content", mock.AnythingOfType("[]omniscient.NoteOption")).
+			Return(func(content string, opts ...NoteOption) *Note {
+				n := &Note{Content: content}
+				for _, opt := range opts {
+					opt(n)
+				}
+				return n
+			}, nil)
+
+		u.Path = "/notes/my-note"
+
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(&updateNoteReq{Content: "new content"})
+		assert.NoError(t, err)
+
+		req, err := http.NewRequest("PUT", u.String(), &buf)
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+		defer res.Body.Close()
+		var note Note
+		err = json.NewDecoder(res.Body).Decode(&note)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "my-note", note.ID)
+	})
+}
+
+func TestAppUpsertNoteInvalidID(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Update", "catalog", "new content", []NoteOption(nil)).Return(nil, ErrNoteNotFound)
+		mnr.On("Create", "new content", mock.AnythingOfType("[]omniscient.NoteOption")).Return(nil, ErrInvalidNoteID)
+
+		u.Path = "/notes/catalog"
+
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(&updateNoteReq{Content: "new content"})
+		assert.NoError(t, err)
+
+		req, err := http.NewRequest("PUT", u.String(), &buf)
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func TestAppUpsertReservedNoteID(t *testing.T) {
+	// reserved ids must be turned away without touching the keys they name,
+	// so the redis client expects no calls.
+	mrc := &MockRedisClient{}
+	rnr, err := NewRedisNoteRepository(RedisClientOption(mrc))
+	assert.NoError(t, err)
+
+	withAppOptions(t, nil, []AppOption{AppNoteRepository(rnr)}, func(u *url.URL, _ *MockNoteRepository, h *Health) {
+		for id := range reservedNoteIDs {
+			u.Path = "/v1/notes/" + id
+
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(&updateNoteReq{Content: "new content"})
+			assert.NoError(t, err)
+
+			req, err := http.NewRequest("PUT", u.String(), &buf)
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode, id)
+
+			req, err = http.NewRequest("DELETE", u.String(), nil)
+			assert.NoError(t, err)
+
+			res, err = http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusNoContent, res.StatusCode, id)
+		}
+
+		mrc.AssertExpectations(t)
+	})
+}
+
+func TestAppRetrieveNoteBySlug(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("RetrieveBySlug", "deploy").Return(&Note{ID: "1", Slug: "deploy"}, nil)
+
+		u.Path = "/v1/notes/by-slug/deploy"
+
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		defer res.Body.Close()
+		var note Note
+		err = json.NewDecoder(res.Body).Decode(&note)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "1", note.ID)
+	})
+}
+
+func TestAppCreateWithTakenSlug(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Create", "new note", mock.AnythingOfType("[]omniscient.NoteOption")).Return(nil, ErrNoteSlugTaken)
+
+		var buf bytes.Buffer
+		cnr := &createNoteReq{Content: "new note"}
+		cnr.Slug = "deploy"
+		err := json.NewEncoder(&buf).Encode(cnr)
+		assert.NoError(t, err)
+
+		u.Path = "/notes"
+
+		res, err := http.Post(u.String(), "application/json", &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusConflict, res.StatusCode)
+	})
+}
+
 func TestAppDeleteNote(t *testing.T) {
 	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
 		mnr.On("Delete", "1").Return(nil)
 
-		u.Path = "/notes/1"
+		u.Path = "/v1/notes/1"
 
 		req, err := http.NewRequest("DELETE", u.String(), nil)
 		assert.NoError(t, err)
@@ -195,3 +397,145 @@ func TestAppInfo(t *testing.T) {
 		assert.Equal(t, "dev", ai.Revision)
 	})
 }
+
+func TestAppPatchNote(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		content     string
+		slug        string
+	}{
+		{
+			name:        "merge patch",
+			contentType: mimeMergePatch,
+			body:        `{"content":"patched","slug":"my-note"}`,
+			status:      http.StatusOK,
+			content:     "patched",
+			slug:        "my-note",
+		},
+		{
+			name:        "json patch",
+			contentType: mimeJSONPatch,
+			body:        `[{"op":"test","path":"/content","value":"test"},{"op":"replace","path":"/content","value":"patched"}]`,
+			status:      http.StatusOK,
+			content:     "patched",
+		},
+		{
+			name:        "failed test",
+			contentType: mimeJSONPatch,
+			body:        `[{"op":"test","path":"/content","value":"other"},{"op":"replace","path":"/content","value":"patched"}]`,
+			status:      http.StatusConflict,
+		},
+		{
+			name:        "read only field",
+			contentType: mimeMergePatch,
+			body:        `{"id":"2"}`,
+			status:      http.StatusUnprocessableEntity,
+		},
+		{
+			name:        "unknown field",
+			contentType: mimeJSONPatch,
+			body:        `[{"op":"add","path":"/title","value":"title"}]`,
+			status:      http.StatusUnprocessableEntity,
+		},
+		{
+			name:        "invalid slug",
+			contentType: mimeMergePatch,
+			body:        `{"slug":"Not A Slug"}`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "malformed patch",
+			contentType: mimeJSONPatch,
+			body:        `{"op":"remove"}`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "unsupported content type",
+			contentType: "application/json",
+			body:        `{"content":"patched"}`,
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range cases {
+		withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+			mnr.On("Patch", "1", mock.AnythingOfType("func(*omniscient.Note) error")).
+				Return(func(id string, fn func(*Note) error) *Note {
+					n := &Note{ID: id, Content: "test"}
+					if err := fn(n); err != nil {
+						return nil
+					}
+					return n
+				}, func(id string, fn func(*Note) error) error {
+					return fn(&Note{ID: id, Content: "test"})
+				})
+
+			u.Path = "/v1/notes/1"
+
+			req, err := http.NewRequest("PATCH", u.String(), bytes.NewBufferString(tc.body))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, res.StatusCode, tc.name)
+
+			defer res.Body.Close()
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var note Note
+			err = json.NewDecoder(res.Body).Decode(&note)
+			assert.NoError(t, err)
+
+			assert.Equal(t, "1", note.ID, tc.name)
+			assert.Equal(t, tc.content, note.Content, tc.name)
+			assert.Equal(t, tc.slug, note.Slug, tc.name)
+		})
+	}
+}
+
+func TestAppPatchMissingNote(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Patch", "1", mock.AnythingOfType("func(*omniscient.Note) error")).
+			Return(nil, ErrNoteNotFound)
+
+		u.Path = "/v1/notes/1"
+
+		req, err := http.NewRequest("PATCH", u.String(), bytes.NewBufferString(`{"content":"patched"}`))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", mimeMergePatch)
+
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
+
+func TestAppRetrieveNotesPage(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("ListPage", int64(10), int64(2)).Return([]Note{{ID: "1"}, {ID: "2"}}, true, nil)
+
+		u.Path = "/v1/notes"
+		u.RawQuery = "cursor=10&limit=2"
+
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, `</v1/notes?cursor=12&limit=2>; rel="next"`, res.Header.Get("Link"))
+
+		defer res.Body.Close()
+		var notes []Note
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&notes))
+		assert.Len(t, notes, 2)
+
+		u.RawQuery = "limit=0"
+		res, err = http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	})
+}
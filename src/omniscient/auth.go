@@ -0,0 +1,220 @@
+package omniscient
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+const (
+	// HeaderAPIKey is an alternative to sending an API key as a bearer
+	// token in the Authorization header.
+	HeaderAPIKey = "X-API-Key"
+
+	principalContextKey = "principal"
+)
+
+// ErrUnauthenticated is returned when a request needs credentials and has
+// none.
+var ErrUnauthenticated = &NoteError{Code: CodeUnauthorized, Message: "authentication is required"}
+
+// requireScope rejects requests which aren't authenticated, or whose
+// principal wasn't granted scope. If neither API keys nor JWTs are
+// configured, every request is allowed. Requests are rate limited by the
+// address they were made from before they are authenticated, and by who made
+// them once they are allowed, and then the tenant they are made in is
+// resolved.
+func (a *App) requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		inTenant := a.rateLimit(func(c echo.Context) error {
+			return a.withTenant(c, next)
+		})
+
+		return func(c echo.Context) error {
+			if a.apiKeys == nil && a.jwt == nil {
+				return inTenant(c)
+			}
+
+			if err := a.rateLimitAddress(c); err != nil {
+				return err
+			}
+
+			p, err := a.authenticate(c)
+			if err != nil {
+				if ne, ok := err.(*NoteError); ok && ne.Code == CodeUnauthorized {
+					c.Response().Header().Set("WWW-Authenticate", `Bearer realm="omniscient"`)
+					requestLog(c).WithError(err).Info("request not authenticated")
+				}
+				return err
+			}
+
+			if !p.HasScope(scope) {
+				return NewProblem(CodeForbidden, "the %s scope is required", scope)
+			}
+
+			// the admin routes reach beyond a single tenant.
+			if scope == ScopeAdmin && p.Tenant != "" {
+				return NewProblem(CodeForbidden, "principals tied to a tenant can't use the admin routes")
+			}
+
+			return inTenant(c)
+		}
+	}
+}
+
+// authenticate returns the principal the request was made by.
+func (a *App) authenticate(c echo.Context) (*Principal, error) {
+	if p := principalFor(c); p != nil {
+		return p, nil
+	}
+
+	key := c.Request().Header().Get(HeaderAPIKey)
+	if auth := c.Request().Header().Get(echo.HeaderAuthorization); key == "" && auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return nil, ErrUnauthenticated
+		}
+		key = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	if key == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	var p *Principal
+	var err error
+	switch {
+	case a.jwt != nil && isJWT(key):
+		p, err = a.jwt.Verify(key)
+	case a.apiKeys != nil:
+		p, err = a.apiKeys.Authenticate(key)
+	default:
+		err = ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set(principalContextKey, p)
+	requestLog(c).Debug("request authenticated")
+	return p, nil
+}
+
+// isJWT returns true if a bearer token looks like a JWT rather than an API
+// key.
+func isJWT(token string) bool {
+	return !strings.HasPrefix(token, apiKeyPrefix) && strings.Count(token, ".") == 2
+}
+
+// requestLog returns a log entry for the request, with who it was made by if
+// it has been authenticated.
+func requestLog(c echo.Context) *log.Entry {
+	entry := log.WithField("request_id", c.Request().Header().Get(HeaderRequestID))
+	if p := principalFor(c); p != nil {
+		entry = entry.WithFields(log.Fields{
+			"principal_id":   p.ID,
+			"principal_name": p.Name,
+			"auth_method":    p.Method,
+		})
+	}
+
+	if t := tenantFor(c); t != nil {
+		entry = entry.WithField("tenant", t.ID)
+	}
+
+	return entry
+}
+
+// withTenant resolves the tenant a request is made in, and counts the
+// request against it once next has handled it.
+func (a *App) withTenant(c echo.Context, next echo.HandlerFunc) error {
+	t, err := a.resolveTenant(c)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return next(c)
+	}
+
+	c.Set(tenantContextKey, t)
+	err = next(c)
+
+	status := c.Response().Status()
+	if err != nil {
+		status = noteErrorStatus(err)
+	}
+	tenantRequestsCounter.WithLabelValues(t.ID, strconv.Itoa(status)).Inc()
+
+	return err
+}
+
+// resolveTenant returns the tenant a request is made in, or nil if it isn't
+// made in one. A principal tied to a tenant is always in it. Otherwise, the
+// X-Tenant header chooses the tenant, but only if the API is open or the
+// principal is an admin.
+func (a *App) resolveTenant(c echo.Context) (*Tenant, error) {
+	id := c.Request().Header().Get(HeaderTenant)
+
+	if p := principalFor(c); p != nil {
+		switch {
+		case p.Tenant != "" && id != "" && id != p.Tenant:
+			return nil, NewProblem(CodeForbidden, "requests can only be made in tenant %s", p.Tenant)
+		case p.Tenant != "":
+			id = p.Tenant
+		case id != "" && !p.HasScope(ScopeAdmin):
+			return nil, NewProblem(CodeForbidden, "only admins can choose a tenant")
+		}
+	}
+
+	if id == "" {
+		return nil, nil
+	}
+
+	if a.tenants == nil {
+		return nil, NewProblem(CodeInvalidRequest, "tenants are not enabled")
+	}
+
+	return a.tenants.Retrieve(id)
+}
+
+// notes returns the notes the request can access. Requests made in a tenant
+// can only access its notes. Once a request has been authenticated, it can
+// only access the notes its principal was given access to.
+func (a *App) notes(c echo.Context) NoteRepository {
+	nr := a.noteRepo
+	if t := tenantFor(c); t != nil {
+		nr = a.noteRepo.(TenantNoteRepository).ForTenant(t)
+	}
+
+	if p := principalFor(c); p != nil {
+		return NewACLNoteRepository(nr, p)
+	}
+
+	return nr
+}
+
+// tenantFor returns the tenant a request is made in, or nil if it isn't made
+// in one.
+func tenantFor(c echo.Context) *Tenant {
+	t, _ := c.Get(tenantContextKey).(*Tenant)
+	return t
+}
+
+// principalFor returns the principal a request was authenticated as, or nil
+// if it wasn't.
+func principalFor(c echo.Context) *Principal {
+	p, _ := c.Get(principalContextKey).(*Principal)
+	return p
+}
+
+// requestTenant returns the id of the tenant a request is made in, or "" if
+// it isn't made in one.
+func requestTenant(c echo.Context) string {
+	if t := tenantFor(c); t != nil {
+		return t.ID
+	}
+
+	return ""
+}
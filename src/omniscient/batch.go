@@ -0,0 +1,194 @@
+package omniscient
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultMaxBatchSize = 100
+)
+
+type batchOpReq struct {
+	Op      NoteOpKind `json:"op"`
+	ID      string     `json:"id,omitempty"`
+	Content string     `json:"content,omitempty"`
+	noteExpiry
+}
+
+type batchReq struct {
+	Atomic     bool         `json:"atomic"`
+	Operations []batchOpReq `json:"operations"`
+}
+
+type batchOpResult struct {
+	Status int       `json:"status"`
+	Note   *Note     `json:"note,omitempty"`
+	Code   ErrorCode `json:"code,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type batchResp struct {
+	Results []batchOpResult `json:"results"`
+}
+
+// batch runs multiple note operations in one request. Each operation gets its
+// own status. In atomic mode the operations run in a single transaction, and
+// if one fails, none are applied.
+func (a *App) batch() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		br := &batchReq{}
+		if err := c.Bind(br); err != nil {
+			return err
+		}
+
+		if len(br.Operations) == 0 {
+			return NewProblem(CodeInvalidRequest, "batch has no operations")
+		}
+
+		if len(br.Operations) > a.maxBatchSize {
+			return NewProblem(CodeRequestTooLarge, "batch has more than %d operations", a.maxBatchSize)
+		}
+
+		v := a.newValidation()
+		br.validate(v, "")
+		if err := v.err(); err != nil {
+			return err
+		}
+
+		ops := br.noteOps(v.now)
+		nr := a.notes(c)
+
+		if br.Atomic {
+			status, resp := a.runAtomicBatch(nr, ops)
+			return c.JSON(status, resp)
+		}
+
+		resp := batchResp{}
+		for _, op := range ops {
+			resp.Results = append(resp.Results, a.runNoteOp(nr, op))
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (opr *batchOpReq) validate(v *validation, prefix string) {
+	switch opr.Op {
+	case NoteOpCreate:
+	case NoteOpRetrieve, NoteOpUpdate, NoteOpDelete:
+		if opr.ID == "" {
+			v.add(fieldName(prefix, "id"), CodeRequired, "id is required")
+		}
+	default:
+		v.add(fieldName(prefix, "op"), CodeInvalidValue, "unknown op %q", opr.Op)
+	}
+
+	if opr.Op == NoteOpCreate || opr.Op == NoteOpUpdate {
+		v.content(fieldName(prefix, "content"), opr.Content)
+		opr.noteExpiry.validate(v, prefix)
+	}
+}
+
+func (br *batchReq) validate(v *validation, prefix string) {
+	for i := range br.Operations {
+		br.Operations[i].validate(v, fmt.Sprintf("%s[%d]", fieldName(prefix, "operations"), i))
+	}
+}
+
+// noteOps converts a validated batch to operations on notes.
+func (br *batchReq) noteOps(now time.Time) []NoteOp {
+	var ops []NoteOp
+	for _, opr := range br.Operations {
+		ops = append(ops, NoteOp{
+			Kind:    opr.Op,
+			ID:      opr.ID,
+			Content: opr.Content,
+			Options: opr.options(now),
+		})
+	}
+
+	return ops
+}
+
+func (a *App) runNoteOp(nr NoteRepository, op NoteOp) batchOpResult {
+	var note *Note
+	var err error
+
+	switch op.Kind {
+	case NoteOpCreate:
+		note, err = nr.Create(op.Content, op.Options...)
+	case NoteOpRetrieve:
+		note, err = nr.Retrieve(op.ID)
+	case NoteOpUpdate:
+		note, err = nr.Update(op.ID, op.Content, op.Options...)
+	case NoteOpDelete:
+		err = nr.Delete(op.ID)
+	}
+
+	if err != nil {
+		return opErrorResult(err)
+	}
+
+	return batchOpResult{Status: noteOpStatus(op.Kind), Note: note}
+}
+
+func (a *App) runAtomicBatch(nr NoteRepository, ops []NoteOp) (int, batchResp) {
+	resp := batchResp{
+		Results: make([]batchOpResult, len(ops)),
+	}
+
+	notes, err := nr.Transact(ops)
+	if err == nil {
+		for i, op := range ops {
+			resp.Results[i] = batchOpResult{Status: noteOpStatus(op.Kind), Note: notes[i]}
+		}
+
+		return http.StatusOK, resp
+	}
+
+	// nothing was applied, so every operation depends on the failed one.
+	status := http.StatusConflict
+	failed := -1
+	if oe, ok := err.(*OpError); ok {
+		status = noteErrorStatus(oe.Err)
+		failed = oe.Index
+		err = oe.Err
+	} else if err != ErrTxConflict {
+		status = http.StatusInternalServerError
+	}
+
+	for i := range ops {
+		resp.Results[i] = batchOpResult{
+			Status: http.StatusFailedDependency,
+			Error:  "batch was not applied",
+		}
+	}
+
+	if failed >= 0 {
+		resp.Results[failed] = opErrorResult(err)
+	}
+
+	return status, resp
+}
+
+// opErrorResult is the result of an operation which failed with err. Internal
+// errors are not described to the client.
+func opErrorResult(err error) batchOpResult {
+	p := problemFor(err)
+	return batchOpResult{Status: p.Status, Code: p.Code, Error: p.Error()}
+}
+
+func noteOpStatus(kind NoteOpKind) int {
+	switch kind {
+	case NoteOpCreate:
+		return http.StatusCreated
+	case NoteOpDelete:
+		return http.StatusNoContent
+	}
+
+	return http.StatusOK
+}
@@ -0,0 +1,113 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postBatch(t *testing.T, u *url.URL, br *batchReq) (int, batchResp) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(br)
+	assert.NoError(t, err)
+
+	u.Path = "/v1/batch"
+
+	res, err := http.Post(u.String(), "application/json", &buf)
+	assert.NoError(t, err)
+
+	defer res.Body.Close()
+	var resp batchResp
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	assert.NoError(t, err)
+
+	return res.StatusCode, resp
+}
+
+func TestAppBatch(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Create", "new note", []NoteOption(nil)).Return(&Note{ID: "1"}, nil)
+		mnr.On("Retrieve", "2").Return(nil, ErrNoteNotFound)
+		mnr.On("Delete", "3").Return(nil)
+
+		status, resp := postBatch(t, u, &batchReq{
+			Operations: []batchOpReq{
+				{Op: NoteOpCreate, Content: "new note"},
+				{Op: NoteOpRetrieve, ID: "2"},
+				{Op: NoteOpDelete, ID: "3"},
+			},
+		})
+
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, resp.Results, 3)
+		assert.Equal(t, http.StatusCreated, resp.Results[0].Status)
+		assert.Equal(t, "1", resp.Results[0].Note.ID)
+		assert.Equal(t, http.StatusNotFound, resp.Results[1].Status)
+		assert.Equal(t, http.StatusNoContent, resp.Results[2].Status)
+	})
+}
+
+func TestAppBatchAtomic(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		ops := []NoteOp{
+			{Kind: NoteOpUpdate, ID: "1", Content: "updated"},
+			{Kind: NoteOpRetrieve, ID: "2"},
+		}
+		mnr.On("Transact", ops).Return([]*Note{{ID: "1"}, {ID: "2"}}, nil)
+
+		status, resp := postBatch(t, u, &batchReq{
+			Atomic: true,
+			Operations: []batchOpReq{
+				{Op: NoteOpUpdate, ID: "1", Content: "updated"},
+				{Op: NoteOpRetrieve, ID: "2"},
+			},
+		})
+
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, http.StatusOK, resp.Results[0].Status)
+		assert.Equal(t, "2", resp.Results[1].Note.ID)
+	})
+}
+
+func TestAppBatchAtomicFailure(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		ops := []NoteOp{
+			{Kind: NoteOpDelete, ID: "1"},
+			{Kind: NoteOpRetrieve, ID: "2"},
+		}
+		mnr.On("Transact", ops).Return(nil, &OpError{Index: 1, Err: ErrNoteNotFound})
+
+		status, resp := postBatch(t, u, &batchReq{
+			Atomic: true,
+			Operations: []batchOpReq{
+				{Op: NoteOpDelete, ID: "1"},
+				{Op: NoteOpRetrieve, ID: "2"},
+			},
+		})
+
+		assert.Equal(t, http.StatusNotFound, status)
+		assert.Equal(t, http.StatusFailedDependency, resp.Results[0].Status)
+		assert.Equal(t, http.StatusNotFound, resp.Results[1].Status)
+	})
+}
+
+func TestAppBatchInvalid(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		status, _ := postBatch(t, u, &batchReq{
+			Operations: []batchOpReq{{Op: NoteOpUpdate}},
+		})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+		status, _ = postBatch(t, u, &batchReq{})
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		status, _ = postBatch(t, u, &batchReq{
+			Operations: make([]batchOpReq, defaultMaxBatchSize+1),
+		})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	})
+}
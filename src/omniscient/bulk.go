@@ -0,0 +1,170 @@
+package omniscient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+const (
+	mimeNDJSON = "application/x-ndjson"
+
+	// maxImportLineSize is the largest note, in bytes, which can be imported.
+	maxImportLineSize = 1 << 20
+
+	importModeCreate = "create"
+	importModeUpsert = "upsert"
+)
+
+// notesMethod dispatches custom methods on the notes collection, e.g.
+// /notes:import. echo treats ':' as the start of a path parameter, so all
+// the methods share a route and are selected by name.
+func (a *App) notesMethod(methods map[string]echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h, ok := methods[strings.TrimPrefix(c.Param("method"), ":")]
+		if !ok {
+			return echo.ErrNotFound
+		}
+
+		return h(c)
+	}
+}
+
+type importResult struct {
+	Line   int       `json:"line"`
+	ID     string    `json:"id,omitempty"`
+	Status int       `json:"status"`
+	Code   ErrorCode `json:"code,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// importNotes reads notes as NDJSON from the request body and stores them one
+// line at a time, streaming back a result for each line. Ids are only kept
+// if preserve_ids is set. In upsert mode, notes with an existing id are
+// replaced rather than reported as conflicts.
+func (a *App) importNotes() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		preserveIDs := c.QueryParam("preserve_ids") == "true"
+
+		mode := c.QueryParam("mode")
+		if mode == "" {
+			mode = importModeCreate
+		}
+
+		if mode != importModeCreate && mode != importModeUpsert {
+			return fieldProblem("mode", CodeInvalidRequest, "mode must be create or upsert")
+		}
+
+		if mode == importModeUpsert && !preserveIDs {
+			return fieldProblem("preserve_ids", CodeInvalidRequest, "upsert mode requires preserve_ids")
+		}
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, mimeNDJSON)
+		res.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(res)
+		flusher, _ := res.(http.Flusher)
+
+		nr := a.notes(c)
+		scanner := bufio.NewScanner(c.Request().Body())
+		scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+
+		line := 0
+		for scanner.Scan() {
+			line++
+
+			b := bytes.TrimSpace(scanner.Bytes())
+			if len(b) == 0 {
+				continue
+			}
+
+			result := a.importNote(nr, b, preserveIDs, mode == importModeUpsert)
+			result.Line = line
+
+			if err := enc.Encode(result); err != nil {
+				return err
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			result := importResult{
+				Line:   line + 1,
+				Status: http.StatusBadRequest,
+				Code:   CodeInvalidRequest,
+				Error:  err.Error(),
+			}
+			return enc.Encode(result)
+		}
+
+		return nil
+	}
+}
+
+func (a *App) importNote(nr NoteRepository, b []byte, preserveID, overwrite bool) importResult {
+	var note Note
+	if err := json.Unmarshal(b, &note); err != nil {
+		return importResult{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Error: err.Error()}
+	}
+
+	if !preserveID {
+		note.ID = ""
+	}
+
+	v := a.newValidation()
+	v.content(fieldNoteContent, note.Content)
+	if err := v.err(); err != nil {
+		p := problemFor(err)
+		return importResult{ID: note.ID, Status: p.Status, Code: p.Code, Error: p.Error()}
+	}
+
+	created, err := nr.Import(&note, overwrite)
+	switch {
+	case err != nil:
+		p := problemFor(err)
+		return importResult{ID: note.ID, Status: p.Status, Code: p.Code, Error: p.Error()}
+	case created:
+		return importResult{ID: note.ID, Status: http.StatusCreated}
+	}
+
+	return importResult{ID: note.ID, Status: http.StatusOK}
+}
+
+// exportNotes streams every note as NDJSON.
+func (a *App) exportNotes() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, mimeNDJSON)
+		res.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(res)
+		flusher, _ := res.(http.Flusher)
+
+		err := a.notes(c).Walk(func(note *Note) error {
+			if err := enc.Encode(note); err != nil {
+				return err
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			return nil
+		})
+		if err != nil {
+			// the status has already been sent, so the export is cut short.
+			log.WithError(err).Error("unable to export notes")
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package omniscient
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAppImportNotes(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		isNote := func(id, content string) interface{} {
+			return mock.MatchedBy(func(n *Note) bool {
+				return n.ID == id && n.Content == content
+			})
+		}
+		mnr.On("Import", isNote("1", "first"), true).Return(true, nil)
+		mnr.On("Import", isNote("2", "second"), true).Return(false, nil)
+
+		body := strings.Join([]string{
+			`{"id":"1","content":"first"}`,
+			``,
+			`{"id":"2","content":"second"}`,
+			`{"id":`,
+		}, "\n")
+
+		u.Path = "/v1/notes:import"
+		u.RawQuery = "preserve_ids=true&mode=upsert"
+
+		res, err := http.Post(u.String(), mimeNDJSON, strings.NewReader(body))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		defer res.Body.Close()
+		var results []importResult
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var result importResult
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+			results = append(results, result)
+		}
+
+		assert.Equal(t, []importResult{
+			{Line: 1, ID: "1", Status: http.StatusCreated},
+			{Line: 3, ID: "2", Status: http.StatusOK},
+			{Line: 4, Status: http.StatusBadRequest, Code: CodeInvalidRequest, Error: results[2].Error},
+		}, results)
+	})
+}
+
+func TestAppImportNotesConflict(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Import", mock.AnythingOfType("*omniscient.Note"), false).Return(false, ErrNoteExists)
+
+		u.Path = "/v1/notes:import"
+		u.RawQuery = "preserve_ids=true"
+
+		res, err := http.Post(u.String(), mimeNDJSON, strings.NewReader(`{"id":"1","content":"first"}`))
+		assert.NoError(t, err)
+
+		defer res.Body.Close()
+		var result importResult
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		assert.Equal(t, http.StatusConflict, result.Status)
+	})
+}
+
+func TestAppImportNotesUpsertRequiresIDs(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/v1/notes:import"
+		u.RawQuery = "mode=upsert"
+
+		res, err := http.Post(u.String(), mimeNDJSON, strings.NewReader(`{"content":"first"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func TestAppExportNotes(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Walk", mock.AnythingOfType("func(*omniscient.Note) error")).
+			Run(func(args mock.Arguments) {
+				fn := args.Get(0).(func(*Note) error)
+				fn(&Note{ID: "1"})
+				fn(&Note{ID: "2"})
+			}).
+			Return(nil)
+
+		u.Path = "/v1/notes:export"
+
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, mimeNDJSON, res.Header.Get("Content-Type"))
+
+		defer res.Body.Close()
+		var ids []string
+		dec := json.NewDecoder(res.Body)
+		for dec.More() {
+			var note Note
+			assert.NoError(t, dec.Decode(&note))
+			ids = append(ids, note.ID)
+		}
+
+		assert.Equal(t, []string{"1", "2"}, ids)
+	})
+}
+
+func TestAppUnknownNotesMethod(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/v1/notes:unknown"
+
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
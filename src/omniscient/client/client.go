@@ -0,0 +1,677 @@
+// Package client is a client for the omniscient HTTP API.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"backoff"
+
+	"github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	headerRequestID      = "X-Request-Id"
+	headerIdempotencyKey = "Idempotency-Key"
+	headerTenant         = "X-Tenant"
+
+	mimeJSON        = "application/json"
+	mimeJSONPatch   = "application/json-patch+json"
+	mimeProblemJSON = "application/problem+json"
+
+	apiPrefix = "/v1"
+)
+
+var (
+	// DefaultRetryPolicy retries failed requests for up to about 5 seconds,
+	// or longer if the API asks to wait with Retry-After.
+	DefaultRetryPolicy = backoff.Policy{
+		Millis: []int{0, 100, 250, 500, 1000, 2500},
+	}
+
+	nextLink = regexp.MustCompile(`<([^>]*)>;\s*rel="next"`)
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context which sends id as the request id of the
+// requests made with it. Requests made without one get a new request id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id carried by ctx.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Note is a note.
+type Note struct {
+	ID        string     `json:"id"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Slug      string     `json:"slug,omitempty"`
+	Version   int64      `json:"version,omitempty"`
+	Owner     string     `json:"owner,omitempty"`
+	// Shares are the roles, reader or editor, other principals have on the
+	// note, by principal id.
+	Shares map[string]string `json:"shares,omitempty"`
+}
+
+// NoteInput is the content and attributes of a note being created or
+// updated. At most one of ExpiresAt and TTL can be set.
+type NoteInput struct {
+	Content   string
+	Slug      string
+	ExpiresAt *time.Time
+	TTL       time.Duration
+}
+
+// MarshalJSON encodes the input as the API expects it.
+func (in *NoteInput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Content   string     `json:"content"`
+		Slug      string     `json:"slug,omitempty"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		TTL       int64      `json:"ttl,omitempty"`
+	}{
+		Content:   in.Content,
+		Slug:      in.Slug,
+		ExpiresAt: in.ExpiresAt,
+		TTL:       int64(in.TTL / time.Second),
+	})
+}
+
+// PatchOp is an operation of a JSON Patch (RFC 6902). Paths name the fields
+// of a note, e.g. /content.
+type PatchOp struct {
+	Op    string
+	Path  string
+	From  string
+	Value interface{}
+}
+
+// MarshalJSON encodes the operation. Value is sent even when it is a zero
+// value, except by remove, move and copy, which don't take one.
+func (op PatchOp) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Op    string       `json:"op"`
+		Path  string       `json:"path"`
+		From  string       `json:"from,omitempty"`
+		Value *interface{} `json:"value,omitempty"`
+	}{
+		Op:   op.Op,
+		Path: op.Path,
+		From: op.From,
+	}
+
+	switch op.Op {
+	case "remove", "move", "copy":
+	default:
+		out.Value = &op.Value
+	}
+
+	return json.Marshal(out)
+}
+
+// ListOptions selects a page of notes.
+type ListOptions struct {
+	// Limit is the number of notes in the page.
+	Limit int
+	// Cursor is where the page starts. It is the NextCursor of the previous
+	// page, or empty for the first page.
+	Cursor string
+}
+
+// NotePage is a page of notes.
+type NotePage struct {
+	Notes []Note
+	// NextCursor is the cursor for the next page. It is empty on the last page.
+	NextCursor string
+}
+
+// Client is a client for the omniscient HTTP API.
+type Client struct {
+	baseURL     *url.URL
+	httpClient  *http.Client
+	retryPolicy backoff.Policy
+	token       string
+	tenant      string
+}
+
+// Option is an option for configuring Client.
+type Option func(*Client) error
+
+// HTTPClient sets the HTTP client used for requests.
+func HTTPClient(hc *http.Client) Option {
+	return func(c *Client) error {
+		if hc == nil {
+			return errors.New("http client is nil")
+		}
+
+		c.httpClient = hc
+		return nil
+	}
+}
+
+// Token sets the bearer token sent with every request.
+func Token(token string) Option {
+	return func(c *Client) error {
+		c.token = token
+		return nil
+	}
+}
+
+// InTenant makes every request in the tenant with id. Only admins not tied
+// to a tenant can choose one.
+func InTenant(id string) Option {
+	return func(c *Client) error {
+		c.tenant = id
+		return nil
+	}
+}
+
+// RetryPolicy sets the backoff policy for retrying failed requests. Each
+// entry of the policy is an attempt, so a policy with a single entry never
+// retries. Only GET, PUT and DELETE requests, and requests with an
+// idempotency key, are retried.
+func RetryPolicy(p backoff.Policy) Option {
+	return func(c *Client) error {
+		if len(p.Millis) == 0 {
+			return errors.New("retry policy has no attempts")
+		}
+
+		c.retryPolicy = p
+		return nil
+	}
+}
+
+// New creates an instance of Client for the API at baseURL.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url: %v", err)
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("base url %q must be absolute", baseURL)
+	}
+
+	c := &Client{
+		baseURL:     u,
+		httpClient:  http.DefaultClient,
+		retryPolicy: DefaultRetryPolicy,
+	}
+
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Create creates a note. The request carries an idempotency key, so it is
+// safe to retry.
+func (c *Client) Create(ctx context.Context, in *NoteInput) (*Note, error) {
+	var note Note
+	hdr := http.Header{}
+	hdr.Set(headerIdempotencyKey, uuid.NewV4().String())
+
+	if _, err := c.do(ctx, "POST", "/notes", nil, hdr, in, &note); err != nil {
+		return nil, err
+	}
+
+	return &note, nil
+}
+
+// Retrieve retrieves a note.
+func (c *Client) Retrieve(ctx context.Context, id string) (*Note, error) {
+	var note Note
+	if _, err := c.do(ctx, "GET", notePath(id), nil, nil, nil, &note); err != nil {
+		return nil, err
+	}
+
+	return &note, nil
+}
+
+// List lists a page of notes.
+func (c *Client) List(ctx context.Context, opts *ListOptions) (*NotePage, error) {
+	q := url.Values{}
+	if opts != nil && opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts != nil && opts.Cursor != "" {
+		q.Set("cursor", opts.Cursor)
+	}
+	if len(q) == 0 {
+		// without either, every note would be listed.
+		q.Set("limit", "100")
+	}
+
+	page := &NotePage{}
+	res, err := c.do(ctx, "GET", "/notes", q, nil, nil, &page.Notes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the next page may be one of several links.
+	if m := nextLink.FindStringSubmatch(strings.Join(res.Header["Link"], ", ")); m != nil {
+		if next, err := url.Parse(m[1]); err == nil {
+			page.NextCursor = next.Query().Get("cursor")
+		}
+	}
+
+	return page, nil
+}
+
+// ListAll calls fn for every note, fetching a page at a time. Listing stops
+// at the first error returned by fn.
+func (c *Client) ListAll(ctx context.Context, fn func(*Note) error) error {
+	opts := &ListOptions{}
+	for {
+		page, err := c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		for i := range page.Notes {
+			if err := fn(&page.Notes[i]); err != nil {
+				return err
+			}
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// Update updates a note. If the note does not exist, it is created with id.
+func (c *Client) Update(ctx context.Context, id string, in *NoteInput) (*Note, error) {
+	var note Note
+	if _, err := c.do(ctx, "PUT", notePath(id), nil, nil, in, &note); err != nil {
+		return nil, err
+	}
+
+	return &note, nil
+}
+
+// Patch applies a JSON Patch to a note. If a test operation of the patch
+// fails, the error is a conflict.
+func (c *Client) Patch(ctx context.Context, id string, ops []PatchOp) (*Note, error) {
+	var note Note
+	hdr := http.Header{}
+	hdr.Set("Content-Type", mimeJSONPatch)
+
+	if _, err := c.do(ctx, "PATCH", notePath(id), nil, hdr, ops, &note); err != nil {
+		return nil, err
+	}
+
+	return &note, nil
+}
+
+// Share replaces who a note is shared with. shares are roles, reader or
+// editor, by principal id. Only the owner of a note can share it.
+func (c *Client) Share(ctx context.Context, id string, shares map[string]string) (*Note, error) {
+	in := struct {
+		Shares map[string]string `json:"shares"`
+	}{shares}
+
+	var note Note
+	if _, err := c.do(ctx, "PUT", notePath(id)+"/shares", nil, nil, &in, &note); err != nil {
+		return nil, err
+	}
+
+	return &note, nil
+}
+
+// Delete deletes a note.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", notePath(id), nil, nil, nil, nil)
+	return err
+}
+
+// Export writes every note to w as NDJSON, in the format accepted by the
+// import endpoint.
+func (c *Client) Export(ctx context.Context, w io.Writer) error {
+	_, err := c.do(ctx, "GET", "/notes:export", nil, nil, nil, w)
+	return err
+}
+
+// APIKey is a key clients authenticate with.
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Tenant is the tenant the key is tied to, if any.
+	Tenant string `json:"tenant,omitempty"`
+	// Key is the key itself. It is only set when the key is created.
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// CreateAPIKey creates an API key granted scopes. It needs the admin scope.
+func (c *Client) CreateAPIKey(ctx context.Context, name string, scopes []string) (*APIKey, error) {
+	return c.CreateTenantAPIKey(ctx, name, scopes, "")
+}
+
+// CreateTenantAPIKey creates an API key granted scopes, which can only
+// access the notes of tenant. It needs the admin scope.
+func (c *Client) CreateTenantAPIKey(ctx context.Context, name string, scopes []string, tenant string) (*APIKey, error) {
+	in := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		Tenant string   `json:"tenant,omitempty"`
+	}{name, scopes, tenant}
+
+	var key APIKey
+	if _, err := c.do(ctx, "POST", "/api-keys", nil, nil, &in, &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// ListAPIKeys lists the API keys. It needs the admin scope.
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	if _, err := c.do(ctx, "GET", "/api-keys", nil, nil, nil, &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey revokes an API key. It needs the admin scope.
+func (c *Client) DeleteAPIKey(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", "/api-keys/"+id, nil, nil, nil, nil)
+	return err
+}
+
+// ShareLink is a read-only public link to a note.
+type ShareLink struct {
+	ID        string     `json:"id"`
+	NoteID    string     `json:"note_id"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// MaxViews is how many times the note can be viewed through the link.
+	// Zero is unlimited.
+	MaxViews int64 `json:"max_views,omitempty"`
+	Views    int64 `json:"views"`
+	// URL is where anyone can view the note, without authenticating.
+	URL string `json:"url"`
+}
+
+// ShareLinkInput is the expiry and view limit of a share link being
+// created. Links without either last until they are revoked.
+type ShareLinkInput struct {
+	TTL      time.Duration
+	MaxViews int64
+}
+
+// CreateShareLink creates a public link to the note with id. Only the owner
+// of a note can create one.
+func (c *Client) CreateShareLink(ctx context.Context, id string, in *ShareLinkInput) (*ShareLink, error) {
+	body := struct {
+		TTL      int64 `json:"ttl,omitempty"`
+		MaxViews int64 `json:"max_views,omitempty"`
+	}{int64(in.TTL / time.Second), in.MaxViews}
+
+	var l ShareLink
+	if _, err := c.do(ctx, "POST", notePath(id)+"/share", nil, nil, &body, &l); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// ListShareLinks lists the public links to the note with id.
+func (c *Client) ListShareLinks(ctx context.Context, id string) ([]ShareLink, error) {
+	var links []ShareLink
+	if _, err := c.do(ctx, "GET", notePath(id)+"/share", nil, nil, nil, &links); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// RevokeShareLink revokes the public link with linkID to the note with id.
+func (c *Client) RevokeShareLink(ctx context.Context, id, linkID string) error {
+	_, err := c.do(ctx, "DELETE", notePath(id)+"/share/"+linkID, nil, nil, nil, nil)
+	return err
+}
+
+// RevokeShareLinks revokes every public link to the note with id.
+func (c *Client) RevokeShareLinks(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", notePath(id)+"/share", nil, nil, nil, nil)
+	return err
+}
+
+// Tenant is an isolated namespace of notes, with its own quota.
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// MaxNotes and MaxBytes are the quota of the tenant. Zero is unlimited.
+	MaxNotes  int64     `json:"max_notes,omitempty"`
+	MaxBytes  int64     `json:"max_bytes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Usage is only set when a single tenant is retrieved.
+	Usage *TenantUsage `json:"usage,omitempty"`
+}
+
+// TenantUsage is what a tenant is using of its quota.
+type TenantUsage struct {
+	Notes int64 `json:"notes"`
+	Bytes int64 `json:"bytes"`
+}
+
+// CreateTenant creates a tenant. It needs the admin scope.
+func (c *Client) CreateTenant(ctx context.Context, t *Tenant) (*Tenant, error) {
+	in := struct {
+		ID       string `json:"id"`
+		Name     string `json:"name,omitempty"`
+		MaxNotes int64  `json:"max_notes,omitempty"`
+		MaxBytes int64  `json:"max_bytes,omitempty"`
+	}{t.ID, t.Name, t.MaxNotes, t.MaxBytes}
+
+	var created Tenant
+	if _, err := c.do(ctx, "POST", "/tenants", nil, nil, &in, &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// ListTenants lists the tenants. It needs the admin scope.
+func (c *Client) ListTenants(ctx context.Context) ([]Tenant, error) {
+	var tenants []Tenant
+	if _, err := c.do(ctx, "GET", "/tenants", nil, nil, nil, &tenants); err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+// GetTenant retrieves a tenant with its usage. It needs the admin scope.
+func (c *Client) GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	var t Tenant
+	if _, err := c.do(ctx, "GET", "/tenants/"+id, nil, nil, nil, &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// DeleteTenant deletes a tenant and all of its notes. It needs the admin
+// scope.
+func (c *Client) DeleteTenant(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", "/tenants/"+id, nil, nil, nil, nil)
+	return err
+}
+
+// notePath is the path of a note. It is escaped when the URL is encoded.
+func notePath(id string) string {
+	return "/notes/" + id
+}
+
+// do sends a request to the API, retrying it according to the retry policy
+// if it fails in a way which might succeed later and sending it again cannot
+// repeat the change. The response body is decoded into out, or copied to it
+// if it is an io.Writer.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, hdr http.Header, in, out interface{}) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+
+	u := *c.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + apiPrefix + path
+	u.RawQuery = q.Encode()
+
+	reqID := RequestID(ctx)
+	if reqID == "" {
+		reqID = uuid.NewV4().String()
+	}
+
+	retry := idempotent(method) || hdr.Get(headerIdempotencyKey) != ""
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && !retry {
+			return nil, lastErr
+		}
+
+		wait, err := c.retryPolicy.Duration(attempt)
+		if err != nil {
+			return nil, lastErr
+		}
+
+		// wait as long as the API asked to, if it is longer.
+		if e, ok := lastErr.(*Error); ok && e.RetryAfter > wait {
+			wait = e.RetryAfter
+		}
+
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		for k, vs := range hdr {
+			req.Header[k] = vs
+		}
+		req.Header.Set(headerRequestID, reqID)
+		req.Header.Set("Accept", mimeJSON)
+		if in != nil && req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", mimeJSON)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.tenant != "" {
+			req.Header.Set(headerTenant, c.tenant)
+		}
+
+		res, err := ctxhttp.Do(ctx, c.httpClient, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			lastErr = err
+			continue
+		}
+
+		if res.StatusCode >= http.StatusBadRequest {
+			lastErr = decodeError(res, reqID)
+			if retryable(res.StatusCode) {
+				continue
+			}
+
+			return nil, lastErr
+		}
+
+		err = decodeBody(res, out)
+		return res, err
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// idempotent reports whether sending a request with method more than once
+// has the same effect as sending it once.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+
+	return false
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func decodeBody(res *http.Response, out interface{}) error {
+	defer res.Body.Close()
+
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		_, err := io.Copy(ioutil.Discard, res.Body)
+		return err
+	}
+
+	if w, ok := out.(io.Writer); ok {
+		_, err := io.Copy(w, res.Body)
+		return err
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,306 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"backoff"
+	"omniscient"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+)
+
+var testRetryPolicy = backoff.Policy{Millis: []int{0, 1, 1}}
+
+// withServer serves an App backed by a mock note repository. wrap can
+// intercept requests before they reach the app.
+func withServer(t *testing.T, wrap func(http.Handler) http.Handler, fn func(c *Client, mnr *omniscient.MockNoteRepository)) {
+	health, err := omniscient.NewHealth()
+	assert.NoError(t, err)
+
+	mnr := &omniscient.MockNoteRepository{}
+	app, err := omniscient.NewApp(
+		omniscient.AppNoteRepository(mnr),
+		omniscient.AppHealth(health),
+		omniscient.AppRedisClient(nil))
+	assert.NoError(t, err)
+
+	h := app.Mux
+	if wrap != nil {
+		h = wrap(h)
+	}
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	c, err := New(ts.URL, RetryPolicy(testRetryPolicy))
+	assert.NoError(t, err)
+
+	fn(c, mnr)
+
+	assert.NoError(t, health.Stop())
+}
+
+func TestClientCreate(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("Create", "new note", mock.AnythingOfType("[]omniscient.NoteOption")).
+			Return(func(content string, opts ...omniscient.NoteOption) *omniscient.Note {
+				n := &omniscient.Note{ID: "1", Content: content}
+				for _, opt := range opts {
+					opt(n)
+				}
+				return n
+			}, nil)
+
+		note, err := c.Create(context.Background(), &NoteInput{Content: "new note", Slug: "new-note", TTL: time.Hour})
+		assert.NoError(t, err)
+		assert.Equal(t, "1", note.ID)
+		assert.Equal(t, "new-note", note.Slug)
+		assert.NotNil(t, note.ExpiresAt)
+	})
+}
+
+func TestClientRetrieve(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("Retrieve", "1").Return(&omniscient.Note{ID: "1", Content: "test"}, nil)
+		mnr.On("Retrieve", "missing").Return(nil, omniscient.ErrNoteNotFound)
+
+		note, err := c.Retrieve(context.Background(), "1")
+		assert.NoError(t, err)
+		assert.Equal(t, "test", note.Content)
+
+		ctx := WithRequestID(context.Background(), "req-1")
+		_, err = c.Retrieve(ctx, "missing")
+		assert.True(t, IsNotFound(err))
+
+		e := err.(*Error)
+		assert.Equal(t, CodeNoteNotFound, e.Code)
+		assert.Equal(t, "req-1", e.RequestID)
+	})
+}
+
+func TestClientList(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("ListPage", int64(0), int64(2)).Return([]omniscient.Note{{ID: "1"}, {ID: "2"}}, true, nil)
+		mnr.On("ListPage", int64(2), int64(2)).Return([]omniscient.Note{{ID: "3"}}, false, nil)
+
+		page, err := c.List(context.Background(), &ListOptions{Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, page.Notes, 2)
+		assert.Equal(t, "2", page.NextCursor)
+
+		page, err = c.List(context.Background(), &ListOptions{Limit: 2, Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Len(t, page.Notes, 1)
+		assert.Empty(t, page.NextCursor)
+	})
+}
+
+func TestClientListAll(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("ListPage", int64(0), int64(100)).Return([]omniscient.Note{{ID: "1"}}, true, nil)
+		mnr.On("ListPage", int64(100), int64(100)).Return([]omniscient.Note{{ID: "2"}}, false, nil)
+
+		var ids []string
+		err := c.ListAll(context.Background(), func(n *Note) error {
+			ids = append(ids, n.ID)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1", "2"}, ids)
+	})
+}
+
+func TestClientUpdateValidation(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		_, err := c.Update(context.Background(), "1", &NoteInput{})
+		assert.True(t, IsValidation(err))
+
+		e := err.(*Error)
+		assert.Equal(t, []FieldError{
+			{Field: "content", Code: "required", Message: "content is required"},
+		}, e.Fields)
+	})
+}
+
+func TestClientDelete(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("Delete", "1").Return(nil)
+
+		err := c.Delete(context.Background(), "1")
+		assert.NoError(t, err)
+
+		mnr.AssertExpectations(t)
+	})
+}
+
+func TestClientRetries(t *testing.T) {
+	var mu sync.Mutex
+	var reqIDs []string
+
+	unavailable := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			reqIDs = append(reqIDs, r.Header.Get(headerRequestID))
+			n := len(reqIDs)
+			mu.Unlock()
+
+			if n < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	withServer(t, unavailable, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("Retrieve", "1").Return(&omniscient.Note{ID: "1"}, nil)
+
+		_, err := c.Retrieve(context.Background(), "1")
+		assert.NoError(t, err)
+
+		assert.Len(t, reqIDs, 3)
+		assert.Equal(t, reqIDs[0], reqIDs[1])
+		assert.Equal(t, reqIDs[0], reqIDs[2])
+	})
+}
+
+func TestClientRetriesNonIdempotent(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+
+	unavailable := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			keys = append(keys, r.Header.Get(headerIdempotencyKey))
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+	}
+
+	withServer(t, unavailable, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		// a patch may have been applied, so it is not sent again.
+		_, err := c.Patch(context.Background(), "1", []PatchOp{{Op: "replace", Path: "/content", Value: "x"}})
+		assert.Error(t, err)
+		assert.Len(t, keys, 1)
+
+		// a create carries an idempotency key, so it is.
+		keys = nil
+		_, err = c.Create(context.Background(), &NoteInput{Content: "x"})
+		assert.Error(t, err)
+		if assert.Len(t, keys, len(testRetryPolicy.Millis)) {
+			assert.NotEmpty(t, keys[0])
+			assert.Equal(t, keys[0], keys[1])
+		}
+	})
+}
+
+func TestClientRetriesExhausted(t *testing.T) {
+	unavailable := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+	}
+
+	withServer(t, unavailable, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		_, err := c.Retrieve(context.Background(), "1")
+		e, ok := err.(*Error)
+		if assert.True(t, ok) {
+			assert.Equal(t, http.StatusServiceUnavailable, e.StatusCode)
+		}
+	})
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+
+	limited := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			times = append(times, time.Now())
+			n := len(times)
+			mu.Unlock()
+
+			if n < 2 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	withServer(t, limited, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("Retrieve", "1").Return(&omniscient.Note{ID: "1"}, nil)
+
+		_, err := c.Retrieve(context.Background(), "1")
+		assert.NoError(t, err)
+
+		if assert.Len(t, times, 2) {
+			assert.True(t, times[1].Sub(times[0]) >= time.Second)
+		}
+	})
+}
+
+func TestClientContextCanceled(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := c.Retrieve(ctx, "1")
+		assert.Equal(t, context.Canceled, err)
+	})
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := New("localhost:8080")
+	assert.Error(t, err)
+
+	_, err = New("http://localhost:8080", RetryPolicy(backoff.Policy{}))
+	assert.Equal(t, errors.New("retry policy has no attempts"), err)
+}
+
+func TestClientPatchConflict(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("Patch", "1", mock.AnythingOfType("func(*omniscient.Note) error")).
+			Return(nil, func(id string, fn func(*omniscient.Note) error) error {
+				return fn(&omniscient.Note{ID: id, Content: "changed"})
+			})
+
+		_, err := c.Patch(context.Background(), "1", []PatchOp{
+			{Op: "test", Path: "/content", Value: "original"},
+			{Op: "replace", Path: "/content", Value: "edited"},
+		})
+		assert.True(t, IsConflict(err))
+	})
+}
+
+func TestClientPatchZeroValue(t *testing.T) {
+	withServer(t, nil, func(c *Client, mnr *omniscient.MockNoteRepository) {
+		mnr.On("Patch", "1", mock.AnythingOfType("func(*omniscient.Note) error")).
+			Return(func(id string, fn func(*omniscient.Note) error) *omniscient.Note {
+				n := &omniscient.Note{ID: id, Content: "old"}
+				if err := fn(n); err != nil {
+					return nil
+				}
+				return n
+			}, nil)
+
+		note, err := c.Patch(context.Background(), "1", []PatchOp{
+			{Op: "replace", Path: "/content", Value: ""},
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "", note.Content)
+		}
+	})
+}
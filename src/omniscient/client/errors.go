@@ -0,0 +1,113 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error codes returned by the API. See the problem model in the OpenAPI
+// document served at /openapi.json for the full list.
+const (
+	CodeNoteNotFound     = "note_not_found"
+	CodeNoteExists       = "note_exists"
+	CodeNoteSlugTaken    = "note_slug_taken"
+	CodeValidationFailed = "validation_failed"
+	CodeConflict         = "conflict"
+	CodeRateLimited      = "rate_limited"
+)
+
+// FieldError describes why a field of a request is not valid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is an error response from the API.
+type Error struct {
+	StatusCode int          `json:"status"`
+	Type       string       `json:"type"`
+	Title      string       `json:"title"`
+	Detail     string       `json:"detail"`
+	Code       string       `json:"code"`
+	RequestID  string       `json:"request_id"`
+	Fields     []FieldError `json:"errors"`
+	// RetryAfter is how long the API asked to wait before retrying, if it
+	// did.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Detail
+	if msg == "" {
+		msg = e.Title
+	}
+
+	return fmt.Sprintf("omniscient: %s (status %d, code %s, request %s)",
+		msg, e.StatusCode, e.Code, e.RequestID)
+}
+
+// IsNotFound returns true if err is an Error for a note which does not exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsConflict returns true if err is an Error for a request which conflicts
+// with the current state of a note.
+func IsConflict(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusConflict
+}
+
+// IsValidation returns true if err is an Error for a request which is not
+// valid. The fields which aren't valid are listed in the Error.
+func IsValidation(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == CodeValidationFailed
+}
+
+// IsRateLimited returns true if err is an Error for a request which was
+// rejected for being over a rate limit.
+func IsRateLimited(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusTooManyRequests
+}
+
+// decodeError reads an error response. Responses which aren't problems are
+// described by their status.
+func decodeError(res *http.Response, reqID string) error {
+	defer res.Body.Close()
+
+	e := &Error{}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	ct, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if ct == mimeProblemJSON {
+		if err := json.Unmarshal(b, e); err != nil {
+			return fmt.Errorf("omniscient: unable to decode error: %v", err)
+		}
+	}
+
+	e.StatusCode = res.StatusCode
+	if e.Title == "" {
+		e.Title = http.StatusText(res.StatusCode)
+	}
+	if e.RequestID == "" {
+		e.RequestID = reqID
+	}
+	if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	return e
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"omniscient/client"
+
+	"golang.org/x/net/context"
+)
+
+const summaryLength = 60
+
+// command runs the commands of the cli.
+type command struct {
+	ctx    context.Context
+	client *client.Client
+	editor string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (cmd *command) commands() map[string]func([]string) error {
+	return map[string]func([]string) error{
+		"create":  cmd.create,
+		"list":    cmd.list,
+		"search":  cmd.search,
+		"get":     cmd.get,
+		"edit":    cmd.edit,
+		"delete":  cmd.delete,
+		"share":   cmd.share,
+		"links":   cmd.links,
+		"export":  cmd.export,
+		"keys":    cmd.keys,
+		"tenants": cmd.tenants,
+	}
+}
+
+func (cmd *command) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(cmd.stderr)
+	return fs
+}
+
+func (cmd *command) create(args []string) error {
+	fs := cmd.flagSet("create")
+	var (
+		slug = fs.String("slug", "", "slug for the note")
+		ttl  = fs.Duration("ttl", 0, "time until the note expires")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var content string
+	if isTerminal(cmd.stdin) {
+		s, err := cmd.editContent("", "")
+		if err != nil {
+			return err
+		}
+		content = s
+	} else {
+		b, err := ioutil.ReadAll(cmd.stdin)
+		if err != nil {
+			return err
+		}
+		content = string(b)
+	}
+
+	if strings.TrimSpace(content) == "" {
+		return errors.New("note is empty")
+	}
+
+	note, err := cmd.client.Create(cmd.ctx, &client.NoteInput{
+		Content: content,
+		Slug:    *slug,
+		TTL:     *ttl,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cmd.stdout, note.ID)
+	return nil
+}
+
+func (cmd *command) list(args []string) error {
+	fs := cmd.flagSet("list")
+	var (
+		output = fs.String("o", "table", "output format: table or json")
+		query  = fs.String("q", "", "only list notes containing query")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return cmd.listNotes(*output, *query)
+}
+
+func (cmd *command) search(args []string) error {
+	fs := cmd.flagSet("search")
+	output := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("search needs a query")
+	}
+
+	return cmd.listNotes(*output, fs.Arg(0))
+}
+
+// listNotes lists the notes whose content or slug contains query, ignoring
+// case.
+func (cmd *command) listNotes(output, query string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q", output)
+	}
+
+	query = strings.ToLower(query)
+
+	notes := []client.Note{}
+	err := cmd.client.ListAll(cmd.ctx, func(n *client.Note) error {
+		if strings.Contains(strings.ToLower(n.Content), query) ||
+			strings.Contains(strings.ToLower(n.Slug), query) {
+			notes = append(notes, *n)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		return writeJSON(cmd.stdout, notes)
+	}
+
+	tw := tabwriter.NewWriter(cmd.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSLUG\tUPDATED\tCONTENT")
+	for _, n := range notes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			n.ID, n.Slug, n.UpdatedAt.Format(time.RFC3339), summary(n.Content))
+	}
+	return tw.Flush()
+}
+
+func (cmd *command) get(args []string) error {
+	fs := cmd.flagSet("get")
+	output := fs.String("o", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("get needs a note id")
+	}
+
+	note, err := cmd.client.Retrieve(cmd.ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "text":
+		_, err := io.WriteString(cmd.stdout, note.Content)
+		return err
+	case "json":
+		return writeJSON(cmd.stdout, note)
+	default:
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+}
+
+// edit opens a note in the editor, and saves it if it was changed. If the
+// note was changed by someone else while it was being edited, it is not saved
+// and the edited content is kept in a file.
+func (cmd *command) edit(args []string) error {
+	fs := cmd.flagSet("edit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("edit needs a note id")
+	}
+
+	note, err := cmd.client.Retrieve(cmd.ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "omniscient-"+note.ID+"-")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	f.Close()
+
+	content, err := cmd.editContent(path, note.Content)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	if content == note.Content {
+		os.Remove(path)
+		fmt.Fprintln(cmd.stderr, "note was not changed")
+		return nil
+	}
+
+	// the version changes with every save, even ones made within the same
+	// second. Notes saved before there were versions don't have one.
+	check := client.PatchOp{Op: "test", Path: "/version", Value: note.Version}
+	if note.Version == 0 {
+		check = client.PatchOp{Op: "test", Path: "/updated_at", Value: note.UpdatedAt}
+	}
+
+	_, err = cmd.client.Patch(cmd.ctx, note.ID, []client.PatchOp{
+		check,
+		{Op: "replace", Path: "/content", Value: content},
+	})
+	if client.IsConflict(err) {
+		return fmt.Errorf("note was changed since it was opened; your edit is saved in %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%v; your edit is saved in %s", err, path)
+	}
+
+	os.Remove(path)
+	return nil
+}
+
+func (cmd *command) delete(args []string) error {
+	fs := cmd.flagSet("delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("delete needs a note id")
+	}
+
+	for _, id := range fs.Args() {
+		if err := cmd.client.Delete(cmd.ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// share replaces who a note is shared with. Without any shares, the note is
+// no longer shared.
+func (cmd *command) share(args []string) error {
+	fs := cmd.flagSet("share")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("share needs a note id")
+	}
+
+	shares := map[string]string{}
+	for _, arg := range fs.Args()[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("share %q must be principal=role", arg)
+		}
+		shares[parts[0]] = parts[1]
+	}
+
+	_, err := cmd.client.Share(cmd.ctx, fs.Arg(0), shares)
+	return err
+}
+
+func (cmd *command) export(args []string) error {
+	fs := cmd.flagSet("export")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return cmd.client.Export(cmd.ctx, cmd.stdout)
+}
+
+// links manages the public links to a note.
+func (cmd *command) links(args []string) error {
+	if len(args) == 0 {
+		return errors.New("links needs create, list or revoke")
+	}
+
+	switch args[0] {
+	case "create":
+		return cmd.createLink(args[1:])
+	case "list":
+		return cmd.listLinks(args[1:])
+	case "revoke":
+		return cmd.revokeLinks(args[1:])
+	}
+
+	return fmt.Errorf("unknown links command %q", args[0])
+}
+
+func (cmd *command) createLink(args []string) error {
+	fs := cmd.flagSet("links create")
+	ttl := fs.Duration("ttl", 0, "how long the link lasts, e.g. 24h")
+	maxViews := fs.Int64("max-views", 0, "how many times the note can be viewed, or 0 for unlimited")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("links create needs a note id")
+	}
+
+	l, err := cmd.client.CreateShareLink(cmd.ctx, fs.Arg(0), &client.ShareLinkInput{
+		TTL:      *ttl,
+		MaxViews: *maxViews,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cmd.stdout, l.URL)
+	return nil
+}
+
+func (cmd *command) listLinks(args []string) error {
+	fs := cmd.flagSet("links list")
+	output := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("links list needs a note id")
+	}
+
+	links, err := cmd.client.ListShareLinks(cmd.ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return writeJSON(cmd.stdout, links)
+	}
+
+	tw := tabwriter.NewWriter(cmd.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tVIEWS\tEXPIRES\tURL")
+	for _, l := range links {
+		views := strconv.FormatInt(l.Views, 10)
+		if l.MaxViews > 0 {
+			views += "/" + strconv.FormatInt(l.MaxViews, 10)
+		}
+
+		expires := "never"
+		if l.ExpiresAt != nil {
+			expires = l.ExpiresAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.ID, views, expires, l.URL)
+	}
+	return tw.Flush()
+}
+
+func (cmd *command) revokeLinks(args []string) error {
+	fs := cmd.flagSet("links revoke")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("links revoke needs a note id")
+	}
+
+	id := fs.Arg(0)
+	if fs.NArg() == 1 {
+		return cmd.client.RevokeShareLinks(cmd.ctx, id)
+	}
+
+	for _, link := range fs.Args()[1:] {
+		if err := cmd.client.RevokeShareLink(cmd.ctx, id, link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keys manages API keys.
+func (cmd *command) keys(args []string) error {
+	if len(args) == 0 {
+		return errors.New("keys needs create, list or revoke")
+	}
+
+	switch args[0] {
+	case "create":
+		return cmd.createKey(args[1:])
+	case "list":
+		return cmd.listKeys(args[1:])
+	case "revoke":
+		return cmd.revokeKeys(args[1:])
+	}
+
+	return fmt.Errorf("unknown keys command %q", args[0])
+}
+
+func (cmd *command) createKey(args []string) error {
+	fs := cmd.flagSet("keys create")
+	scopes := fs.String("scopes", "notes:read,notes:write", "comma separated scopes: notes:read, notes:write or admin")
+	tenant := fs.String("tenant", "", "tenant the key can only access the notes of")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("keys create needs a name")
+	}
+
+	key, err := cmd.client.CreateTenantAPIKey(cmd.ctx, fs.Arg(0), strings.Split(*scopes, ","), *tenant)
+	if err != nil {
+		return err
+	}
+
+	// the key can't be retrieved again, so it is the only output.
+	fmt.Fprintln(cmd.stdout, key.Key)
+	return nil
+}
+
+func (cmd *command) listKeys(args []string) error {
+	fs := cmd.flagSet("keys list")
+	output := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	keys, err := cmd.client.ListAPIKeys(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return writeJSON(cmd.stdout, keys)
+	}
+
+	tw := tabwriter.NewWriter(cmd.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tLAST USED")
+	for _, k := range keys {
+		lastUsed := "never"
+		if k.LastUsedAt != nil {
+			lastUsed = k.LastUsedAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","), lastUsed)
+	}
+	return tw.Flush()
+}
+
+func (cmd *command) revokeKeys(args []string) error {
+	fs := cmd.flagSet("keys revoke")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("keys revoke needs a key id")
+	}
+
+	for _, id := range fs.Args() {
+		if err := cmd.client.DeleteAPIKey(cmd.ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tenants manages tenants.
+func (cmd *command) tenants(args []string) error {
+	if len(args) == 0 {
+		return errors.New("tenants needs create, list, get or delete")
+	}
+
+	switch args[0] {
+	case "create":
+		return cmd.createTenant(args[1:])
+	case "list":
+		return cmd.listTenants(args[1:])
+	case "get":
+		return cmd.getTenant(args[1:])
+	case "delete":
+		return cmd.deleteTenants(args[1:])
+	}
+
+	return fmt.Errorf("unknown tenants command %q", args[0])
+}
+
+func (cmd *command) createTenant(args []string) error {
+	fs := cmd.flagSet("tenants create")
+	name := fs.String("name", "", "name of the tenant")
+	maxNotes := fs.Int64("max-notes", 0, "how many notes the tenant can have, or 0 for unlimited")
+	maxBytes := fs.Int64("max-bytes", 0, "how many bytes of content the tenant can have, or 0 for unlimited")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("tenants create needs an id")
+	}
+
+	t, err := cmd.client.CreateTenant(cmd.ctx, &client.Tenant{
+		ID:       fs.Arg(0),
+		Name:     *name,
+		MaxNotes: *maxNotes,
+		MaxBytes: *maxBytes,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cmd.stdout, t.ID)
+	return nil
+}
+
+func (cmd *command) listTenants(args []string) error {
+	fs := cmd.flagSet("tenants list")
+	output := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	tenants, err := cmd.client.ListTenants(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return writeJSON(cmd.stdout, tenants)
+	}
+
+	return writeTenants(cmd.stdout, tenants)
+}
+
+func (cmd *command) getTenant(args []string) error {
+	fs := cmd.flagSet("tenants get")
+	output := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("tenants get needs a tenant id")
+	}
+
+	t, err := cmd.client.GetTenant(cmd.ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return writeJSON(cmd.stdout, t)
+	}
+
+	return writeTenants(cmd.stdout, []client.Tenant{*t})
+}
+
+func (cmd *command) deleteTenants(args []string) error {
+	fs := cmd.flagSet("tenants delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("tenants delete needs a tenant id")
+	}
+
+	for _, id := range fs.Args() {
+		if err := cmd.client.DeleteTenant(cmd.ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeTenants writes tenants as a table. Their usage is only shown if it
+// is known.
+func writeTenants(w io.Writer, tenants []client.Tenant) error {
+	limit := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tNOTES\tBYTES")
+	for _, t := range tenants {
+		notes, bytes := limit(t.MaxNotes), limit(t.MaxBytes)
+		if t.Usage != nil {
+			notes = fmt.Sprintf("%d/%s", t.Usage.Notes, notes)
+			bytes = fmt.Sprintf("%d/%s", t.Usage.Bytes, bytes)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.ID, t.Name, notes, bytes)
+	}
+	return tw.Flush()
+}
+
+// editContent writes content to the file at path, opens it in the editor
+// and returns what was saved. If path is empty, a temporary file is used.
+func (cmd *command) editContent(path, content string) (string, error) {
+	if path == "" {
+		f, err := ioutil.TempFile("", "omniscient-")
+		if err != nil {
+			return "", err
+		}
+		path = f.Name()
+		f.Close()
+		defer os.Remove(path)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		return "", err
+	}
+
+	// the editor is run by the shell, so it can have arguments, e.g. "code -w".
+	c := exec.Command("sh", "-c", cmd.editor+` "$1"`, "sh", path)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = cmd.stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("editor %q failed: %v", cmd.editor, err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// isTerminal returns true if r is a terminal rather than a pipe or file.
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// summary is the first line of content, shortened to fit in a table.
+func summary(content string) string {
+	line := strings.TrimSpace(content)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = strings.TrimSpace(line[:i]) + " …"
+	}
+
+	if r := []rune(line); len(r) > summaryLength {
+		line = string(r[:summaryLength-1]) + "…"
+	}
+
+	return line
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// config is where the server is, how to authenticate with it and which
+// tenant to work in.
+type config struct {
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Tenant string `json:"tenant"`
+}
+
+// loadConfig loads the config file, and overrides it with the environment.
+// A missing config file is not an error unless OMNISCIENT_CONFIG names it.
+func loadConfig(getenv func(string) string) (*config, error) {
+	cfg := &config{}
+
+	path, explicit := getenv("OMNISCIENT_CONFIG"), true
+	if path == "" {
+		path, explicit = defaultConfigPath(getenv), false
+	}
+
+	if path != "" {
+		f, err := os.Open(path)
+		switch {
+		case err == nil:
+			defer f.Close()
+			if err := json.NewDecoder(f).Decode(cfg); err != nil {
+				return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+			}
+		case !os.IsNotExist(err) || explicit:
+			return nil, fmt.Errorf("unable to read config file: %v", err)
+		}
+	}
+
+	if u := getenv("OMNISCIENT_URL"); u != "" {
+		cfg.URL = u
+	}
+	if t := getenv("OMNISCIENT_TOKEN"); t != "" {
+		cfg.Token = t
+	}
+	if t := getenv("OMNISCIENT_TENANT"); t != "" {
+		cfg.Tenant = t
+	}
+
+	return cfg, nil
+}
+
+func defaultConfigPath(getenv func(string) string) string {
+	if dir := getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "omniscient", "cli.json")
+	}
+
+	if home := getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", "omniscient", "cli.json")
+	}
+
+	return ""
+}
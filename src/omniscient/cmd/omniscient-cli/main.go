@@ -0,0 +1,153 @@
+// Command omniscient-cli manages notes on an omniscient server.
+//
+// The server URL and credentials are read from the -url and -token flags,
+// the OMNISCIENT_URL and OMNISCIENT_TOKEN environment variables, or a JSON
+// config file, in that order. The tenant to work in, if any, is read the
+// same way from -tenant, OMNISCIENT_TENANT or the config file. The config file is
+// $XDG_CONFIG_HOME/omniscient/cli.json (~/.config/omniscient/cli.json by
+// default) unless OMNISCIENT_CONFIG names another:
+//
+//	{"url": "https://notes.example.com", "token": "secret", "tenant": "acme"}
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"omniscient/client"
+
+	"golang.org/x/net/context"
+)
+
+const usage = `usage: omniscient-cli [-url url] [-token token] [-tenant id] <command> [args]
+
+commands:
+  create [-slug slug] [-ttl duration]  create a note from stdin or $EDITOR
+  list [-o table|json] [-q query]      list notes
+  search [-o table|json] <query>       list notes containing query
+  get [-o text|json] <id>              print a note
+  edit <id>                            edit a note in $EDITOR
+  delete <id>...                       delete notes
+  share <id> [principal=role]...       share a note as reader or editor
+  links create [-ttl duration] [-max-views n] <id>
+                                       create a public link to a note
+  links list [-o table|json] <id>      list the public links to a note
+  links revoke <id> [link]...          revoke some or all public links to a note
+  export                               write every note to stdout as NDJSON
+  keys create [-scopes scopes] [-tenant id] <name>
+                                       create an API key and print it
+  keys list [-o table|json]            list API keys
+  keys revoke <id>...                  revoke API keys
+  tenants create [-name name] [-max-notes n] [-max-bytes n] <id>
+                                       create a tenant
+  tenants list [-o table|json]         list tenants
+  tenants get [-o table|json] <id>     print a tenant and its usage
+  tenants delete <id>...               delete tenants and all their notes
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line args, and returns the exit status.
+func run(args []string, getenv func(string) string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("omniscient-cli", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+
+	var (
+		url    = fs.String("url", "", "server url")
+		token  = fs.String("token", "", "credentials for the server")
+		tenant = fs.String("tenant", "", "tenant to work in")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		fmt.Fprintf(stderr, "omniscient-cli: %v\n", err)
+		return 1
+	}
+
+	if *url != "" {
+		cfg.URL = *url
+	}
+	if *token != "" {
+		cfg.Token = *token
+	}
+	if *tenant != "" {
+		cfg.Tenant = *tenant
+	}
+
+	if cfg.URL == "" {
+		fmt.Fprintln(stderr, "omniscient-cli: no server url; set -url, OMNISCIENT_URL or the config file")
+		return 1
+	}
+
+	var opts []client.Option
+	if cfg.Token != "" {
+		opts = append(opts, client.Token(cfg.Token))
+	}
+	if cfg.Tenant != "" {
+		opts = append(opts, client.InTenant(cfg.Tenant))
+	}
+
+	c, err := client.New(cfg.URL, opts...)
+	if err != nil {
+		fmt.Fprintf(stderr, "omniscient-cli: %v\n", err)
+		return 1
+	}
+
+	cmd := &command{
+		ctx:    context.Background(),
+		client: c,
+		editor: editor(getenv),
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	name, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	fn, ok := cmd.commands()[name]
+	if !ok {
+		fmt.Fprintf(stderr, "omniscient-cli: unknown command %q\n", name)
+		fs.Usage()
+		return 2
+	}
+
+	if err := fn(cmdArgs); err != nil {
+		if err == flag.ErrHelp {
+			return 2
+		}
+
+		fmt.Fprintf(stderr, "omniscient-cli: %s: %v\n", name, err)
+		if e, ok := err.(*client.Error); ok {
+			for _, fe := range e.Fields {
+				fmt.Fprintf(stderr, "  %s: %s\n", fe.Field, fe.Message)
+			}
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// editor is the command used to edit notes.
+func editor(getenv func(string) string) string {
+	for _, name := range []string{"VISUAL", "EDITOR"} {
+		if e := strings.TrimSpace(getenv(name)); e != "" {
+			return e
+		}
+	}
+
+	return "vi"
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"omniscient"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// withServer serves an App backed by a mock note repository, and passes a
+// function which runs the cli against it with env as the environment.
+func withServer(t *testing.T, fn func(cli func(env map[string]string, stdin string, args ...string) (int, string, string), mnr *omniscient.MockNoteRepository)) {
+	health, err := omniscient.NewHealth()
+	assert.NoError(t, err)
+
+	mnr := &omniscient.MockNoteRepository{}
+	app, err := omniscient.NewApp(
+		omniscient.AppNoteRepository(mnr),
+		omniscient.AppHealth(health),
+		omniscient.AppRedisClient(nil))
+	assert.NoError(t, err)
+
+	ts := httptest.NewServer(app.Mux)
+	defer ts.Close()
+
+	cli := func(env map[string]string, stdin string, args ...string) (int, string, string) {
+		getenv := func(k string) string {
+			if k == "OMNISCIENT_URL" {
+				return ts.URL
+			}
+			return env[k]
+		}
+
+		var stdout, stderr bytes.Buffer
+		code := run(args, getenv, strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	fn(cli, mnr)
+
+	assert.NoError(t, health.Stop())
+}
+
+func TestCLICreateFromStdin(t *testing.T) {
+	withServer(t, func(cli func(map[string]string, string, ...string) (int, string, string), mnr *omniscient.MockNoteRepository) {
+		mnr.On("Create", "from stdin\n", mock.AnythingOfType("[]omniscient.NoteOption")).
+			Return(&omniscient.Note{ID: "1", Content: "from stdin\n"}, nil)
+
+		code, stdout, stderr := cli(nil, "from stdin\n", "create")
+		assert.Equal(t, 0, code, stderr)
+		assert.Equal(t, "1\n", stdout)
+		mnr.AssertExpectations(t)
+	})
+}
+
+func TestCLIList(t *testing.T) {
+	updated := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	notes := []omniscient.Note{
+		{ID: "1", Content: "buy milk\nand eggs", UpdatedAt: updated},
+		{ID: "2", Content: "call bob", Slug: "bob", UpdatedAt: updated},
+	}
+
+	withServer(t, func(cli func(map[string]string, string, ...string) (int, string, string), mnr *omniscient.MockNoteRepository) {
+		mnr.On("ListPage", int64(0), int64(100)).Return(notes, false, nil)
+
+		code, stdout, stderr := cli(nil, "", "list")
+		assert.Equal(t, 0, code, stderr)
+		assert.Equal(t, ""+
+			"ID  SLUG  UPDATED               CONTENT\n"+
+			"1         2016-07-01T12:00:00Z  buy milk …\n"+
+			"2   bob   2016-07-01T12:00:00Z  call bob\n", stdout)
+
+		code, stdout, stderr = cli(nil, "", "search", "-o", "json", "BOB")
+		assert.Equal(t, 0, code, stderr)
+		assert.Contains(t, stdout, `"id": "2"`)
+		assert.NotContains(t, stdout, `"id": "1"`)
+	})
+}
+
+func TestCLIEdit(t *testing.T) {
+	updated := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		version int64
+		code    int
+	}{
+		{name: "saved", version: 3, code: 0},
+		// the note is changed between being fetched and saved, within the
+		// second it was fetched in.
+		{name: "changed by someone else", version: 4, code: 1},
+	}
+
+	for _, tc := range cases {
+		withServer(t, func(cli func(map[string]string, string, ...string) (int, string, string), mnr *omniscient.MockNoteRepository) {
+			mnr.On("Retrieve", "1").
+				Return(&omniscient.Note{ID: "1", Content: "old", UpdatedAt: updated, Version: 3}, nil)
+
+			var saved string
+			mnr.On("Patch", "1", mock.AnythingOfType("func(*omniscient.Note) error")).
+				Return(nil, func(id string, fn func(*omniscient.Note) error) error {
+					n := &omniscient.Note{ID: id, Content: "old", UpdatedAt: updated, Version: tc.version}
+					if err := fn(n); err != nil {
+						return err
+					}
+					saved = n.Content
+					return nil
+				})
+
+			env := map[string]string{"EDITOR": "sed -i s/old/new/"}
+			code, _, stderr := cli(env, "", "edit", "1")
+			assert.Equal(t, tc.code, code, "%s: %s", tc.name, stderr)
+
+			if tc.code == 0 {
+				assert.Equal(t, "new", saved, tc.name)
+			} else {
+				assert.Contains(t, stderr, "note was changed since it was opened", tc.name)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "omniscient-cli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "omniscient", "cli.json")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.NoError(t, ioutil.WriteFile(path,
+		[]byte(`{"url": "http://file", "token": "file-token"}`), 0600))
+
+	env := map[string]string{
+		"XDG_CONFIG_HOME": dir,
+		"OMNISCIENT_URL":  "http://env",
+	}
+
+	cfg, err := loadConfig(func(k string) string { return env[k] })
+	assert.NoError(t, err)
+	assert.Equal(t, &config{URL: "http://env", Token: "file-token"}, cfg)
+
+	env["OMNISCIENT_CONFIG"] = filepath.Join(dir, "missing.json")
+	_, err = loadConfig(func(k string) string { return env[k] })
+	assert.Error(t, err)
+}
@@ -2,20 +2,75 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"omniscient"
+	"omniscient/events"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/getsentry/raven-go"
 	"github.com/kouhin/envflag"
+	"golang.org/x/net/context"
+	"gopkg.in/redis.v3"
 )
 
+// webhookConsumerGroup is the consumer group of the event stream webhook
+// deliveries are queued by.
+const webhookConsumerGroup = "webhooks"
+
 func main() {
 	var (
-		redisAddr = flag.String("omniscient-redis-addr", "localhost:6379", "redis address")
-		httpAddr  = flag.String("omniscient-http-addr", ":8080", "http server address")
-		sentryURL = flag.String("omniscient-sentry-url", "", "sentry url")
+		redisAddr  = flag.String("omniscient-redis-addr", "localhost:6379", "redis address")
+		httpAddr   = flag.String("omniscient-http-addr", ":8080", "http server address")
+		sentryURL  = flag.String("omniscient-sentry-url", "", "sentry url")
+		idStrategy = flag.String("omniscient-id-strategy", "uuid", "note id strategy: uuid, ulid or base62")
+
+		maxBatchSize      = flag.Int("omniscient-max-batch-size", 100, "maximum number of operations in a batch")
+		sweepInterval     = flag.Duration("omniscient-sweep-interval", 30*time.Second, "interval for sweeping expired notes")
+		idempotencyWindow = flag.Duration("omniscient-idempotency-window", 24*time.Hour, "how long idempotency keys are kept")
+		maxBodyBytes      = flag.Int64("omniscient-max-body-bytes", 1<<20, "maximum size of a request body in bytes")
+		maxContentLength  = flag.Int("omniscient-max-content-length", 64*1024, "maximum number of characters in a note")
+		legacySunset      = flag.String("omniscient-legacy-sunset", "", "RFC 3339 time the unversioned routes will be removed")
+		contentTypes      = flag.String("omniscient-content-types", "application/json", "comma separated content types accepted for notes")
+
+		graphQLMaxDepth      = flag.Int("omniscient-graphql-max-depth", 10, "maximum depth of a graphql query")
+		graphQLMaxComplexity = flag.Int("omniscient-graphql-max-complexity", 20000, "maximum complexity of a graphql query")
+
+		feedRetention = flag.Int64("omniscient-feed-retention", 10000, "number of recent note events kept for watchers to resume from")
+
+		eventStream       = flag.String("omniscient-event-stream", "", "redis stream domain events are appended to, if set")
+		eventStreamMaxLen = flag.Int64("omniscient-event-stream-max-len", 100000, "approximate number of entries kept in the event stream")
+
+		requireAPIKeys = flag.Bool("omniscient-require-api-keys", false, "require an api key for the notes api; create the first one with the create-api-key command")
+
+		jwtIssuer     = flag.String("omniscient-jwt-issuer", "", "issuer bearer tokens must have, if set")
+		jwtAudience   = flag.String("omniscient-jwt-audience", "", "audience bearer tokens must be issued for, if set")
+		jwtClockSkew  = flag.Duration("omniscient-jwt-clock-skew", time.Minute, "clock skew allowed when checking bearer token times")
+		jwtHMACSecret = flag.String("omniscient-jwt-hmac-secret", "", "secret for verifying HS256, HS384 and HS512 bearer tokens")
+		jwtPublicKey  = flag.String("omniscient-jwt-public-key", "", "PEM file with an RSA or ECDSA public key for verifying bearer tokens")
+		jwksFile      = flag.String("omniscient-jwt-jwks-file", "", "JWKS file with keys for verifying bearer tokens, reloaded when it changes")
+
+		shareLinkSecret = flag.String("omniscient-share-link-secret", "", "secret of at least 32 bytes for signing public share links; they are disabled without one")
+
+		rateLimit        = flag.String("omniscient-rate-limit", "", "requests each client can make to each route, e.g. 100/1m; requests aren't limited if empty")
+		rateLimitRoutes  = flag.String("omniscient-rate-limit-routes", "", "comma separated limits of routes, e.g. POST /notes=10/1m")
+		rateLimitClients = flag.String("omniscient-rate-limit-clients", "", "comma separated limits of principal ids or ip addresses, e.g. 10.0.0.1=1000/1m")
+		rateLimitProxies = flag.Int("omniscient-rate-limit-trusted-proxies", 0, "number of proxies in front of the server which add to the X-Forwarded-For header, for identifying clients limited by their address")
+
+		enableTenants = flag.Bool("omniscient-tenants", false, "let requests be made in tenants, chosen by their principal or the X-Tenant header")
+
+		noteKeysFile           = flag.String("omniscient-note-keys-file", "", "JSON file with the master keys note content is encrypted with, reloaded when it changes; content is stored in plaintext without one")
+		noteKeysReloadInterval = flag.Duration("omniscient-note-keys-reload-interval", time.Minute, "interval for checking the note keys file for changes")
+		keyRotationInterval    = flag.Duration("omniscient-key-rotation-interval", 10*time.Second, "interval for checking for a note key rotation requested with the rotate-keys command")
+
+		tombstoneTTL = flag.Duration("omniscient-tombstone-ttl", 30*24*time.Hour, "how long deleted notes are remembered for syncing clients")
+
+		webhookPollInterval = flag.Duration("omniscient-webhook-poll-interval", time.Second, "interval for sending due webhook deliveries")
 	)
 	envflag.Parse()
 
@@ -29,6 +84,30 @@ func main() {
 		log.Fatalf("unable to create redis client: %v", err)
 	}
 
+	apiKeys, err := omniscient.NewAPIKeys(rc)
+	if err != nil {
+		log.Fatalf("unable to create api keys: %v", err)
+	}
+
+	if flag.Arg(0) == "create-api-key" {
+		createAPIKey(apiKeys, flag.Args()[1:])
+		return
+	}
+
+	// the notes are re-encrypted by the servers, in the background.
+	if flag.Arg(0) == "rotate-keys" {
+		if *noteKeysFile == "" {
+			log.Fatal("rotate-keys needs a note keys file")
+		}
+
+		if err := omniscient.RequestKeyRotation(rc); err != nil {
+			log.Fatalf("unable to request note key rotation: %v", err)
+		}
+
+		log.Info("requested note key rotation; the servers log its progress")
+		return
+	}
+
 	redisPingCheck := func() bool {
 		_, err := rc.Ping()
 		if err != nil {
@@ -37,17 +116,171 @@ func main() {
 		return true
 	}
 
-	nr, err := omniscient.NewRedisNoteRepository(omniscient.RedisClientOption(rc))
+	feed, err := omniscient.NewNoteFeed(rc,
+		omniscient.NoteFeedRetention(*feedRetention))
+	if err != nil {
+		log.Fatalf("unable to create note feed: %v", err)
+	}
+
+	webhooks, err := omniscient.NewWebhooks(rc,
+		omniscient.WebhooksPollInterval(*webhookPollInterval))
+	if err != nil {
+		log.Fatalf("unable to create webhooks: %v", err)
+	}
+
+	if err := webhooks.Start(); err != nil {
+		log.Fatalf("unable to start webhook worker: %v", err)
+	}
+
+	nrOpts := []omniscient.RedisNoteRepositoryOption{
+		omniscient.RedisClientOption(rc),
+		omniscient.NoteIDStrategy(*idStrategy),
+		omniscient.NoteEventPublisher(feed),
+		omniscient.NoteTombstoneTTL(*tombstoneTTL),
+	}
+
+	if *eventStream != "" {
+		nrOpts = append(nrOpts, omniscient.NoteEventStream(*eventStream, *eventStreamMaxLen))
+
+		// events are appended to the stream with the change, so webhooks fed
+		// from it don't lose deliveries if the process stops after a change.
+		consumeWebhookEvents(*redisAddr, *eventStream, webhooks)
+	} else {
+		log.Warning("no event stream is set, so webhook deliveries are lost if the server stops right after a change")
+		nrOpts = append(nrOpts, omniscient.NoteEventPublisher(webhooks))
+	}
+
+	if *noteKeysFile != "" {
+		noteKeys, err := omniscient.NewNoteKeys(*noteKeysFile, *noteKeysReloadInterval)
+		if err != nil {
+			log.Fatalf("unable to load note keys: %v", err)
+		}
+
+		nrOpts = append(nrOpts, omniscient.NoteEncryption(noteKeys))
+	}
+
+	nr, err := omniscient.NewRedisNoteRepository(nrOpts...)
 	if err != nil {
 		log.Fatalf("unable to create note repository: %v", err)
 	}
 
+	var tenants *omniscient.Tenants
+	var noteSweeper omniscient.NoteSweeper = nr
+	if *enableTenants {
+		if tenants, err = omniscient.NewTenants(rc); err != nil {
+			log.Fatalf("unable to create tenants: %v", err)
+		}
+
+		noteSweeper = omniscient.NewTenantSweeper(nr, tenants)
+	}
+
+	if *noteKeysFile != "" {
+		keyRotation, err := omniscient.NewKeyRotation(rc, nr,
+			omniscient.KeyRotationTenants(tenants),
+			omniscient.KeyRotationInterval(*keyRotationInterval))
+		if err != nil {
+			log.Fatalf("unable to create key rotation: %v", err)
+		}
+
+		if err := keyRotation.Start(); err != nil {
+			log.Fatalf("unable to start key rotation: %v", err)
+		}
+	}
+
+	sweeper, err := omniscient.NewExpirySweeper(noteSweeper,
+		omniscient.SweepIntervalOption(*sweepInterval))
+	if err != nil {
+		log.Fatalf("unable to create expiry sweeper: %v", err)
+	}
+
+	if err := sweeper.Start(); err != nil {
+		log.Fatalf("unable to start expiry sweeper: %v", err)
+	}
+
+	var sunset time.Time
+	if *legacySunset != "" {
+		if sunset, err = time.Parse(time.RFC3339, *legacySunset); err != nil {
+			log.Fatalf("invalid legacy sunset: %v", err)
+		}
+	}
+
 	health, err := omniscient.NewHealth(
 		omniscient.HealthCheckOption(redisPingCheck))
 
-	app, err := omniscient.NewApp(
+	appOpts := []omniscient.AppOption{
 		omniscient.AppNoteRepository(nr),
-		omniscient.AppHealth(health))
+		omniscient.AppHealth(health),
+		omniscient.AppRedisClient(rc),
+		omniscient.AppMaxBatchSize(*maxBatchSize),
+		omniscient.AppIdempotencyWindow(*idempotencyWindow),
+		omniscient.AppMaxBodyBytes(*maxBodyBytes),
+		omniscient.AppMaxContentLength(*maxContentLength),
+		omniscient.AppContentTypes(strings.Split(*contentTypes, ",")...),
+		omniscient.AppLegacySunset(sunset),
+		omniscient.AppNoteFeed(feed),
+		omniscient.AppWebhooks(webhooks),
+		omniscient.AppGraphQLMaxDepth(*graphQLMaxDepth),
+		omniscient.AppGraphQLMaxComplexity(*graphQLMaxComplexity),
+	}
+
+	if *requireAPIKeys {
+		appOpts = append(appOpts, omniscient.AppAPIKeys(apiKeys))
+	}
+
+	if tenants != nil {
+		appOpts = append(appOpts, omniscient.AppTenants(tenants))
+	}
+
+	if *shareLinkSecret != "" {
+		shareLinks, err := omniscient.NewShareLinks(rc, []byte(*shareLinkSecret))
+		if err != nil {
+			log.Fatalf("unable to create share links: %v", err)
+		}
+
+		appOpts = append(appOpts, omniscient.AppShareLinks(shareLinks))
+	}
+
+	if *rateLimit != "" {
+		limiter, err := newRateLimiter(rc, *rateLimit, *rateLimitRoutes, *rateLimitClients, *rateLimitProxies)
+		if err != nil {
+			log.Fatalf("unable to create rate limiter: %v", err)
+		}
+
+		appOpts = append(appOpts, omniscient.AppRateLimiter(limiter))
+	}
+
+	if *jwtHMACSecret != "" || *jwtPublicKey != "" || *jwksFile != "" {
+		jwtOpts := []omniscient.JWTOption{
+			omniscient.JWTIssuer(*jwtIssuer),
+			omniscient.JWTAudience(*jwtAudience),
+			omniscient.JWTClockSkew(*jwtClockSkew),
+		}
+
+		if *jwtHMACSecret != "" {
+			jwtOpts = append(jwtOpts, omniscient.JWTHMACKey("", []byte(*jwtHMACSecret)))
+		}
+
+		if *jwtPublicKey != "" {
+			pem, err := ioutil.ReadFile(*jwtPublicKey)
+			if err != nil {
+				log.Fatalf("unable to read jwt public key: %v", err)
+			}
+			jwtOpts = append(jwtOpts, omniscient.JWTPublicKey("", pem))
+		}
+
+		if *jwksFile != "" {
+			jwtOpts = append(jwtOpts, omniscient.JWTKeySetFile(*jwksFile, 0))
+		}
+
+		verifier, err := omniscient.NewJWTVerifier(jwtOpts...)
+		if err != nil {
+			log.Fatalf("unable to create jwt verifier: %v", err)
+		}
+
+		appOpts = append(appOpts, omniscient.AppJWTVerifier(verifier))
+	}
+
+	app, err := omniscient.NewApp(appOpts...)
 	if err != nil {
 		log.Fatalf("unable to create app: %v", err)
 	}
@@ -55,3 +288,117 @@ func main() {
 	http.Handle("/", app.Mux)
 	log.Fatal(http.ListenAndServe(*httpAddr, nil))
 }
+
+// consumeWebhookEvents queues webhook deliveries for the events in stream,
+// as a member of the webhooks consumer group, until the process exits.
+func consumeWebhookEvents(redisAddr, stream string, webhooks *omniscient.Webhooks) {
+	name, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("unable to name webhook event consumer: %v", err)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: redisAddr, ReadTimeout: time.Minute})
+	consumer, err := events.NewConsumer(client, stream, webhookConsumerGroup, name)
+	if err != nil {
+		log.Fatalf("unable to create webhook event consumer: %v", err)
+	}
+
+	// earlier events were already published to the webhooks.
+	if err := consumer.CreateGroup("$"); err != nil {
+		log.Fatalf("unable to create webhook consumer group: %v", err)
+	}
+
+	go func() {
+		for {
+			err := consumer.Run(context.Background(), webhooks.HandleEvent)
+			log.WithError(err).Warning("webhook event consumer stopped, restarting")
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// newRateLimiter creates a rate limiter with the default limit in limit,
+// and the comma separated name=limit pairs in routes and clients.
+func newRateLimiter(rc omniscient.RedisClient, limit, routes, clients string, trustedProxies int) (*omniscient.RateLimiter, error) {
+	defaultLimit, err := omniscient.ParseRateLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []omniscient.RateLimiterOption{omniscient.RateLimitTrustedProxies(trustedProxies)}
+
+	err = eachRateLimit(routes, func(route string, rl omniscient.RateLimit) error {
+		parts := strings.Fields(route)
+		if len(parts) != 2 {
+			return fmt.Errorf("route %q is not a method and path", route)
+		}
+
+		opts = append(opts, omniscient.RateLimitRoute(strings.ToUpper(parts[0]), parts[1], rl))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRateLimit(clients, func(client string, rl omniscient.RateLimit) error {
+		opts = append(opts, omniscient.RateLimitClient(client, rl))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return omniscient.NewRateLimiter(rc, defaultLimit, opts...)
+}
+
+// eachRateLimit calls fn with each name=limit pair in the comma separated s.
+func eachRateLimit(s string, fn func(string, omniscient.RateLimit) error) error {
+	if s == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("%q is not name=limit", pair)
+		}
+
+		rl, err := omniscient.ParseRateLimit(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return err
+		}
+
+		if err := fn(strings.TrimSpace(pair[:i]), rl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createAPIKey creates an API key named args[0] with the comma separated
+// scopes in args[1], admin by default, and prints it. It is how the first
+// key is created, before there is a key to use the api with.
+func createAPIKey(apiKeys *omniscient.APIKeys, args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		log.Fatal("usage: omniscient create-api-key <name> [scopes]")
+	}
+
+	scopes := []string{omniscient.ScopeAdmin}
+	if len(args) == 2 {
+		scopes = strings.Split(args[1], ",")
+	}
+
+	for _, s := range scopes {
+		if !omniscient.ValidScope(s) {
+			log.Fatalf("unknown scope %q", s)
+		}
+	}
+
+	key, err := apiKeys.Create(args[0], scopes)
+	if err != nil {
+		log.Fatalf("unable to create api key: %v", err)
+	}
+
+	fmt.Println(key.Key)
+}
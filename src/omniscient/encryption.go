@@ -0,0 +1,416 @@
+package omniscient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	fieldNoteKeyID   = "key_id"
+	fieldNoteDataKey = "data_key"
+
+	// noteKeySize is the size of master and data keys, for AES-256.
+	noteKeySize = 32
+
+	defaultNoteKeysReloadInterval = time.Minute
+)
+
+// ErrNoteKeysNotConfigured is returned when loading an encrypted note
+// without any note keys.
+var ErrNoteKeysNotConfigured = errors.New("note is encrypted, but note encryption is not configured")
+
+// noteKeysDoc is the file master keys are loaded from. Keys are base64
+// encoded, and new data keys are wrapped with the active one.
+//
+//	{"active": "2", "keys": {"1": "...", "2": "..."}}
+type noteKeysDoc struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// NoteKeys are the master keys the content of notes is encrypted with.
+// Each note's content is encrypted with AES-GCM using a data key of its own,
+// which is stored with the note, wrapped by the active master key. Keeping
+// old master keys in the file lets notes wrapped by them be read until their
+// keys are rotated.
+//
+// The file is checked for changes at most once every interval, and reloaded
+// when it has changed, so a new active key can be rolled out before the
+// notes are rotated to it.
+type NoteKeys struct {
+	path     string
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	active  string
+	keys    map[string]cipher.AEAD
+	modTime time.Time
+	checked time.Time
+}
+
+// NewNoteKeys loads the master keys in the file at path. The file is
+// checked for changes at most once every interval.
+func NewNoteKeys(path string, interval time.Duration) (*NoteKeys, error) {
+	if interval <= 0 {
+		interval = defaultNoteKeysReloadInterval
+	}
+
+	nk := &NoteKeys{path: path, interval: interval, now: time.Now}
+
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+
+	if err := nk.reload(nk.now()); err != nil {
+		return nil, err
+	}
+
+	return nk, nil
+}
+
+// ActiveKeyID returns the id of the key new data keys are wrapped with.
+func (nk *NoteKeys) ActiveKeyID() string {
+	active, _ := nk.current()
+	return active
+}
+
+// sealedContent is note content encrypted with a data key, and the data key
+// wrapped by the master key with KeyID. Both are base64 encoded, with the
+// nonce they were sealed with in front.
+type sealedContent struct {
+	KeyID   string
+	DataKey string
+	Content string
+}
+
+// seal encrypts the content of the note with id with a new data key. The
+// content can only be opened as the content of the same note.
+func (nk *NoteKeys) seal(id, content string) (*sealedContent, error) {
+	active, keys := nk.current()
+
+	dataKey := make([]byte, noteKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &sealedContent{KeyID: active}
+	if sc.DataKey, err = sealBase64(keys[active], dataKey, []byte(active)); err != nil {
+		return nil, err
+	}
+
+	if sc.Content, err = sealBase64(aead, []byte(content), []byte(id)); err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// open decrypts the content of the note with id.
+func (nk *NoteKeys) open(id string, sc *sealedContent) (string, error) {
+	_, keys := nk.current()
+
+	master, ok := keys[sc.KeyID]
+	if !ok {
+		return "", fmt.Errorf("note %s is encrypted with unknown key %q", id, sc.KeyID)
+	}
+
+	dataKey, err := openBase64(master, sc.DataKey, []byte(sc.KeyID))
+	if err != nil {
+		return "", fmt.Errorf("unable to unwrap data key of note %s: %v", id, err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := openBase64(aead, sc.Content, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt note %s: %v", id, err)
+	}
+
+	return string(content), nil
+}
+
+// current returns the keys, reloading them first if the file has changed.
+// If the file can't be reloaded, the keys it had are kept.
+func (nk *NoteKeys) current() (string, map[string]cipher.AEAD) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+
+	if now := nk.now(); now.Sub(nk.checked) >= nk.interval {
+		if err := nk.reload(now); err != nil {
+			log.WithError(err).WithField("path", nk.path).Warning("unable to reload note keys")
+		}
+	}
+
+	return nk.active, nk.keys
+}
+
+// reload reloads the keys if the file changed since they were loaded. nk.mu
+// must be held.
+func (nk *NoteKeys) reload(now time.Time) error {
+	nk.checked = now
+
+	fi, err := os.Stat(nk.path)
+	if err != nil {
+		return err
+	}
+
+	if nk.keys != nil && fi.ModTime().Equal(nk.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(nk.path)
+	if err != nil {
+		return err
+	}
+
+	active, keys, err := parseNoteKeys(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", nk.path, err)
+	}
+
+	nk.active, nk.keys = active, keys
+	nk.modTime = fi.ModTime()
+	return nil
+}
+
+func parseNoteKeys(b []byte) (string, map[string]cipher.AEAD, error) {
+	var doc noteKeysDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return "", nil, err
+	}
+
+	if _, ok := doc.Keys[doc.Active]; !ok {
+		return "", nil, fmt.Errorf("active note key %q is not one of the keys", doc.Active)
+	}
+
+	keys := map[string]cipher.AEAD{}
+	for id, s := range doc.Keys {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", nil, fmt.Errorf("note key %q is not base64: %v", id, err)
+		}
+
+		if len(key) != noteKeySize {
+			return "", nil, fmt.Errorf("note key %q must be %d bytes", id, noteKeySize)
+		}
+
+		if keys[id], err = newGCM(key); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return doc.Active, keys, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealBase64(aead cipher.AEAD, plaintext, data []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, data)), nil
+}
+
+func openBase64(aead cipher.AEAD, s string, data []byte) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], data)
+}
+
+// NoteEncryption encrypts the content of notes with keys. Notes stored
+// before it was enabled are read as they are, until they are next saved or
+// their keys are rotated.
+//
+// While it is enabled, the copies of notes made for every change, in the
+// event stream and for publishers such as the feed and webhooks, leave the
+// content out, so consumers have to retrieve it. The only plaintext copies
+// left are the responses the Idempotency middleware keeps for replaying,
+// which expire with its window.
+func NoteEncryption(keys *NoteKeys) RedisNoteRepositoryOption {
+	return func(rnr *RedisNoteRepository) error {
+		rnr.keys = keys
+		return nil
+	}
+}
+
+// sealContent returns the hash fields the content of note is stored in.
+func (nr *RedisNoteRepository) sealContent(note *Note) ([]string, error) {
+	if nr.keys == nil {
+		return []string{fieldNoteContent, note.Content}, nil
+	}
+
+	sc, err := nr.keys.seal(note.ID, note.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		fieldNoteContent, sc.Content,
+		fieldNoteKeyID, sc.KeyID,
+		fieldNoteDataKey, sc.DataKey,
+	}, nil
+}
+
+// withoutContent returns the copy of note to hand out with an event, which
+// leaves the content out if it is encrypted.
+func (nr *RedisNoteRepository) withoutContent(note *Note) *Note {
+	if nr.keys == nil || note == nil {
+		return note
+	}
+
+	n := *note
+	n.Content = ""
+	return &n
+}
+
+// openContent returns the content of the note with id stored in the hash m,
+// decrypting it if it was encrypted.
+func (nr *RedisNoteRepository) openContent(id string, m map[string]string) (string, error) {
+	if m[fieldNoteKeyID] == "" {
+		return m[fieldNoteContent], nil
+	}
+
+	if nr.keys == nil {
+		return "", ErrNoteKeysNotConfigured
+	}
+
+	return nr.keys.open(id, &sealedContent{
+		KeyID:   m[fieldNoteKeyID],
+		DataKey: m[fieldNoteDataKey],
+		Content: m[fieldNoteContent],
+	})
+}
+
+// RotateKeys re-encrypts the content of every note which isn't encrypted
+// with the active key, including notes stored before encryption was
+// enabled, so the keys they were encrypted with can be retired. Notes can be
+// used while their keys are rotated. Notes created or deleted during a
+// rotation can make it miss others, so rotate until no note is re-encrypted.
+// It returns how many notes were re-encrypted.
+func (nr *RedisNoteRepository) RotateKeys() (int, error) {
+	if nr.keys == nil {
+		return 0, errors.New("note encryption is not enabled")
+	}
+
+	rotated := 0
+	for start := int64(0); start >= 0; {
+		n, next, err := nr.rotateKeysPage(start)
+		rotated += n
+		if err != nil {
+			return rotated, err
+		}
+
+		start = next
+	}
+
+	return rotated, nil
+}
+
+// rotateKeysPage re-encrypts the notes in the page of the catalog which
+// starts at start. It returns how many notes were re-encrypted, and where
+// the next page starts, or -1 if it was the last page.
+func (nr *RedisNoteRepository) rotateKeysPage(start int64) (int, int64, error) {
+	ids, err := nr.redisClient.LRange(nr.keyForID(catalogKey),
+		start, start+walkPageSize-1)
+	if err != nil {
+		return 0, start, err
+	}
+
+	rotated := 0
+	for _, id := range ids {
+		ok, err := nr.rotateKey(id)
+		if err != nil {
+			return rotated, start, err
+		}
+
+		if ok {
+			rotated++
+		}
+	}
+
+	if len(ids) < walkPageSize {
+		return rotated, -1, nil
+	}
+
+	return rotated, start + walkPageSize, nil
+}
+
+// rotateKey re-encrypts the content of the note with id with the active
+// key, unless it already is. Nothing else about the note changes. It
+// returns true if the note was re-encrypted.
+func (nr *RedisNoteRepository) rotateKey(id string) (bool, error) {
+	key := nr.keyForID(id)
+
+	var rotated bool
+	var err error
+	for attempt := 0; attempt < maxPatchAttempts; attempt++ {
+		rotated = false
+		err = nr.redisClient.Watch(func(tx RedisTx) error {
+			m, err := tx.HGetAllMap(key)
+			if err != nil {
+				return err
+			}
+
+			if len(m) == 0 || m[fieldNoteKeyID] == nr.keys.ActiveKeyID() {
+				return nil
+			}
+
+			content, err := nr.openContent(id, m)
+			if err != nil {
+				return err
+			}
+
+			fields, err := nr.sealContent(&Note{ID: id, Content: content})
+			if err != nil {
+				return err
+			}
+
+			rotated = true
+			return tx.Exec(func() error {
+				_, err := tx.HMSet(key, fields[0], fields[1], fields[2:]...)
+				return err
+			})
+		}, key)
+
+		if err != ErrTxConflict {
+			break
+		}
+	}
+
+	return rotated && err == nil, err
+}
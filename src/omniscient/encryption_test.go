@@ -0,0 +1,250 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"omniscient/events"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// writeNoteKeys writes a note keys file with a key for each id, made of the
+// id's first byte, and sets when it was modified.
+func writeNoteKeys(t *testing.T, path, active string, modTime time.Time, ids ...string) {
+	doc := noteKeysDoc{Active: active, Keys: map[string]string{}}
+	for _, id := range ids {
+		doc.Keys[id] = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), noteKeySize))
+	}
+
+	b, err := json.Marshal(&doc)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, b, 0600))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+// withNoteKeys loads note keys from a file written by writeNoteKeys.
+func withNoteKeys(t *testing.T, active string, ids []string, fn func(nk *NoteKeys, path string)) {
+	dir, err := ioutil.TempDir("", "notekeys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	writeNoteKeys(t, path, active, time.Now().Add(-time.Hour), ids...)
+
+	nk, err := NewNoteKeys(path, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fn(nk, path)
+}
+
+func TestParseNoteKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, noteKeySize))
+
+	active, keys, err := parseNoteKeys([]byte(`{"active": "1", "keys": {"1": "` + key + `"}}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1", active)
+		assert.Len(t, keys, 1)
+	}
+
+	for _, doc := range []string{
+		`{`,
+		`{"active": "2", "keys": {"1": "` + key + `"}}`,
+		`{"active": "1", "keys": {"1": "not base64"}}`,
+		`{"active": "1", "keys": {"1": "c2hvcnQ="}}`,
+	} {
+		_, _, err := parseNoteKeys([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func TestNoteKeysSeal(t *testing.T) {
+	withNoteKeys(t, "a", []string{"a"}, func(nk *NoteKeys, path string) {
+		sc, err := nk.seal("1", "secret")
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "a", sc.KeyID)
+		assert.NotContains(t, sc.Content, "secret")
+
+		content, err := nk.open("1", sc)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "secret", content)
+		}
+
+		// content can't be moved to another note.
+		_, err = nk.open("2", sc)
+		assert.Error(t, err)
+
+		_, err = nk.open("1", &sealedContent{KeyID: "b", DataKey: sc.DataKey, Content: sc.Content})
+		assert.Error(t, err)
+	})
+}
+
+func TestNoteKeysReload(t *testing.T) {
+	withNoteKeys(t, "a", []string{"a"}, func(nk *NoteKeys, path string) {
+		sealed, err := nk.seal("1", "secret")
+		assert.NoError(t, err)
+
+		writeNoteKeys(t, path, "b", time.Now(), "a", "b")
+
+		// the file isn't checked again until the interval has passed.
+		assert.Equal(t, "a", nk.ActiveKeyID())
+
+		nk.now = func() time.Time { return time.Now().Add(time.Minute) }
+		assert.Equal(t, "b", nk.ActiveKeyID())
+
+		content, err := nk.open("1", sealed)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "secret", content)
+		}
+
+		// broken files are ignored.
+		assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+		nk.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		assert.Equal(t, "b", nk.ActiveKeyID())
+	})
+}
+
+func TestRedisNoteRepoEncryption(t *testing.T) {
+	withNoteKeys(t, "a", []string{"a"}, func(nk *NoteKeys, path string) {
+		stored := map[string]string{}
+
+		mrc := &MockRedisClient{}
+		mrc.On("HMSet", "notes:1", "id", "1", mock.AnythingOfType("[]string")).
+			Run(func(args mock.Arguments) {
+				stored[fieldNoteID] = "1"
+				pairs := args.Get(3).([]string)
+				for i := 0; i+1 < len(pairs); i += 2 {
+					stored[pairs[i]] = pairs[i+1]
+				}
+			}).Return("", nil)
+		mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
+		mrc.On("HGetAllMap", "notes:1").Return(stored, nil)
+		mrc.On("HGetAllMap", "notes:2").Return(map[string]string{"id": "2", "content": "plain"}, nil)
+
+		rnr, err := NewRedisNoteRepository(RedisClientOption(mrc), NoteEncryption(nk))
+		assert.NoError(t, err)
+
+		assert.NoError(t, rnr.save(&Note{ID: "1", Content: "secret"}))
+		assert.Equal(t, "a", stored[fieldNoteKeyID])
+		assert.NotEmpty(t, stored[fieldNoteDataKey])
+		assert.NotContains(t, stored[fieldNoteContent], "secret")
+
+		n, err := rnr.load("1")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "secret", n.Content)
+		}
+
+		// notes stored before encryption was enabled are read as they are.
+		n, err = rnr.load("2")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "plain", n.Content)
+		}
+
+		plain, err := NewRedisNoteRepository(RedisClientOption(mrc))
+		assert.NoError(t, err)
+
+		_, err = plain.load("1")
+		assert.Equal(t, ErrNoteKeysNotConfigured, err)
+	})
+}
+
+func TestRedisNoteRepoRotateKeys(t *testing.T) {
+	withNoteKeys(t, "a", []string{"a"}, func(nk *NoteKeys, path string) {
+		old, err := nk.seal("1", "secret")
+		assert.NoError(t, err)
+
+		writeNoteKeys(t, path, "b", time.Now(), "a", "b")
+		nk.now = func() time.Time { return time.Now().Add(time.Minute) }
+
+		current, err := nk.seal("2", "current")
+		assert.NoError(t, err)
+
+		var rotated []string
+		mrc := &MockRedisClient{}
+		mtx := &MockRedisTx{}
+		mrc.On("LRange", "notes:catalog", int64(0), int64(walkPageSize-1)).Return([]string{"1", "2", "3", "gone"}, nil)
+		mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), mock.AnythingOfType("[]string")).
+			Return(func(fn func(RedisTx) error, keys ...string) error {
+				return fn(mtx)
+			})
+		mtx.On("Exec", mock.AnythingOfType("func() error")).
+			Return(func(fn func() error) error {
+				return fn()
+			})
+		mtx.On("HGetAllMap", "notes:1").Return(map[string]string{
+			fieldNoteID: "1", fieldNoteContent: old.Content, fieldNoteKeyID: old.KeyID, fieldNoteDataKey: old.DataKey,
+		}, nil)
+		mtx.On("HGetAllMap", "notes:2").Return(map[string]string{
+			fieldNoteID: "2", fieldNoteContent: current.Content, fieldNoteKeyID: current.KeyID, fieldNoteDataKey: current.DataKey,
+		}, nil)
+		mtx.On("HGetAllMap", "notes:3").Return(map[string]string{fieldNoteID: "3", fieldNoteContent: "plain"}, nil)
+		mtx.On("HGetAllMap", "notes:gone").Return(map[string]string{}, nil)
+		mtx.On("HMSet", mock.AnythingOfType("string"), fieldNoteContent, mock.AnythingOfType("string"), mock.AnythingOfType("[]string")).
+			Run(func(args mock.Arguments) {
+				rotated = append(rotated, args.String(0))
+				sc := &sealedContent{Content: args.String(2)}
+				pairs := args.Get(3).([]string)
+				assert.Equal(t, []string{fieldNoteKeyID, "b", fieldNoteDataKey}, pairs[:3])
+				sc.KeyID, sc.DataKey = pairs[1], pairs[3]
+
+				content, err := nk.open(args.String(0)[len("notes:"):], sc)
+				assert.NoError(t, err)
+				assert.Contains(t, []string{"secret", "plain"}, content)
+			}).Return("", nil)
+
+		rnr, err := NewRedisNoteRepository(RedisClientOption(mrc), NoteEncryption(nk))
+		assert.NoError(t, err)
+
+		n, err := rnr.RotateKeys()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, []string{"notes:1", "notes:3"}, rotated)
+	})
+}
+
+func TestRedisNoteRepoEncryptionEvents(t *testing.T) {
+	withNoteKeys(t, "a", []string{"a"}, func(nk *NoteKeys, path string) {
+		mrc := &MockRedisClient{}
+		mrc.On("Do", xaddArgs(events.NoteUpdated, func(fields map[string]string) {
+			assert.NotContains(t, fields[events.FieldBefore], "old secret")
+			assert.NotContains(t, fields[events.FieldAfter], "new secret")
+			assert.Contains(t, fields[events.FieldAfter], `"version":2`)
+		})).Return("1-0", nil)
+
+		mp := &MockNotePublisher{}
+		mp.On("Publish", NoteUpdated, "1", mock.AnythingOfType("*omniscient.Note")).
+			Run(func(args mock.Arguments) {
+				n := args.Get(2).(*Note)
+				assert.Empty(t, n.Content)
+				assert.Equal(t, int64(2), n.Version)
+			}).Return(nil)
+
+		rnr, err := NewRedisNoteRepository(RedisClientOption(mrc), NoteEncryption(nk),
+			NoteEventStream("events", 0), NoteEventPublisher(mp))
+		assert.NoError(t, err)
+
+		before := &Note{ID: "1", Content: "old secret", Version: 1}
+		after := &Note{ID: "1", Content: "new secret", Version: 2}
+		assert.NoError(t, rnr.appendEvent(events.NoteUpdated, "1", before, after))
+		rnr.publish(NoteUpdated, "1", after)
+
+		// the notes handed out are copies, so the caller's keep their content.
+		assert.Equal(t, "new secret", after.Content)
+
+		mrc.AssertExpectations(t)
+		mp.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,245 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/redis.v3"
+)
+
+const (
+	defaultBatchSize    = 100
+	defaultBlockTimeout = 5 * time.Second
+	defaultClaimIdle    = time.Minute
+)
+
+// Handler handles an event. If it returns an error, the event is left
+// pending and handled again once it has been idle for the claim time.
+type Handler func(ctx context.Context, e *Event) error
+
+// Consumer reads events from a stream as a member of a consumer group, so
+// each event is handled by one consumer of the group. Events are
+// acknowledged once they have been handled. Events left pending by failed
+// handlers or consumers which went away are claimed and handled again, so
+// handlers should be idempotent.
+type Consumer struct {
+	client    *redis.Client
+	stream    string
+	group     string
+	name      string
+	batchSize int64
+	block     time.Duration
+	claimIdle time.Duration
+}
+
+// ConsumerOption is an option for configuring Consumer.
+type ConsumerOption func(*Consumer) error
+
+// NewConsumer creates an instance of Consumer. The client's read timeout,
+// if it has one, must be longer than the block timeout.
+func NewConsumer(client *redis.Client, stream, group, name string, opts ...ConsumerOption) (*Consumer, error) {
+	if stream == "" || group == "" || name == "" {
+		return nil, errors.New("stream, group and consumer name are required")
+	}
+
+	c := &Consumer{
+		client:    client,
+		stream:    stream,
+		group:     group,
+		name:      name,
+		batchSize: defaultBatchSize,
+		block:     defaultBlockTimeout,
+		claimIdle: defaultClaimIdle,
+	}
+
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// BatchSize sets how many events are read at once.
+func BatchSize(n int64) ConsumerOption {
+	return func(c *Consumer) error {
+		if n < 1 {
+			return errors.New("batch size must be at least 1")
+		}
+
+		c.batchSize = n
+		return nil
+	}
+}
+
+// BlockTimeout sets how long a read waits for new events.
+func BlockTimeout(d time.Duration) ConsumerOption {
+	return func(c *Consumer) error {
+		if d < time.Millisecond {
+			return errors.New("block timeout must be at least a millisecond")
+		}
+
+		c.block = d
+		return nil
+	}
+}
+
+// ClaimIdle sets how long an event is left pending before another consumer
+// claims it.
+func ClaimIdle(d time.Duration) ConsumerOption {
+	return func(c *Consumer) error {
+		if d < time.Millisecond {
+			return errors.New("claim idle time must be at least a millisecond")
+		}
+
+		c.claimIdle = d
+		return nil
+	}
+}
+
+// CreateGroup creates the consumer group, and the stream if it doesn't
+// exist. The group starts reading after the entry with id start, which is
+// "$" for new events only or "0" for every event in the stream. It is not
+// an error if the group already exists.
+func (c *Consumer) CreateGroup(start string) error {
+	cmd := redis.NewCmd("XGROUP", "CREATE", c.stream, c.group, start, "MKSTREAM")
+	c.client.Process(cmd)
+
+	err := cmd.Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+
+	return err
+}
+
+// Run handles events until ctx is done or Redis fails.
+func (c *Consumer) Run(ctx context.Context, h Handler) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		entries, err := c.claim()
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			if entries, err = c.read(); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range entries {
+			if err := c.handle(ctx, h, e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Consumer) handle(ctx context.Context, h Handler, en entry) error {
+	// deleted or malformed entries can never be handled, so they are
+	// acknowledged and skipped.
+	if en.fields != nil {
+		if e, err := decodeEvent(en.id, en.fields); err == nil {
+			if err := h(ctx, e); err != nil {
+				// left pending, to be claimed again.
+				return nil
+			}
+		}
+	}
+
+	cmd := redis.NewCmd("XACK", c.stream, c.group, en.id)
+	c.client.Process(cmd)
+	return cmd.Err()
+}
+
+// claim takes over events which have been pending for the claim idle time.
+func (c *Consumer) claim() ([]entry, error) {
+	cmd := redis.NewCmd("XAUTOCLAIM", c.stream, c.group, c.name,
+		strconv.FormatInt(int64(c.claimIdle/time.Millisecond), 10), "0-0",
+		"COUNT", c.batchSize)
+	c.client.Process(cmd)
+
+	v, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, ok := v.([]interface{})
+	if !ok || len(reply) < 2 {
+		return nil, fmt.Errorf("unexpected XAUTOCLAIM reply %v", v)
+	}
+
+	return parseEntries(reply[1])
+}
+
+// read waits for new events.
+func (c *Consumer) read() ([]entry, error) {
+	cmd := redis.NewCmd("XREADGROUP", "GROUP", c.group, c.name,
+		"COUNT", c.batchSize,
+		"BLOCK", int64(c.block/time.Millisecond),
+		"STREAMS", c.stream, ">")
+	c.client.Process(cmd)
+
+	v, err := cmd.Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	streams, ok := v.([]interface{})
+	if !ok || len(streams) == 0 {
+		return nil, nil
+	}
+
+	stream, ok := streams[0].([]interface{})
+	if !ok || len(stream) < 2 {
+		return nil, fmt.Errorf("unexpected XREADGROUP reply %v", v)
+	}
+
+	return parseEntries(stream[1])
+}
+
+// entry is a stream entry. fields is nil for entries which were deleted
+// while they were pending.
+type entry struct {
+	id     string
+	fields []interface{}
+}
+
+func parseEntries(v interface{}) ([]entry, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected entries %v", v)
+	}
+
+	entries := make([]entry, 0, len(list))
+	for _, item := range list {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected entry %v", item)
+		}
+
+		id, ok := pair[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected entry id %v", pair[0])
+		}
+
+		fields, _ := pair[1].([]interface{})
+		entries = append(entries, entry{id: id, fields: fields})
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,115 @@
+// Package events reads the domain events omniscient appends to a Redis
+// Stream for every change to a note.
+//
+// Each stream entry has these fields:
+//
+//	type     NoteCreated, NoteUpdated or NoteDeleted
+//	note_id  the id of the note
+//	tenant   the tenant the note belongs to, unless it has none
+//	before   the note as JSON before the change, unless it was created
+//	after    the note as JSON after the change, unless it was deleted
+//	time     when the change was made, in RFC 3339 format
+//
+// Entries are written in the same transaction as the change, so a change is
+// never missed or reported without having been made. When note encryption is
+// enabled, the notes in before and after have no content.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Type is the type of a domain event.
+type Type string
+
+const (
+	// NoteCreated is appended when a note is created.
+	NoteCreated Type = "NoteCreated"
+	// NoteUpdated is appended when a note is changed.
+	NoteUpdated Type = "NoteUpdated"
+	// NoteDeleted is appended when a note is deleted or has expired. Before
+	// is not set for expired notes.
+	NoteDeleted Type = "NoteDeleted"
+)
+
+// Fields of a stream entry.
+const (
+	FieldType   = "type"
+	FieldNoteID = "note_id"
+	FieldTenant = "tenant"
+	FieldBefore = "before"
+	FieldAfter  = "after"
+	FieldTime   = "time"
+)
+
+// Note is a note as it was before or after a change.
+type Note struct {
+	ID        string     `json:"id"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Slug      string     `json:"slug,omitempty"`
+	Version   int64      `json:"version,omitempty"`
+}
+
+// Event is a domain event read from the stream.
+type Event struct {
+	// ID is the id of the stream entry.
+	ID     string
+	Type   Type
+	NoteID string
+	// Tenant is the tenant the note belongs to, if any.
+	Tenant string
+	Before *Note
+	After  *Note
+	Time   time.Time
+}
+
+// decodeEvent decodes the stream entry with id and fields, which alternate
+// between names and values.
+func decodeEvent(id string, fields []interface{}) (*Event, error) {
+	e := &Event{ID: id}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+
+		var err error
+		switch name {
+		case FieldType:
+			e.Type = Type(value)
+		case FieldNoteID:
+			e.NoteID = value
+		case FieldTenant:
+			e.Tenant = value
+		case FieldBefore:
+			e.Before, err = decodeNote(value)
+		case FieldAfter:
+			e.After, err = decodeNote(value)
+		case FieldTime:
+			e.Time, err = time.Parse(time.RFC3339Nano, value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("entry %s: invalid %s: %v", id, name, err)
+		}
+	}
+
+	if e.Type == "" || e.NoteID == "" {
+		return nil, fmt.Errorf("entry %s: not a note event", id)
+	}
+
+	return e, nil
+}
+
+func decodeNote(s string) (*Note, error) {
+	var n Note
+	if err := json.Unmarshal([]byte(s), &n); err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
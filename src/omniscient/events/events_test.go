@@ -0,0 +1,60 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEntries(t *testing.T) {
+	entries, err := parseEntries([]interface{}{
+		[]interface{}{"1-0", []interface{}{
+			FieldType, "NoteUpdated",
+			FieldNoteID, "1",
+			FieldTime, "2016-07-01T12:00:00.5Z",
+			FieldBefore, `{"id":"1","content":"old"}`,
+			FieldAfter, `{"id":"1","content":"new"}`,
+		}},
+		// deleted while it was pending.
+		[]interface{}{"2-0", nil},
+	})
+	assert.NoError(t, err)
+
+	if assert.Len(t, entries, 2) {
+		assert.Nil(t, entries[1].fields)
+
+		e, err := decodeEvent(entries[0].id, entries[0].fields)
+		assert.NoError(t, err)
+		assert.Equal(t, "1-0", e.ID)
+		assert.Equal(t, NoteUpdated, e.Type)
+		assert.Equal(t, "1", e.NoteID)
+		assert.Equal(t, "old", e.Before.Content)
+		assert.Equal(t, "new", e.After.Content)
+		assert.Equal(t, time.Date(2016, 7, 1, 12, 0, 0, 5e8, time.UTC), e.Time)
+	}
+
+	_, err = parseEntries([]interface{}{"1-0"})
+	assert.Error(t, err)
+}
+
+func TestDecodeEventInvalid(t *testing.T) {
+	_, err := decodeEvent("1-0", []interface{}{FieldType, "NoteCreated"})
+	assert.EqualError(t, err, "entry 1-0: not a note event")
+
+	_, err = decodeEvent("1-0", []interface{}{FieldType, "NoteCreated", FieldNoteID, "1", FieldAfter, "{"})
+	assert.EqualError(t, err, "entry 1-0: invalid after: unexpected end of JSON input")
+}
+
+func TestNewConsumer(t *testing.T) {
+	_, err := NewConsumer(nil, "events", "", "worker-1")
+	assert.Error(t, err)
+
+	c, err := NewConsumer(nil, "events", "indexer", "worker-1", BatchSize(10), ClaimIdle(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), c.batchSize)
+	assert.Equal(t, time.Second, c.claimIdle)
+
+	_, err = NewConsumer(nil, "events", "indexer", "worker-1", BlockTimeout(0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,113 @@
+package omniscient
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultSweepInterval = 30 * time.Second
+)
+
+// NoteSweeper removes expired notes.
+type NoteSweeper interface {
+	SweepExpired(t time.Time) (int, error)
+}
+
+// ExpirySweeper periodically removes expired notes from a note repository.
+type ExpirySweeper struct {
+	sweeper       NoteSweeper
+	sweepInterval time.Duration
+
+	mu        sync.Mutex
+	sweepQuit chan struct{}
+}
+
+// ExpirySweeperOption is an ExpirySweeper configuration option.
+type ExpirySweeperOption func(*ExpirySweeper) error
+
+// NewExpirySweeper builds an instance of ExpirySweeper.
+func NewExpirySweeper(ns NoteSweeper, opts ...ExpirySweeperOption) (*ExpirySweeper, error) {
+	es := &ExpirySweeper{
+		sweeper:       ns,
+		sweepInterval: defaultSweepInterval,
+	}
+
+	for _, opt := range opts {
+		err := opt(es)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return es, nil
+}
+
+// SweepIntervalOption sets how often expired notes are swept.
+func SweepIntervalOption(d time.Duration) ExpirySweeperOption {
+	return func(es *ExpirySweeper) error {
+		if d <= 0 {
+			return errors.New("sweep interval must be positive")
+		}
+
+		es.sweepInterval = d
+		return nil
+	}
+}
+
+// Start starts the sweep loop.
+func (es *ExpirySweeper) Start() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.sweepQuit != nil {
+		return errors.New("expiry sweeper has already been started")
+	}
+
+	quit := make(chan struct{})
+	es.sweepQuit = quit
+
+	go func() {
+		ticker := time.NewTicker(es.sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case t := <-ticker.C:
+				es.sweep(t)
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the sweep loop.
+func (es *ExpirySweeper) Stop() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.sweepQuit == nil {
+		return errors.New("expiry sweeper has not previously been started")
+	}
+
+	close(es.sweepQuit)
+	es.sweepQuit = nil
+	return nil
+}
+
+func (es *ExpirySweeper) sweep(t time.Time) int {
+	n, err := es.sweeper.SweepExpired(t)
+	if err != nil {
+		log.WithError(err).Warning("unable to sweep expired notes")
+	}
+
+	notesExpiredCounter.Add(float64(n))
+
+	return n
+}
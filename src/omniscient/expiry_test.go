@@ -0,0 +1,39 @@
+package omniscient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNoteSweeper chan time.Time
+
+func (ns fakeNoteSweeper) SweepExpired(t time.Time) (int, error) {
+	ns <- t
+	return 1, nil
+}
+
+func TestExpirySweeper(t *testing.T) {
+	ns := make(fakeNoteSweeper, 1)
+
+	es, err := NewExpirySweeper(ns, SweepIntervalOption(time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.NoError(t, es.Start())
+	assert.Error(t, es.Start())
+
+	select {
+	case <-ns:
+	case <-time.After(time.Second):
+		t.Fatal("expired notes were not swept")
+	}
+
+	assert.NoError(t, es.Stop())
+	assert.Error(t, es.Stop())
+}
+
+func TestExpirySweeperInvalidInterval(t *testing.T) {
+	_, err := NewExpirySweeper(make(fakeNoteSweeper), SweepIntervalOption(0))
+	assert.Error(t, err)
+}
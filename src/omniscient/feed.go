@@ -0,0 +1,414 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// NoteEventType is the kind of change a NoteEvent describes.
+type NoteEventType string
+
+const (
+	// NoteCreated is published when a note is created.
+	NoteCreated NoteEventType = "created"
+	// NoteUpdated is published when a note is changed.
+	NoteUpdated NoteEventType = "updated"
+	// NoteDeleted is published when a note is deleted or has expired.
+	NoteDeleted NoteEventType = "deleted"
+
+	defaultFeedRetention = 10000
+
+	// watchBufferSize is how many events are buffered for a slow watcher
+	// before they are dropped and read back from the event log instead.
+	watchBufferSize = 64
+
+	feedSeqKey     = "seq"
+	feedLogKey     = "log"
+	feedChannelKey = "events"
+)
+
+// ErrWatchCursorExpired is returned when watching from an event which is no
+// longer kept in the event log.
+var ErrWatchCursorExpired = &NoteError{Code: CodeWatchCursorExpired, Message: "events after last_event_id are no longer kept; resync and watch from now"}
+
+// publishScript numbers an event, appends it to the event log and publishes
+// it, all atomically so the log and the live feed agree on the order.
+// ARGV[1] is the event as a JSON object without an id.
+const publishScript = `
+local id = redis.call('INCR', KEYS[1])
+local event = '{"id":' .. id .. ',' .. string.sub(ARGV[1], 2)
+redis.call('ZADD', KEYS[2], id, event)
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -(tonumber(ARGV[2]) + 1))
+redis.call('PUBLISH', ARGV[3], event)
+return id
+`
+
+// NoteEvent is a change to a note.
+type NoteEvent struct {
+	ID     int64         `json:"id,omitempty"`
+	Type   NoteEventType `json:"type"`
+	NoteID string        `json:"note_id"`
+	// Tenant is the tenant the note belongs to, if any.
+	Tenant string `json:"tenant,omitempty"`
+	// Note is the note after the change. It is not set for deletes, and has
+	// no content when note encryption is enabled.
+	Note *Note     `json:"note,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// NotePublisher publishes changes to notes.
+type NotePublisher interface {
+	Publish(typ NoteEventType, id string, n *Note) error
+}
+
+// TenantNotePublisher is a NotePublisher which can publish changes to the
+// notes of a tenant.
+type TenantNotePublisher interface {
+	NotePublisher
+	PublishTenant(tenant string, typ NoteEventType, id string, n *Note) error
+}
+
+// NoteFeed is a feed of changes to notes shared by every replica through
+// Redis. Events are numbered in order, and the most recent ones are kept so
+// watchers can resume from the last event they saw.
+type NoteFeed struct {
+	redisClient RedisClient
+	base        string
+	retention   int64
+
+	mu       sync.Mutex
+	sub      RedisSubscription
+	watchers map[*NoteWatch]struct{}
+}
+
+var _ TenantNotePublisher = (*NoteFeed)(nil)
+
+// NoteFeedOption is an option for configuring NoteFeed.
+type NoteFeedOption func(*NoteFeed) error
+
+// NewNoteFeed creates an instance of NoteFeed.
+func NewNoteFeed(rc RedisClient, opts ...NoteFeedOption) (*NoteFeed, error) {
+	f := &NoteFeed{
+		redisClient: rc,
+		base:        "feed",
+		retention:   defaultFeedRetention,
+		watchers:    map[*NoteWatch]struct{}{},
+	}
+
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// NoteFeedBase sets the base string for the feed's keys and channel.
+func NoteFeedBase(base string) NoteFeedOption {
+	return func(f *NoteFeed) error {
+		f.base = base
+		return nil
+	}
+}
+
+// NoteFeedRetention sets how many of the most recent events are kept for
+// watchers to resume from.
+func NoteFeedRetention(n int64) NoteFeedOption {
+	return func(f *NoteFeed) error {
+		if n < 1 {
+			return errors.New("feed retention must be at least 1")
+		}
+
+		f.retention = n
+		return nil
+	}
+}
+
+// Publish adds an event for a change to the note with id to the feed.
+func (f *NoteFeed) Publish(typ NoteEventType, id string, n *Note) error {
+	return f.PublishTenant("", typ, id, n)
+}
+
+// PublishTenant adds an event for a change to the note with id of tenant to
+// the feed.
+func (f *NoteFeed) PublishTenant(tenant string, typ NoteEventType, id string, n *Note) error {
+	b, err := json.Marshal(&NoteEvent{
+		Type:   typ,
+		NoteID: id,
+		Tenant: tenant,
+		Note:   n,
+		Time:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = f.redisClient.Eval(publishScript,
+		[]string{f.key(feedSeqKey), f.key(feedLogKey)},
+		[]string{string(b), strconv.FormatInt(f.retention, 10), f.key(feedChannelKey)})
+
+	return err
+}
+
+// LastID returns the id of the most recent event, or 0 if there are none.
+func (f *NoteFeed) LastID() (int64, error) {
+	s, err := f.redisClient.Get(f.key(feedSeqKey))
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Since returns the events after the event with id, oldest first. If some
+// of them are no longer kept, ErrWatchCursorExpired is returned.
+func (f *NoteFeed) Since(id int64) ([]*NoteEvent, error) {
+	members, err := f.redisClient.ZRangeByScore(f.key(feedLogKey),
+		"("+strconv.FormatInt(id, 10), "+inf")
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*NoteEvent, 0, len(members))
+	for _, m := range members {
+		var e NoteEvent
+		if err := json.Unmarshal([]byte(m), &e); err != nil {
+			return nil, err
+		}
+
+		events = append(events, &e)
+	}
+
+	if len(events) > 0 && events[0].ID != id+1 {
+		return nil, ErrWatchCursorExpired
+	}
+
+	return events, nil
+}
+
+// Watch starts watching for events after the event with lastID. If lastID
+// is negative, only events published from now on are watched. The watch
+// must be stopped when it is no longer needed.
+func (f *NoteFeed) Watch(lastID int64) (*NoteWatch, error) {
+	w := &NoteWatch{
+		feed:   f,
+		live:   make(chan *NoteEvent, watchBufferSize),
+		events: make(chan *NoteEvent),
+		quit:   make(chan struct{}),
+	}
+
+	// subscribe before reading the log, so no event is missed in between.
+	if err := f.add(w); err != nil {
+		return nil, err
+	}
+
+	var backlog []*NoteEvent
+	var err error
+	if lastID < 0 {
+		lastID, err = f.LastID()
+	} else {
+		backlog, err = f.Since(lastID)
+	}
+	if err != nil {
+		f.remove(w)
+		return nil, err
+	}
+
+	go w.run(lastID, backlog)
+
+	return w, nil
+}
+
+// add registers w to receive live events, subscribing to the feed's channel
+// if w is the first watcher.
+func (f *NoteFeed) add(w *NoteWatch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.sub == nil {
+		sub, err := f.redisClient.Subscribe(f.key(feedChannelKey))
+		if err != nil {
+			return err
+		}
+
+		f.sub = sub
+		go f.receive(sub)
+	}
+
+	f.watchers[w] = struct{}{}
+	return nil
+}
+
+// remove unregisters w, and closes the subscription once no one is watching.
+func (f *NoteFeed) remove(w *NoteWatch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.watchers[w]; !ok {
+		return
+	}
+
+	delete(f.watchers, w)
+
+	if len(f.watchers) == 0 && f.sub != nil {
+		if err := f.sub.Close(); err != nil {
+			log.WithError(err).Warning("unable to close feed subscription")
+		}
+		f.sub = nil
+	}
+}
+
+// receive fans out the events received by sub to the watchers, until sub is
+// closed or fails.
+func (f *NoteFeed) receive(sub RedisSubscription) {
+	for {
+		payload, err := sub.ReceiveMessage()
+
+		f.mu.Lock()
+		if f.sub != sub {
+			// closed by remove.
+			f.mu.Unlock()
+			return
+		}
+
+		if err != nil {
+			log.WithError(err).Warning("feed subscription failed")
+			for w := range f.watchers {
+				w.fail(err)
+			}
+			f.watchers = map[*NoteWatch]struct{}{}
+			f.sub = nil
+			f.mu.Unlock()
+
+			sub.Close()
+			return
+		}
+
+		var e NoteEvent
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			log.WithError(err).Warning("unable to decode feed event")
+			f.mu.Unlock()
+			continue
+		}
+
+		for w := range f.watchers {
+			select {
+			case w.live <- &e:
+			default:
+				// the watcher is behind. it reads the dropped events back
+				// from the log when it sees the next one.
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *NoteFeed) key(name string) string {
+	return strings.Join([]string{f.base, name}, ":")
+}
+
+// NoteWatch is a watch on a NoteFeed started by NoteFeed.Watch.
+type NoteWatch struct {
+	feed   *NoteFeed
+	live   chan *NoteEvent
+	events chan *NoteEvent
+	quit   chan struct{}
+	stop   sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// Events returns the events, in order and without gaps. It is closed when
+// the watch is stopped or fails.
+func (w *NoteWatch) Events() <-chan *NoteEvent {
+	return w.events
+}
+
+// Err returns why the watch failed, once Events is closed.
+func (w *NoteWatch) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Stop stops the watch.
+func (w *NoteWatch) Stop() {
+	w.stop.Do(func() {
+		close(w.quit)
+		w.feed.remove(w)
+	})
+}
+
+// fail ends the watch with err. It is called by the feed, which then no
+// longer sends it events.
+func (w *NoteWatch) fail(err error) {
+	w.setErr(err)
+	close(w.live)
+}
+
+func (w *NoteWatch) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+}
+
+func (w *NoteWatch) run(last int64, backlog []*NoteEvent) {
+	defer close(w.events)
+
+	send := func(events []*NoteEvent) bool {
+		for _, e := range events {
+			if e.ID <= last {
+				continue
+			}
+
+			select {
+			case w.events <- e:
+				last = e.ID
+			case <-w.quit:
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if !send(backlog) {
+		return
+	}
+
+	for {
+		select {
+		case e, ok := <-w.live:
+			if !ok {
+				return
+			}
+
+			events := []*NoteEvent{e}
+			if e.ID > last+1 {
+				// events were dropped. the log has them, and e as well.
+				var err error
+				if events, err = w.feed.Since(last); err != nil {
+					w.setErr(err)
+					return
+				}
+			}
+
+			if !send(events) {
+				return
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeSubscription is a RedisSubscription which receives the messages sent
+// to it.
+type fakeSubscription struct {
+	msgs   chan string
+	errs   chan error
+	closed chan struct{}
+}
+
+func newFakeSubscription() *fakeSubscription {
+	return &fakeSubscription{
+		msgs:   make(chan string),
+		errs:   make(chan error),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *fakeSubscription) ReceiveMessage() (string, error) {
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case err := <-s.errs:
+		return "", err
+	case <-s.closed:
+		return "", errors.New("closed")
+	}
+}
+
+func (s *fakeSubscription) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func eventJSON(id int64, typ NoteEventType, noteID string) string {
+	return fmt.Sprintf(`{"id":%d,"type":%q,"note_id":%q,"time":"2016-07-01T12:00:00Z"}`, id, typ, noteID)
+}
+
+// nextEvent returns the id of the next event, or -1 if the events are
+// closed.
+func nextEvent(t *testing.T, w *NoteWatch) int64 {
+	select {
+	case e, ok := <-w.Events():
+		if !ok {
+			return -1
+		}
+		return e.ID
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+		return 0
+	}
+}
+
+func TestNoteFeedPublish(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("Eval", publishScript, []string{"feed:seq", "feed:log"}, mock.MatchedBy(func(args []string) bool {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(args[0]), &e); err != nil {
+			return false
+		}
+
+		// the script adds the id.
+		_, hasID := e["id"]
+		return !hasID && e["type"] == "created" && e["note_id"] == "1" &&
+			args[1] == "10" && args[2] == "feed:events"
+	})).Return(int64(1), nil)
+
+	f, err := NewNoteFeed(mrc, NoteFeedRetention(10))
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.Publish(NoteCreated, "1", &Note{ID: "1", Content: "new"}))
+	mrc.AssertExpectations(t)
+}
+
+func TestNoteFeedSince(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("ZRangeByScore", "feed:log", "(1", "+inf").
+		Return([]string{eventJSON(2, NoteCreated, "1"), eventJSON(3, NoteDeleted, "1")}, nil)
+	mrc.On("ZRangeByScore", "feed:log", "(0", "+inf").
+		Return([]string{eventJSON(2, NoteCreated, "1")}, nil)
+
+	f, err := NewNoteFeed(mrc)
+	assert.NoError(t, err)
+
+	events, err := f.Since(1)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, NoteCreated, events[0].Type)
+		assert.Equal(t, int64(3), events[1].ID)
+	}
+
+	// event 1 has been trimmed from the log.
+	_, err = f.Since(0)
+	assert.Equal(t, ErrWatchCursorExpired, err)
+}
+
+func TestNoteFeedWatch(t *testing.T) {
+	sub := newFakeSubscription()
+
+	mrc := &MockRedisClient{}
+	mrc.On("Subscribe", []string{"feed:events"}).Return(sub, nil).Once()
+	mrc.On("ZRangeByScore", "feed:log", "(1", "+inf").
+		Return([]string{eventJSON(2, NoteCreated, "1")}, nil)
+	mrc.On("ZRangeByScore", "feed:log", "(3", "+inf").
+		Return([]string{eventJSON(4, NoteUpdated, "1"), eventJSON(5, NoteDeleted, "1")}, nil)
+
+	f, err := NewNoteFeed(mrc)
+	assert.NoError(t, err)
+
+	w, err := f.Watch(1)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(2), nextEvent(t, w))
+
+	sub.msgs <- eventJSON(2, NoteCreated, "1")
+	sub.msgs <- eventJSON(3, NoteUpdated, "1")
+	assert.Equal(t, int64(3), nextEvent(t, w))
+
+	// event 4 was missed, so it is read from the log.
+	sub.msgs <- eventJSON(5, NoteDeleted, "1")
+	assert.Equal(t, int64(4), nextEvent(t, w))
+	assert.Equal(t, int64(5), nextEvent(t, w))
+
+	w.Stop()
+	assert.Equal(t, int64(-1), nextEvent(t, w))
+	assert.NoError(t, w.Err())
+
+	select {
+	case <-sub.closed:
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not closed")
+	}
+
+	mrc.AssertExpectations(t)
+}
+
+func TestNoteFeedWatchFromNow(t *testing.T) {
+	sub := newFakeSubscription()
+
+	mrc := &MockRedisClient{}
+	mrc.On("Subscribe", []string{"feed:events"}).Return(sub, nil)
+	mrc.On("Get", "feed:seq").Return("7", nil)
+
+	f, err := NewNoteFeed(mrc)
+	assert.NoError(t, err)
+
+	w, err := f.Watch(-1)
+	assert.NoError(t, err)
+	defer w.Stop()
+
+	sub.msgs <- eventJSON(8, NoteCreated, "1")
+	assert.Equal(t, int64(8), nextEvent(t, w))
+
+	sub.errs <- errors.New("connection lost")
+	assert.Equal(t, int64(-1), nextEvent(t, w))
+	assert.EqualError(t, w.Err(), "connection lost")
+}
@@ -0,0 +1,897 @@
+package omniscient
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file parses GraphQL documents. It covers the executable parts of the
+// language: operations, variables, fields, arguments, aliases, fragments and
+// directives. Type system definitions are not parsed.
+
+// gqlLocation is a position in a GraphQL document.
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlSyntaxError is an error parsing a GraphQL document.
+type gqlSyntaxError struct {
+	loc gqlLocation
+	msg string
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.loc.Line, e.loc.Column, e.msg)
+}
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	loc   gqlLocation
+}
+
+func (t gqlToken) String() string {
+	switch t.kind {
+	case gqlEOF:
+		return "end of document"
+	case gqlString:
+		return strconv.Quote(t.value)
+	}
+
+	return fmt.Sprintf("%q", t.value)
+}
+
+// gqlLexer splits a document into tokens.
+type gqlLexer struct {
+	src       string
+	pos       int
+	line      int
+	lineStart int
+}
+
+func (l *gqlLexer) loc() gqlLocation {
+	return gqlLocation{Line: l.line, Column: utf8.RuneCountInString(l.src[l.lineStart:l.pos]) + 1}
+}
+
+func (l *gqlLexer) errorf(format string, args ...interface{}) error {
+	return &gqlSyntaxError{loc: l.loc(), msg: fmt.Sprintf(format, args...)}
+}
+
+func (l *gqlLexer) newline() {
+	l.line++
+	l.lineStart = l.pos
+}
+
+// skip skips white space, commas and comments.
+func (l *gqlLexer) skip() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == ',':
+			l.pos++
+		case c == '\n':
+			l.pos++
+			l.newline()
+		case c == '\r':
+			l.pos++
+			if l.pos < len(l.src) && l.src[l.pos] == '\n' {
+				l.pos++
+			}
+			l.newline()
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\uFEFF"):
+			l.pos += len("\uFEFF")
+		default:
+			return
+		}
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	l.skip()
+
+	loc := l.loc()
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlEOF, loc: loc}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$()=:@[]{}|&", c) >= 0:
+		l.pos++
+		return gqlToken{kind: gqlPunct, value: string(c), loc: loc}, nil
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{kind: gqlPunct, value: "...", loc: loc}, nil
+	case isNameStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return gqlToken{kind: gqlName, value: l.src[start:l.pos], loc: loc}, nil
+	case c == '-' || isDigit(c):
+		return l.number(loc)
+	case strings.HasPrefix(l.src[l.pos:], `"""`):
+		return l.blockString(loc)
+	case c == '"':
+		return l.string(loc)
+	}
+
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return gqlToken{}, l.errorf("unexpected character %q", r)
+}
+
+func (l *gqlLexer) number(loc gqlLocation) (gqlToken, error) {
+	start := l.pos
+	kind := gqlInt
+
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+
+	// errors are reported at the start of the number.
+	fail := func(format string, args ...interface{}) error {
+		return &gqlSyntaxError{loc: loc, msg: fmt.Sprintf(format, args...)}
+	}
+
+	digits := func() int {
+		n := 0
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+			n++
+		}
+		return n
+	}
+
+	intStart := l.pos
+	if digits() == 0 {
+		return gqlToken{}, fail("invalid number")
+	}
+	if l.src[intStart] == '0' && l.pos-intStart > 1 {
+		return gqlToken{}, fail("invalid number, unexpected digit after 0")
+	}
+
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = gqlFloat
+		l.pos++
+		if digits() == 0 {
+			return gqlToken{}, fail("invalid number, expected digit after .")
+		}
+	}
+
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = gqlFloat
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if digits() == 0 {
+			return gqlToken{}, fail("invalid number, expected digit in exponent")
+		}
+	}
+
+	if l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || l.src[l.pos] == '.') {
+		return gqlToken{}, fail("invalid number, unexpected %q", l.src[l.pos])
+	}
+
+	return gqlToken{kind: kind, value: l.src[start:l.pos], loc: loc}, nil
+}
+
+func (l *gqlLexer) string(loc gqlLocation) (gqlToken, error) {
+	l.pos++
+
+	var b bytes.Buffer
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' || l.src[l.pos] == '\r' {
+			return gqlToken{}, l.errorf("unterminated string")
+		}
+
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return gqlToken{kind: gqlString, value: b.String(), loc: loc}, nil
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.src) {
+				return gqlToken{}, l.errorf("unterminated string")
+			}
+
+			esc := l.src[l.pos]
+			l.pos++
+			switch esc {
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if l.pos+4 > len(l.src) {
+					return gqlToken{}, l.errorf("invalid unicode escape")
+				}
+				n, err := strconv.ParseUint(l.src[l.pos:l.pos+4], 16, 32)
+				if err != nil {
+					return gqlToken{}, l.errorf("invalid unicode escape")
+				}
+				l.pos += 4
+				b.WriteRune(rune(n))
+			default:
+				return gqlToken{}, l.errorf("invalid escape \\%c", esc)
+			}
+		default:
+			b.WriteByte(c)
+			l.pos++
+		}
+	}
+}
+
+func (l *gqlLexer) blockString(loc gqlLocation) (gqlToken, error) {
+	l.pos += 3
+
+	var b bytes.Buffer
+	for {
+		switch {
+		case l.pos >= len(l.src):
+			return gqlToken{}, l.errorf("unterminated string")
+		case strings.HasPrefix(l.src[l.pos:], `"""`):
+			l.pos += 3
+			return gqlToken{kind: gqlString, value: blockStringValue(b.String()), loc: loc}, nil
+		case strings.HasPrefix(l.src[l.pos:], `\"""`):
+			b.WriteString(`"""`)
+			l.pos += 4
+		case l.src[l.pos] == '\n':
+			b.WriteByte('\n')
+			l.pos++
+			l.newline()
+		default:
+			b.WriteByte(l.src[l.pos])
+			l.pos++
+		}
+	}
+}
+
+// blockStringValue removes the common indentation and the blank first and
+// last lines of a block string.
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.Replace(raw, "\r\n", "\n", -1), "\n")
+
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = ""
+			}
+		}
+	}
+
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// gqlDocument is a parsed GraphQL document.
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string
+	name       string
+	vars       []*gqlVarDef
+	directives []*gqlDirective
+	selections []gqlSelection
+	loc        gqlLocation
+}
+
+type gqlVarDef struct {
+	name string
+	typ  *gqlTypeRef
+	def  gqlValue
+	loc  gqlLocation
+}
+
+// gqlTypeRef is a type named in a document, e.g. [ID!]!.
+type gqlTypeRef struct {
+	name    string
+	elem    *gqlTypeRef
+	nonNull bool
+}
+
+func (t *gqlTypeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+
+	return s
+}
+
+type gqlFragment struct {
+	name       string
+	typeCond   string
+	directives []*gqlDirective
+	selections []gqlSelection
+	loc        gqlLocation
+}
+
+// gqlSelection is one of *gqlFieldNode, *gqlFragmentSpread or
+// *gqlInlineFragment.
+type gqlSelection interface{}
+
+type gqlFieldNode struct {
+	alias      string
+	name       string
+	args       []*gqlArgNode
+	directives []*gqlDirective
+	selections []gqlSelection
+	loc        gqlLocation
+}
+
+// key is the name of the field in the response.
+func (f *gqlFieldNode) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+
+	return f.name
+}
+
+type gqlFragmentSpread struct {
+	name       string
+	directives []*gqlDirective
+	loc        gqlLocation
+}
+
+type gqlInlineFragment struct {
+	typeCond   string
+	directives []*gqlDirective
+	selections []gqlSelection
+	loc        gqlLocation
+}
+
+type gqlDirective struct {
+	name string
+	args []*gqlArgNode
+	loc  gqlLocation
+}
+
+type gqlArgNode struct {
+	name  string
+	value gqlValue
+	loc   gqlLocation
+}
+
+// gqlValue is a value in a document. It is nil, bool, int64, float64, string,
+// gqlEnum, gqlVariable, []gqlValue or *gqlObjectValue.
+type gqlValue interface{}
+
+type gqlEnum string
+
+type gqlVariable string
+
+type gqlObjectValue struct {
+	fields []*gqlArgNode
+}
+
+// gqlParser parses a document a token at a time.
+type gqlParser struct {
+	lexer *gqlLexer
+	tok   gqlToken
+}
+
+// parseGraphQL parses a GraphQL document.
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lexer: &gqlLexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.peek(gqlPunct, "{"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(gqlName, "query"), p.peek(gqlName, "mutation"), p.peek(gqlName, "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(gqlName, "fragment"):
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[f.name]; ok {
+				return nil, &gqlSyntaxError{loc: f.loc, msg: fmt.Sprintf("fragment %q is defined more than once", f.name)}
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected()
+		}
+	}
+
+	if len(doc.operations) == 0 {
+		return nil, &gqlSyntaxError{loc: p.tok.loc, msg: "document has no operations"}
+	}
+
+	return doc, nil
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) peek(kind gqlTokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *gqlParser) unexpected() error {
+	return &gqlSyntaxError{loc: p.tok.loc, msg: fmt.Sprintf("unexpected %s", p.tok)}
+}
+
+// skip advances past the token if it is kind and value, and returns true if
+// it was.
+func (p *gqlParser) skip(kind gqlTokenKind, value string) (bool, error) {
+	if !p.peek(kind, value) {
+		return false, nil
+	}
+
+	return true, p.advance()
+}
+
+func (p *gqlParser) expect(kind gqlTokenKind, value string) error {
+	if !p.peek(kind, value) {
+		return &gqlSyntaxError{loc: p.tok.loc, msg: fmt.Sprintf("expected %q, found %s", value, p.tok)}
+	}
+
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", &gqlSyntaxError{loc: p.tok.loc, msg: fmt.Sprintf("expected a name, found %s", p.tok)}
+	}
+
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query", loc: p.tok.loc}
+
+	if p.tok.kind == gqlName {
+		op.kind = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind == gqlName {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			op.name = name
+		}
+
+		if p.peek(gqlPunct, "(") {
+			vars, err := p.varDefs()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = vars
+		}
+
+		directives, err := p.directives(false)
+		if err != nil {
+			return nil, err
+		}
+		op.directives = directives
+	}
+
+	sels, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sels
+
+	return op, nil
+}
+
+func (p *gqlParser) varDefs() ([]*gqlVarDef, error) {
+	if err := p.expect(gqlPunct, "("); err != nil {
+		return nil, err
+	}
+
+	var defs []*gqlVarDef
+	for {
+		if ok, err := p.skip(gqlPunct, ")"); err != nil || ok {
+			return defs, err
+		}
+
+		def := &gqlVarDef{loc: p.tok.loc}
+		if err := p.expect(gqlPunct, "$"); err != nil {
+			return nil, err
+		}
+
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		def.name = name
+
+		if err := p.expect(gqlPunct, ":"); err != nil {
+			return nil, err
+		}
+
+		if def.typ, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+
+		if ok, err := p.skip(gqlPunct, "="); err != nil {
+			return nil, err
+		} else if ok {
+			if def.def, err = p.value(true); err != nil {
+				return nil, err
+			}
+		}
+
+		defs = append(defs, def)
+	}
+}
+
+func (p *gqlParser) typeRef() (*gqlTypeRef, error) {
+	t := &gqlTypeRef{}
+
+	if ok, err := p.skip(gqlPunct, "["); err != nil {
+		return nil, err
+	} else if ok {
+		if t.elem, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(gqlPunct, "]"); err != nil {
+			return nil, err
+		}
+	} else {
+		if t.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	ok, err := p.skip(gqlPunct, "!")
+	t.nonNull = ok
+	return t, err
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	f := &gqlFragment{loc: p.tok.loc}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.name == "on" {
+		return nil, &gqlSyntaxError{loc: f.loc, msg: `a fragment can't be named "on"`}
+	}
+
+	if err := p.expect(gqlName, "on"); err != nil {
+		return nil, err
+	}
+
+	if f.typeCond, err = p.name(); err != nil {
+		return nil, err
+	}
+
+	if f.directives, err = p.directives(false); err != nil {
+		return nil, err
+	}
+
+	if f.selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect(gqlPunct, "{"); err != nil {
+		return nil, err
+	}
+
+	var sels []gqlSelection
+	for {
+		if len(sels) == 0 && p.peek(gqlPunct, "}") {
+			return nil, p.unexpected()
+		}
+
+		if ok, err := p.skip(gqlPunct, "}"); err != nil || ok {
+			return sels, err
+		}
+
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	loc := p.tok.loc
+
+	if ok, err := p.skip(gqlPunct, "..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == gqlName && p.tok.value != "on" {
+			spread := &gqlFragmentSpread{loc: loc}
+			if spread.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if spread.directives, err = p.directives(false); err != nil {
+				return nil, err
+			}
+			return spread, nil
+		}
+
+		inline := &gqlInlineFragment{loc: loc}
+		if ok, err := p.skip(gqlName, "on"); err != nil {
+			return nil, err
+		} else if ok {
+			if inline.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if inline.directives, err = p.directives(false); err != nil {
+			return nil, err
+		}
+		if inline.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+		return inline, nil
+	}
+
+	f := &gqlFieldNode{loc: loc}
+
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := p.skip(gqlPunct, ":"); err != nil {
+		return nil, err
+	} else if ok {
+		f.alias = name
+		if name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	f.name = name
+
+	if f.args, err = p.args(false); err != nil {
+		return nil, err
+	}
+
+	if f.directives, err = p.directives(false); err != nil {
+		return nil, err
+	}
+
+	if p.peek(gqlPunct, "{") {
+		if f.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (p *gqlParser) args(constant bool) ([]*gqlArgNode, error) {
+	if ok, err := p.skip(gqlPunct, "("); err != nil || !ok {
+		return nil, err
+	}
+
+	var args []*gqlArgNode
+	for {
+		if len(args) == 0 && p.peek(gqlPunct, ")") {
+			return nil, p.unexpected()
+		}
+
+		if ok, err := p.skip(gqlPunct, ")"); err != nil || ok {
+			return args, err
+		}
+
+		arg := &gqlArgNode{loc: p.tok.loc}
+
+		var err error
+		if arg.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(gqlPunct, ":"); err != nil {
+			return nil, err
+		}
+		if arg.value, err = p.value(constant); err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+	}
+}
+
+func (p *gqlParser) directives(constant bool) ([]*gqlDirective, error) {
+	var directives []*gqlDirective
+	for p.peek(gqlPunct, "@") {
+		d := &gqlDirective{loc: p.tok.loc}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if d.args, err = p.args(constant); err != nil {
+			return nil, err
+		}
+
+		directives = append(directives, d)
+	}
+
+	return directives, nil
+}
+
+// value parses a value. Constant values can't contain variables.
+func (p *gqlParser) value(constant bool) (gqlValue, error) {
+	tok := p.tok
+
+	switch {
+	case tok.kind == gqlPunct && tok.value == "$" && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+
+	case tok.kind == gqlPunct && tok.value == "[":
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		list := []gqlValue{}
+		for {
+			if ok, err := p.skip(gqlPunct, "]"); err != nil || ok {
+				return list, err
+			}
+
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+
+	case tok.kind == gqlPunct && tok.value == "{":
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		obj := &gqlObjectValue{}
+		for {
+			if ok, err := p.skip(gqlPunct, "}"); err != nil || ok {
+				return obj, err
+			}
+
+			field := &gqlArgNode{loc: p.tok.loc}
+
+			var err error
+			if field.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(gqlPunct, ":"); err != nil {
+				return nil, err
+			}
+			if field.value, err = p.value(constant); err != nil {
+				return nil, err
+			}
+
+			obj.fields = append(obj.fields, field)
+		}
+
+	case tok.kind == gqlInt:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{loc: tok.loc, msg: fmt.Sprintf("integer %s is out of range", tok.value)}
+		}
+		return n, p.advance()
+
+	case tok.kind == gqlFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{loc: tok.loc, msg: fmt.Sprintf("float %s is out of range", tok.value)}
+		}
+		return f, p.advance()
+
+	case tok.kind == gqlString:
+		return tok.value, p.advance()
+
+	case tok.kind == gqlName:
+		var v gqlValue
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = gqlEnum(tok.value)
+		}
+		return v, p.advance()
+	}
+
+	return nil, p.unexpected()
+}
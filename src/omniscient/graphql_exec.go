@@ -0,0 +1,1108 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// This file executes GraphQL documents against a schema. The schema is
+// built from Go values rather than parsed.
+//
+// The engine is written here rather than vendored: the schema is small, and
+// its depth and complexity limits and the batching of note loads are part of
+// execution, which the Go GraphQL libraries leave to resolvers and would
+// bring their own dependencies for.
+
+// gqlType is a GraphQL type: *gqlScalar, *gqlEnumType, *gqlObject,
+// *gqlInputObject, *gqlList or *gqlNonNull.
+type gqlType interface {
+	String() string
+}
+
+// gqlScalar is a leaf type. parse coerces an input value, and returns false
+// if the value can't be coerced.
+type gqlScalar struct {
+	name  string
+	desc  string
+	parse func(v interface{}) (interface{}, bool)
+}
+
+func (t *gqlScalar) String() string { return t.name }
+
+// gqlEnumType is a leaf type whose values are one of a set of names.
+type gqlEnumType struct {
+	name   string
+	desc   string
+	values []string
+}
+
+func (t *gqlEnumType) String() string { return t.name }
+
+type gqlObject struct {
+	name   string
+	desc   string
+	fields []*gqlField
+}
+
+func (t *gqlObject) String() string { return t.name }
+
+func (t *gqlObject) field(name string) *gqlField {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// gqlResolveFn resolves the value of a field of source. The value can be a
+// gqlThunk, which is called once every sibling field has been resolved so
+// their loads can be batched.
+type gqlResolveFn func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error)
+
+// gqlThunk is a value which is resolved later.
+type gqlThunk func() (interface{}, error)
+
+// gqlCostFn is the complexity of a field given the complexity of its
+// selections.
+type gqlCostFn func(args map[string]interface{}, childCost int) int
+
+type gqlField struct {
+	name    string
+	desc    string
+	args    []*gqlInputValue
+	typ     gqlType
+	resolve gqlResolveFn
+	// cost defaults to one plus the cost of the selections.
+	cost gqlCostFn
+}
+
+type gqlInputObject struct {
+	name   string
+	desc   string
+	fields []*gqlInputValue
+}
+
+func (t *gqlInputObject) String() string { return t.name }
+
+// gqlInputValue is an argument or a field of an input object.
+type gqlInputValue struct {
+	name string
+	desc string
+	typ  gqlType
+	// def is the default value, if hasDef is set.
+	def    interface{}
+	hasDef bool
+}
+
+type gqlList struct {
+	elem gqlType
+}
+
+func (t *gqlList) String() string { return "[" + t.elem.String() + "]" }
+
+type gqlNonNull struct {
+	elem gqlType
+}
+
+func (t *gqlNonNull) String() string { return t.elem.String() + "!" }
+
+func gqlListOf(t gqlType) gqlType    { return &gqlList{elem: t} }
+func gqlNonNullOf(t gqlType) gqlType { return &gqlNonNull{elem: t} }
+
+var (
+	gqlStringType = &gqlScalar{name: "String", parse: func(v interface{}) (interface{}, bool) {
+		s, ok := v.(string)
+		return s, ok
+	}}
+	gqlIDType = &gqlScalar{name: "ID", parse: func(v interface{}) (interface{}, bool) {
+		switch v := v.(type) {
+		case string:
+			return v, true
+		case int64:
+			return fmt.Sprint(v), true
+		}
+		return nil, false
+	}}
+	gqlIntType = &gqlScalar{name: "Int", parse: func(v interface{}) (interface{}, bool) {
+		switch v := v.(type) {
+		case int:
+			return v, true
+		case int64:
+			if v >= math.MinInt32 && v <= math.MaxInt32 {
+				return int(v), true
+			}
+		case float64:
+			// variables are decoded from JSON as floats.
+			if v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+				return int(v), true
+			}
+		}
+		return nil, false
+	}}
+	gqlBooleanType = &gqlScalar{name: "Boolean", parse: func(v interface{}) (interface{}, bool) {
+		b, ok := v.(bool)
+		return b, ok
+	}}
+	gqlDateTimeType = &gqlScalar{
+		name: "DateTime",
+		desc: "An RFC 3339 date and time.",
+		parse: func(v interface{}) (interface{}, bool) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			t, err := time.Parse(time.RFC3339, s)
+			return t, err == nil
+		},
+	}
+
+	gqlBuiltinScalars = []*gqlScalar{gqlStringType, gqlIDType, gqlIntType, gqlBooleanType}
+)
+
+// gqlSchema is a GraphQL schema.
+type gqlSchema struct {
+	query    *gqlObject
+	mutation *gqlObject
+	// types are the named types of the schema, in the order they are
+	// described.
+	types         []gqlType
+	introspection *gqlIntrospection
+}
+
+// newGQLSchema creates a schema with the root types query and mutation, and
+// the named types types.
+func newGQLSchema(query, mutation *gqlObject, types ...gqlType) *gqlSchema {
+	s := &gqlSchema{query: query, mutation: mutation, types: types}
+	s.introspection = newGQLIntrospection(s)
+	s.introspection.measure(s)
+	return s
+}
+
+// field looks up a field of typ, including the introspection fields of the
+// query type.
+func (s *gqlSchema) field(typ *gqlObject, name string) *gqlField {
+	if typ == s.query && isIntrospectionField(name) {
+		for _, f := range s.introspection.fields {
+			if f.name == name {
+				return f
+			}
+		}
+		return nil
+	}
+
+	return typ.field(name)
+}
+
+// inputType looks up an input type named by a variable definition.
+func (s *gqlSchema) inputType(ref *gqlTypeRef) gqlType {
+	if ref.elem != nil {
+		elem := s.inputType(ref.elem)
+		if elem == nil {
+			return nil
+		}
+		return wrapNonNull(gqlListOf(elem), ref.nonNull)
+	}
+
+	for _, t := range s.allTypes() {
+		if t.String() != ref.name {
+			continue
+		}
+
+		switch t.(type) {
+		case *gqlScalar, *gqlEnumType, *gqlInputObject:
+			return wrapNonNull(t, ref.nonNull)
+		}
+	}
+
+	return nil
+}
+
+// allTypes are the named types of the schema, with the built in scalars and
+// the introspection types.
+func (s *gqlSchema) allTypes() []gqlType {
+	types := make([]gqlType, 0, len(gqlBuiltinScalars)+len(s.types)+len(s.introspection.types))
+	for _, t := range gqlBuiltinScalars {
+		types = append(types, t)
+	}
+
+	types = append(types, s.types...)
+	return append(types, s.introspection.types...)
+}
+
+func wrapNonNull(t gqlType, nonNull bool) gqlType {
+	if nonNull {
+		return gqlNonNullOf(t)
+	}
+
+	return t
+}
+
+// sdl describes the schema in the GraphQL schema definition language.
+func (s *gqlSchema) sdl() string {
+	var b bytes.Buffer
+
+	describe := func(indent, desc string) {
+		if desc != "" {
+			fmt.Fprintf(&b, "%s\"\"\"%s\"\"\"\n", indent, desc)
+		}
+	}
+
+	inputValue := func(iv *gqlInputValue) string {
+		s := iv.name + ": " + iv.typ.String()
+		if iv.hasDef {
+			def, _ := json.Marshal(iv.def)
+			s += " = " + string(def)
+		}
+		return s
+	}
+
+	b.WriteString("schema {\n  query: " + s.query.name + "\n")
+	if s.mutation != nil {
+		b.WriteString("  mutation: " + s.mutation.name + "\n")
+	}
+	b.WriteString("}\n")
+
+	for _, t := range s.types {
+		b.WriteString("\n")
+
+		switch t := t.(type) {
+		case *gqlScalar:
+			describe("", t.desc)
+			fmt.Fprintf(&b, "scalar %s\n", t.name)
+		case *gqlEnumType:
+			describe("", t.desc)
+			fmt.Fprintf(&b, "enum %s {\n", t.name)
+			for _, v := range t.values {
+				fmt.Fprintf(&b, "  %s\n", v)
+			}
+			b.WriteString("}\n")
+		case *gqlObject:
+			describe("", t.desc)
+			fmt.Fprintf(&b, "type %s {\n", t.name)
+			for _, f := range t.fields {
+				describe("  ", f.desc)
+				args := make([]string, len(f.args))
+				for i, a := range f.args {
+					args[i] = inputValue(a)
+				}
+				if len(args) > 0 {
+					fmt.Fprintf(&b, "  %s(%s): %s\n", f.name, strings.Join(args, ", "), f.typ)
+				} else {
+					fmt.Fprintf(&b, "  %s: %s\n", f.name, f.typ)
+				}
+			}
+			b.WriteString("}\n")
+		case *gqlInputObject:
+			describe("", t.desc)
+			fmt.Fprintf(&b, "input %s {\n", t.name)
+			for _, f := range t.fields {
+				describe("  ", f.desc)
+				fmt.Fprintf(&b, "  %s\n", inputValue(f))
+			}
+			b.WriteString("}\n")
+		}
+	}
+
+	return b.String()
+}
+
+// gqlError is an error in a GraphQL response.
+type gqlError struct {
+	Message    string                 `json:"message"`
+	Locations  []gqlLocation          `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e *gqlError) Error() string {
+	return e.Message
+}
+
+func gqlErrorf(loc gqlLocation, format string, args ...interface{}) *gqlError {
+	return &gqlError{
+		Message:   fmt.Sprintf(format, args...),
+		Locations: []gqlLocation{loc},
+	}
+}
+
+// gqlOrderedMap is a JSON object which keeps its keys in order, as GraphQL
+// responses list fields in the order they were selected.
+type gqlOrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGQLOrderedMap() *gqlOrderedMap {
+	return &gqlOrderedMap{values: map[string]interface{}{}}
+}
+
+func (m *gqlOrderedMap) set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+
+	m.values[key] = value
+}
+
+// MarshalJSON encodes the map as a JSON object.
+func (m *gqlOrderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+
+	for i, k := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlRequest is a GraphQL request.
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlOptions limit what a request can ask for.
+type gqlOptions struct {
+	maxDepth      int
+	maxComplexity int
+	// queryOnly rejects mutations, e.g. for requests made with GET.
+	queryOnly bool
+	// readOnly rejects mutations from callers who can't change notes.
+	readOnly bool
+}
+
+// gqlExecution is the state of executing a request.
+type gqlExecution struct {
+	schema    *gqlSchema
+	rc        *gqlResolveContext
+	fragments map[string]*gqlFragment
+	vars      map[string]interface{}
+	errors    []*gqlError
+}
+
+// executeGraphQL executes req. If the request can't be executed, the response
+// only has errors; otherwise it has data, and errors for fields which could
+// not be resolved.
+func executeGraphQL(schema *gqlSchema, rc *gqlResolveContext, opts gqlOptions, req *gqlRequest) *gqlOrderedMap {
+	res := newGQLOrderedMap()
+
+	fail := func(errs ...*gqlError) *gqlOrderedMap {
+		res.set("errors", errs)
+		return res
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		if se, ok := err.(*gqlSyntaxError); ok {
+			return fail(gqlErrorf(se.loc, "%s", se.Error()))
+		}
+		return fail(&gqlError{Message: err.Error()})
+	}
+
+	op, gerr := selectOperation(doc, req.OperationName)
+	if gerr != nil {
+		return fail(gerr)
+	}
+
+	var root *gqlObject
+	switch op.kind {
+	case "query":
+		root = schema.query
+	case "mutation":
+		if opts.queryOnly {
+			return fail(gqlErrorf(op.loc, "mutations must be sent with POST"))
+		}
+		if opts.readOnly {
+			return fail(gqlErrorf(op.loc, "mutations require the %s scope", ScopeNotesWrite))
+		}
+		root = schema.mutation
+	}
+	if root == nil {
+		return fail(gqlErrorf(op.loc, "%s operations are not supported", op.kind))
+	}
+
+	ex := &gqlExecution{
+		schema:    schema,
+		rc:        rc,
+		fragments: doc.fragments,
+	}
+
+	if ex.vars, gerr = ex.coerceVariables(op, req.Variables); gerr != nil {
+		return fail(gerr)
+	}
+
+	v := &gqlValidator{ex: ex, visiting: map[string]bool{}}
+	depth, cost := v.selections(root, op.selections, 1)
+	if len(v.errors) > 0 {
+		return fail(v.errors...)
+	}
+
+	if opts.maxDepth > 0 && depth > opts.maxDepth {
+		return fail(gqlErrorf(op.loc, "query has depth %d, which is more than the limit of %d", depth, opts.maxDepth))
+	}
+	if opts.maxComplexity > 0 && cost > opts.maxComplexity {
+		return fail(gqlErrorf(op.loc, "query has complexity %d, which is more than the limit of %d", cost, opts.maxComplexity))
+	}
+	if v.introspectionCost > gqlMaxIntrospectionComplexity {
+		return fail(gqlErrorf(op.loc, "introspection has complexity %d, which is more than the limit of %d", v.introspectionCost, gqlMaxIntrospectionComplexity))
+	}
+
+	data, ok := ex.executeSelections(root, nil, op.selections, nil, op.kind == "mutation")
+	if ok {
+		res.set("data", data)
+	} else {
+		res.set("data", nil)
+	}
+
+	if len(ex.errors) > 0 {
+		res.set("errors", ex.errors)
+	}
+
+	return res
+}
+
+func selectOperation(doc *gqlDocument, name string) (*gqlOperation, *gqlError) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, &gqlError{Message: "operationName is required when the document has more than one operation"}
+		}
+		return doc.operations[0], nil
+	}
+
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+
+	return nil, &gqlError{Message: fmt.Sprintf("operation %q is not in the document", name)}
+}
+
+func (ex *gqlExecution) coerceVariables(op *gqlOperation, values map[string]interface{}) (map[string]interface{}, *gqlError) {
+	vars := map[string]interface{}{}
+
+	for _, def := range op.vars {
+		typ := ex.schema.inputType(def.typ)
+		if typ == nil {
+			return nil, gqlErrorf(def.loc, "variable $%s has unknown input type %s", def.name, def.typ)
+		}
+
+		v, provided := values[def.name]
+		if !provided {
+			if def.def == nil {
+				if _, ok := typ.(*gqlNonNull); ok {
+					return nil, gqlErrorf(def.loc, "variable $%s of type %s is required", def.name, typ)
+				}
+				continue
+			}
+
+			var err error
+			if v, err = ex.literal(def.def); err != nil {
+				return nil, gqlErrorf(def.loc, "variable $%s: %v", def.name, err)
+			}
+		}
+
+		coerced, err := coerceInput(typ, v)
+		if err != nil {
+			return nil, gqlErrorf(def.loc, "variable $%s: %v", def.name, err)
+		}
+		vars[def.name] = coerced
+	}
+
+	return vars, nil
+}
+
+// literal converts a value in the document to a plain value, substituting
+// variables. It is not coerced.
+func (ex *gqlExecution) literal(v gqlValue) (interface{}, error) {
+	switch v := v.(type) {
+	case gqlVariable:
+		return ex.vars[string(v)], nil
+	case gqlEnum:
+		return string(v), nil
+	case []gqlValue:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if list[i], err = ex.literal(e); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case *gqlObjectValue:
+		m := map[string]interface{}{}
+		for _, f := range v.fields {
+			if _, ok := m[f.name]; ok {
+				return nil, fmt.Errorf("field %q is given more than once", f.name)
+			}
+			fv, err := ex.literal(f.value)
+			if err != nil {
+				return nil, err
+			}
+			m[f.name] = fv
+		}
+		return m, nil
+	}
+
+	return v, nil
+}
+
+// coerceInput coerces a plain value to an input type.
+func coerceInput(typ gqlType, v interface{}) (interface{}, error) {
+	if nn, ok := typ.(*gqlNonNull); ok {
+		if v == nil {
+			return nil, fmt.Errorf("expected a value of type %s, found null", typ)
+		}
+		return coerceInput(nn.elem, v)
+	}
+
+	if v == nil {
+		return nil, nil
+	}
+
+	switch t := typ.(type) {
+	case *gqlList:
+		items, ok := v.([]interface{})
+		if !ok {
+			// a single value is coerced to a list of one.
+			items = []interface{}{v}
+		}
+
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			if list[i], err = coerceInput(t.elem, item); err != nil {
+				return nil, fmt.Errorf("item %d: %v", i, err)
+			}
+		}
+		return list, nil
+
+	case *gqlScalar:
+		if parsed, ok := t.parse(v); ok {
+			return parsed, nil
+		}
+		return nil, fmt.Errorf("expected a value of type %s, found %s", t, gqlValueString(v))
+
+	case *gqlEnumType:
+		if s, ok := v.(string); ok && containsString(t.values, s) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("expected a value of type %s, found %s", t, gqlValueString(v))
+
+	case *gqlInputObject:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an object of type %s, found %s", t, gqlValueString(v))
+		}
+		return coerceFields(t.name, t.fields, m)
+	}
+
+	return nil, fmt.Errorf("%s is not an input type", typ)
+}
+
+// coerceFields coerces the fields of an input object, or the arguments of a
+// field.
+func coerceFields(owner string, defs []*gqlInputValue, values map[string]interface{}) (map[string]interface{}, error) {
+	for name := range values {
+		if inputValue(defs, name) == nil {
+			return nil, fmt.Errorf("%s has no field %q", owner, name)
+		}
+	}
+
+	coerced := map[string]interface{}{}
+	for _, def := range defs {
+		v, ok := values[def.name]
+		if !ok {
+			if def.hasDef {
+				v = def.def
+			} else if _, nonNull := def.typ.(*gqlNonNull); nonNull {
+				return nil, fmt.Errorf("%q of type %s is required", def.name, def.typ)
+			} else {
+				continue
+			}
+		}
+
+		c, err := coerceInput(def.typ, v)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", def.name, err)
+		}
+		coerced[def.name] = c
+	}
+
+	return coerced, nil
+}
+
+func inputValue(defs []*gqlInputValue, name string) *gqlInputValue {
+	for _, def := range defs {
+		if def.name == name {
+			return def
+		}
+	}
+
+	return nil
+}
+
+func gqlValueString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(b)
+}
+
+// args coerces the arguments given to a field or directive. Arguments which
+// are variables that weren't provided are treated as missing.
+func (ex *gqlExecution) args(owner string, defs []*gqlInputValue, nodes []*gqlArgNode) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, node := range nodes {
+		if inputValue(defs, node.name) == nil {
+			return nil, fmt.Errorf("unknown argument %q of %s", node.name, owner)
+		}
+		if _, ok := values[node.name]; ok {
+			return nil, fmt.Errorf("argument %q is given more than once", node.name)
+		}
+
+		if name, ok := node.value.(gqlVariable); ok {
+			if _, provided := ex.vars[string(name)]; !provided {
+				continue
+			}
+		}
+
+		v, err := ex.literal(node.value)
+		if err != nil {
+			return nil, err
+		}
+		values[node.name] = v
+	}
+
+	return coerceFields(owner, defs, values)
+}
+
+var gqlSkipIncludeArgs = []*gqlInputValue{
+	{name: "if", typ: gqlNonNullOf(gqlBooleanType)},
+}
+
+// included applies the @skip and @include directives.
+func (ex *gqlExecution) included(directives []*gqlDirective) (bool, error) {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			return false, gqlErrorf(d.loc, "unknown directive @%s", d.name)
+		}
+
+		args, err := ex.args("@"+d.name, gqlSkipIncludeArgs, d.args)
+		if err != nil {
+			return false, gqlErrorf(d.loc, "@%s: %v", d.name, err)
+		}
+
+		if args["if"].(bool) == (d.name == "skip") {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// gqlCollectedField is the fields of a selection set with the same response
+// key.
+type gqlCollectedField struct {
+	key   string
+	nodes []*gqlFieldNode
+}
+
+// collectFields flattens fragments and applies directives. visiting guards
+// against fragments which spread themselves.
+func (ex *gqlExecution) collectFields(typ *gqlObject, sels []gqlSelection, fields []*gqlCollectedField, visiting map[string]bool) ([]*gqlCollectedField, error) {
+	for _, sel := range sels {
+		switch sel := sel.(type) {
+		case *gqlFieldNode:
+			ok, err := ex.included(sel.directives)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+
+			key := sel.key()
+			found := false
+			for _, f := range fields {
+				if f.key == key {
+					if f.nodes[0].name != sel.name {
+						return nil, gqlErrorf(sel.loc, "fields %q and %q conflict because they are both returned as %q", f.nodes[0].name, sel.name, key)
+					}
+					f.nodes = append(f.nodes, sel)
+					found = true
+					break
+				}
+			}
+			if !found {
+				fields = append(fields, &gqlCollectedField{key: key, nodes: []*gqlFieldNode{sel}})
+			}
+
+		case *gqlFragmentSpread:
+			ok, err := ex.included(sel.directives)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+
+			frag, ok := ex.fragments[sel.name]
+			if !ok {
+				return nil, gqlErrorf(sel.loc, "unknown fragment %q", sel.name)
+			}
+			if visiting[sel.name] {
+				return nil, gqlErrorf(sel.loc, "fragment %q spreads itself", sel.name)
+			}
+			if frag.typeCond != typ.name {
+				return nil, gqlErrorf(sel.loc, "fragment %q on %s can't be spread on %s", sel.name, frag.typeCond, typ.name)
+			}
+
+			visiting[sel.name] = true
+			fields, err = ex.collectFields(typ, frag.selections, fields, visiting)
+			delete(visiting, sel.name)
+			if err != nil {
+				return nil, err
+			}
+
+		case *gqlInlineFragment:
+			ok, err := ex.included(sel.directives)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+
+			if sel.typeCond != "" && sel.typeCond != typ.name {
+				return nil, gqlErrorf(sel.loc, "fragment on %s can't be spread on %s", sel.typeCond, typ.name)
+			}
+
+			if fields, err = ex.collectFields(typ, sel.selections, fields, visiting); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return fields, nil
+}
+
+// namedType unwraps lists and non-null types.
+func namedType(t gqlType) gqlType {
+	for {
+		switch w := t.(type) {
+		case *gqlList:
+			t = w.elem
+		case *gqlNonNull:
+			t = w.elem
+		default:
+			return t
+		}
+	}
+}
+
+// mergedSelections are the selections of fields with the same response key.
+func mergedSelections(nodes []*gqlFieldNode) []gqlSelection {
+	if len(nodes) == 1 {
+		return nodes[0].selections
+	}
+
+	var sels []gqlSelection
+	for _, n := range nodes {
+		sels = append(sels, n.selections...)
+	}
+
+	return sels
+}
+
+// gqlValidator checks a query against the schema before it is executed, and
+// measures its depth and complexity.
+type gqlValidator struct {
+	ex       *gqlExecution
+	visiting map[string]bool
+	errors   []*gqlError
+	// introspectionCost is the complexity of the introspection fields,
+	// which isn't part of the complexity of the query.
+	introspectionCost int
+}
+
+func (v *gqlValidator) addError(err error) {
+	if ge, ok := err.(*gqlError); ok {
+		v.errors = append(v.errors, ge)
+		return
+	}
+
+	v.errors = append(v.errors, &gqlError{Message: err.Error()})
+}
+
+// selections returns the depth and complexity of a selection set.
+func (v *gqlValidator) selections(typ *gqlObject, sels []gqlSelection, depth int) (int, int) {
+	fields, err := v.ex.collectFields(typ, sels, nil, v.visiting)
+	if err != nil {
+		v.addError(err)
+		return 0, 0
+	}
+
+	maxDepth, total := depth, 0
+	for _, cf := range fields {
+		node := cf.nodes[0]
+		if node.name == "__typename" {
+			total++
+			continue
+		}
+
+		def := v.ex.schema.field(typ, node.name)
+		if def == nil {
+			v.addError(gqlErrorf(node.loc, "cannot query field %q on type %s", node.name, typ.name))
+			continue
+		}
+
+		args, err := v.ex.args(fmt.Sprintf("%s.%s", typ.name, def.name), def.args, node.args)
+		if err != nil {
+			v.addError(gqlErrorf(node.loc, "%v", err))
+			continue
+		}
+
+		sels := mergedSelections(cf.nodes)
+
+		childDepth, childCost := depth, 0
+		switch t := namedType(def.typ).(type) {
+		case *gqlObject:
+			if len(sels) == 0 {
+				v.addError(gqlErrorf(node.loc, "field %q of type %s must have a selection of subfields", node.name, def.typ))
+				continue
+			}
+			childDepth, childCost = v.selections(t, sels, depth+1)
+		default:
+			if len(sels) > 0 {
+				v.addError(gqlErrorf(node.loc, "field %q of type %s can't have a selection of subfields", node.name, def.typ))
+				continue
+			}
+		}
+
+		cost := 1 + childCost
+		if def.cost != nil {
+			cost = def.cost(args, childCost)
+		}
+
+		// the introspection query nests types deeper than any query of
+		// notes, so introspection is only limited by its complexity.
+		if isIntrospectionField(def.name) {
+			v.introspectionCost += cost
+			continue
+		}
+
+		if childDepth > maxDepth {
+			maxDepth = childDepth
+		}
+
+		total += cost
+	}
+
+	return maxDepth, total
+}
+
+// executeSelections resolves the fields of source. Every field is resolved
+// before any thunks are called, unless serial is set, as it is for
+// mutations. It returns false if a non-null field couldn't be resolved, in
+// which case source must be null.
+func (ex *gqlExecution) executeSelections(typ *gqlObject, source interface{}, sels []gqlSelection, path []interface{}, serial bool) (*gqlOrderedMap, bool) {
+	// the selections were checked when the query was validated.
+	fields, _ := ex.collectFields(typ, sels, nil, map[string]bool{})
+
+	type resolved struct {
+		field *gqlCollectedField
+		def   *gqlField
+		value interface{}
+		err   error
+	}
+
+	results := make([]*resolved, 0, len(fields))
+
+	complete := func(r *resolved) (interface{}, bool) {
+		node := r.field.nodes[0]
+		fieldPath := appendPath(path, r.field.key)
+
+		if r.err == nil {
+			if thunk, ok := r.value.(gqlThunk); ok {
+				r.value, r.err = thunk()
+			}
+		}
+
+		if r.err != nil {
+			ex.addError(r.err, node.loc, fieldPath)
+			if _, ok := r.def.typ.(*gqlNonNull); ok {
+				return nil, false
+			}
+			return nil, true
+		}
+
+		return ex.completeValue(r.def.typ, r.field.nodes, r.value, fieldPath)
+	}
+
+	out := newGQLOrderedMap()
+	for _, cf := range fields {
+		node := cf.nodes[0]
+		if node.name == "__typename" {
+			out.set(cf.key, typ.name)
+			continue
+		}
+
+		def := ex.schema.field(typ, node.name)
+		args, _ := ex.args(typ.name+"."+def.name, def.args, node.args)
+		value, err := def.resolve(ex.rc, source, args)
+
+		r := &resolved{field: cf, def: def, value: value, err: err}
+		if serial {
+			v, ok := complete(r)
+			if !ok {
+				return nil, false
+			}
+			out.set(cf.key, v)
+			continue
+		}
+
+		// keep the place of the field in the response.
+		out.set(cf.key, nil)
+		results = append(results, r)
+	}
+
+	for _, r := range results {
+		v, ok := complete(r)
+		if !ok {
+			return nil, false
+		}
+		out.set(r.field.key, v)
+	}
+
+	return out, true
+}
+
+// completeValue converts a resolved value to its type. It returns false if
+// the value is null but its type is non-null.
+func (ex *gqlExecution) completeValue(typ gqlType, nodes []*gqlFieldNode, v interface{}, path []interface{}) (interface{}, bool) {
+	if nn, ok := typ.(*gqlNonNull); ok {
+		if isNil(v) {
+			ex.addError(&gqlError{Message: "cannot return null for non-nullable field"}, nodes[0].loc, path)
+			return nil, false
+		}
+
+		// a nil result means an error was added for one of its fields.
+		res, ok := ex.completeValue(nn.elem, nodes, v, path)
+		return res, ok && res != nil
+	}
+
+	if isNil(v) {
+		return nil, true
+	}
+
+	switch t := typ.(type) {
+	case *gqlList:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			ex.addError(fmt.Errorf("expected a list for field of type %s", typ), nodes[0].loc, path)
+			return nil, true
+		}
+
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			item, ok := ex.completeValue(t.elem, nodes, rv.Index(i).Interface(), appendPath(path, i))
+			if !ok {
+				return nil, true
+			}
+			list[i] = item
+		}
+		return list, true
+
+	case *gqlObject:
+		m, ok := ex.executeSelections(t, v, mergedSelections(nodes), path, false)
+		if !ok {
+			return nil, true
+		}
+		return m, true
+	}
+
+	return v, true
+}
+
+func (ex *gqlExecution) addError(err error, loc gqlLocation, path []interface{}) {
+	ge := &gqlError{
+		Locations: []gqlLocation{loc},
+		Path:      path,
+	}
+
+	if e, ok := err.(*gqlError); ok {
+		ge.Message = e.Message
+		ge.Extensions = e.Extensions
+	} else {
+		p := problemFor(err)
+		if p.Status >= http.StatusInternalServerError {
+			log.WithError(err).WithField("request_id", ex.rc.requestID).Error("graphql field failed")
+		}
+
+		ge.Message = p.Detail
+		if ge.Message == "" {
+			ge.Message = p.Title
+		}
+
+		ge.Extensions = map[string]interface{}{"code": p.Code}
+		if len(p.Errors) > 0 {
+			ge.Extensions["errors"] = p.Errors
+		}
+	}
+
+	ex.errors = append(ex.errors, ge)
+}
+
+// appendPath appends to a copy of path, as paths of sibling fields share
+// their prefix.
+func appendPath(path []interface{}, elem interface{}) []interface{} {
+	p := make([]interface{}, len(path), len(path)+1)
+	copy(p, path)
+	return append(p, elem)
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface, reflect.Func:
+		return rv.IsNil()
+	}
+
+	return false
+}
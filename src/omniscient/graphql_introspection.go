@@ -0,0 +1,337 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// This file describes a schema to itself, with the __schema and __type
+// fields of its query type and the types of the introspection system.
+
+// gqlMaxIntrospectionComplexity limits the introspection fields of a query,
+// which the limits of the app don't apply to. The usual introspection query
+// has a complexity of about a quarter of it.
+const gqlMaxIntrospectionComplexity = 100000
+
+var (
+	gqlTypeKindType = &gqlEnumType{
+		name:   "__TypeKind",
+		desc:   "The kind of a type.",
+		values: []string{"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL"},
+	}
+	gqlDirectiveLocationType = &gqlEnumType{
+		name:   "__DirectiveLocation",
+		desc:   "Where a directive can be used.",
+		values: []string{"QUERY", "MUTATION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+	}
+)
+
+// gqlDirectiveDef is a directive which documents can use.
+type gqlDirectiveDef struct {
+	name      string
+	desc      string
+	locations []string
+	args      []*gqlInputValue
+}
+
+// gqlDirectives are the directives which are applied when fields are
+// collected.
+var gqlDirectives = []*gqlDirectiveDef{
+	{
+		name:      "skip",
+		desc:      "Skip the selection if the argument is true.",
+		locations: []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		args:      gqlSkipIncludeArgs,
+	},
+	{
+		name:      "include",
+		desc:      "Include the selection only if the argument is true.",
+		locations: []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		args:      gqlSkipIncludeArgs,
+	},
+}
+
+// gqlIntrospection is the introspection system of a schema.
+type gqlIntrospection struct {
+	types  []gqlType
+	fields []*gqlField
+
+	// the longest lists of each kind in the schema, which bound the
+	// complexity of the fields which return them.
+	maxTypes, maxFields, maxArgs, maxInputFields, maxEnumValues int
+}
+
+func newGQLIntrospection(s *gqlSchema) *gqlIntrospection {
+	in := &gqlIntrospection{}
+
+	optional := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+
+	// listCost is the cost of a list which has at most *n items.
+	listCost := func(n *int) gqlCostFn {
+		return func(args map[string]interface{}, childCost int) int {
+			return 1 + *n*childCost
+		}
+	}
+
+	includeDeprecated := []*gqlInputValue{
+		{name: "includeDeprecated", typ: gqlBooleanType, def: false, hasDef: true},
+	}
+
+	schemaType := &gqlObject{name: "__Schema", desc: "A GraphQL schema."}
+	typeType := &gqlObject{name: "__Type", desc: "A type of the schema, or a list or non-null type wrapping one."}
+	fieldType := &gqlObject{name: "__Field", desc: "A field of an object type."}
+	inputValueType := &gqlObject{name: "__InputValue", desc: "An argument, or a field of an input object type."}
+	enumValueType := &gqlObject{name: "__EnumValue", desc: "A value of an enum type."}
+	directiveType := &gqlObject{name: "__Directive", desc: "A directive which documents can use."}
+
+	schemaType.fields = []*gqlField{
+		{name: "types", typ: gqlNonNullOf(gqlListOf(gqlNonNullOf(typeType))), cost: listCost(&in.maxTypes), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlSchema).allTypes(), nil
+		}},
+		{name: "queryType", typ: gqlNonNullOf(typeType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlSchema).query, nil
+		}},
+		{name: "mutationType", typ: typeType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if m := source.(*gqlSchema).mutation; m != nil {
+				return m, nil
+			}
+			return nil, nil
+		}},
+		{name: "subscriptionType", typ: typeType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, nil
+		}},
+		{name: "directives", typ: gqlNonNullOf(gqlListOf(gqlNonNullOf(directiveType))), cost: func(args map[string]interface{}, childCost int) int {
+			return 1 + len(gqlDirectives)*childCost
+		}, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return gqlDirectives, nil
+		}},
+	}
+
+	typeType.fields = []*gqlField{
+		{name: "kind", typ: gqlNonNullOf(gqlTypeKindType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			switch source.(type) {
+			case *gqlScalar:
+				return "SCALAR", nil
+			case *gqlEnumType:
+				return "ENUM", nil
+			case *gqlObject:
+				return "OBJECT", nil
+			case *gqlInputObject:
+				return "INPUT_OBJECT", nil
+			case *gqlList:
+				return "LIST", nil
+			}
+			return "NON_NULL", nil
+		}},
+		{name: "name", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			switch source.(type) {
+			case *gqlList, *gqlNonNull:
+				return nil, nil
+			}
+			return source.(gqlType).String(), nil
+		}},
+		{name: "description", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			switch t := source.(type) {
+			case *gqlScalar:
+				return optional(t.desc), nil
+			case *gqlEnumType:
+				return optional(t.desc), nil
+			case *gqlObject:
+				return optional(t.desc), nil
+			case *gqlInputObject:
+				return optional(t.desc), nil
+			}
+			return nil, nil
+		}},
+		{name: "fields", args: includeDeprecated, typ: gqlListOf(gqlNonNullOf(fieldType)), cost: listCost(&in.maxFields), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if t, ok := source.(*gqlObject); ok {
+				return t.fields, nil
+			}
+			return nil, nil
+		}},
+		{name: "interfaces", typ: gqlListOf(gqlNonNullOf(typeType)), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if _, ok := source.(*gqlObject); ok {
+				return []gqlType{}, nil
+			}
+			return nil, nil
+		}},
+		{name: "possibleTypes", typ: gqlListOf(gqlNonNullOf(typeType)), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, nil
+		}},
+		{name: "enumValues", args: includeDeprecated, typ: gqlListOf(gqlNonNullOf(enumValueType)), cost: listCost(&in.maxEnumValues), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if t, ok := source.(*gqlEnumType); ok {
+				return t.values, nil
+			}
+			return nil, nil
+		}},
+		{name: "inputFields", typ: gqlListOf(gqlNonNullOf(inputValueType)), cost: listCost(&in.maxInputFields), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if t, ok := source.(*gqlInputObject); ok {
+				return t.fields, nil
+			}
+			return nil, nil
+		}},
+		{name: "ofType", typ: typeType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			switch t := source.(type) {
+			case *gqlList:
+				return t.elem, nil
+			case *gqlNonNull:
+				return t.elem, nil
+			}
+			return nil, nil
+		}},
+	}
+
+	fieldType.fields = []*gqlField{
+		{name: "name", typ: gqlNonNullOf(gqlStringType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlField).name, nil
+		}},
+		{name: "description", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return optional(source.(*gqlField).desc), nil
+		}},
+		{name: "args", typ: gqlNonNullOf(gqlListOf(gqlNonNullOf(inputValueType))), cost: listCost(&in.maxArgs), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if a := source.(*gqlField).args; a != nil {
+				return a, nil
+			}
+			return []*gqlInputValue{}, nil
+		}},
+		{name: "type", typ: gqlNonNullOf(typeType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlField).typ, nil
+		}},
+		{name: "isDeprecated", typ: gqlNonNullOf(gqlBooleanType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return false, nil
+		}},
+		{name: "deprecationReason", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, nil
+		}},
+	}
+
+	inputValueType.fields = []*gqlField{
+		{name: "name", typ: gqlNonNullOf(gqlStringType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlInputValue).name, nil
+		}},
+		{name: "description", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return optional(source.(*gqlInputValue).desc), nil
+		}},
+		{name: "type", typ: gqlNonNullOf(typeType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlInputValue).typ, nil
+		}},
+		{name: "defaultValue", desc: "The default value as a GraphQL literal, if there is one.", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			iv := source.(*gqlInputValue)
+			if !iv.hasDef {
+				return nil, nil
+			}
+			b, err := json.Marshal(iv.def)
+			return string(b), err
+		}},
+	}
+
+	enumValueType.fields = []*gqlField{
+		{name: "name", typ: gqlNonNullOf(gqlStringType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(string), nil
+		}},
+		{name: "description", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, nil
+		}},
+		{name: "isDeprecated", typ: gqlNonNullOf(gqlBooleanType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return false, nil
+		}},
+		{name: "deprecationReason", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, nil
+		}},
+	}
+
+	directiveType.fields = []*gqlField{
+		{name: "name", typ: gqlNonNullOf(gqlStringType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlDirectiveDef).name, nil
+		}},
+		{name: "description", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return optional(source.(*gqlDirectiveDef).desc), nil
+		}},
+		{name: "locations", typ: gqlNonNullOf(gqlListOf(gqlNonNullOf(gqlDirectiveLocationType))), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlDirectiveDef).locations, nil
+		}},
+		{name: "args", typ: gqlNonNullOf(gqlListOf(gqlNonNullOf(inputValueType))), cost: listCost(&in.maxArgs), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*gqlDirectiveDef).args, nil
+		}},
+	}
+
+	in.types = []gqlType{
+		schemaType, typeType, fieldType, inputValueType, enumValueType,
+		directiveType, gqlTypeKindType, gqlDirectiveLocationType,
+	}
+
+	in.fields = []*gqlField{
+		{
+			name: "__schema",
+			desc: "The schema of the API.",
+			typ:  gqlNonNullOf(schemaType),
+			resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return s, nil
+			},
+		},
+		{
+			name: "__type",
+			desc: "A type of the schema by name.",
+			args: []*gqlInputValue{{name: "name", typ: gqlNonNullOf(gqlStringType)}},
+			typ:  typeType,
+			resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				for _, t := range s.allTypes() {
+					if t.String() == args["name"].(string) {
+						return t, nil
+					}
+				}
+				return nil, nil
+			},
+		},
+	}
+
+	return in
+}
+
+// measure finds the longest lists of s. It is called once the introspection
+// types are part of the schema, as they describe themselves too.
+func (in *gqlIntrospection) measure(s *gqlSchema) {
+	types := s.allTypes()
+	in.maxTypes = len(types)
+
+	for _, d := range gqlDirectives {
+		in.maxArgs = maxInt(in.maxArgs, len(d.args))
+	}
+
+	for _, t := range types {
+		switch t := t.(type) {
+		case *gqlObject:
+			in.maxFields = maxInt(in.maxFields, len(t.fields))
+			for _, f := range t.fields {
+				in.maxArgs = maxInt(in.maxArgs, len(f.args))
+			}
+		case *gqlInputObject:
+			in.maxInputFields = maxInt(in.maxInputFields, len(t.fields))
+		case *gqlEnumType:
+			in.maxEnumValues = maxInt(in.maxEnumValues, len(t.values))
+		}
+	}
+
+	for _, f := range in.fields {
+		in.maxArgs = maxInt(in.maxArgs, len(f.args))
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// isIntrospectionField returns true if name is a field of the introspection
+// system rather than of the schema.
+func isIntrospectionField(name string) bool {
+	return strings.HasPrefix(name, "__")
+}
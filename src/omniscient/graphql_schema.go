@@ -0,0 +1,501 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultGraphQLMaxDepth      = 10
+	defaultGraphQLMaxComplexity = 20000
+)
+
+// errStopWalk stops walking notes early.
+var errStopWalk = errors.New("stop walk")
+
+// gqlResolveContext is passed to every resolver of a request.
+type gqlResolveContext struct {
+	app *App
+	// notes are the notes the request can access.
+	notes     NoteRepository
+	loader    *noteLoader
+	requestID string
+}
+
+// noteLoader collects the notes retrieved by id while resolving sibling
+// fields, and retrieves them with a single call to the repository. Loaded
+// notes are kept for the rest of the request.
+type noteLoader struct {
+	nr      NoteRepository
+	pending []string
+	notes   map[string]*Note
+	errs    map[string]error
+}
+
+func newNoteLoader(nr NoteRepository) *noteLoader {
+	return &noteLoader{
+		nr:    nr,
+		notes: map[string]*Note{},
+		errs:  map[string]error{},
+	}
+}
+
+// load returns a thunk for the note with id. The note is nil if it doesn't
+// exist.
+func (l *noteLoader) load(id string) gqlThunk {
+	if !l.loaded(id) && !containsString(l.pending, id) {
+		l.pending = append(l.pending, id)
+	}
+
+	return func() (interface{}, error) {
+		if !l.loaded(id) {
+			l.dispatch()
+		}
+
+		if err := l.errs[id]; err != nil {
+			return nil, err
+		}
+
+		return l.notes[id], nil
+	}
+}
+
+func (l *noteLoader) loaded(id string) bool {
+	_, ok := l.notes[id]
+	if !ok {
+		_, ok = l.errs[id]
+	}
+
+	return ok
+}
+
+// dispatch retrieves the pending notes.
+func (l *noteLoader) dispatch() {
+	ids := l.pending
+	l.pending = nil
+
+	notes, err := l.nr.RetrieveMany(ids)
+	for i, id := range ids {
+		if err != nil {
+			l.errs[id] = err
+			continue
+		}
+
+		l.notes[id] = notes[i]
+	}
+}
+
+// prime stores a note retrieved some other way, or nil for a note which is
+// known not to exist.
+func (l *noteLoader) prime(id string, n *Note) {
+	delete(l.errs, id)
+	l.notes[id] = n
+}
+
+// noteConnection is a page of notes.
+type noteConnection struct {
+	notes     []Note
+	more      bool
+	endCursor string
+}
+
+// pageArgs are the first and after arguments of a paginated field.
+var pageArgs = []*gqlInputValue{
+	{name: "first", desc: "The number of notes in the page.", typ: gqlIntType, def: defaultPageSize, hasDef: true},
+	{name: "after", desc: "The endCursor of the previous page.", typ: gqlStringType},
+}
+
+// page converts the first and after arguments to an offset and limit.
+func (rc *gqlResolveContext) page(args map[string]interface{}) (int64, int64, error) {
+	v := rc.app.newValidation()
+
+	limit := int64(args["first"].(int))
+	if limit < 1 || limit > maxPageSize {
+		v.add("first", CodeInvalidValue, "first must be between 1 and %d", maxPageSize)
+	}
+
+	var offset int64
+	if after, ok := args["after"].(string); ok {
+		n, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || n < 0 {
+			v.add("after", CodeInvalidValue, "after is not valid")
+		}
+		offset = n
+	}
+
+	return offset, limit, v.err()
+}
+
+// pageCost is the cost of a page of notes, which is the cost of every note
+// which can be in it.
+func pageCost(args map[string]interface{}, childCost int) int {
+	first, _ := args["first"].(int)
+	if first < 1 {
+		first = 1
+	}
+
+	return 1 + first*childCost
+}
+
+func newConnection(notes []Note, offset int64, more bool) *noteConnection {
+	conn := &noteConnection{notes: notes, more: more}
+	if len(notes) > 0 {
+		conn.endCursor = strconv.FormatInt(offset+int64(len(notes)), 10)
+	}
+
+	return conn
+}
+
+// noteInput converts a NoteInput to a request, and validates it.
+func (rc *gqlResolveContext) noteInput(in map[string]interface{}) (*createNoteReq, error) {
+	req := &createNoteReq{}
+	req.Content, _ = in["content"].(string)
+	req.Slug, _ = in["slug"].(string)
+	if t, ok := in["expiresAt"].(time.Time); ok {
+		req.ExpiresAt = &t
+	}
+	if ttl, ok := in["ttl"].(int); ok {
+		req.TTL = int64(ttl)
+	}
+
+	v := rc.app.newValidation()
+	req.validate(v, "input")
+	return req, v.err()
+}
+
+// searchNotes returns a page of the notes whose content or slug contains
+// query, ignoring case.
+func searchNotes(nr NoteRepository, query string, offset, limit int64) ([]Note, bool, error) {
+	query = strings.ToLower(query)
+
+	var (
+		notes   []Note
+		skipped int64
+		more    bool
+	)
+
+	err := nr.Walk(func(n *Note) error {
+		if !strings.Contains(strings.ToLower(n.Content), query) &&
+			!strings.Contains(strings.ToLower(n.Slug), query) {
+			return nil
+		}
+
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+
+		if int64(len(notes)) == limit {
+			more = true
+			return errStopWalk
+		}
+
+		notes = append(notes, *n)
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, false, err
+	}
+
+	return notes, more, nil
+}
+
+// noteSchema is the GraphQL schema for notes.
+var noteSchema = newNoteSchema()
+
+func newNoteSchema() *gqlSchema {
+	note := func(source interface{}) *Note { return source.(*Note) }
+
+	noteType := &gqlObject{
+		name: "Note",
+		desc: "A note.",
+		fields: []*gqlField{
+			{name: "id", typ: gqlNonNullOf(gqlIDType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return note(source).ID, nil
+			}},
+			{name: "content", typ: gqlNonNullOf(gqlStringType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return note(source).Content, nil
+			}},
+			{name: "slug", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				if slug := note(source).Slug; slug != "" {
+					return slug, nil
+				}
+				return nil, nil
+			}},
+			{name: "owner", desc: "The id of the principal who owns the note, if it has an owner.", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				if owner := note(source).Owner; owner != "" {
+					return owner, nil
+				}
+				return nil, nil
+			}},
+			{name: "createdAt", typ: gqlNonNullOf(gqlDateTimeType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return note(source).CreatedAt, nil
+			}},
+			{name: "updatedAt", typ: gqlNonNullOf(gqlDateTimeType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return note(source).UpdatedAt, nil
+			}},
+			{name: "expiresAt", desc: "When the note expires, if it does.", typ: gqlDateTimeType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return note(source).ExpiresAt, nil
+			}},
+		},
+	}
+
+	pageInfoType := &gqlObject{
+		name: "PageInfo",
+		fields: []*gqlField{
+			{name: "hasNextPage", typ: gqlNonNullOf(gqlBooleanType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return source.(*noteConnection).more, nil
+			}},
+			{name: "endCursor", desc: "The cursor for the next page. It is null if the page is empty.", typ: gqlStringType, resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				if c := source.(*noteConnection).endCursor; c != "" {
+					return c, nil
+				}
+				return nil, nil
+			}},
+		},
+	}
+
+	connectionType := &gqlObject{
+		name: "NoteConnection",
+		desc: "A page of notes.",
+		fields: []*gqlField{
+			{name: "nodes", typ: gqlNonNullOf(gqlListOf(gqlNonNullOf(noteType))), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				conn := source.(*noteConnection)
+				nodes := make([]*Note, len(conn.notes))
+				for i := range conn.notes {
+					nodes[i] = &conn.notes[i]
+				}
+				return nodes, nil
+			}},
+			{name: "pageInfo", typ: gqlNonNullOf(pageInfoType), resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return source, nil
+			}},
+		},
+	}
+
+	noteInputType := &gqlInputObject{
+		name: "NoteInput",
+		desc: "The content and attributes of a note. At most one of expiresAt and ttl can be set.",
+		fields: []*gqlInputValue{
+			{name: "content", typ: gqlNonNullOf(gqlStringType)},
+			{name: "slug", typ: gqlStringType},
+			{name: "expiresAt", typ: gqlDateTimeType},
+			{name: "ttl", desc: "The time to live in seconds.", typ: gqlIntType},
+		},
+	}
+
+	query := &gqlObject{
+		name: "Query",
+		fields: []*gqlField{
+			{
+				name: "note",
+				desc: "A note by id or slug. Exactly one of them must be given.",
+				args: []*gqlInputValue{
+					{name: "id", typ: gqlIDType},
+					{name: "slug", typ: gqlStringType},
+				},
+				typ: noteType,
+				resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+					id, hasID := args["id"].(string)
+					slug, hasSlug := args["slug"].(string)
+					if hasID == hasSlug {
+						return nil, NewProblem(CodeInvalidRequest, "exactly one of id and slug must be given")
+					}
+
+					if hasID {
+						return rc.loader.load(id), nil
+					}
+
+					n, err := rc.notes.RetrieveBySlug(slug)
+					if err == ErrNoteNotFound {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, err
+					}
+
+					rc.loader.prime(n.ID, n)
+					return n, nil
+				},
+			},
+			{
+				name: "notes",
+				desc: "A page of notes.",
+				args: pageArgs,
+				typ:  gqlNonNullOf(connectionType),
+				cost: pageCost,
+				resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+					offset, limit, err := rc.page(args)
+					if err != nil {
+						return nil, err
+					}
+
+					notes, more, err := rc.notes.ListPage(offset, limit)
+					if err != nil {
+						return nil, err
+					}
+
+					for i := range notes {
+						rc.loader.prime(notes[i].ID, &notes[i])
+					}
+
+					return newConnection(notes, offset, more), nil
+				},
+			},
+			{
+				name: "search",
+				desc: "A page of the notes whose content or slug contains query, ignoring case.",
+				args: append([]*gqlInputValue{
+					{name: "query", typ: gqlNonNullOf(gqlStringType)},
+				}, pageArgs...),
+				typ:  gqlNonNullOf(connectionType),
+				cost: pageCost,
+				resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+					offset, limit, err := rc.page(args)
+					if err != nil {
+						return nil, err
+					}
+
+					notes, more, err := searchNotes(rc.notes, args["query"].(string), offset, limit)
+					if err != nil {
+						return nil, err
+					}
+
+					return newConnection(notes, offset, more), nil
+				},
+			},
+		},
+	}
+
+	mutation := &gqlObject{
+		name: "Mutation",
+		fields: []*gqlField{
+			{
+				name: "createNote",
+				args: []*gqlInputValue{{name: "input", typ: gqlNonNullOf(noteInputType)}},
+				typ:  gqlNonNullOf(noteType),
+				resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+					req, err := rc.noteInput(args["input"].(map[string]interface{}))
+					if err != nil {
+						return nil, err
+					}
+
+					n, err := rc.notes.Create(req.Content, req.options(time.Now())...)
+					if err != nil {
+						return nil, err
+					}
+
+					rc.loader.prime(n.ID, n)
+					return n, nil
+				},
+			},
+			{
+				name: "updateNote",
+				desc: "Replace the content and attributes of an existing note.",
+				args: []*gqlInputValue{
+					{name: "id", typ: gqlNonNullOf(gqlIDType)},
+					{name: "input", typ: gqlNonNullOf(noteInputType)},
+				},
+				typ: gqlNonNullOf(noteType),
+				resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+					req, err := rc.noteInput(args["input"].(map[string]interface{}))
+					if err != nil {
+						return nil, err
+					}
+
+					n, err := rc.notes.Update(args["id"].(string), req.Content, req.options(time.Now())...)
+					if err != nil {
+						return nil, err
+					}
+
+					rc.loader.prime(n.ID, n)
+					return n, nil
+				},
+			},
+			{
+				name: "deleteNote",
+				desc: "Delete a note, and return its id.",
+				args: []*gqlInputValue{{name: "id", typ: gqlNonNullOf(gqlIDType)}},
+				typ:  gqlNonNullOf(gqlIDType),
+				resolve: func(rc *gqlResolveContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+					id := args["id"].(string)
+					if err := rc.notes.Delete(id); err != nil {
+						return nil, err
+					}
+
+					rc.loader.prime(id, nil)
+					return id, nil
+				},
+			},
+		},
+	}
+
+	return newGQLSchema(query, mutation,
+		query, mutation, noteType, connectionType, pageInfoType,
+		noteInputType, gqlDateTimeType)
+}
+
+// graphQL executes GraphQL requests. Queries can be sent with GET or POST,
+// and mutations only with POST. Requests which can't be executed get a 400.
+func (a *App) graphQL() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := &gqlRequest{}
+		opts := gqlOptions{
+			maxDepth:      a.graphQLMaxDepth,
+			maxComplexity: a.graphQLMaxComplexity,
+		}
+
+		if p := principalFor(c); p != nil && !p.HasScope(ScopeNotesWrite) {
+			opts.readOnly = true
+		}
+
+		if c.Request().Method() == echo.GET {
+			opts.queryOnly = true
+			req.Query = c.QueryParam("query")
+			req.OperationName = c.QueryParam("operationName")
+			if vars := c.QueryParam("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					return fieldProblem("variables", CodeInvalidRequest, "variables must be a JSON object")
+				}
+			}
+		} else if err := c.Bind(req); err != nil {
+			return err
+		}
+
+		if req.Query == "" {
+			return fieldProblem("query", CodeInvalidRequest, "query is required")
+		}
+
+		nr := a.notes(c)
+		rc := &gqlResolveContext{
+			app:       a,
+			notes:     nr,
+			loader:    newNoteLoader(nr),
+			requestID: c.Request().Header().Get(HeaderRequestID),
+		}
+
+		res := executeGraphQL(noteSchema, rc, opts, req)
+
+		status := http.StatusOK
+		if _, ok := res.values["data"]; !ok {
+			status = http.StatusBadRequest
+		}
+
+		return c.JSON(status, res)
+	}
+}
+
+// graphQLSchema serves the schema in the GraphQL schema definition language.
+func (a *App) graphQLSchema() echo.HandlerFunc {
+	sdl := noteSchema.sdl()
+
+	return func(c echo.Context) error {
+		return c.String(http.StatusOK, sdl)
+	}
+}
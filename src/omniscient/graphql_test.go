@@ -0,0 +1,447 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// runGraphQL executes a request against the note schema, and returns the
+// response as JSON.
+func runGraphQL(t *testing.T, mnr *MockNoteRepository, opts gqlOptions, query string, vars map[string]interface{}) string {
+	a := &App{noteRepo: mnr, maxContentLength: defaultMaxContentLength}
+	rc := &gqlResolveContext{app: a, notes: mnr, loader: newNoteLoader(mnr)}
+
+	res := executeGraphQL(noteSchema, rc, opts, &gqlRequest{Query: query, Variables: vars})
+
+	b, err := json.Marshal(res)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		# a comment
+		query Note($id: ID!, $first: Int = 10) {
+			a: note(id: $id) { ...fields }
+			notes(first: $first, after: "10") @include(if: true) {
+				nodes { ... on Note { id } }
+			}
+		}
+
+		fragment fields on Note { id, content }
+	`)
+	assert.NoError(t, err)
+
+	if assert.Len(t, doc.operations, 1) {
+		op := doc.operations[0]
+		assert.Equal(t, "query", op.kind)
+		assert.Equal(t, "Note", op.name)
+		assert.Len(t, op.vars, 2)
+		assert.Equal(t, "ID!", op.vars[0].typ.String())
+		assert.Equal(t, int64(10), op.vars[1].def)
+
+		a := op.selections[0].(*gqlFieldNode)
+		assert.Equal(t, "a", a.key())
+		assert.Equal(t, gqlVariable("id"), a.args[0].value)
+
+		notes := op.selections[1].(*gqlFieldNode)
+		assert.Equal(t, "10", notes.args[1].value)
+		assert.Equal(t, "include", notes.directives[0].name)
+	}
+
+	assert.Contains(t, doc.fragments, "fields")
+
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{src: `{ note(id: "1") `, msg: "syntax error at 1:17: expected a name, found end of document"},
+		{src: `{ note(id: 01) { id } }`, msg: "syntax error at 1:12: invalid number, unexpected digit after 0"},
+		{src: `{ note(id: "1 }`, msg: "syntax error at 1:16: unterminated string"},
+		{src: `{}`, msg: `syntax error at 1:2: unexpected "}"`},
+		{src: `fragment f on Note { id }`, msg: "syntax error at 1:26: document has no operations"},
+	}
+
+	for _, tc := range cases {
+		_, err := parseGraphQL(tc.src)
+		if assert.Error(t, err, tc.src) {
+			assert.Equal(t, tc.msg, err.Error(), tc.src)
+		}
+	}
+}
+
+func TestBlockStringValue(t *testing.T) {
+	assert.Equal(t, "first\n  second", blockStringValue("\n    first\n      second\n  "))
+}
+
+func TestGraphQLNoteBatchesLoads(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("RetrieveMany", []string{"1", "2"}).
+		Return([]*Note{{ID: "1", Content: "one"}, nil}, nil).Once()
+
+	res := runGraphQL(t, mnr, gqlOptions{}, `{
+		a: note(id: "1") { id content }
+		b: note(id: "2") { id }
+		c: note(id: "1") { __typename slug }
+	}`, nil)
+
+	assert.JSONEq(t, `{"data": {
+		"a": {"id": "1", "content": "one"},
+		"b": null,
+		"c": {"__typename": "Note", "slug": null}
+	}}`, res)
+	mnr.AssertExpectations(t)
+}
+
+func TestGraphQLNotes(t *testing.T) {
+	updated := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	notes := []Note{
+		{ID: "1", Content: "one", UpdatedAt: updated},
+		{ID: "2", Content: "two", UpdatedAt: updated},
+	}
+
+	mnr := &MockNoteRepository{}
+	mnr.On("ListPage", int64(2), int64(2)).Return(notes, true, nil)
+
+	res := runGraphQL(t, mnr, gqlOptions{}, `query($after: String) {
+		notes(first: 2, after: $after) {
+			nodes { ...note }
+			pageInfo { hasNextPage endCursor }
+		}
+		again: note(id: "2") { id }
+	}
+
+	fragment note on Note { id updatedAt }`, map[string]interface{}{"after": "2"})
+
+	assert.JSONEq(t, `{"data": {
+		"notes": {
+			"nodes": [
+				{"id": "1", "updatedAt": "2016-07-01T12:00:00Z"},
+				{"id": "2", "updatedAt": "2016-07-01T12:00:00Z"}
+			],
+			"pageInfo": {"hasNextPage": true, "endCursor": "4"}
+		},
+		"again": {"id": "2"}
+	}}`, res)
+
+	// the note listed by notes is not retrieved again.
+	mnr.AssertNotCalled(t, "RetrieveMany", mock.Anything)
+}
+
+func TestGraphQLSearch(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Walk", mock.AnythingOfType("func(*omniscient.Note) error")).
+		Return(func(fn func(*Note) error) error {
+			for _, n := range []*Note{
+				{ID: "1", Content: "Buy milk"},
+				{ID: "2", Content: "call bob"},
+				{ID: "3", Content: "more milk"},
+				{ID: "4", Content: "milk again"},
+			} {
+				if err := fn(n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+	res := runGraphQL(t, mnr, gqlOptions{}, `{
+		search(query: "MILK", first: 1, after: "1") {
+			nodes { id }
+			pageInfo { hasNextPage }
+		}
+	}`, nil)
+
+	assert.JSONEq(t, `{"data": {"search": {
+		"nodes": [{"id": "3"}],
+		"pageInfo": {"hasNextPage": true}
+	}}}`, res)
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Create", "new", mock.AnythingOfType("[]omniscient.NoteOption")).
+		Return(func(content string, opts ...NoteOption) *Note {
+			n := &Note{ID: "1", Content: content}
+			for _, opt := range opts {
+				opt(n)
+			}
+			return n
+		}, nil)
+	mnr.On("Delete", "missing").Return(ErrNoteNotFound)
+
+	res := runGraphQL(t, mnr, gqlOptions{}, `mutation($input: NoteInput!) {
+		created: createNote(input: $input) { id content slug }
+		deleteNote(id: "missing")
+	}`, map[string]interface{}{
+		"input": map[string]interface{}{"content": "new", "slug": "new-note"},
+	})
+
+	assert.JSONEq(t, `{
+		"data": null,
+		"errors": [{
+			"message": "note not found",
+			"locations": [{"line": 3, "column": 3}],
+			"path": ["deleteNote"],
+			"extensions": {"code": "note_not_found"}
+		}]
+	}`, res)
+	mnr.AssertExpectations(t)
+
+	res = runGraphQL(t, mnr, gqlOptions{}, `mutation {
+		createNote(input: {content: "", ttl: -1}) { id }
+	}`, nil)
+
+	var out struct {
+		Data   interface{}
+		Errors []gqlError
+	}
+	assert.NoError(t, json.Unmarshal([]byte(res), &out))
+	assert.Nil(t, out.Data)
+	if assert.Len(t, out.Errors, 1) {
+		assert.Equal(t, string(CodeValidationFailed), out.Errors[0].Extensions["code"])
+		assert.Len(t, out.Errors[0].Extensions["errors"], 2)
+	}
+}
+
+// gqlIntrospectionQuery is the query GraphQL tools describe schemas with.
+const gqlIntrospectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives { name description locations args { ...InputValue } }
+  }
+}
+
+fragment FullType on __Type {
+  kind name description
+  fields(includeDeprecated: true) {
+    name description
+    args { ...InputValue }
+    type { ...TypeRef }
+    isDeprecated deprecationReason
+  }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) { name description isDeprecated deprecationReason }
+  possibleTypes { ...TypeRef }
+}
+
+fragment InputValue on __InputValue {
+  name description type { ...TypeRef } defaultValue
+}
+
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name
+    ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } } }
+}
+`
+
+func TestGraphQLIntrospection(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	opts := gqlOptions{maxDepth: defaultGraphQLMaxDepth, maxComplexity: defaultGraphQLMaxComplexity}
+
+	var out struct {
+		Data struct {
+			Schema struct {
+				QueryType    struct{ Name string }
+				MutationType struct{ Name string }
+				Types        []struct {
+					Kind   string
+					Name   string
+					Fields []struct {
+						Name string
+						Args []struct {
+							Name         string
+							DefaultValue *string
+						}
+						Type struct {
+							Kind   string
+							OfType struct{ Name string }
+						}
+					}
+					EnumValues []struct{ Name string }
+				}
+				Directives []struct{ Name string }
+			} `json:"__schema"`
+		}
+		Errors []interface{}
+	}
+	res := runGraphQL(t, mnr, opts, gqlIntrospectionQuery, nil)
+	assert.NoError(t, json.Unmarshal([]byte(res), &out))
+	assert.Empty(t, out.Errors)
+
+	schema := out.Data.Schema
+	assert.Equal(t, "Query", schema.QueryType.Name)
+	assert.Equal(t, "Mutation", schema.MutationType.Name)
+	if assert.Len(t, schema.Directives, 2) {
+		assert.Equal(t, "skip", schema.Directives[0].Name)
+	}
+
+	kinds := map[string]string{}
+	for _, typ := range schema.Types {
+		kinds[typ.Name] = typ.Kind
+
+		switch typ.Name {
+		case "Query":
+			if assert.Len(t, typ.Fields, 3) {
+				notes := typ.Fields[1]
+				assert.Equal(t, "notes", notes.Name)
+				assert.Equal(t, "NON_NULL", notes.Type.Kind)
+				assert.Equal(t, "NoteConnection", notes.Type.OfType.Name)
+				if assert.Len(t, notes.Args, 2) && assert.NotNil(t, notes.Args[0].DefaultValue) {
+					assert.Equal(t, "100", *notes.Args[0].DefaultValue)
+				}
+			}
+		case "__TypeKind":
+			assert.Len(t, typ.EnumValues, 8)
+		}
+	}
+	assert.Equal(t, "OBJECT", kinds["Note"])
+	assert.Equal(t, "INPUT_OBJECT", kinds["NoteInput"])
+	assert.Equal(t, "SCALAR", kinds["DateTime"])
+	assert.Equal(t, "SCALAR", kinds["String"])
+	assert.Equal(t, "OBJECT", kinds["__Schema"])
+	assert.Equal(t, "ENUM", kinds["__TypeKind"])
+
+	res = runGraphQL(t, mnr, opts, `{ __type(name: "Note") { name fields { name } } missing: __type(name: "Title") { name } }`, nil)
+	assert.JSONEq(t, `{"data": {"__type": {"name": "Note", "fields": [
+		{"name": "id"}, {"name": "content"}, {"name": "slug"}, {"name": "owner"},
+		{"name": "createdAt"}, {"name": "updatedAt"}, {"name": "expiresAt"}
+	]}, "missing": null}}`, res)
+
+	// introspection is only part of the query type.
+	res = runGraphQL(t, mnr, opts, `mutation { __schema { queryType { name } } }`, nil)
+	assert.Contains(t, res, `cannot query field \"__schema\" on type Mutation`)
+
+	mnr.AssertExpectations(t)
+}
+
+func TestGraphQLRequestErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  gqlOptions
+		query string
+		vars  map[string]interface{}
+		msg   string
+	}{
+		{
+			name:  "unknown field",
+			query: `{ note(id: "1") { title } }`,
+			msg:   `cannot query field "title" on type Note`,
+		},
+		{
+			name:  "missing selection",
+			query: `{ note(id: "1") }`,
+			msg:   `field "note" of type Note must have a selection of subfields`,
+		},
+		{
+			name:  "unknown argument",
+			query: `{ note(name: "1") { id } }`,
+			msg:   `unknown argument "name" of Query.note`,
+		},
+		{
+			name:  "wrong argument type",
+			query: `{ notes(first: "ten") { nodes { id } } }`,
+			msg:   `"first": expected a value of type Int, found "ten"`,
+		},
+		{
+			name:  "missing variable",
+			query: `query($id: ID!) { note(id: $id) { id } }`,
+			msg:   `variable $id of type ID! is required`,
+		},
+		{
+			name:  "fragment cycle",
+			query: `{ note(id: "1") { ...a } } fragment a on Note { ...a }`,
+			msg:   `fragment "a" spreads itself`,
+		},
+		{
+			name:  "too deep",
+			opts:  gqlOptions{maxDepth: 2},
+			query: `{ notes { pageInfo { hasNextPage } } }`,
+			msg:   `query has depth 3, which is more than the limit of 2`,
+		},
+		{
+			name:  "too complex",
+			opts:  gqlOptions{maxComplexity: 100},
+			query: `{ notes(first: 50) { nodes { id content } } }`,
+			msg:   `query has complexity 151, which is more than the limit of 100`,
+		},
+		{
+			name:  "introspection too complex",
+			query: `{ __schema { types { fields { type { fields { type { fields { type { fields { name } } } } } } } } } }`,
+			msg:   `introspection has complexity 155802, which is more than the limit of 100000`,
+		},
+		{
+			name:  "mutation with GET",
+			opts:  gqlOptions{queryOnly: true},
+			query: `mutation { deleteNote(id: "1") }`,
+			msg:   `mutations must be sent with POST`,
+		},
+	}
+
+	for _, tc := range cases {
+		mnr := &MockNoteRepository{}
+		res := runGraphQL(t, mnr, tc.opts, tc.query, tc.vars)
+
+		var out map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(res), &out))
+		assert.NotContains(t, out, "data", tc.name)
+
+		errs, _ := out["errors"].([]interface{})
+		if assert.Len(t, errs, 1, tc.name) {
+			assert.Equal(t, tc.msg, errs[0].(map[string]interface{})["message"], tc.name)
+		}
+
+		mnr.AssertExpectations(t)
+	}
+}
+
+func TestAppGraphQL(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("RetrieveMany", []string{"1"}).Return([]*Note{{ID: "1", Content: "one"}}, nil)
+
+		u.Path = "/graphql"
+
+		body := bytes.NewBufferString(`{"query": "query($id: ID) { note(id: $id) { content } }", "variables": {"id": "1"}}`)
+		res, err := http.Post(u.String(), "application/json", body)
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.JSONEq(t, `{"data": {"note": {"content": "one"}}}`, string(b))
+
+		q := url.Values{}
+		q.Set("query", `mutation { deleteNote(id: "1") }`)
+		u.RawQuery = q.Encode()
+		res, err = http.Get(u.String())
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+		u.RawQuery = ""
+		p := doProblemRequest(t, "POST", u.String(), `{"query": ""}`)
+		assert.Equal(t, CodeInvalidRequest, p.Code)
+
+		u.Path = "/graphql/schema"
+		res, err = http.Get(u.String())
+		assert.NoError(t, err)
+		b, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), "notes(first: Int = 100, after: String): NoteConnection!")
+	})
+}
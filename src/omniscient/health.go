@@ -64,12 +64,14 @@ func (h *Health) Start() error {
 		return errors.New("health check has already been started")
 	}
 
+	// the quit channel is made before returning, so Stop can be called as
+	// soon as Start returns.
+	h.mu.Lock()
+	h.checkQuit = make(chan struct{})
+	h.mu.Unlock()
+
 	go func() {
 		ticker := time.NewTicker(h.checkInterval)
-
-		h.mu.Lock()
-		h.checkQuit = make(chan struct{})
-		h.mu.Unlock()
 		h.stateChange <- struct{}{}
 
 		for {
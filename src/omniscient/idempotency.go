@@ -0,0 +1,246 @@
+package omniscient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+const (
+	// HeaderIdempotencyKey is the header a client uses to make a request idempotent.
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed is set on responses replayed for a repeated request.
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	defaultIdempotencyWindow = 24 * time.Hour
+
+	// idempotencyLease is how long a request in progress holds its key. If
+	// the server dies before the request finishes, the key can be retried
+	// after that, rather than being stuck in progress for the whole window.
+	idempotencyLease = time.Minute
+
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotentResponse is the stored response for an idempotency key. A zero
+// status means the first request is still in progress.
+type idempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+type idempotency struct {
+	redisClient RedisClient
+	base        string
+	window      time.Duration
+}
+
+// IdempotencyOption is an option for configuring the Idempotency middleware.
+type IdempotencyOption func(*idempotency) error
+
+// IdempotencyWindow sets how long responses are kept for replaying.
+func IdempotencyWindow(d time.Duration) IdempotencyOption {
+	return func(i *idempotency) error {
+		if d <= 0 {
+			return errors.New("idempotency window must be positive")
+		}
+
+		i.window = d
+		return nil
+	}
+}
+
+// IdempotencyBase sets the base string for the keys responses are stored under.
+func IdempotencyBase(base string) IdempotencyOption {
+	return func(i *idempotency) error {
+		i.base = base
+		return nil
+	}
+}
+
+// Idempotency makes requests carrying an Idempotency-Key header safe to
+// retry. The first response for a key is stored in Redis and replayed for
+// later requests with the same key. Reusing a key for a different request
+// is rejected, as is a retry while the first request is still in progress.
+// Server errors are not stored, so those requests can be retried. Keys are
+// scoped to the tenant and principal making the request, so nobody can
+// replay anyone else's responses.
+func Idempotency(rc RedisClient, opts ...IdempotencyOption) (echo.MiddlewareFunc, error) {
+	i := &idempotency{
+		redisClient: rc,
+		base:        "idempotency",
+		window:      defaultIdempotencyWindow,
+	}
+
+	for _, opt := range opts {
+		if err := opt(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return i.middleware, nil
+}
+
+func (i *idempotency) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header().Get(HeaderIdempotencyKey)
+		if key == "" {
+			return next(c)
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			return fieldProblem(HeaderIdempotencyKey, CodeInvalidRequest, "idempotency key is too long")
+		}
+
+		body, err := ioutil.ReadAll(c.Request().Body())
+		if err != nil {
+			return err
+		}
+		c.Request().SetBody(bytes.NewReader(body))
+
+		fingerprint := i.fingerprint(c, body)
+		storeKey := i.storeKey(c, key)
+
+		stored, err := i.reserve(storeKey, fingerprint)
+		if err != nil {
+			return err
+		}
+
+		if stored != nil {
+			return i.replay(c, fingerprint, stored)
+		}
+
+		var buf bytes.Buffer
+		res := c.Response()
+		w := res.Writer()
+		res.SetWriter(io.MultiWriter(w, &buf))
+		if err := next(c); err != nil {
+			// render the error now so it's stored like any other response.
+			c.Error(err)
+		}
+		res.SetWriter(w)
+
+		if res.Status() >= http.StatusInternalServerError {
+			// let the request be retried.
+			if _, err := i.redisClient.Delete(storeKey); err != nil {
+				log.WithError(err).Warning("unable to release idempotency key")
+			}
+			return nil
+		}
+
+		ir := idempotentResponse{
+			Fingerprint: fingerprint,
+			Status:      res.Status(),
+			ContentType: res.Header().Get(echo.HeaderContentType),
+			Body:        buf.Bytes(),
+		}
+
+		if err := i.store(storeKey, &ir); err != nil {
+			log.WithError(err).Warning("unable to store idempotent response")
+		}
+
+		return nil
+	}
+}
+
+// storeKey returns the Redis key the response for key is stored under.
+func (i *idempotency) storeKey(c echo.Context, key string) string {
+	parts := []string{i.base}
+	if t := tenantFor(c); t != nil {
+		parts = append(parts, tenantsKey, t.ID)
+	}
+
+	// principal ids are escaped, so one can't end in another's key.
+	if p := principalFor(c); p != nil {
+		parts = append(parts, "principals", url.QueryEscape(p.ID))
+	}
+
+	return strings.Join(append(parts, key), ":")
+}
+
+func (i *idempotency) fingerprint(c echo.Context, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(c.Request().Method()))
+	h.Write([]byte{0})
+	h.Write([]byte(c.Request().URL().Path()))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reserve claims key for a new request, for as long as its lease. If key
+// has already been claimed, the stored response is returned instead.
+func (i *idempotency) reserve(key, fingerprint string) (*idempotentResponse, error) {
+	b, err := json.Marshal(&idempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	lease := idempotencyLease
+	if i.window < lease {
+		lease = i.window
+	}
+
+	ok, err := i.redisClient.SetNX(key, string(b), lease)
+	if err != nil || ok {
+		return nil, err
+	}
+
+	s, err := i.redisClient.Get(key)
+	if err == ErrKeyNotFound {
+		// the first request failed and released the key in the meantime.
+		return i.reserve(key, fingerprint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ir idempotentResponse
+	if err := json.Unmarshal([]byte(s), &ir); err != nil {
+		return nil, err
+	}
+
+	return &ir, nil
+}
+
+func (i *idempotency) store(key string, ir *idempotentResponse) error {
+	b, err := json.Marshal(ir)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.redisClient.Set(key, string(b), i.window)
+	return err
+}
+
+func (i *idempotency) replay(c echo.Context, fingerprint string, ir *idempotentResponse) error {
+	if ir.Fingerprint != fingerprint {
+		return NewProblem(CodeIdempotencyKeyReused, "idempotency key has already been used for a different request")
+	}
+
+	if ir.Status == 0 {
+		return NewProblem(CodeIdempotencyKeyInProgress, "a request with this idempotency key is in progress")
+	}
+
+	res := c.Response()
+	res.Header().Set(HeaderIdempotentReplayed, "true")
+	if ir.ContentType != "" {
+		res.Header().Set(echo.HeaderContentType, ir.ContentType)
+	}
+	res.WriteHeader(ir.Status)
+	_, err := res.Write(ir.Body)
+	return err
+}
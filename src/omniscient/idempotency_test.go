@@ -0,0 +1,209 @@
+package omniscient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/engine"
+	"github.com/labstack/echo/engine/standard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// withIdempotentServer serves a handler wrapped by the Idempotency
+// middleware, using a map as the Redis store.
+func withIdempotentServer(t *testing.T, h echo.HandlerFunc, fn func(url string, store map[string]string, mrc *MockRedisClient)) {
+	var mu sync.Mutex
+	store := map[string]string{}
+
+	mrc := &MockRedisClient{}
+	// requests in progress only hold their key for the lease, and responses
+	// are kept for the whole window.
+	mrc.On("SetNX", mock.AnythingOfType("string"), mock.AnythingOfType("string"), idempotencyLease).
+		Return(func(key string, value interface{}, d time.Duration) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := store[key]; ok {
+				return false
+			}
+			store[key] = value.(string)
+			return true
+		}, nil)
+	mrc.On("Get", mock.AnythingOfType("string")).
+		Return(func(key string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			return store[key]
+		}, nil)
+	mrc.On("Set", mock.AnythingOfType("string"), mock.AnythingOfType("string"), time.Hour).
+		Return(func(key string, value interface{}, d time.Duration) string {
+			mu.Lock()
+			defer mu.Unlock()
+			store[key] = value.(string)
+			return "OK"
+		}, nil)
+	mrc.On("Delete", mock.AnythingOfType("[]string")).
+		Return(func(keys ...string) int64 {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, key := range keys {
+				delete(store, key)
+			}
+			return int64(len(keys))
+		}, nil)
+
+	idempotent, err := Idempotency(mrc, IdempotencyWindow(time.Hour))
+	assert.NoError(t, err)
+
+	e := echo.New()
+	e.SetHTTPErrorHandler(handleError)
+	// the principal is taken from a header, instead of authenticating.
+	principal := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if id := c.Request().Header().Get("X-Principal"); id != "" {
+				c.Set(principalContextKey, &Principal{ID: id})
+			}
+			return next(c)
+		}
+	}
+	e.Post("/notes", h, principal, idempotent)
+
+	std := standard.WithConfig(engine.Config{})
+	std.SetHandler(e)
+
+	ts := httptest.NewServer(std)
+	defer ts.Close()
+
+	fn(ts.URL+"/notes", store, mrc)
+}
+
+func postIdempotent(t *testing.T, url, key, body string) (*http.Response, string) {
+	return postIdempotentAs(t, url, "", key, body)
+}
+
+func postIdempotentAs(t *testing.T, url, principal, key, body string) (*http.Response, string) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set(HeaderIdempotencyKey, key)
+	if principal != "" {
+		req.Header.Set("X-Principal", principal)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+
+	return res, string(b)
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	calls := 0
+	h := func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusCreated, "created")
+	}
+
+	withIdempotentServer(t, h, func(url string, store map[string]string, mrc *MockRedisClient) {
+		res, body := postIdempotent(t, url, "abc", "note")
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, "created", body)
+		assert.Empty(t, res.Header.Get(HeaderIdempotentReplayed))
+
+		res, body = postIdempotent(t, url, "abc", "note")
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, "created", body)
+		assert.Equal(t, "true", res.Header.Get(HeaderIdempotentReplayed))
+
+		assert.Equal(t, 1, calls)
+
+		res, _ = postIdempotent(t, url, "abc", "different note")
+		assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+		res, _ = postIdempotent(t, url, "def", "different note")
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, 2, calls)
+	})
+}
+
+func TestIdempotencyPerPrincipal(t *testing.T) {
+	calls := 0
+	h := func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusCreated, "created")
+	}
+
+	withIdempotentServer(t, h, func(url string, store map[string]string, mrc *MockRedisClient) {
+		postIdempotentAs(t, url, "alice", "abc", "note")
+
+		res, _ := postIdempotentAs(t, url, "bob", "abc", "note")
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Empty(t, res.Header.Get(HeaderIdempotentReplayed))
+
+		// ids can't be made to run into each other's keys.
+		postIdempotentAs(t, url, "alice:principals:x", "abc", "note")
+
+		assert.Equal(t, 3, calls)
+		assert.Contains(t, store, "idempotency:principals:alice:abc")
+		assert.Contains(t, store, "idempotency:principals:alice%3Aprincipals%3Ax:abc")
+	})
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	h := func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	}
+
+	withIdempotentServer(t, h, func(url string, store map[string]string, mrc *MockRedisClient) {
+		res, _ := postIdempotent(t, url, "abc", "note")
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+		// pretend the first request has not finished yet.
+		for key, value := range store {
+			store[key] = value[:strings.Index(value, `,"status"`)] + "}"
+		}
+
+		res, _ = postIdempotent(t, url, "abc", "note")
+		assert.Equal(t, http.StatusConflict, res.StatusCode)
+	})
+}
+
+func TestIdempotencyServerErrorReleasesKey(t *testing.T) {
+	calls := 0
+	h := func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusInternalServerError, "failed")
+	}
+
+	withIdempotentServer(t, h, func(url string, store map[string]string, mrc *MockRedisClient) {
+		postIdempotent(t, url, "abc", "note")
+		postIdempotent(t, url, "abc", "note")
+
+		assert.Equal(t, 2, calls)
+		assert.Empty(t, store)
+	})
+}
+
+func TestIdempotencyWithoutKey(t *testing.T) {
+	calls := 0
+	h := func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusCreated, "created")
+	}
+
+	withIdempotentServer(t, h, func(url string, store map[string]string, mrc *MockRedisClient) {
+		postIdempotent(t, url, "", "note")
+		postIdempotent(t, url, "", "note")
+
+		assert.Equal(t, 2, calls)
+		mrc.AssertNotCalled(t, "SetNX", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
@@ -0,0 +1,118 @@
+package omniscient
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"regexp"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// IDStrategyUUID generates random UUIDv4 ids.
+	IDStrategyUUID = "uuid"
+	// IDStrategyULID generates ULIDs, which sort by creation time.
+	IDStrategyULID = "ulid"
+	// IDStrategyBase62 generates short random base62 ids.
+	IDStrategyBase62 = "base62"
+
+	crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	base62Alphabet    = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// base62IDBytes is the number of random bytes in a base62 id.
+	base62IDBytes = 12
+)
+
+var (
+	idStrategies = map[string]idGenFn{
+		IDStrategyUUID:   newUUID,
+		IDStrategyULID:   newULID,
+		IDStrategyBase62: newBase62ID,
+	}
+
+	validNoteID   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,127}$`)
+	validNoteSlug = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+	// reservedNoteIDs can't be used as ids because they name other keys
+	// under the note base.
+	reservedNoteIDs = map[string]bool{
+		catalogKey:     true,
+		expiryKey:      true,
+		slugsKey:       true,
+		changesKey:     true,
+		changeSeqKey:   true,
+		tombstonesKey:  true,
+		changeFloorKey: true,
+	}
+)
+
+func newUUID() string {
+	return uuid.NewV4().String()
+}
+
+// newULID generates a ULID: a 48 bit millisecond timestamp followed by 80
+// random bits, encoded as 26 characters of Crockford's base32.
+func newULID() string {
+	var b [16]byte
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(fmt.Sprintf("unable to read random bytes: %v", err))
+	}
+
+	n := new(big.Int).SetBytes(b[:])
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordAlphabet[n.Uint64()&0x1f]
+		n.Rsh(n, 5)
+	}
+
+	return string(out)
+}
+
+func newBase62ID() string {
+	b := make([]byte, base62IDBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("unable to read random bytes: %v", err))
+	}
+
+	n := new(big.Int).SetBytes(b)
+	base := big.NewInt(int64(len(base62Alphabet)))
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		out = append(out, base62Alphabet[mod.Int64()])
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return string(out)
+}
+
+// ValidateNoteID checks that a client chosen id can be used for a note.
+func ValidateNoteID(id string) error {
+	if !validNoteID.MatchString(id) || reservedNoteIDs[id] {
+		return ErrInvalidNoteID
+	}
+
+	return nil
+}
+
+// ValidateNoteSlug checks that a slug can be used as an alias for a note.
+func ValidateNoteSlug(slug string) error {
+	if len(slug) > 100 || !validNoteSlug.MatchString(slug) {
+		return ErrInvalidNoteSlug
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package omniscient
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewULID(t *testing.T) {
+	first := newULID()
+	time.Sleep(2 * time.Millisecond)
+	second := newULID()
+
+	assert.Regexp(t, regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`), first)
+	assert.True(t, first < second, "ulids sort by creation time")
+}
+
+func TestNewBase62ID(t *testing.T) {
+	id := newBase62ID()
+
+	assert.Regexp(t, regexp.MustCompile(`^[0-9A-Za-z]{1,17}$`), id)
+	assert.NotEqual(t, id, newBase62ID())
+}
+
+func TestNoteIDStrategy(t *testing.T) {
+	_, err := NewRedisNoteRepository(NoteIDStrategy(IDStrategyULID))
+	assert.NoError(t, err)
+
+	_, err = NewRedisNoteRepository(NoteIDStrategy("sequential"))
+	assert.Error(t, err)
+}
+
+func TestValidateNoteID(t *testing.T) {
+	for _, id := range []string{"1", "my-note", "01ARZ3NDEKTSV4RRFFQ69G5FAV", "a_b"} {
+		assert.NoError(t, ValidateNoteID(id), id)
+	}
+
+	for _, id := range []string{"", "-note", "a:b", "a/b", catalogKey, slugsKey, changesKey, tombstonesKey} {
+		assert.Equal(t, ErrInvalidNoteID, ValidateNoteID(id), id)
+	}
+}
+
+func TestValidateNoteSlug(t *testing.T) {
+	for _, slug := range []string{"deploy", "deploy-checklist-2"} {
+		assert.NoError(t, ValidateNoteSlug(slug), slug)
+	}
+
+	for _, slug := range []string{"", "Deploy", "deploy--checklist", "-deploy", "deploy checklist"} {
+		assert.Equal(t, ErrInvalidNoteSlug, ValidateNoteSlug(slug), slug)
+	}
+}
@@ -0,0 +1,332 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// errPatchTestFailed is returned when a JSON Patch test operation does
+	// not match the document.
+	errPatchTestFailed = &NoteError{Code: CodePatchTestFailed, Message: "patch test operation failed"}
+)
+
+// patchError is returned when a patch can't be applied to a document.
+type patchError struct {
+	msg string
+}
+
+func (e *patchError) Error() string {
+	return e.msg
+}
+
+func patchErrorf(format string, args ...interface{}) error {
+	return &patchError{msg: fmt.Sprintf(format, args...)}
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to target, returning
+// the patched document. target is not changed.
+func applyMergePatch(target, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	tm := map[string]interface{}{}
+	if m, ok := target.(map[string]interface{}); ok {
+		for k, v := range m {
+			tm[k] = v
+		}
+	}
+
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+			continue
+		}
+
+		tm[k] = applyMergePatch(tm[k], v)
+	}
+
+	return tm
+}
+
+// jsonPatchOp is an operation in a JSON Patch (RFC 6902) document.
+type jsonPatchOp struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies the operations of a JSON Patch (RFC 6902) to doc.
+// If an operation fails, none of the document is changed.
+func applyJSONPatch(doc interface{}, ops []jsonPatchOp) (interface{}, error) {
+	doc = deepCopyJSON(doc)
+
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, patchErrorf("operation %d: path is required", i)
+		}
+
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, patchErrorf("operation %d: value is required", i)
+			}
+
+			if err := json.Unmarshal(*op.Value, &value); err != nil {
+				return nil, patchErrorf("operation %d: %v", i, err)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, patchErrorf("operation %d: from is required", i)
+			}
+		case "remove":
+		default:
+			return nil, patchErrorf("operation %d: unknown op %q", i, op.Op)
+		}
+
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = jsonPointerAdd(doc, *op.Path, value)
+		case "remove":
+			doc, _, err = jsonPointerRemove(doc, *op.Path)
+		case "replace":
+			if doc, _, err = jsonPointerRemove(doc, *op.Path); err == nil {
+				doc, err = jsonPointerAdd(doc, *op.Path, value)
+			}
+		case "move":
+			if strings.HasPrefix(*op.Path, *op.From+"/") {
+				return nil, patchErrorf("operation %d: can't move a value into itself", i)
+			}
+
+			var moved interface{}
+			if doc, moved, err = jsonPointerRemove(doc, *op.From); err == nil {
+				doc, err = jsonPointerAdd(doc, *op.Path, moved)
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = jsonPointerGet(doc, *op.From); err == nil {
+				doc, err = jsonPointerAdd(doc, *op.Path, deepCopyJSON(copied))
+			}
+		case "test":
+			var current interface{}
+			if current, err = jsonPointerGet(doc, *op.Path); err == nil && !reflect.DeepEqual(current, value) {
+				return nil, errPatchTestFailed
+			}
+		}
+
+		if err != nil {
+			return nil, patchErrorf("operation %d: %v", i, err)
+		}
+	}
+
+	return doc, nil
+}
+
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		t = strings.Replace(t, "~1", "/", -1)
+		tokens[i] = strings.Replace(t, "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+func arrayIndex(token string, arr []interface{}, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return len(arr), nil
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	max := len(arr) - 1
+	if allowEnd {
+		max = len(arr)
+	}
+
+	if i > max {
+		return 0, fmt.Errorf("array index %d is out of range", i)
+	}
+
+	return i, nil
+}
+
+func jsonPointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := doc
+	for _, t := range tokens {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("path %q does not exist", pointer)
+			}
+			cur = v
+		case []interface{}:
+			i, err := arrayIndex(t, c, false)
+			if err != nil {
+				return nil, err
+			}
+			cur = c[i]
+		default:
+			return nil, fmt.Errorf("path %q does not exist", pointer)
+		}
+	}
+
+	return cur, nil
+}
+
+// jsonPointerAdd adds value at pointer, returning the new document.
+func jsonPointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, p, true)
+		if err != nil {
+			return nil, err
+		}
+
+		p = append(p, nil)
+		copy(p[i+1:], p[i:])
+		p[i] = value
+		return jsonPointerSet(doc, parentPointer, p)
+	default:
+		return nil, fmt.Errorf("path %q does not exist", pointer)
+	}
+
+	return doc, nil
+}
+
+// jsonPointerSet replaces the existing value at pointer, returning the new
+// document. Arrays change length when values are added or removed, so they
+// are written back to their parent with it.
+func jsonPointerSet(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := jsonPointerGet(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, p, false)
+		if err != nil {
+			return nil, err
+		}
+		p[i] = value
+	}
+
+	return doc, nil
+}
+
+// jsonPointerRemove removes the value at pointer, returning the new document
+// and the removed value.
+func jsonPointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		v, ok := p[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path %q does not exist", pointer)
+		}
+		delete(p, last)
+		return doc, v, nil
+	case []interface{}:
+		i, err := arrayIndex(last, p, false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		v := p[i]
+		p = append(p[:i:i], p[i+1:]...)
+		doc, err = jsonPointerSet(doc, parentPointer, p)
+		return doc, v, err
+	}
+
+	return nil, nil, fmt.Errorf("path %q does not exist", pointer)
+}
+
+func deepCopyJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = deepCopyJSON(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, e := range t {
+			a[i] = deepCopyJSON(e)
+		}
+		return a
+	}
+
+	return v
+}
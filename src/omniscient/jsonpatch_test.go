@@ -0,0 +1,87 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	var v interface{}
+	err := json.Unmarshal([]byte(s), &v)
+	assert.NoError(t, err)
+	return v
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	cases := []struct {
+		target, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":["b"]}`, `{"a":["c","d"]}`, `{"a":["c","d"]}`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+	}
+
+	for _, tc := range cases {
+		target := decodeJSON(t, tc.target)
+		got := applyMergePatch(target, decodeJSON(t, tc.patch))
+		assert.Equal(t, decodeJSON(t, tc.expected), got, tc.patch)
+		assert.Equal(t, decodeJSON(t, tc.target), target, tc.patch)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	cases := []struct {
+		doc, patch, expected string
+	}{
+		{`{"a":"b"}`, `[{"op":"add","path":"/c","value":"d"}]`, `{"a":"b","c":"d"}`},
+		{`{"a":["b","d"]}`, `[{"op":"add","path":"/a/1","value":"c"}]`, `{"a":["b","c","d"]}`},
+		{`{"a":["b"]}`, `[{"op":"add","path":"/a/-","value":"c"}]`, `{"a":["b","c"]}`},
+		{`{"a":"b","c":"d"}`, `[{"op":"remove","path":"/c"}]`, `{"a":"b"}`},
+		{`{"a":[["b","c"]]}`, `[{"op":"remove","path":"/a/0/0"}]`, `{"a":[["c"]]}`},
+		{`{"a":"b"}`, `[{"op":"replace","path":"/a","value":"c"}]`, `{"a":"c"}`},
+		{`{"a":"b"}`, `[{"op":"move","from":"/a","path":"/c"}]`, `{"c":"b"}`},
+		{`{"a":{"b":"c"}}`, `[{"op":"copy","from":"/a","path":"/d"}]`, `{"a":{"b":"c"},"d":{"b":"c"}}`},
+		{`{"a/b":"c","~":"d"}`, `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/~0"}]`, `{}`},
+		{`{"a":"b"}`, `[{"op":"test","path":"/a","value":"b"}]`, `{"a":"b"}`},
+	}
+
+	for _, tc := range cases {
+		var ops []jsonPatchOp
+		err := json.Unmarshal([]byte(tc.patch), &ops)
+		assert.NoError(t, err)
+
+		got, err := applyJSONPatch(decodeJSON(t, tc.doc), ops)
+		assert.NoError(t, err, tc.patch)
+		assert.Equal(t, decodeJSON(t, tc.expected), got, tc.patch)
+	}
+}
+
+func TestApplyJSONPatchErrors(t *testing.T) {
+	cases := []struct {
+		patch    string
+		expected error
+	}{
+		{`[{"op":"test","path":"/a","value":"c"}]`, errPatchTestFailed},
+		{`[{"op":"remove","path":"/missing"}]`, patchErrorf(`operation 0: path "/missing" does not exist`)},
+		{`[{"op":"add","path":"/a/b/c","value":"c"}]`, patchErrorf(`operation 0: path "/a/b" does not exist`)},
+		{`[{"op":"add","path":"/c"}]`, patchErrorf("operation 0: value is required")},
+		{`[{"op":"move","from":"/a","path":"/a/b"}]`, patchErrorf("operation 0: can't move a value into itself")},
+		{`[{"op":"frob","path":"/a"}]`, patchErrorf(`operation 0: unknown op "frob"`)},
+	}
+
+	for _, tc := range cases {
+		var ops []jsonPatchOp
+		err := json.Unmarshal([]byte(tc.patch), &ops)
+		assert.NoError(t, err)
+
+		doc := decodeJSON(t, `{"a":"b"}`)
+		_, err = applyJSONPatch(doc, ops)
+		assert.Equal(t, tc.expected, err, tc.patch)
+		assert.Equal(t, decodeJSON(t, `{"a":"b"}`), doc, tc.patch)
+	}
+}
@@ -0,0 +1,509 @@
+package omniscient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultJWTClockSkew       = time.Minute
+	defaultJWKSReloadInterval = 10 * time.Second
+)
+
+// jwtMethods are the algorithms tokens can be signed with. "none" is never
+// accepted.
+var jwtMethods = []string{
+	"HS256", "HS384", "HS512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+}
+
+// jwtKey is a key tokens are verified with. id and alg are optional, and
+// limit which tokens the key is used for.
+type jwtKey struct {
+	id  string
+	alg string
+	key interface{}
+}
+
+// verifies returns true if the key can verify a token with the key id kid
+// signed with method.
+func (k *jwtKey) verifies(kid string, method jwt.SigningMethod) bool {
+	if kid != "" && k.id != kid {
+		return false
+	}
+
+	if k.alg != "" && k.alg != method.Alg() {
+		return false
+	}
+
+	// the key type has to match the algorithm, so a public key can't be
+	// used as an HMAC secret.
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok := k.key.([]byte)
+		return ok
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := k.key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		_, ok := k.key.(*ecdsa.PublicKey)
+		return ok
+	}
+
+	return false
+}
+
+// jwtAudience is the aud claim, which is either a string or an array.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+
+	*a = ss
+	return nil
+}
+
+// jwtClaims are the claims omniscient reads from a token.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+	IssuedAt  *float64    `json:"iat"`
+	Name      string      `json:"name"`
+	// Scope is a space separated list of scopes, as in OAuth 2.
+	Scope string `json:"scope"`
+	// Scopes is a list of scopes, as some issuers send them.
+	Scopes []string `json:"scp"`
+	// Tenant is the tenant the subject is tied to, if any.
+	Tenant string `json:"tenant"`
+}
+
+// Valid is checked by JWTVerifier rather than jwt-go, which doesn't allow
+// for clock skew.
+func (c *jwtClaims) Valid() error {
+	return nil
+}
+
+// JWTVerifier authenticates requests made with a JSON Web Token as their
+// bearer token. Tokens are verified with static keys, or the keys in a
+// JWKS file which is reloaded when it changes.
+type JWTVerifier struct {
+	parser   *jwt.Parser
+	issuer   string
+	audience string
+	skew     time.Duration
+	static   []jwtKey
+	jwks     *jwksFile
+	now      func() time.Time
+}
+
+// JWTOption is an option for configuring JWTVerifier.
+type JWTOption func(*JWTVerifier) error
+
+// NewJWTVerifier creates an instance of JWTVerifier. At least one key, or
+// a JWKS file, is required.
+func NewJWTVerifier(opts ...JWTOption) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		parser: &jwt.Parser{ValidMethods: jwtMethods},
+		skew:   defaultJWTClockSkew,
+		now:    time.Now,
+	}
+
+	for _, opt := range opts {
+		if err := opt(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(v.static) == 0 && v.jwks == nil {
+		return nil, errors.New("jwt verification needs a key or a jwks file")
+	}
+
+	return v, nil
+}
+
+// JWTIssuer sets the issuer tokens must have.
+func JWTIssuer(iss string) JWTOption {
+	return func(v *JWTVerifier) error {
+		v.issuer = iss
+		return nil
+	}
+}
+
+// JWTAudience sets an audience tokens must be issued for.
+func JWTAudience(aud string) JWTOption {
+	return func(v *JWTVerifier) error {
+		v.audience = aud
+		return nil
+	}
+}
+
+// JWTClockSkew sets how far the issuer's clock can be from ours when
+// checking when a token expires or becomes valid.
+func JWTClockSkew(d time.Duration) JWTOption {
+	return func(v *JWTVerifier) error {
+		if d < 0 {
+			return errors.New("jwt clock skew can not be negative")
+		}
+
+		v.skew = d
+		return nil
+	}
+}
+
+// JWTHMACKey adds a secret for verifying HS256, HS384 and HS512 tokens. If
+// kid is set, it is only used for tokens with that key id.
+func JWTHMACKey(kid string, secret []byte) JWTOption {
+	return func(v *JWTVerifier) error {
+		if len(secret) < 32 {
+			return errors.New("jwt hmac secret must be at least 32 bytes")
+		}
+
+		v.static = append(v.static, jwtKey{id: kid, key: secret})
+		return nil
+	}
+}
+
+// JWTPublicKey adds a PEM encoded RSA or ECDSA public key for verifying
+// RS, PS and ES tokens. If kid is set, it is only used for tokens with that
+// key id.
+func JWTPublicKey(kid string, pem []byte) JWTOption {
+	return func(v *JWTVerifier) error {
+		var key interface{}
+		if rk, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+			key = rk
+		} else if ek, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+			key = ek
+		} else {
+			return errors.New("jwt public key must be a PEM encoded RSA or ECDSA public key")
+		}
+
+		v.static = append(v.static, jwtKey{id: kid, key: key})
+		return nil
+	}
+}
+
+// JWTKeySetFile verifies tokens with the keys in the JWKS file at path. The
+// file is checked for changes at most once every interval, and reloaded
+// when it has changed.
+func JWTKeySetFile(path string, interval time.Duration) JWTOption {
+	return func(v *JWTVerifier) error {
+		if interval <= 0 {
+			interval = defaultJWKSReloadInterval
+		}
+
+		f := &jwksFile{path: path, interval: interval}
+		if err := f.load(time.Now()); err != nil {
+			return err
+		}
+
+		v.jwks = f
+		return nil
+	}
+}
+
+// Verify verifies token and returns the principal it was issued to.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	var candidates []jwtKey
+	next := 0
+
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		if candidates == nil {
+			kid, _ := t.Header["kid"].(string)
+			for _, k := range v.keys() {
+				if k.verifies(kid, t.Method) {
+					candidates = append(candidates, k)
+				}
+			}
+
+			if len(candidates) == 0 {
+				return nil, errors.New("no key for the token")
+			}
+		}
+
+		return candidates[next].key, nil
+	}
+
+	var claims *jwtClaims
+	for {
+		claims = &jwtClaims{}
+		_, err := v.parser.ParseWithClaims(token, claims, keyFunc)
+
+		// without a key id, every key which could have signed the token
+		// is tried.
+		if ve, ok := err.(*jwt.ValidationError); ok &&
+			ve.Errors&jwt.ValidationErrorSignatureInvalid != 0 && next+1 < len(candidates) {
+			next++
+			continue
+		}
+
+		if err != nil {
+			return nil, invalidToken("%v", err)
+		}
+
+		break
+	}
+
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	scopes = append(scopes, claims.Scopes...)
+
+	p := &Principal{ID: claims.Subject, Name: claims.Name, Method: AuthJWT, Tenant: claims.Tenant}
+	if p.Name == "" {
+		p.Name = claims.Subject
+	}
+
+	// scopes omniscient doesn't know are for other services.
+	for _, s := range scopes {
+		if ValidScope(s) {
+			p.Scopes = append(p.Scopes, s)
+		}
+	}
+
+	return p, nil
+}
+
+func (v *JWTVerifier) validate(c *jwtClaims) error {
+	now := float64(v.now().Unix())
+	skew := v.skew.Seconds()
+
+	switch {
+	case c.ExpiresAt == nil:
+		return invalidToken("token has no expiry")
+	case now > *c.ExpiresAt+skew:
+		return invalidToken("token has expired")
+	case c.NotBefore != nil && now+skew < *c.NotBefore:
+		return invalidToken("token is not valid yet")
+	case c.IssuedAt != nil && now+skew < *c.IssuedAt:
+		return invalidToken("token was issued in the future")
+	case v.issuer != "" && c.Issuer != v.issuer:
+		return invalidToken("token issuer is not accepted")
+	case v.audience != "" && !containsString(c.Audience, v.audience):
+		return invalidToken("token audience is not accepted")
+	case c.Subject == "":
+		return invalidToken("token has no subject")
+	}
+
+	return nil
+}
+
+func (v *JWTVerifier) keys() []jwtKey {
+	if v.jwks == nil {
+		return v.static
+	}
+
+	return append(v.jwks.current(v.now()), v.static...)
+}
+
+func invalidToken(format string, args ...interface{}) error {
+	return &NoteError{Code: CodeUnauthorized, Message: "bearer token is not valid: " + fmt.Sprintf(format, args...)}
+}
+
+// jwksFile is a JWKS file, reloaded when it changes.
+type jwksFile struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	keys    []jwtKey
+	modTime time.Time
+	checked time.Time
+}
+
+// current returns the keys, reloading them first if the file has changed.
+// If the file can't be reloaded, the keys it had are kept.
+func (f *jwksFile) current(now time.Time) []jwtKey {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.checked) >= f.interval {
+		if err := f.reload(now); err != nil {
+			log.WithError(err).WithField("path", f.path).Warning("unable to reload jwks file")
+		}
+	}
+
+	return f.keys
+}
+
+func (f *jwksFile) load(now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.reload(now)
+}
+
+// reload reloads the keys if the file changed since they were loaded. f.mu
+// must be held.
+func (f *jwksFile) reload(now time.Time) error {
+	f.checked = now
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	if f.keys != nil && fi.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+
+	f.keys = keys
+	f.modTime = fi.ModTime()
+	return nil
+}
+
+// jwk is a JSON Web Key, as described in RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA keys.
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// symmetric keys.
+	K string `json:"k"`
+}
+
+// parseJWKS parses the signing keys of a JWKS document. Encryption keys
+// and key types which can't sign tokens are skipped.
+func parseJWKS(b []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	keys := []jwtKey{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i, err)
+		}
+
+		if key != nil {
+			keys = append(keys, jwtKey{id: k.Kid, alg: k.Alg, key: key})
+		}
+	}
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %v", err)
+		}
+
+		e, err := decodeJWKInt(k.E)
+		if err != nil || e.BitLen() > 31 {
+			return nil, errors.New("invalid e")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %v", err)
+		}
+
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %v", err)
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		b, err := decodeJWKBytes(k.K)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid k")
+		}
+
+		return b, nil
+	}
+
+	return nil, nil
+}
+
+func decodeJWKBytes(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := decodeJWKBytes(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,258 @@
+package omniscient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+var testJWTSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func signJWT(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestJWTVerifier(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	v, err := NewJWTVerifier(
+		JWTHMACKey("", testJWTSecret),
+		JWTIssuer("https://issuer.example.com"),
+		JWTAudience("omniscient"),
+		JWTClockSkew(30*time.Second))
+	if !assert.NoError(t, err) {
+		return
+	}
+	v.now = func() time.Time { return now }
+
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":   "https://issuer.example.com",
+			"aud":   "omniscient",
+			"sub":   "user-1",
+			"name":  "Ada",
+			"exp":   now.Add(time.Minute).Unix(),
+			"iat":   now.Unix(),
+			"scope": "notes:read other:scope",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		scopes []string
+		err    bool
+	}{
+		{
+			name:   "valid",
+			token:  signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, claims(nil)),
+			scopes: []string{ScopeNotesRead},
+		},
+		{
+			name:   "audience array and scp",
+			token:  signJWT(t, jwt.SigningMethodHS512, "", testJWTSecret, claims(jwt.MapClaims{"aud": []string{"other", "omniscient"}, "scope": nil, "scp": []string{"notes:write"}})),
+			scopes: []string{ScopeNotesWrite},
+		},
+		{
+			name:   "expired within skew",
+			token:  signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, claims(jwt.MapClaims{"exp": now.Add(-20 * time.Second).Unix()})),
+			scopes: []string{ScopeNotesRead},
+		},
+		{
+			name:  "expired",
+			token: signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, claims(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()})),
+			err:   true,
+		},
+		{
+			name:  "no expiry",
+			token: signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, claims(jwt.MapClaims{"exp": nil})),
+			err:   true,
+		},
+		{
+			name:  "not valid yet",
+			token: signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, claims(jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()})),
+			err:   true,
+		},
+		{
+			name:  "wrong issuer",
+			token: signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, claims(jwt.MapClaims{"iss": "https://evil.example.com"})),
+			err:   true,
+		},
+		{
+			name:  "wrong audience",
+			token: signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, claims(jwt.MapClaims{"aud": "other"})),
+			err:   true,
+		},
+		{
+			name:  "wrong secret",
+			token: signJWT(t, jwt.SigningMethodHS256, "", []byte("fedcba9876543210fedcba9876543210"), claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "unsigned",
+			token: signJWT(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims(nil)),
+			err:   true,
+		},
+	}
+
+	for _, tc := range cases {
+		p, err := v.Verify(tc.token)
+		if tc.err {
+			assert.Error(t, err, tc.name)
+			if ne, ok := err.(*NoteError); assert.True(t, ok, tc.name) {
+				assert.Equal(t, CodeUnauthorized, ne.Code, tc.name)
+			}
+			continue
+		}
+
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, "user-1", p.ID, tc.name)
+			assert.Equal(t, "Ada", p.Name, tc.name)
+			assert.Equal(t, AuthJWT, p.Method, tc.name)
+			assert.Equal(t, tc.scopes, p.Scopes, tc.name)
+		}
+	}
+}
+
+func writeJWKS(t *testing.T, path string, modTime time.Time, keys map[string]*ecdsa.PrivateKey) {
+	enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, k := range keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "EC", Kid: kid, Alg: "ES256", Use: "sig", Crv: "P-256",
+			X: enc(k.X.Bytes()), Y: enc(k.Y.Bytes()),
+		})
+	}
+
+	b, err := json.Marshal(&set)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, b, 0600))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestJWTVerifierKeySetFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, start, map[string]*ecdsa.PrivateKey{"old": oldKey})
+
+	v, err := NewJWTVerifier(JWTKeySetFile(path, time.Minute))
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := start
+	v.now = func() time.Time { return now }
+
+	claims := jwt.MapClaims{"sub": "svc", "exp": start.Add(time.Hour).Unix(), "scp": []string{"admin"}}
+	oldToken := signJWT(t, jwt.SigningMethodES256, "old", oldKey, claims)
+	newToken := signJWT(t, jwt.SigningMethodES256, "new", newKey, claims)
+
+	p, err := v.Verify(oldToken)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{ScopeAdmin}, p.Scopes)
+	}
+
+	_, err = v.Verify(newToken)
+	assert.Error(t, err)
+
+	// the old key is rotated out.
+	writeJWKS(t, path, start.Add(time.Second), map[string]*ecdsa.PrivateKey{"new": newKey})
+
+	// the file isn't checked again until the interval passes.
+	_, err = v.Verify(newToken)
+	assert.Error(t, err)
+
+	now = start.Add(2 * time.Minute)
+	_, err = v.Verify(newToken)
+	assert.NoError(t, err)
+	_, err = v.Verify(oldToken)
+	assert.Error(t, err)
+
+	// a broken file keeps the keys it had.
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	assert.NoError(t, os.Chtimes(path, start.Add(2*time.Second), start.Add(2*time.Second)))
+	now = start.Add(4 * time.Minute)
+	_, err = v.Verify(newToken)
+	assert.NoError(t, err)
+}
+
+func TestAppRequiresJWT(t *testing.T) {
+	v, err := NewJWTVerifier(JWTHMACKey("", testJWTSecret))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	token := signJWT(t, jwt.SigningMethodHS256, "", testJWTSecret, jwt.MapClaims{
+		"sub":   "user-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": ScopeNotesRead,
+	})
+
+	withAppOptions(t, nil, []AppOption{AppJWTVerifier(v)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(&Note{ID: "1", Owner: "user-1"}, nil)
+		u.Path = "/v1/notes/1"
+
+		do := func(method, token string) *http.Response {
+			req, err := http.NewRequest(method, u.String(), nil)
+			assert.NoError(t, err)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			return res
+		}
+
+		res := do("GET", "")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		res = do("GET", token+"x")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		res = do("GET", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		res = do("DELETE", token)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	})
+}
@@ -0,0 +1,304 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	keyRotationKey     = "keyrotation"
+	keyRotationLockKey = "keyrotation:lock"
+
+	defaultKeyRotationInterval = 10 * time.Second
+
+	// keyRotationLockTTL is how long a server works on a rotation without
+	// making progress before another one can take over.
+	keyRotationLockTTL = time.Minute
+)
+
+// keyRotationProgress is how far a rotation has got. It is kept in Redis
+// after every page of notes.
+type keyRotationProgress struct {
+	// Tenant is the tenant whose notes are being rotated, or empty for the
+	// notes outside tenants, which are rotated first.
+	Tenant string `json:"tenant,omitempty"`
+	// Start is where the next page of the catalog starts.
+	Start int64 `json:"start"`
+	// Pass counts the passes over every note. Notes created or deleted
+	// during a pass can make it miss others, so passes are made until one
+	// doesn't re-encrypt any note.
+	Pass    int   `json:"pass"`
+	Rotated int64 `json:"rotated"`
+	Total   int64 `json:"total"`
+}
+
+// RequestKeyRotation requests every note, in every tenant, to be
+// re-encrypted with the active note key. The notes are re-encrypted in the
+// background by a server running a KeyRotation. A rotation which is already
+// under way starts again.
+func RequestKeyRotation(rc RedisClient) error {
+	b, err := json.Marshal(&keyRotationProgress{Pass: 1})
+	if err != nil {
+		return err
+	}
+
+	_, err = rc.Set(keyRotationKey, string(b), 0)
+	return err
+}
+
+// KeyRotation re-encrypts notes which aren't encrypted with the active note
+// key in the background, once a rotation has been requested with
+// RequestKeyRotation. Its progress is kept in Redis, so if the server stops,
+// the rotation carries on where it left off once a server is running again.
+// Only one server works on a rotation at a time.
+type KeyRotation struct {
+	redisClient RedisClient
+	nr          *RedisNoteRepository
+	tenants     *Tenants
+	interval    time.Duration
+
+	mu   sync.Mutex
+	quit chan struct{}
+}
+
+// KeyRotationOption is a KeyRotation configuration option.
+type KeyRotationOption func(*KeyRotation) error
+
+// NewKeyRotation builds an instance of KeyRotation for the notes of nr,
+// which must have note encryption enabled.
+func NewKeyRotation(rc RedisClient, nr *RedisNoteRepository, opts ...KeyRotationOption) (*KeyRotation, error) {
+	if nr.keys == nil {
+		return nil, errors.New("note encryption is not enabled")
+	}
+
+	kr := &KeyRotation{
+		redisClient: rc,
+		nr:          nr,
+		interval:    defaultKeyRotationInterval,
+	}
+
+	for _, opt := range opts {
+		if err := opt(kr); err != nil {
+			return nil, err
+		}
+	}
+
+	return kr, nil
+}
+
+// KeyRotationTenants rotates the keys of the notes of every tenant too.
+func KeyRotationTenants(ts *Tenants) KeyRotationOption {
+	return func(kr *KeyRotation) error {
+		kr.tenants = ts
+		return nil
+	}
+}
+
+// KeyRotationInterval sets how often a requested rotation is checked for.
+func KeyRotationInterval(d time.Duration) KeyRotationOption {
+	return func(kr *KeyRotation) error {
+		if d <= 0 {
+			return errors.New("key rotation interval must be positive")
+		}
+
+		kr.interval = d
+		return nil
+	}
+}
+
+// Start starts checking for requested rotations.
+func (kr *KeyRotation) Start() error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if kr.quit != nil {
+		return errors.New("key rotation has already been started")
+	}
+
+	quit := make(chan struct{})
+	kr.quit = quit
+
+	go func() {
+		ticker := time.NewTicker(kr.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := kr.rotate(quit); err != nil {
+					log.WithError(err).Warning("unable to rotate note keys")
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops checking for requested rotations. A rotation under way stops
+// after the page of notes it is on.
+func (kr *KeyRotation) Stop() error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if kr.quit == nil {
+		return errors.New("key rotation has not previously been started")
+	}
+
+	close(kr.quit)
+	kr.quit = nil
+	return nil
+}
+
+// rotate works on the requested rotation, if there is one and no other
+// server is working on it, until it is done or quit is closed.
+func (kr *KeyRotation) rotate(quit <-chan struct{}) error {
+	locked, err := kr.redisClient.SetNX(keyRotationLockKey, "1", keyRotationLockTTL)
+	if err != nil || !locked {
+		return err
+	}
+	defer kr.redisClient.Delete(keyRotationLockKey)
+
+	for {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+
+		p, err := kr.progress()
+		if err != nil || p == nil {
+			return err
+		}
+
+		done, err := kr.step(p)
+		if err != nil || done {
+			return err
+		}
+
+		if _, err := kr.redisClient.Set(keyRotationLockKey, "1", keyRotationLockTTL); err != nil {
+			return err
+		}
+	}
+}
+
+// progress returns the progress of the requested rotation, or nil if none
+// is requested.
+func (kr *KeyRotation) progress() (*keyRotationProgress, error) {
+	s, err := kr.redisClient.Get(keyRotationKey)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p keyRotationProgress
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// step rotates the keys of the next page of notes, and keeps the progress.
+// It returns true once the rotation is done.
+func (kr *KeyRotation) step(p *keyRotationProgress) (bool, error) {
+	nr, err := kr.repository(p.Tenant)
+	if err != nil && err != ErrTenantNotFound {
+		return false, err
+	}
+
+	// the notes of a tenant which has been deleted are skipped.
+	next := int64(-1)
+	if nr != nil {
+		var n int
+		n, next, err = nr.rotateKeysPage(p.Start)
+		p.Rotated += int64(n)
+		p.Total += int64(n)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	fields := log.Fields{"tenant": p.Tenant, "pass": p.Pass, "rotated": p.Total}
+	switch {
+	case next >= 0:
+		p.Start = next
+		log.WithFields(fields).WithField("start", next).Info("rotating note keys")
+	default:
+		tenant, err := kr.nextTenant(p.Tenant)
+		if err != nil {
+			return false, err
+		}
+
+		if tenant != "" {
+			p.Tenant, p.Start = tenant, 0
+			break
+		}
+
+		if p.Rotated == 0 {
+			log.WithFields(fields).Info("rotated note keys")
+			_, err := kr.redisClient.Delete(keyRotationKey)
+			return true, err
+		}
+
+		p.Tenant, p.Start, p.Rotated = "", 0, 0
+		p.Pass++
+		log.WithFields(fields).Info("rotating note keys again, for notes the last pass missed")
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = kr.redisClient.Set(keyRotationKey, string(b), 0)
+	return false, err
+}
+
+// repository returns the notes of the tenant with id, or the notes outside
+// tenants if id is empty.
+func (kr *KeyRotation) repository(id string) (*RedisNoteRepository, error) {
+	if id == "" {
+		return kr.nr, nil
+	}
+
+	if kr.tenants == nil {
+		return nil, ErrTenantNotFound
+	}
+
+	t, err := kr.tenants.Retrieve(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr.nr.ForTenant(t).(*RedisNoteRepository), nil
+}
+
+// nextTenant returns the id of the tenant after the one with id, in the
+// order of their ids, or an empty string if it was the last one.
+func (kr *KeyRotation) nextTenant(id string) (string, error) {
+	if kr.tenants == nil {
+		return "", nil
+	}
+
+	ts, err := kr.tenants.List()
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range ts {
+		if t.ID > id {
+			return t.ID, nil
+		}
+	}
+
+	return "", nil
+}
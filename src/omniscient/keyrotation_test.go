@@ -0,0 +1,88 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestKeyRotationResumes(t *testing.T) {
+	withNoteKeys(t, "a", []string{"a"}, func(nk *NoteKeys, path string) {
+		// a rotation stopped after the first page of the first pass.
+		b, err := json.Marshal(&keyRotationProgress{Start: walkPageSize, Pass: 1, Rotated: 1, Total: 1})
+		assert.NoError(t, err)
+		progress := string(b)
+
+		mrc := &MockRedisClient{}
+		mrc.On("SetNX", keyRotationLockKey, "1", keyRotationLockTTL).Return(true, nil).Once()
+		mrc.On("Set", keyRotationLockKey, "1", keyRotationLockTTL).Return("OK", nil)
+		mrc.On("Delete", []string{keyRotationLockKey}).Return(int64(1), nil)
+		mrc.On("Get", keyRotationKey).Return(func(string) string { return progress }, nil)
+		mrc.On("Set", keyRotationKey, mock.AnythingOfType("string"), mock.Anything).
+			Run(func(args mock.Arguments) {
+				progress = args.String(1)
+			}).Return("OK", nil)
+		mrc.On("Delete", []string{keyRotationKey}).Return(int64(1), nil).Once()
+
+		// the rotation carries on from the second page, then a second pass
+		// finds nothing left to re-encrypt.
+		note := map[string]string{fieldNoteID: "3", fieldNoteContent: "plain"}
+		mrc.On("LRange", "notes:catalog", int64(walkPageSize), int64(2*walkPageSize-1)).Return([]string{"3"}, nil).Once()
+		mrc.On("LRange", "notes:catalog", int64(0), int64(walkPageSize-1)).Return([]string{"3"}, nil).Once()
+		expectWatch(mrc, "notes:3")
+		mrc.On("HGetAllMap", "notes:3").Return(func(string) map[string]string { return note }, nil)
+		mrc.On("HMSet", "notes:3", fieldNoteContent, mock.AnythingOfType("string"), mock.AnythingOfType("[]string")).
+			Run(func(args mock.Arguments) {
+				pairs := args.Get(3).([]string)
+				note = map[string]string{fieldNoteID: "3", fieldNoteContent: args.String(2)}
+				for i := 0; i+1 < len(pairs); i += 2 {
+					note[pairs[i]] = pairs[i+1]
+				}
+			}).Return("", nil).Once()
+
+		rnr, err := NewRedisNoteRepository(RedisClientOption(mrc), NoteEncryption(nk))
+		assert.NoError(t, err)
+
+		kr, err := NewKeyRotation(mrc, rnr)
+		assert.NoError(t, err)
+
+		assert.NoError(t, kr.rotate(make(chan struct{})))
+		assert.Equal(t, "a", note[fieldNoteKeyID])
+
+		var p keyRotationProgress
+		assert.NoError(t, json.Unmarshal([]byte(progress), &p))
+		assert.Equal(t, keyRotationProgress{Pass: 2, Total: 2}, p)
+
+		mrc.AssertExpectations(t)
+	})
+}
+
+func TestKeyRotationLocked(t *testing.T) {
+	withNoteKeys(t, "a", []string{"a"}, func(nk *NoteKeys, path string) {
+		// another server is working on the rotation.
+		mrc := &MockRedisClient{}
+		mrc.On("SetNX", keyRotationLockKey, "1", keyRotationLockTTL).Return(false, nil)
+
+		rnr, err := NewRedisNoteRepository(RedisClientOption(mrc), NoteEncryption(nk))
+		assert.NoError(t, err)
+
+		kr, err := NewKeyRotation(mrc, rnr)
+		assert.NoError(t, err)
+
+		assert.NoError(t, kr.rotate(make(chan struct{})))
+		mrc.AssertNotCalled(t, "Get", keyRotationKey)
+	})
+}
+
+func TestRequestKeyRotation(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("Set", keyRotationKey, `{"start":0,"pass":1,"rotated":0,"total":0}`, mock.Anything).Return("OK", nil)
+
+	assert.NoError(t, RequestKeyRotation(mrc))
+	mrc.AssertExpectations(t)
+
+	_, err := NewKeyRotation(mrc, &RedisNoteRepository{})
+	assert.Error(t, err)
+}
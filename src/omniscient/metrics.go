@@ -24,15 +24,58 @@ var requestSummary = prometheus.NewSummary(prometheus.SummaryOpts{
 	Help: "Request duration.",
 })
 
+var notesExpiredCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "omniscient_notes_expired",
+	Help: "Number of notes removed after expiring.",
+})
+
+var deprecatedRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "omniscient_deprecated_requests",
+	Help: "Number of requests to deprecated routes.",
+}, []string{"method", "path"})
+
+var tenantRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "omniscient_tenant_requests",
+	Help: "Number of requests made in each tenant.",
+}, []string{"tenant", "status"})
+
+var tenantNotesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "omniscient_tenant_notes",
+	Help: "Number of notes each tenant has, as of when its quota was last checked.",
+}, []string{"tenant"})
+
+var tenantBytesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "omniscient_tenant_bytes",
+	Help: "Bytes of note content each tenant has, as of when its quota was last checked.",
+}, []string{"tenant"})
+
+var rateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "omniscient_rate_limited_requests",
+	Help: "Number of requests rejected for being over a rate limit.",
+}, []string{"route"})
+
+var rateLimitFallbackCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "omniscient_rate_limit_fallbacks",
+	Help: "Number of times rate limiting fell back to counting requests in memory.",
+})
+
 var metricsCollectors = []prometheus.Collector{
 	hitCounter,
 	requestHistogram,
 	requestSummary,
+	notesExpiredCounter,
+	deprecatedRequestsCounter,
+	tenantRequestsCounter,
+	tenantNotesGauge,
+	tenantBytesGauge,
+	rateLimitedCounter,
+	rateLimitFallbackCounter,
 }
 
 func initMetrics() error {
 	for _, c := range metricsCollectors {
-		err := prometheus.Register(c)
+		// the collectors are shared by every App in the process.
+		_, err := prometheus.RegisterOrGet(c)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,20 @@
+package omniscient
+
+import "github.com/stretchr/testify/mock"
+
+type MockNotePublisher struct {
+	mock.Mock
+}
+
+func (_m *MockNotePublisher) Publish(typ NoteEventType, id string, n *Note) error {
+	ret := _m.Called(typ, id, n)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(NoteEventType, string, *Note) error); ok {
+		r0 = rf(typ, id, n)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -6,12 +6,12 @@ type MockNoteRepository struct {
 	mock.Mock
 }
 
-func (_m *MockNoteRepository) Create(content string) (*Note, error) {
-	ret := _m.Called(content)
+func (_m *MockNoteRepository) Create(content string, opts ...NoteOption) (*Note, error) {
+	ret := _m.Called(content, opts)
 
 	var r0 *Note
-	if rf, ok := ret.Get(0).(func(string) *Note); ok {
-		r0 = rf(content)
+	if rf, ok := ret.Get(0).(func(string, ...NoteOption) *Note); ok {
+		r0 = rf(content, opts...)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*Note)
@@ -19,8 +19,8 @@ func (_m *MockNoteRepository) Create(content string) (*Note, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(content)
+	if rf, ok := ret.Get(1).(func(string, ...NoteOption) error); ok {
+		r1 = rf(content, opts...)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -48,12 +48,54 @@ func (_m *MockNoteRepository) Retrieve(id string) (*Note, error) {
 
 	return r0, r1
 }
-func (_m *MockNoteRepository) Update(id string, content string) (*Note, error) {
-	ret := _m.Called(id, content)
+func (_m *MockNoteRepository) RetrieveBySlug(slug string) (*Note, error) {
+	ret := _m.Called(slug)
+
+	var r0 *Note
+	if rf, ok := ret.Get(0).(func(string) *Note); ok {
+		r0 = rf(slug)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Note)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(slug)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) RetrieveMany(ids []string) ([]*Note, error) {
+	ret := _m.Called(ids)
+
+	var r0 []*Note
+	if rf, ok := ret.Get(0).(func([]string) []*Note); ok {
+		r0 = rf(ids)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*Note)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func([]string) error); ok {
+		r1 = rf(ids)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) Update(id string, content string, opts ...NoteOption) (*Note, error) {
+	ret := _m.Called(id, content, opts)
 
 	var r0 *Note
-	if rf, ok := ret.Get(0).(func(string, string) *Note); ok {
-		r0 = rf(id, content)
+	if rf, ok := ret.Get(0).(func(string, string, ...NoteOption) *Note); ok {
+		r0 = rf(id, content, opts...)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*Note)
@@ -61,8 +103,29 @@ func (_m *MockNoteRepository) Update(id string, content string) (*Note, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(id, content)
+	if rf, ok := ret.Get(1).(func(string, string, ...NoteOption) error); ok {
+		r1 = rf(id, content, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) Patch(id string, fn func(*Note) error) (*Note, error) {
+	ret := _m.Called(id, fn)
+
+	var r0 *Note
+	if rf, ok := ret.Get(0).(func(string, func(*Note) error) *Note); ok {
+		r0 = rf(id, fn)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Note)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, func(*Note) error) error); ok {
+		r1 = rf(id, fn)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -102,3 +165,191 @@ func (_m *MockNoteRepository) List() ([]Note, error) {
 
 	return r0, r1
 }
+func (_m *MockNoteRepository) ListPage(offset int64, limit int64) ([]Note, bool, error) {
+	ret := _m.Called(offset, limit)
+
+	var r0 []Note
+	if rf, ok := ret.Get(0).(func(int64, int64) []Note); ok {
+		r0 = rf(offset, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Note)
+		}
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(int64, int64) bool); ok {
+		r1 = rf(offset, limit)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(int64, int64) error); ok {
+		r2 = rf(offset, limit)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+func (_m *MockNoteRepository) Walk(fn func(*Note) error) error {
+	ret := _m.Called(fn)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(func(*Note) error) error); ok {
+		r0 = rf(fn)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+func (_m *MockNoteRepository) Import(note *Note, overwrite bool) (bool, error) {
+	ret := _m.Called(note, overwrite)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(*Note, bool) bool); ok {
+		r0 = rf(note, overwrite)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*Note, bool) error); ok {
+		r1 = rf(note, overwrite)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) Transact(ops []NoteOp) ([]*Note, error) {
+	ret := _m.Called(ops)
+
+	var r0 []*Note
+	if rf, ok := ret.Get(0).(func([]NoteOp) []*Note); ok {
+		r0 = rf(ops)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*Note)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func([]NoteOp) error); ok {
+		r1 = rf(ops)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) ChangeSeq() (int64, error) {
+	ret := _m.Called()
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func() int64); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) Changes(since int64, limit int64) (*NoteChanges, error) {
+	ret := _m.Called(since, limit)
+
+	var r0 *NoteChanges
+	if rf, ok := ret.Get(0).(func(int64, int64) *NoteChanges); ok {
+		r0 = rf(since, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*NoteChanges)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(int64, int64) error); ok {
+		r1 = rf(since, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) SnapshotList() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockNoteRepository) ListSnapshot(snapshot string, offset int64, limit int64) ([]Note, bool, error) {
+	ret := _m.Called(snapshot, offset, limit)
+
+	var r0 []Note
+	if rf, ok := ret.Get(0).(func(string, int64, int64) []Note); ok {
+		r0 = rf(snapshot, offset, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Note)
+		}
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(string, int64, int64) bool); ok {
+		r1 = rf(snapshot, offset, limit)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string, int64, int64) error); ok {
+		r2 = rf(snapshot, offset, limit)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+func (_m *MockNoteRepository) Readers(ids []string) ([][]string, error) {
+	ret := _m.Called(ids)
+
+	var r0 [][]string
+	if rf, ok := ret.Get(0).(func([]string) [][]string); ok {
+		r0 = rf(ids)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([][]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func([]string) error); ok {
+		r1 = rf(ids)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -0,0 +1,481 @@
+package omniscient
+
+import "github.com/stretchr/testify/mock"
+
+import "time"
+
+type MockRedisTx struct {
+	mock.Mock
+}
+
+func (_m *MockRedisTx) Delete(keys ...string) (int64, error) {
+	ret := _m.Called(keys)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(...string) int64); ok {
+		r0 = rf(keys...)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(...string) error); ok {
+		r1 = rf(keys...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Do(args ...interface{}) (interface{}, error) {
+	ret := _m.Called(args)
+
+	var r0 interface{}
+	if rf, ok := ret.Get(0).(func(...interface{}) interface{}); ok {
+		r0 = rf(args...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(interface{})
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(...interface{}) error); ok {
+		r1 = rf(args...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Eval(script string, keys []string, args []string) (interface{}, error) {
+	ret := _m.Called(script, keys, args)
+
+	var r0 interface{}
+	if rf, ok := ret.Get(0).(func(string, []string, []string) interface{}); ok {
+		r0 = rf(script, keys, args)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(interface{})
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, []string, []string) error); ok {
+		r1 = rf(script, keys, args)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Exists(key string) (bool, error) {
+	ret := _m.Called(key)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string) bool); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) ExpireAt(key string, tm time.Time) (bool, error) {
+	ret := _m.Called(key, tm)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, time.Time) bool); ok {
+		r0 = rf(key, tm)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, time.Time) error); ok {
+		r1 = rf(key, tm)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Get(key string) (string, error) {
+	ret := _m.Called(key)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) HDel(key string, fields ...string) (int64, error) {
+	ret := _m.Called(key, fields)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string, ...string) int64); ok {
+		r0 = rf(key, fields...)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, ...string) error); ok {
+		r1 = rf(key, fields...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) HGet(key string, field string) (string, error) {
+	ret := _m.Called(key, field)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, string) string); ok {
+		r0 = rf(key, field)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(key, field)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) HGetAllMap(key string) (map[string]string, error) {
+	ret := _m.Called(key)
+
+	var r0 map[string]string
+	if rf, ok := ret.Get(0).(func(string) map[string]string); ok {
+		r0 = rf(key)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) HMSet(key string, field string, value string, pairs ...string) (string, error) {
+	ret := _m.Called(key, field, value, pairs)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, string, string, ...string) string); ok {
+		r0 = rf(key, field, value, pairs...)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, string, ...string) error); ok {
+		r1 = rf(key, field, value, pairs...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) HSet(key string, field string, value string) (bool, error) {
+	ret := _m.Called(key, field, value)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, string, string) bool); ok {
+		r0 = rf(key, field, value)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, string) error); ok {
+		r1 = rf(key, field, value)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) HSetNX(key string, field string, value string) (bool, error) {
+	ret := _m.Called(key, field, value)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, string, string) bool); ok {
+		r0 = rf(key, field, value)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, string) error); ok {
+		r1 = rf(key, field, value)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) LPush(key string, values ...string) (int64, error) {
+	ret := _m.Called(key, values)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string, ...string) int64); ok {
+		r0 = rf(key, values...)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, ...string) error); ok {
+		r1 = rf(key, values...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) LRange(key string, start int64, stop int64) ([]string, error) {
+	ret := _m.Called(key, start, stop)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(string, int64, int64) []string); ok {
+		r0 = rf(key, start, stop)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int64, int64) error); ok {
+		r1 = rf(key, start, stop)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) LRem(key string, count int64, value interface{}) (int64, error) {
+	ret := _m.Called(key, count, value)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string, int64, interface{}) int64); ok {
+		r0 = rf(key, count, value)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int64, interface{}) error); ok {
+		r1 = rf(key, count, value)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Persist(key string) (bool, error) {
+	ret := _m.Called(key)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string) bool); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Ping() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Set(key string, value interface{}, expiration time.Duration) (string, error) {
+	ret := _m.Called(key, value, expiration)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, interface{}, time.Duration) string); ok {
+		r0 = rf(key, value, expiration)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, interface{}, time.Duration) error); ok {
+		r1 = rf(key, value, expiration)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	ret := _m.Called(key, value, expiration)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, interface{}, time.Duration) bool); ok {
+		r0 = rf(key, value, expiration)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, interface{}, time.Duration) error); ok {
+		r1 = rf(key, value, expiration)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Subscribe(channels ...string) (RedisSubscription, error) {
+	ret := _m.Called(channels)
+
+	var r0 RedisSubscription
+	if rf, ok := ret.Get(0).(func(...string) RedisSubscription); ok {
+		r0 = rf(channels...)
+	} else {
+		r0 = ret.Get(0).(RedisSubscription)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(...string) error); ok {
+		r1 = rf(channels...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) ZAdd(key string, score float64, member string) (int64, error) {
+	ret := _m.Called(key, score, member)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string, float64, string) int64); ok {
+		r0 = rf(key, score, member)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, float64, string) error); ok {
+		r1 = rf(key, score, member)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) ZRangeByScore(key string, min string, max string) ([]string, error) {
+	ret := _m.Called(key, min, max)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(string, string, string) []string); ok {
+		r0 = rf(key, min, max)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, string) error); ok {
+		r1 = rf(key, min, max)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) ZRem(key string, members ...string) (int64, error) {
+	ret := _m.Called(key, members)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string, ...string) int64); ok {
+		r0 = rf(key, members...)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, ...string) error); ok {
+		r1 = rf(key, members...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+func (_m *MockRedisTx) Watch(fn func(tx RedisTx) error, keys ...string) error {
+	ret := _m.Called(fn, keys)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(func(tx RedisTx) error, ...string) error); ok {
+		r0 = rf(fn, keys...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+func (_m *MockRedisTx) Exec(fn func() error) error {
+	ret := _m.Called(fn)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(func() error) error); ok {
+		r0 = rf(fn)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -1,10 +1,15 @@
 package omniscient
 
 import (
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/satori/go.uuid"
+	"omniscient/events"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 const (
@@ -12,23 +17,108 @@ const (
 	fieldNoteContent   = "content"
 	fieldNoteCreatedAt = "created_at"
 	fieldNoteUpdatedAt = "updated_at"
+	fieldNoteExpiresAt = "expires_at"
+	fieldNoteSlug      = "slug"
+	fieldNoteVersion   = "version"
+	fieldNoteOwner     = "owner"
+	fieldNoteShares    = "shares"
 
 	catalogKey = "catalog"
+	expiryKey  = "expiry"
+	slugsKey   = "slugs"
+
+	walkPageSize = 100
+
+	// maxPatchAttempts is how many times a patch is retried if the note is
+	// changed while it is being applied.
+	maxPatchAttempts = 3
 )
 
 var (
 	defaultRedisClient RedisClient
-	defaultIDGenFn     = func() string {
-		return uuid.NewV4().String()
-	}
+	defaultIDGenFn     = newUUID
+
+	// ErrNoteNotFound is returned when a note does not exist or has expired.
+	ErrNoteNotFound = &NoteError{Code: CodeNoteNotFound, Message: "note not found"}
+	// ErrNoteExists is returned when a note with the same id already exists.
+	ErrNoteExists = &NoteError{Code: CodeNoteExists, Message: "note already exists"}
+	// ErrNoteExpired is returned when storing a note which has already expired.
+	ErrNoteExpired = &NoteError{Code: CodeNoteExpired, Message: "note has already expired"}
+	// ErrInvalidNoteID is returned when a client chosen note id is not valid.
+	ErrInvalidNoteID = &NoteError{Code: CodeInvalidNoteID, Message: "note id must be 1-128 letters, digits, '-' or '_'"}
+	// ErrInvalidNoteSlug is returned when a note slug is not valid.
+	ErrInvalidNoteSlug = &NoteError{Code: CodeInvalidNoteSlug, Message: "note slug must be lowercase words of letters and digits separated by '-'"}
+	// ErrNoteSlugTaken is returned when a slug is already used by another note.
+	ErrNoteSlugTaken = &NoteError{Code: CodeNoteSlugTaken, Message: "note slug is already taken"}
+	// ErrVersionConflict is returned when a note is not at the version an
+	// operation expected.
+	ErrVersionConflict = &NoteError{Code: CodeVersionConflict, Message: "note has been changed since the expected version"}
+
+	errSlugInTransaction = &NoteError{Code: CodeInvalidRequest, Message: "note slugs can not be set in a transaction"}
 )
 
 // Note is note.
 type Note struct {
-	ID        string    `json:"id"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        string     `json:"id"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Slug      string     `json:"slug,omitempty"`
+	// Version starts at 1, and goes up by one every time the note is
+	// changed. Notes stored before versions were added have version 0.
+	Version int64 `json:"version,omitempty"`
+	// Owner is the id of the principal who created the note. Notes created
+	// without authentication have no owner.
+	Owner string `json:"owner,omitempty"`
+	// Shares are the roles other principals have been given on the note,
+	// by principal id.
+	Shares map[string]NoteRole `json:"shares,omitempty"`
+}
+
+// IsExpired returns true if the note has an expiry at or before t.
+func (n *Note) IsExpired(t time.Time) bool {
+	return n.ExpiresAt != nil && !n.ExpiresAt.After(t)
+}
+
+// NoteOption is an option applied to a note when it is created or updated.
+type NoteOption func(*Note)
+
+// NoteID sets a client chosen id for a new note.
+func NoteID(id string) NoteOption {
+	return func(n *Note) {
+		n.ID = id
+	}
+}
+
+// NoteSlug sets the slug a note can also be retrieved by.
+func NoteSlug(slug string) NoteOption {
+	return func(n *Note) {
+		n.Slug = slug
+	}
+}
+
+// NoteExpiresAt sets the time a note expires.
+func NoteExpiresAt(t time.Time) NoteOption {
+	return func(n *Note) {
+		t = t.UTC()
+		n.ExpiresAt = &t
+	}
+}
+
+// NoteOwner sets the principal who owns a note.
+func NoteOwner(id string) NoteOption {
+	return func(n *Note) {
+		n.Owner = id
+	}
+}
+
+// NoteShares sets the roles other principals have on a note, replacing the
+// ones it had.
+func NoteShares(shares map[string]NoteRole) NoteOption {
+	return func(n *Note) {
+		n.Shares = shares
+	}
 }
 
 func noteFromMap(m map[string]string) *Note {
@@ -45,16 +135,81 @@ func noteFromMap(m map[string]string) *Note {
 		n.UpdatedAt = t
 	}
 
+	if t, err := time.Parse(time.RFC3339, m[fieldNoteExpiresAt]); err == nil {
+		n.ExpiresAt = &t
+	}
+
+	n.Slug = m[fieldNoteSlug]
+
+	if v, err := strconv.ParseInt(m[fieldNoteVersion], 10, 64); err == nil {
+		n.Version = v
+	}
+
+	n.Owner = m[fieldNoteOwner]
+
+	if s := m[fieldNoteShares]; s != "" {
+		if err := json.Unmarshal([]byte(s), &n.Shares); err != nil {
+			log.WithError(err).WithField("note", n.ID).Warning("unable to decode note shares")
+		}
+	}
+
 	return n
 }
 
 // NoteRepository is a repository for managing notes.
 type NoteRepository interface {
-	Create(content string) (*Note, error)
+	Create(content string, opts ...NoteOption) (*Note, error)
 	Retrieve(id string) (*Note, error)
-	Update(id, content string) (*Note, error)
+	RetrieveBySlug(slug string) (*Note, error)
+	RetrieveMany(ids []string) ([]*Note, error)
+	Update(id, content string, opts ...NoteOption) (*Note, error)
+	Patch(id string, fn func(*Note) error) (*Note, error)
 	Delete(id string) error
 	List() ([]Note, error)
+	ListPage(offset, limit int64) ([]Note, bool, error)
+	Walk(fn func(*Note) error) error
+	Import(note *Note, overwrite bool) (bool, error)
+	Transact(ops []NoteOp) ([]*Note, error)
+	ChangeSeq() (int64, error)
+	Changes(since, limit int64) (*NoteChanges, error)
+	Readers(ids []string) ([][]string, error)
+	SnapshotList() (string, error)
+	ListSnapshot(snapshot string, offset, limit int64) ([]Note, bool, error)
+}
+
+// NoteOpKind is the kind of a note operation.
+type NoteOpKind string
+
+const (
+	// NoteOpCreate creates a note.
+	NoteOpCreate NoteOpKind = "create"
+	// NoteOpRetrieve retrieves a note.
+	NoteOpRetrieve NoteOpKind = "retrieve"
+	// NoteOpUpdate updates a note.
+	NoteOpUpdate NoteOpKind = "update"
+	// NoteOpDelete deletes a note.
+	NoteOpDelete NoteOpKind = "delete"
+)
+
+// NoteOp is an operation on a note which is run as part of a transaction.
+type NoteOp struct {
+	Kind    NoteOpKind
+	ID      string
+	Content string
+	Options []NoteOption
+	// Version, if set, is the version an updated or deleted note must be
+	// at, otherwise the operation fails with ErrVersionConflict.
+	Version int64
+}
+
+// OpError is returned when an operation in a transaction fails.
+type OpError struct {
+	Index int
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
 }
 
 type idGenFn func() string
@@ -64,6 +219,21 @@ type RedisNoteRepository struct {
 	base        string
 	redisClient RedisClient
 	idGen       idGenFn
+	publishers  []NotePublisher
+
+	eventStream       string
+	eventStreamMaxLen int64
+
+	tombstoneTTL time.Duration
+
+	// keys encrypt the content of notes, if set.
+	keys *NoteKeys
+
+	// tenant is set for the notes of a tenant, which are kept within
+	// maxNotes and maxBytes. See ForTenant.
+	tenant   string
+	maxNotes int64
+	maxBytes int64
 }
 
 var _ NoteRepository = (*RedisNoteRepository)(nil)
@@ -71,12 +241,14 @@ var _ NoteRepository = (*RedisNoteRepository)(nil)
 // RedisNoteRepositoryOption is an option for configuring RedisNoteRepository.
 type RedisNoteRepositoryOption func(*RedisNoteRepository) error
 
-// NewRedisNoteRepository creates an instance of NoteRepository.
-func NewRedisNoteRepository(opts ...RedisNoteRepositoryOption) (NoteRepository, error) {
+// NewRedisNoteRepository creates an instance of RedisNoteRepository.
+func NewRedisNoteRepository(opts ...RedisNoteRepositoryOption) (*RedisNoteRepository, error) {
 	rnr := &RedisNoteRepository{
 		base:        "notes",
 		redisClient: defaultRedisClient,
 		idGen:       defaultIDGenFn,
+
+		tombstoneTTL: defaultTombstoneTTL,
 	}
 
 	for _, opt := range opts {
@@ -105,6 +277,20 @@ func NoteIDGenFn(idGen func() string) RedisNoteRepositoryOption {
 	}
 }
 
+// NoteIDStrategy sets the id generator for RedisNoteRepository by name. See
+// IDStrategyUUID, IDStrategyULID and IDStrategyBase62.
+func NoteIDStrategy(name string) RedisNoteRepositoryOption {
+	return func(rnr *RedisNoteRepository) error {
+		idGen, ok := idStrategies[name]
+		if !ok {
+			return fmt.Errorf("unknown id strategy %q", name)
+		}
+
+		rnr.idGen = idGen
+		return nil
+	}
+}
+
 // NoteBase is the base string for all note keys.
 func NoteBase(base string) RedisNoteRepositoryOption {
 	return func(rnr *RedisNoteRepository) error {
@@ -113,28 +299,92 @@ func NoteBase(base string) RedisNoteRepositoryOption {
 	}
 }
 
-// Create creates a new note.
-func (nr *RedisNoteRepository) Create(content string) (*Note, error) {
+// NoteEventPublisher adds a publisher RedisNoteRepository publishes changes
+// to notes to. It can be used more than once.
+func NoteEventPublisher(p NotePublisher) RedisNoteRepositoryOption {
+	return func(rnr *RedisNoteRepository) error {
+		rnr.publishers = append(rnr.publishers, p)
+		return nil
+	}
+}
+
+// Create creates a new note. If the note is given an id with NoteID, it is
+// validated and ErrNoteExists is returned if it is already in use.
+func (nr *RedisNoteRepository) Create(content string, opts ...NoteOption) (*Note, error) {
 	now := time.Now()
 
 	note := Note{
-		ID:        nr.idGen(),
 		Content:   content,
 		CreatedAt: now,
 		UpdatedAt: now,
+		Version:   1,
 	}
 
-	err := nr.save(&note)
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(&note)
 	}
 
-	_, err = nr.redisClient.LPush(nr.keyForID(catalogKey),
-		note.ID)
+	// an id given by the caller may already be in use. It is checked while
+	// the note is watched, so it can't be taken before the note is written.
+	checkExists := note.ID != ""
+	if checkExists {
+		if err := ValidateNoteID(note.ID); err != nil {
+			return nil, err
+		}
+	} else {
+		note.ID = nr.idGen()
+	}
+
+	err := nr.write(note.ID, func(tx RedisTx, w *RedisNoteRepository) error {
+		if checkExists {
+			exists, err := w.redisClient.Exists(w.keyForID(note.ID))
+			if err != nil {
+				return err
+			}
+
+			if exists {
+				return ErrNoteExists
+			}
+		}
+
+		if err := w.checkQuota(1, int64(len(note.Content))); err != nil {
+			return err
+		}
+
+		if note.Slug != "" {
+			if err := w.claimSlug(note.Slug, note.ID); err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec(func() error {
+			if err := w.save(&note); err != nil {
+				return err
+			}
+
+			_, err := w.redisClient.LPush(w.keyForID(catalogKey),
+				note.ID)
+			if err != nil {
+				return err
+			}
+
+			if err := w.recordChange(note.ID, &note); err != nil {
+				return err
+			}
+
+			if err := w.trackUsage(note.ID, &note); err != nil {
+				return err
+			}
+
+			return w.appendEvent(events.NoteCreated, note.ID, nil, &note)
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	nr.publish(NoteCreated, note.ID, &note)
+
 	return &note, nil
 }
 
@@ -143,35 +393,242 @@ func (nr *RedisNoteRepository) Retrieve(id string) (*Note, error) {
 	return nr.load(id)
 }
 
-// Update updates an existing note.
-func (nr *RedisNoteRepository) Update(id, content string) (*Note, error) {
-	m, err := nr.redisClient.HGetAllMap(nr.keyForID(id))
+// RetrieveBySlug retrieves an existing note by its slug.
+func (nr *RedisNoteRepository) RetrieveBySlug(slug string) (*Note, error) {
+	id, err := nr.redisClient.HGet(nr.keyForID(slugsKey), slug)
+	if err == ErrKeyNotFound {
+		return nil, ErrNoteNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	n := noteFromMap(m)
-	n.Content = content
-	n.UpdatedAt = time.Now()
-
-	err = nr.save(n)
+	n, err := nr.load(id)
 	if err != nil {
 		return nil, err
 	}
 
+	// slugs of deleted notes are left behind until they are claimed again.
+	if n.Slug != slug {
+		return nil, ErrNoteNotFound
+	}
+
 	return n, nil
 }
 
+// RetrieveMany retrieves the notes with ids. The notes are in the same order
+// as ids, and are nil for ids which don't exist.
+func (nr *RedisNoteRepository) RetrieveMany(ids []string) ([]*Note, error) {
+	notes := make([]*Note, len(ids))
+	for i, id := range ids {
+		n, err := nr.load(id)
+		if err == ErrNoteNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		notes[i] = n
+	}
+
+	return notes, nil
+}
+
+// Update updates an existing note. Like Patch, it is retried if the note is
+// changed by someone else before it is written.
+func (nr *RedisNoteRepository) Update(id, content string, opts ...NoteOption) (*Note, error) {
+	return nr.Patch(id, func(n *Note) error {
+		n.Content = content
+		for _, opt := range opts {
+			opt(n)
+		}
+		return nil
+	})
+}
+
+// Patch atomically applies fn to an existing note. fn can change the content,
+// slug and expiry of the note. If the note is changed by someone else while
+// fn is being applied, the patch is retried.
+func (nr *RedisNoteRepository) Patch(id string, fn func(*Note) error) (*Note, error) {
+	// reserved ids name keys of other types, which aren't notes.
+	if reservedNoteIDs[id] {
+		return nil, ErrNoteNotFound
+	}
+
+	var patched *Note
+	err := nr.write(id, func(tx RedisTx, w *RedisNoteRepository) error {
+		var err error
+		patched, err = w.patch(tx, id, fn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nr.publish(NoteUpdated, patched.ID, patched)
+
+	return patched, nil
+}
+
+// write makes a change to the note with id. It watches the note before
+// running fn, which reads what the change needs with w and then makes its
+// writes with tx.Exec. The change is retried if the note is changed by
+// someone else before the writes are executed.
+func (nr *RedisNoteRepository) write(id string, fn func(tx RedisTx, w *RedisNoteRepository) error) error {
+	var err error
+	for attempt := 0; attempt < maxPatchAttempts; attempt++ {
+		err = nr.redisClient.Watch(func(tx RedisTx) error {
+			txnr := *nr
+			txnr.redisClient = tx
+
+			return fn(tx, &txnr)
+		}, nr.keyForID(id))
+
+		if err != ErrTxConflict {
+			break
+		}
+	}
+
+	return err
+}
+
+func (nr *RedisNoteRepository) patch(tx RedisTx, id string, fn func(*Note) error) (*Note, error) {
+	n, err := nr.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	patched := *n
+	if err := fn(&patched); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	patched.ID = n.ID
+	patched.CreatedAt = n.CreatedAt
+	patched.UpdatedAt = now
+	patched.Version = n.Version + 1
+
+	if patched.IsExpired(now) {
+		return nil, ErrNoteExpired
+	}
+
+	if err := nr.checkQuota(0, contentDelta(n, &patched)); err != nil {
+		return nil, err
+	}
+
+	if patched.Slug != n.Slug && patched.Slug != "" {
+		if err := nr.claimSlug(patched.Slug, id); err != nil {
+			return nil, err
+		}
+	}
+
+	key := nr.keyForID(id)
+	err = tx.Exec(func() error {
+		if err := nr.save(&patched); err != nil {
+			return err
+		}
+
+		if n.ExpiresAt != nil && patched.ExpiresAt == nil {
+			if _, err := nr.redisClient.HDel(key, fieldNoteExpiresAt); err != nil {
+				return err
+			}
+
+			if _, err := nr.redisClient.Persist(key); err != nil {
+				return err
+			}
+		}
+
+		if n.Slug != "" && patched.Slug == "" {
+			if _, err := nr.redisClient.HDel(key, fieldNoteSlug); err != nil {
+				return err
+			}
+		}
+
+		if err := nr.clearShares(n, &patched); err != nil {
+			return err
+		}
+
+		if err := nr.recordChange(id, &patched); err != nil {
+			return err
+		}
+
+		if err := nr.trackUsage(id, &patched); err != nil {
+			return err
+		}
+
+		return nr.appendEvent(events.NoteUpdated, id, n, &patched)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Slug != "" && patched.Slug != n.Slug {
+		if err := nr.releaseSlug(n.Slug, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return &patched, nil
+}
+
 // Delete deletes an existing note.
 func (nr *RedisNoteRepository) Delete(id string) error {
-	_, err := nr.redisClient.LRem(nr.keyForID(catalogKey), 0, id)
+	// reserved ids name other keys, which must not be deleted as notes.
+	if reservedNoteIDs[id] {
+		return nil
+	}
+
+	// the note as it was before it was deleted, if it existed.
+	var before *Note
+	err := nr.write(id, func(tx RedisTx, w *RedisNoteRepository) error {
+		n, err := w.load(id)
+		if err != nil && err != ErrNoteNotFound {
+			return err
+		}
+		before = n
+
+		return tx.Exec(func() error {
+			_, err := w.redisClient.LRem(w.keyForID(catalogKey), 0, id)
+			if err != nil {
+				return err
+			}
+
+			if _, err := w.redisClient.Delete(w.keyForID(id)); err != nil {
+				return err
+			}
+
+			// the note mustn't be swept if it is created again.
+			if _, err := w.redisClient.ZRem(w.keyForID(expiryKey), id); err != nil {
+				return err
+			}
+
+			// deleting a note which doesn't exist is not a change.
+			if before == nil {
+				return nil
+			}
+
+			if err := w.recordChange(id, nil); err != nil {
+				return err
+			}
+
+			if err := w.trackUsage(id, nil); err != nil {
+				return err
+			}
+
+			return w.appendEvent(events.NoteDeleted, id, before, nil)
+		})
+	})
 	if err != nil {
 		return err
 	}
 
-	_, err = nr.redisClient.Delete(nr.keyForID(id))
+	if before != nil {
+		nr.publish(NoteDeleted, id, nil)
+	}
 
-	return err
+	return nil
 }
 
 // List retrieves all the notes.
@@ -184,6 +641,10 @@ func (nr *RedisNoteRepository) List() ([]Note, error) {
 
 	for _, id := range ids {
 		note, err := nr.load(id)
+		if err == ErrNoteNotFound {
+			// expired, but not swept from the catalog yet
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -194,6 +655,465 @@ func (nr *RedisNoteRepository) List() ([]Note, error) {
 	return notes, nil
 }
 
+// ListPage lists up to limit notes, starting at offset in the catalog. It
+// also returns whether there are more notes after the page. Newer notes are
+// listed first, so offsets shift as notes are created.
+func (nr *RedisNoteRepository) ListPage(offset, limit int64) ([]Note, bool, error) {
+	// fetch one extra id to find out if there is another page.
+	ids, err := nr.redisClient.LRange(nr.keyForID(catalogKey), offset, offset+limit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	more := int64(len(ids)) > limit
+	if more {
+		ids = ids[:limit]
+	}
+
+	notes := []Note{}
+	for _, id := range ids {
+		note, err := nr.load(id)
+		if err == ErrNoteNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		notes = append(notes, *note)
+	}
+
+	return notes, more, nil
+}
+
+// Walk calls fn for each note, fetching the catalog a page at a time so
+// all the notes are never held in memory at once. Walking stops at the first
+// error returned by fn.
+func (nr *RedisNoteRepository) Walk(fn func(*Note) error) error {
+	for start := int64(0); ; start += walkPageSize {
+		ids, err := nr.redisClient.LRange(nr.keyForID(catalogKey),
+			start, start+walkPageSize-1)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			note, err := nr.load(id)
+			if err == ErrNoteNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := fn(note); err != nil {
+				return err
+			}
+		}
+
+		if len(ids) < walkPageSize {
+			return nil
+		}
+	}
+}
+
+// Import stores a note as is, keeping its id and timestamps. A missing id or
+// timestamp is filled in. If a note with the same id exists, it is replaced
+// when overwrite is set, otherwise ErrNoteExists is returned. Import
+// returns true if a new note was created.
+func (nr *RedisNoteRepository) Import(note *Note, overwrite bool) (bool, error) {
+	now := time.Now()
+
+	if note.ID == "" {
+		note.ID = nr.idGen()
+	} else if err := ValidateNoteID(note.ID); err != nil {
+		return false, err
+	}
+
+	if note.CreatedAt.IsZero() {
+		note.CreatedAt = now
+	}
+
+	if note.UpdatedAt.IsZero() {
+		note.UpdatedAt = note.CreatedAt
+	}
+
+	if note.IsExpired(now) {
+		return false, ErrNoteExpired
+	}
+
+	key := nr.keyForID(note.ID)
+	version := note.Version
+
+	var exists bool
+	var before *Note
+	err := nr.write(note.ID, func(tx RedisTx, w *RedisNoteRepository) error {
+		var err error
+		if exists, err = w.redisClient.Exists(key); err != nil {
+			return err
+		}
+
+		if exists && !overwrite {
+			return ErrNoteExists
+		}
+
+		before = nil
+		if exists {
+			n, err := w.load(note.ID)
+			if err != nil && err != ErrNoteNotFound {
+				return err
+			}
+			before = n
+		}
+
+		// the version must go up, so clients syncing the note see the
+		// change.
+		note.Version = version
+		if before != nil && note.Version <= before.Version {
+			note.Version = before.Version + 1
+		}
+		if note.Version < 1 {
+			note.Version = 1
+		}
+
+		if before != nil {
+			err = w.checkQuota(0, contentDelta(before, note))
+		} else {
+			err = w.checkQuota(1, int64(len(note.Content)))
+		}
+		if err != nil {
+			return err
+		}
+
+		if note.Slug != "" {
+			if err := w.claimSlug(note.Slug, note.ID); err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec(func() error {
+			if exists {
+				// remove the old hash so no fields or expiry from it linger.
+				if _, err := w.redisClient.Delete(key); err != nil {
+					return err
+				}
+			}
+
+			if err := w.save(note); err != nil {
+				return err
+			}
+
+			if err := w.recordChange(note.ID, note); err != nil {
+				return err
+			}
+
+			if err := w.trackUsage(note.ID, note); err != nil {
+				return err
+			}
+
+			if exists {
+				return w.appendEvent(events.NoteUpdated, note.ID, before, note)
+			}
+
+			if _, err := w.redisClient.LPush(w.keyForID(catalogKey), note.ID); err != nil {
+				return err
+			}
+
+			return w.appendEvent(events.NoteCreated, note.ID, nil, note)
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		nr.publish(NoteUpdated, note.ID, note)
+		return false, nil
+	}
+
+	nr.publish(NoteCreated, note.ID, note)
+
+	return true, nil
+}
+
+// Transact runs ops atomically, so either all of them are applied or none
+// are. It returns the note resulting from each operation; deletes result in
+// a nil note. If an operation fails, an *OpError is returned. Later
+// operations see the changes made by earlier ones.
+func (nr *RedisNoteRepository) Transact(ops []NoteOp) ([]*Note, error) {
+	var keys []string
+	for _, op := range ops {
+		id := op.ID
+		if op.Kind == NoteOpCreate {
+			// notes created with an id given by the caller are watched too,
+			// so the id can't be taken before the transaction is executed.
+			var n Note
+			for _, opt := range op.Options {
+				opt(&n)
+			}
+			id = n.ID
+		}
+
+		if id != "" {
+			keys = append(keys, nr.keyForID(id))
+		}
+	}
+
+	var notes []*Note
+	err := nr.redisClient.Watch(func(tx RedisTx) error {
+		txnr := *nr
+		txnr.redisClient = tx
+
+		var err error
+		notes, err = txnr.transact(tx, ops)
+		return err
+	}, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+func (nr *RedisNoteRepository) transact(tx RedisTx, ops []NoteOp) ([]*Note, error) {
+	now := time.Now()
+	notes := make([]*Note, len(ops))
+
+	// current is the state of each note changed by the transaction, where
+	// nil marks a deleted note. changed keeps the ids in order.
+	current := map[string]*Note{}
+	created := map[string]bool{}
+	var changed []string
+
+	// original is the state of each loaded note before the transaction, for
+	// the event stream.
+	original := map[string]*Note{}
+	load := func(id string) (*Note, error) {
+		n, err := nr.load(id)
+		if err == nil {
+			original[id] = n
+		}
+		return n, err
+	}
+
+	lookup := func(id string) (*Note, error) {
+		n, ok := current[id]
+		if !ok {
+			return load(id)
+		}
+		if n == nil {
+			return nil, ErrNoteNotFound
+		}
+		return n, nil
+	}
+
+	change := func(id string, n *Note) {
+		if _, ok := current[id]; !ok {
+			changed = append(changed, id)
+		}
+		current[id] = n
+	}
+
+	for i, op := range ops {
+		switch op.Kind {
+		case NoteOpCreate:
+			n := &Note{
+				Content:   op.Content,
+				CreatedAt: now,
+				UpdatedAt: now,
+			}
+
+			for _, opt := range op.Options {
+				opt(n)
+			}
+
+			if n.Slug != "" {
+				return nil, &OpError{Index: i, Err: errSlugInTransaction}
+			}
+
+			if n.ID == "" {
+				n.ID = nr.idGen()
+			} else if err := ValidateNoteID(n.ID); err != nil {
+				return nil, &OpError{Index: i, Err: err}
+			} else if _, err := nr.load(n.ID); err != ErrNoteNotFound {
+				if err == nil {
+					err = ErrNoteExists
+				}
+				return nil, &OpError{Index: i, Err: err}
+			}
+
+			n.Version = 1
+			change(n.ID, n)
+			created[n.ID] = true
+			notes[i] = n
+		case NoteOpRetrieve:
+			n, err := lookup(op.ID)
+			if err != nil {
+				return nil, &OpError{Index: i, Err: err}
+			}
+
+			notes[i] = n
+		case NoteOpUpdate:
+			n, err := lookup(op.ID)
+			if err != nil {
+				return nil, &OpError{Index: i, Err: err}
+			}
+
+			if op.Version != 0 && op.Version != n.Version {
+				return nil, &OpError{Index: i, Err: ErrVersionConflict}
+			}
+
+			updated := *n
+			updated.Content = op.Content
+			updated.UpdatedAt = now
+
+			for _, opt := range op.Options {
+				opt(&updated)
+			}
+
+			updated.ID = op.ID
+			updated.Version = n.Version + 1
+
+			if updated.Slug != n.Slug {
+				return nil, &OpError{Index: i, Err: errSlugInTransaction}
+			}
+
+			change(op.ID, &updated)
+			notes[i] = &updated
+		case NoteOpDelete:
+			if op.Version != 0 {
+				n, err := lookup(op.ID)
+				if err != nil {
+					return nil, &OpError{Index: i, Err: err}
+				}
+				if n.Version != op.Version {
+					return nil, &OpError{Index: i, Err: ErrVersionConflict}
+				}
+			} else if _, ok := current[op.ID]; !ok && nr.eventStream != "" {
+				if _, err := load(op.ID); err != nil && err != ErrNoteNotFound {
+					return nil, &OpError{Index: i, Err: err}
+				}
+			}
+
+			change(op.ID, nil)
+		default:
+			return nil, &OpError{Index: i, Err: fmt.Errorf("unknown operation %q", op.Kind)}
+		}
+	}
+
+	if err := nr.checkQuota(transactUsage(changed, current, created, original)); err != nil {
+		return nil, err
+	}
+
+	err := tx.Exec(func() error {
+		for _, id := range changed {
+			n := current[id]
+			if n == nil {
+				if created[id] {
+					continue
+				}
+
+				if _, err := nr.redisClient.LRem(nr.keyForID(catalogKey), 0, id); err != nil {
+					return err
+				}
+
+				if _, err := nr.redisClient.Delete(nr.keyForID(id)); err != nil {
+					return err
+				}
+
+				if _, err := nr.redisClient.ZRem(nr.keyForID(expiryKey), id); err != nil {
+					return err
+				}
+
+				if err := nr.recordChange(id, nil); err != nil {
+					return err
+				}
+
+				if err := nr.trackUsage(id, nil); err != nil {
+					return err
+				}
+
+				if before, ok := original[id]; ok {
+					if err := nr.appendEvent(events.NoteDeleted, id, before, nil); err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			if err := nr.save(n); err != nil {
+				return err
+			}
+
+			if before, ok := original[id]; ok {
+				if err := nr.clearShares(before, n); err != nil {
+					return err
+				}
+			}
+
+			if err := nr.recordChange(id, n); err != nil {
+				return err
+			}
+
+			if err := nr.trackUsage(id, n); err != nil {
+				return err
+			}
+
+			if created[id] {
+				if _, err := nr.redisClient.LPush(nr.keyForID(catalogKey), id); err != nil {
+					return err
+				}
+
+				if err := nr.appendEvent(events.NoteCreated, id, nil, n); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := nr.appendEvent(events.NoteUpdated, id, original[id], n); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range changed {
+		switch n := current[id]; {
+		case n == nil && !created[id]:
+			nr.publish(NoteDeleted, id, nil)
+		case n != nil && created[id]:
+			nr.publish(NoteCreated, id, n)
+		case n != nil:
+			nr.publish(NoteUpdated, id, n)
+		}
+	}
+
+	return notes, nil
+}
+
+// publish publishes a change to a note. The change has already been made, so
+// failures are logged rather than returned.
+func (nr *RedisNoteRepository) publish(typ NoteEventType, id string, n *Note) {
+	n = nr.withoutContent(n)
+	for _, p := range nr.publishers {
+		var err error
+		if tp, ok := p.(TenantNotePublisher); ok && nr.tenant != "" {
+			err = tp.PublishTenant(nr.tenant, typ, id, n)
+		} else {
+			err = p.Publish(typ, id, n)
+		}
+		if err != nil {
+			log.WithError(err).WithField("note", id).Warning("unable to publish note event")
+		}
+	}
+}
+
 func (nr *RedisNoteRepository) keyForID(id string) string {
 	return strings.Join([]string{
 		nr.base, id,
@@ -203,20 +1123,250 @@ func (nr *RedisNoteRepository) keyForID(id string) string {
 func (nr *RedisNoteRepository) save(note *Note) error {
 	key := nr.keyForID(note.ID)
 
-	_, err := nr.redisClient.HMSet(key,
-		fieldNoteID, note.ID,
-		fieldNoteContent, note.Content,
+	pairs, err := nr.sealContent(note)
+	if err != nil {
+		return err
+	}
+
+	pairs = append(pairs,
 		fieldNoteCreatedAt, note.CreatedAt.Format(time.RFC3339),
-		fieldNoteUpdatedAt, note.UpdatedAt.Format(time.RFC3339))
+		fieldNoteUpdatedAt, note.UpdatedAt.Format(time.RFC3339),
+	)
+
+	if note.ExpiresAt != nil {
+		pairs = append(pairs, fieldNoteExpiresAt, note.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if note.Slug != "" {
+		pairs = append(pairs, fieldNoteSlug, note.Slug)
+	}
+
+	if note.Version > 0 {
+		pairs = append(pairs, fieldNoteVersion, strconv.FormatInt(note.Version, 10))
+	}
+
+	if note.Owner != "" {
+		pairs = append(pairs, fieldNoteOwner, note.Owner)
+	}
+
+	if len(note.Shares) > 0 {
+		b, err := json.Marshal(note.Shares)
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, fieldNoteShares, string(b))
+	}
+
+	if _, err := nr.redisClient.HMSet(key, fieldNoteID, note.ID, pairs...); err != nil {
+		return err
+	}
+
+	// a note which doesn't expire mustn't be left in the expiry index by the
+	// note it replaced, or it would be swept.
+	if note.ExpiresAt == nil {
+		_, err := nr.redisClient.ZRem(nr.keyForID(expiryKey), note.ID)
+		return err
+	}
+
+	if _, err := nr.redisClient.ExpireAt(key, *note.ExpiresAt); err != nil {
+		return err
+	}
+
+	_, err = nr.redisClient.ZAdd(nr.keyForID(expiryKey),
+		float64(note.ExpiresAt.Unix()), note.ID)
+
+	return err
+}
+
+// clearShares removes the shares of a note which no longer has any. save
+// only writes the fields a note has.
+func (nr *RedisNoteRepository) clearShares(before, after *Note) error {
+	if len(before.Shares) == 0 || len(after.Shares) > 0 {
+		return nil
+	}
 
+	_, err := nr.redisClient.HDel(nr.keyForID(after.ID), fieldNoteShares)
 	return err
 }
 
 func (nr *RedisNoteRepository) load(id string) (*Note, error) {
+	// reserved ids name keys of other types, which aren't notes.
+	if reservedNoteIDs[id] {
+		return nil, ErrNoteNotFound
+	}
+
 	m, err := nr.redisClient.HGetAllMap(nr.keyForID(id))
 	if err != nil {
 		return nil, err
 	}
 
-	return noteFromMap(m), nil
+	if len(m) == 0 {
+		return nil, ErrNoteNotFound
+	}
+
+	n := noteFromMap(m)
+	if n.IsExpired(time.Now()) {
+		return nil, ErrNoteNotFound
+	}
+
+	if n.Content, err = nr.openContent(n.ID, m); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// claimSlug points slug at the note with id, unless another note uses it.
+func (nr *RedisNoteRepository) claimSlug(slug, id string) error {
+	if err := ValidateNoteSlug(slug); err != nil {
+		return err
+	}
+
+	key := nr.keyForID(slugsKey)
+	ok, err := nr.redisClient.HSetNX(key, slug, id)
+	if err != nil || ok {
+		return err
+	}
+
+	owner, err := nr.redisClient.HGet(key, slug)
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	if owner == id {
+		return nil
+	}
+
+	// the slug may have been left behind by a deleted or expired note.
+	if owner != "" {
+		n, err := nr.load(owner)
+		if err == nil && n.Slug == slug {
+			return ErrNoteSlugTaken
+		}
+		if err != nil && err != ErrNoteNotFound {
+			return err
+		}
+	}
+
+	_, err = nr.redisClient.HSet(key, slug, id)
+	return err
+}
+
+// releaseSlug removes slug if it points at the note with id.
+func (nr *RedisNoteRepository) releaseSlug(slug, id string) error {
+	key := nr.keyForID(slugsKey)
+	owner, err := nr.redisClient.HGet(key, slug)
+	if err == ErrKeyNotFound || (err == nil && owner != id) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = nr.redisClient.HDel(key, slug)
+	return err
+}
+
+// SweepExpired removes notes which expired at or before t from the catalog.
+// Redis removes the note itself when its key expires, so only the catalog and
+// the expiry index are cleaned up. It returns the number of notes removed.
+func (nr *RedisNoteRepository) SweepExpired(t time.Time) (int, error) {
+	ids, err := nr.redisClient.ZRangeByScore(nr.keyForID(expiryKey),
+		"-inf", strconv.FormatInt(t.Unix(), 10))
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, id := range ids {
+		var expired bool
+		err := nr.write(id, func(tx RedisTx, w *RedisNoteRepository) error {
+			var err error
+			expired, err = w.sweep(tx, id, t)
+			return err
+		})
+		if err != nil {
+			return swept, err
+		}
+
+		if expired {
+			swept++
+			nr.publish(NoteDeleted, id, nil)
+		}
+	}
+
+	return swept, nr.pruneTombstones(t)
+}
+
+// sweep removes the note with id from the expiry index, and from the catalog
+// if it expired at or before t. It reports whether the note was removed. The
+// note is watched, so a note which was deleted and created again since it was
+// indexed is checked as it is now.
+func (nr *RedisNoteRepository) sweep(tx RedisTx, id string, t time.Time) (bool, error) {
+	key := nr.keyForID(id)
+	exists, err := nr.redisClient.Exists(key)
+	if err != nil {
+		return false, err
+	}
+
+	expired := !exists
+	if exists {
+		v, err := nr.redisClient.HGet(key, fieldNoteExpiresAt)
+		if err != nil && err != ErrKeyNotFound {
+			return false, err
+		}
+
+		if v != "" {
+			expiresAt, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return false, err
+			}
+
+			// the note has been given a later expiry, which is indexed.
+			if expiresAt.After(t) {
+				return false, nil
+			}
+
+			expired = true
+		}
+	}
+
+	// a note which was deleted before it expired has a tombstone already.
+	if expired {
+		tombstone, err := nr.redisClient.Do("ZSCORE", nr.keyForID(tombstonesKey), id)
+		if err != nil {
+			return false, err
+		}
+
+		expired = tombstone == nil
+	}
+
+	err = tx.Exec(func() error {
+		if _, err := nr.redisClient.ZRem(nr.keyForID(expiryKey), id); err != nil {
+			return err
+		}
+
+		if !expired {
+			return nil
+		}
+
+		if _, err := nr.redisClient.LRem(nr.keyForID(catalogKey), 0, id); err != nil {
+			return err
+		}
+
+		if err := nr.recordChange(id, nil); err != nil {
+			return err
+		}
+
+		if err := nr.trackUsage(id, nil); err != nil {
+			return err
+		}
+
+		return nr.appendEvent(events.NoteDeleted, id, nil, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return expired, nil
 }
@@ -5,18 +5,43 @@ import (
 	"testing"
 	"time"
 
+	"omniscient/events"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
+// passthroughTx is a transaction which runs its commands on a mock Redis
+// client as soon as they are sent, for tests which don't check what is
+// queued.
+type passthroughTx struct {
+	*MockRedisClient
+}
+
+func (tx passthroughTx) Exec(fn func() error) error {
+	return fn()
+}
+
+// expectWatch expects keys to be watched on a mock Redis client, and runs
+// the transaction with passthroughTx.
+func expectWatch(mrc *MockRedisClient, keys ...string) *mock.Call {
+	return mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), keys).
+		Return(func(fn func(RedisTx) error, keys ...string) error {
+			return fn(passthroughTx{mrc})
+		})
+}
+
 func TestRedisNoteRepoCreate(t *testing.T) {
 	mrc := &MockRedisClient{}
+	expectWatch(mrc, "notes:1")
 	mrc.On("HMSet",
 		"notes:1",
 		"id", "1",
 		mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
 
 	mrc.On("LPush", "notes:catalog", []string{"1"}).Return(int64(0), nil)
+	expectRecordChange(&mrc.Mock, "1", false)
 
 	id := 0
 	igf := func() string {
@@ -36,6 +61,32 @@ func TestRedisNoteRepoCreate(t *testing.T) {
 	assert.NotEmpty(t, n.CreatedAt)
 }
 
+func TestRedisNoteRepoCreateWithExpiry(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expiresAt := time.Now().Add(time.Hour).UTC()
+
+	expectWatch(mrc, "notes:1")
+	mrc.On("HMSet",
+		"notes:1",
+		"id", "1",
+		mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ExpireAt", "notes:1", expiresAt).Return(true, nil)
+	mrc.On("ZAdd", "notes:expiry", float64(expiresAt.Unix()), "1").Return(int64(1), nil)
+	mrc.On("LPush", "notes:catalog", []string{"1"}).Return(int64(0), nil)
+	expectRecordChange(&mrc.Mock, "1", false)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+		NoteIDGenFn(func() string { return "1" }))
+	assert.NoError(t, err)
+
+	n, err := rnr.Create("test", NoteExpiresAt(expiresAt))
+	assert.NoError(t, err)
+	assert.Equal(t, expiresAt, *n.ExpiresAt)
+
+	mrc.AssertExpectations(t)
+}
+
 func TestRedisNoteRepoRetrieve(t *testing.T) {
 	mrc := &MockRedisClient{}
 
@@ -61,6 +112,60 @@ func TestRedisNoteRepoRetrieve(t *testing.T) {
 	assert.NotEmpty(t, n.CreatedAt)
 }
 
+func TestRedisNoteRepoRetrieveExpired(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	now := time.Now()
+
+	m := map[string]string{
+		fieldNoteID:        "1",
+		fieldNoteContent:   "test",
+		fieldNoteCreatedAt: now.Add(-30 * time.Minute).Format(time.RFC3339),
+		fieldNoteUpdatedAt: now.Add(-30 * time.Minute).Format(time.RFC3339),
+		fieldNoteExpiresAt: now.Add(-time.Minute).Format(time.RFC3339),
+	}
+	mrc.On("HGetAllMap", "notes:1").Return(m, nil)
+	mrc.On("HGetAllMap", "notes:2").Return(map[string]string{}, nil)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	_, err = rnr.Retrieve("1")
+	assert.Equal(t, ErrNoteNotFound, err)
+
+	_, err = rnr.Retrieve("2")
+	assert.Equal(t, ErrNoteNotFound, err)
+}
+
+func TestRedisNoteRepoRetrieveMany(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	now := time.Now()
+
+	m := map[string]string{
+		fieldNoteID:        "1",
+		fieldNoteContent:   "test",
+		fieldNoteCreatedAt: now.Format(time.RFC3339),
+		fieldNoteUpdatedAt: now.Format(time.RFC3339),
+	}
+	mrc.On("HGetAllMap", "notes:1").Return(m, nil)
+	mrc.On("HGetAllMap", "notes:2").Return(map[string]string{}, nil)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	notes, err := rnr.RetrieveMany([]string{"2", "1"})
+	assert.NoError(t, err)
+	if assert.Len(t, notes, 2) {
+		assert.Nil(t, notes[0])
+		assert.Equal(t, "1", notes[1].ID)
+	}
+}
+
 func TestRedisNoteRepoUpdate(t *testing.T) {
 	mrc := &MockRedisClient{}
 
@@ -73,11 +178,14 @@ func TestRedisNoteRepoUpdate(t *testing.T) {
 		fieldNoteCreatedAt: now.Add(-30 * time.Minute).Format(time.RFC3339),
 		fieldNoteUpdatedAt: updatedAt.Format(time.RFC3339),
 	}
+	expectWatch(mrc, "notes:1")
 	mrc.On("HGetAllMap", "notes:1").Return(m, nil)
 	mrc.On("HMSet",
 		"notes:1",
 		"id", "1",
 		mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
+	expectRecordChange(&mrc.Mock, "1", false)
 
 	rnr, err := NewRedisNoteRepository(
 		RedisClientOption(mrc),
@@ -89,13 +197,19 @@ func TestRedisNoteRepoUpdate(t *testing.T) {
 	assert.Equal(t, "updated contents", n.Content)
 	assert.True(t, updatedAt.Before(n.UpdatedAt))
 	assert.NotEmpty(t, n.CreatedAt)
+
+	// the note is watched before it is read.
+	mrc.AssertExpectations(t)
 }
 
 func TestRedisNoteRepoDelete(t *testing.T) {
 	mrc := &MockRedisClient{}
 
+	expectWatch(mrc, "notes:1")
+	mrc.On("HGetAllMap", "notes:1").Return(map[string]string{}, nil)
 	mrc.On("LRem", "notes:catalog", int64(0), "1").Return(int64(1), nil)
 	mrc.On("Delete", []string{"notes:1"}).Return(int64(0), nil)
+	mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
 
 	rnr, err := NewRedisNoteRepository(
 		RedisClientOption(mrc),
@@ -106,6 +220,133 @@ func TestRedisNoteRepoDelete(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRedisNoteRepoDeletePublishes(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expectWatch(mrc, "notes:1")
+	expectWatch(mrc, "notes:2")
+	mrc.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1", fieldNoteContent: "test"}, nil)
+	mrc.On("HGetAllMap", "notes:2").Return(map[string]string{}, nil)
+	mrc.On("LRem", "notes:catalog", int64(0), mock.AnythingOfType("string")).Return(int64(0), nil)
+	mrc.On("Delete", []string{"notes:1"}).Return(int64(1), nil)
+	mrc.On("Delete", []string{"notes:2"}).Return(int64(0), nil)
+	mrc.On("ZRem", "notes:expiry", mock.AnythingOfType("[]string")).Return(int64(0), nil)
+	expectRecordChange(&mrc.Mock, "1", true).Once()
+
+	mp := &MockNotePublisher{}
+	mp.On("Publish", NoteDeleted, "1", (*Note)(nil)).Return(nil).Once()
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+		NoteEventPublisher(mp),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, rnr.Delete("1"))
+
+	// deleting a note which doesn't exist is not a change.
+	assert.NoError(t, rnr.Delete("2"))
+
+	mrc.AssertExpectations(t)
+	mp.AssertExpectations(t)
+}
+
+// xaddArgs matches the arguments of an XADD of an event to the stream
+// "events", and checks its fields.
+func xaddArgs(typ events.Type, check func(fields map[string]string)) interface{} {
+	return mock.MatchedBy(func(args []interface{}) bool {
+		if len(args) < 6 || args[0] != "XADD" || args[1] != "events" {
+			return false
+		}
+
+		fields := map[string]string{}
+		for i := 6; i+1 < len(args); i += 2 {
+			fields[args[i].(string)] = args[i+1].(string)
+		}
+
+		if fields[events.FieldType] != string(typ) {
+			return false
+		}
+
+		check(fields)
+		return true
+	})
+}
+
+func TestRedisNoteRepoCreateAppendsEvent(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mtx := &MockRedisTx{}
+
+	mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), []string{"notes:1"}).
+		Return(func(fn func(RedisTx) error, keys ...string) error {
+			return fn(mtx)
+		})
+	mtx.On("Exec", mock.AnythingOfType("func() error")).
+		Return(func(fn func() error) error {
+			return fn()
+		})
+	mtx.On("HMSet", "notes:1", "id", "1", mock.AnythingOfType("[]string")).Return("", nil)
+	mtx.On("LPush", "notes:catalog", []string{"1"}).Return(int64(1), nil)
+	mtx.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
+	expectRecordChange(&mtx.Mock, "1", false)
+	mtx.On("Do", xaddArgs(events.NoteCreated, func(fields map[string]string) {
+		assert.Equal(t, "1", fields[events.FieldNoteID])
+		assert.NotContains(t, fields, events.FieldBefore)
+		assert.Contains(t, fields[events.FieldAfter], `"content":"test"`)
+	})).Return("1-0", nil).Once()
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+		NoteIDGenFn(func() string { return "1" }),
+		NoteEventStream("events", 10),
+	)
+	assert.NoError(t, err)
+
+	_, err = rnr.Create("test")
+	assert.NoError(t, err)
+
+	mtx.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoDeleteAppendsEvent(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mtx := &MockRedisTx{}
+
+	mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), []string{"notes:1"}).
+		Return(func(fn func(RedisTx) error, keys ...string) error {
+			return fn(mtx)
+		})
+	// the note is read after it is watched, before the transaction.
+	mtx.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1", fieldNoteContent: "test"}, nil)
+	mtx.On("Exec", mock.AnythingOfType("func() error")).
+		Return(func(fn func() error) error {
+			return fn()
+		})
+	mtx.On("LRem", "notes:catalog", int64(0), "1").Return(int64(0), nil)
+	// queued commands have no results until the transaction is executed.
+	mtx.On("Delete", []string{"notes:1"}).Return(int64(0), nil)
+	mtx.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
+	expectRecordChange(&mtx.Mock, "1", true)
+	mtx.On("Do", xaddArgs(events.NoteDeleted, func(fields map[string]string) {
+		assert.Contains(t, fields[events.FieldBefore], `"content":"test"`)
+		assert.NotContains(t, fields, events.FieldAfter)
+	})).Return("1-0", nil).Once()
+
+	mp := &MockNotePublisher{}
+	mp.On("Publish", NoteDeleted, "1", (*Note)(nil)).Return(nil).Once()
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+		NoteEventStream("events", 10),
+		NoteEventPublisher(mp),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, rnr.Delete("1"))
+
+	mtx.AssertExpectations(t)
+	mp.AssertExpectations(t)
+}
+
 func TestRedisNoteRepoList(t *testing.T) {
 	mrc := &MockRedisClient{}
 
@@ -131,3 +372,449 @@ func TestRedisNoteRepoList(t *testing.T) {
 	assert.Len(t, notes, 1)
 	assert.NoError(t, err)
 }
+
+func TestRedisNoteRepoSweepExpired(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	now := time.Now()
+
+	mrc.On("ZRangeByScore", "notes:expiry", "-inf", fmt.Sprintf("%d", now.Unix())).
+		Return([]string{"1", "2", "3"}, nil)
+
+	// 1 has expired, and 2 was deleted before it expired.
+	for _, id := range []string{"1", "2"} {
+		expectWatch(mrc, "notes:"+id)
+		mrc.On("Exists", "notes:"+id).Return(false, nil)
+		mrc.On("ZRem", "notes:expiry", []string{id}).Return(int64(1), nil)
+	}
+	mrc.On("Do", []interface{}{"ZSCORE", "notes:tombstones", "1"}).Return(nil, nil)
+	mrc.On("Do", []interface{}{"ZSCORE", "notes:tombstones", "2"}).Return("100", nil)
+	mrc.On("LRem", "notes:catalog", int64(0), "1").Return(int64(1), nil)
+	expectRecordChange(&mrc.Mock, "1", true).Once()
+
+	// 3 was given a later expiry, so it is left in the index.
+	expectWatch(mrc, "notes:3")
+	mrc.On("Exists", "notes:3").Return(true, nil)
+	mrc.On("HGet", "notes:3", fieldNoteExpiresAt).Return(now.Add(time.Hour).Format(time.RFC3339), nil)
+
+	mrc.On("Eval", pruneTombstonesScript,
+		[]string{"notes:changes", "notes:tombstones", "notes:changefloor", "notes:changes:readers"},
+		[]string{fmt.Sprintf("%d", now.Add(-defaultTombstoneTTL).Unix())}).Return(int64(0), nil)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	n, err := rnr.SweepExpired(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	mrc.AssertExpectations(t)
+	mrc.AssertNotCalled(t, "ZRem", "notes:expiry", []string{"3"})
+}
+
+func TestRedisNoteRepoSweepRecreated(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	expiresAt := time.Now().Add(time.Hour).UTC()
+
+	expectWatch(mrc, "notes:1")
+	mrc.On("Exists", "notes:1").Return(false, nil).Once()
+	mrc.On("HMSet", "notes:1", "id", "1", mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ExpireAt", "notes:1", expiresAt).Return(true, nil)
+	mrc.On("ZAdd", "notes:expiry", float64(expiresAt.Unix()), "1").Return(int64(1), nil)
+	mrc.On("LPush", "notes:catalog", []string{"1"}).Return(int64(1), nil)
+	mrc.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1", fieldNoteContent: "test"}, nil)
+	mrc.On("LRem", "notes:catalog", int64(0), "1").Return(int64(1), nil)
+	mrc.On("Delete", []string{"notes:1"}).Return(int64(1), nil)
+	mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(1), nil)
+	expectRecordChange(&mrc.Mock, "1", false)
+	expectRecordChange(&mrc.Mock, "1", true)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	_, err = rnr.Create("test", NoteID("1"), NoteExpiresAt(expiresAt))
+	assert.NoError(t, err)
+
+	assert.NoError(t, rnr.Delete("1"))
+
+	// the note is created again without an expiry.
+	mrc.On("Exists", "notes:1").Return(false, nil).Once()
+	_, err = rnr.Create("test", NoteID("1"))
+	assert.NoError(t, err)
+
+	// the expiry index still has the note if removing it raced the sweep.
+	mrc.On("ZRangeByScore", "notes:expiry", "-inf", fmt.Sprintf("%d", expiresAt.Unix())).
+		Return([]string{"1"}, nil)
+	mrc.On("Exists", "notes:1").Return(true, nil)
+	mrc.On("HGet", "notes:1", fieldNoteExpiresAt).Return("", ErrKeyNotFound)
+	mrc.On("Eval", pruneTombstonesScript, mock.AnythingOfType("[]string"), mock.AnythingOfType("[]string")).
+		Return(int64(0), nil)
+
+	n, err := rnr.SweepExpired(expiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// the live note stays in the catalog.
+	mrc.AssertNumberOfCalls(t, "LRem", 1)
+	mrc.AssertNumberOfCalls(t, "LPush", 2)
+	mrc.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoWalk(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	ids := make([]string, walkPageSize)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%d", i)
+		mrc.On("HGetAllMap", "notes:"+ids[i]).Return(map[string]string{fieldNoteID: ids[i]}, nil)
+	}
+	mrc.On("LRange", "notes:catalog", int64(0), int64(walkPageSize-1)).Return(ids, nil)
+	mrc.On("LRange", "notes:catalog", int64(walkPageSize), int64(2*walkPageSize-1)).Return([]string{"last"}, nil)
+	mrc.On("HGetAllMap", "notes:last").Return(map[string]string{fieldNoteID: "last"}, nil)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	var walked []string
+	err = rnr.Walk(func(n *Note) error {
+		walked = append(walked, n.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, append(ids, "last"), walked)
+}
+
+func TestRedisNoteRepoImport(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	expectWatch(mrc, "notes:1")
+	mrc.On("Exists", "notes:1").Return(false, nil)
+	mrc.On("HMSet",
+		"notes:1",
+		"id", "1",
+		mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
+	mrc.On("LPush", "notes:catalog", []string{"1"}).Return(int64(1), nil)
+	expectRecordChange(&mrc.Mock, "1", false)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	createdAt := time.Now().Add(-time.Hour)
+	n := &Note{ID: "1", Content: "test", CreatedAt: createdAt}
+
+	created, err := rnr.Import(n, false)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, createdAt, n.UpdatedAt)
+	assert.Equal(t, int64(1), n.Version)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoImportExisting(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	expectWatch(mrc, "notes:1")
+	mrc.On("Exists", "notes:1").Return(true, nil)
+	mrc.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1", fieldNoteVersion: "3"}, nil)
+	mrc.On("Delete", []string{"notes:1"}).Return(int64(1), nil)
+	mrc.On("HMSet",
+		"notes:1",
+		"id", "1",
+		mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
+	expectRecordChange(&mrc.Mock, "1", false)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	_, err = rnr.Import(&Note{ID: "1", Content: "test"}, false)
+	assert.Equal(t, ErrNoteExists, err)
+
+	// the version goes up from the overwritten note's.
+	n := &Note{ID: "1", Content: "test", Version: 1}
+	created, err := rnr.Import(n, true)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, int64(4), n.Version)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoTransact(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mtx := &MockRedisTx{}
+
+	// a note created with a given id is watched with the notes changed.
+	mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), []string{"notes:mine", "notes:1", "notes:2"}).
+		Return(func(fn func(RedisTx) error, keys ...string) error {
+			return fn(mtx)
+		})
+
+	mtx.On("HGetAllMap", "notes:mine").Return(map[string]string{}, nil)
+	mtx.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1", fieldNoteContent: "test"}, nil)
+	mtx.On("Exec", mock.AnythingOfType("func() error")).
+		Return(func(fn func() error) error {
+			return fn()
+		})
+	mtx.On("HMSet",
+		mock.AnythingOfType("string"),
+		"id", mock.AnythingOfType("string"),
+		mock.AnythingOfType("[]string")).Return("", nil)
+	mtx.On("ZRem", "notes:expiry", mock.AnythingOfType("[]string")).Return(int64(0), nil)
+	mtx.On("LPush", "notes:catalog", []string{"new"}).Return(int64(1), nil)
+	mtx.On("LPush", "notes:catalog", []string{"mine"}).Return(int64(1), nil)
+	mtx.On("LRem", "notes:catalog", int64(0), "2").Return(int64(1), nil)
+	mtx.On("Delete", []string{"notes:2"}).Return(int64(1), nil)
+	expectRecordChange(&mtx.Mock, "new", false).Once()
+	expectRecordChange(&mtx.Mock, "mine", false).Once()
+	expectRecordChange(&mtx.Mock, "1", false).Once()
+	expectRecordChange(&mtx.Mock, "2", true).Once()
+
+	// events are published once the transaction has been executed.
+	mp := &MockNotePublisher{}
+	mp.On("Publish", NoteCreated, "new", mock.AnythingOfType("*omniscient.Note")).Return(nil).Once()
+	mp.On("Publish", NoteCreated, "mine", mock.AnythingOfType("*omniscient.Note")).Return(nil).Once()
+	mp.On("Publish", NoteUpdated, "1", mock.AnythingOfType("*omniscient.Note")).Return(nil).Once()
+	mp.On("Publish", NoteDeleted, "2", (*Note)(nil)).Return(nil).Once()
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+		NoteIDGenFn(func() string { return "new" }),
+		NoteEventPublisher(mp))
+	assert.NoError(t, err)
+
+	notes, err := rnr.Transact([]NoteOp{
+		{Kind: NoteOpCreate, Content: "created"},
+		{Kind: NoteOpCreate, Content: "mine", Options: []NoteOption{NoteID("mine")}},
+		{Kind: NoteOpUpdate, ID: "1", Content: "updated"},
+		{Kind: NoteOpDelete, ID: "2"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, notes, 4)
+	assert.Equal(t, "new", notes[0].ID)
+	assert.Equal(t, "mine", notes[1].ID)
+	assert.Equal(t, "updated", notes[2].Content)
+	assert.Equal(t, int64(1), notes[0].Version)
+	assert.Equal(t, int64(1), notes[2].Version)
+	assert.Nil(t, notes[3])
+
+	mtx.AssertExpectations(t)
+	mp.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoTransactFailure(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mtx := &MockRedisTx{}
+
+	mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), []string{"notes:1"}).
+		Return(func(fn func(RedisTx) error, keys ...string) error {
+			return fn(mtx)
+		})
+	mtx.On("HGetAllMap", "notes:1").Return(map[string]string{}, nil)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	_, err = rnr.Transact([]NoteOp{
+		{Kind: NoteOpCreate, Content: "created"},
+		{Kind: NoteOpRetrieve, ID: "1"},
+	})
+	assert.Equal(t, &OpError{Index: 1, Err: ErrNoteNotFound}, err)
+
+	mtx.AssertNotCalled(t, "Exec", mock.Anything)
+}
+
+func TestRedisNoteRepoCreateWithID(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mtx := &MockRedisTx{}
+
+	// the id is checked while the note is watched, and nothing is written
+	// if it is taken.
+	mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), []string{"notes:taken"}).
+		Return(func(fn func(RedisTx) error, keys ...string) error {
+			return fn(mtx)
+		})
+	mtx.On("Exists", "notes:taken").Return(true, nil)
+	mrc.On("Exists", "notes:mine").Return(false, nil)
+	expectWatch(mrc, "notes:mine")
+	mrc.On("HMSet",
+		"notes:mine",
+		"id", "mine",
+		mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ZRem", "notes:expiry", []string{"mine"}).Return(int64(0), nil)
+	mrc.On("LPush", "notes:catalog", []string{"mine"}).Return(int64(1), nil)
+	expectRecordChange(&mrc.Mock, "mine", false)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	_, err = rnr.Create("test", NoteID("taken"))
+	assert.Equal(t, ErrNoteExists, err)
+
+	_, err = rnr.Create("test", NoteID("not:valid"))
+	assert.Equal(t, ErrInvalidNoteID, err)
+
+	n, err := rnr.Create("test", NoteID("mine"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mine", n.ID)
+
+	mtx.AssertExpectations(t)
+	mtx.AssertNotCalled(t, "Exec", mock.Anything)
+}
+
+func TestRedisNoteRepoCreateWithSlug(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	// "deploy" belongs to note 2, "stale" to a note which has been deleted.
+	mrc.On("HSetNX", "notes:slugs", "deploy", "1").Return(false, nil)
+	mrc.On("HGet", "notes:slugs", "deploy").Return("2", nil)
+	mrc.On("HGetAllMap", "notes:2").Return(map[string]string{fieldNoteID: "2", fieldNoteSlug: "deploy"}, nil)
+	mrc.On("HSetNX", "notes:slugs", "stale", "1").Return(false, nil)
+	mrc.On("HGet", "notes:slugs", "stale").Return("3", nil)
+	mrc.On("HGetAllMap", "notes:3").Return(map[string]string{}, nil)
+	mrc.On("HSet", "notes:slugs", "stale", "1").Return(false, nil)
+	expectWatch(mrc, "notes:1")
+	mrc.On("HMSet",
+		"notes:1",
+		"id", "1",
+		mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(0), nil)
+	mrc.On("LPush", "notes:catalog", []string{"1"}).Return(int64(1), nil)
+	expectRecordChange(&mrc.Mock, "1", false)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+		NoteIDGenFn(func() string { return "1" }))
+	assert.NoError(t, err)
+
+	_, err = rnr.Create("test", NoteSlug("deploy"))
+	assert.Equal(t, ErrNoteSlugTaken, err)
+
+	n, err := rnr.Create("test", NoteSlug("stale"))
+	assert.NoError(t, err)
+	assert.Equal(t, "stale", n.Slug)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoRetrieveBySlug(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	mrc.On("HGet", "notes:slugs", "deploy").Return("1", nil)
+	mrc.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1", fieldNoteSlug: "deploy"}, nil)
+	mrc.On("HGet", "notes:slugs", "missing").Return("", ErrKeyNotFound)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	n, err := rnr.RetrieveBySlug("deploy")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", n.ID)
+
+	_, err = rnr.RetrieveBySlug("missing")
+	assert.Equal(t, ErrNoteNotFound, err)
+}
+
+func TestRedisNoteRepoPatch(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mtx := &MockRedisTx{}
+
+	mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), []string{"notes:1"}).
+		Return(func(fn func(RedisTx) error, keys ...string) error {
+			return fn(mtx)
+		})
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	mtx.On("HGetAllMap", "notes:1").Return(map[string]string{
+		fieldNoteID:        "1",
+		fieldNoteContent:   "test",
+		fieldNoteExpiresAt: expiresAt,
+	}, nil)
+	mtx.On("Exec", mock.AnythingOfType("func() error")).
+		Return(func(fn func() error) error {
+			return fn()
+		})
+	mtx.On("HMSet",
+		"notes:1",
+		"id", "1",
+		mock.AnythingOfType("[]string")).Return("", nil)
+	mtx.On("HDel", "notes:1", []string{fieldNoteExpiresAt}).Return(int64(1), nil)
+	mtx.On("Persist", "notes:1").Return(true, nil)
+	mtx.On("ZRem", "notes:expiry", []string{"1"}).Return(int64(1), nil)
+	expectRecordChange(&mtx.Mock, "1", false)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	note, err := rnr.Patch("1", func(n *Note) error {
+		n.ID = "2"
+		n.Content = "patched"
+		n.ExpiresAt = nil
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", note.ID)
+	assert.Equal(t, "patched", note.Content)
+	assert.Nil(t, note.ExpiresAt)
+
+	mtx.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoPatchRetriesConflicts(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	mrc.On("Watch", mock.AnythingOfType("func(omniscient.RedisTx) error"), []string{"notes:1"}).
+		Return(ErrTxConflict)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	_, err = rnr.Patch("1", func(n *Note) error { return nil })
+	assert.Equal(t, ErrTxConflict, err)
+
+	mrc.AssertNumberOfCalls(t, "Watch", maxPatchAttempts)
+}
+
+func TestRedisNoteRepoListPage(t *testing.T) {
+	mrc := &MockRedisClient{}
+
+	mrc.On("LRange", "notes:catalog", int64(2), int64(4)).Return([]string{"3", "4", "5"}, nil)
+	mrc.On("HGetAllMap", "notes:3").Return(map[string]string{fieldNoteID: "3", fieldNoteContent: "test"}, nil)
+	mrc.On("HGetAllMap", "notes:4").Return(map[string]string{}, nil)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+	)
+	assert.NoError(t, err)
+
+	notes, more, err := rnr.ListPage(2, 2)
+	assert.NoError(t, err)
+	assert.True(t, more)
+	assert.Len(t, notes, 1)
+	assert.Equal(t, "3", notes[0].ID)
+
+	mrc.AssertNotCalled(t, "HGetAllMap", "notes:5")
+}
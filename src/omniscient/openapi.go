@@ -0,0 +1,783 @@
+package omniscient
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	openAPIVersion = "3.0.0"
+	schemaRefBase  = "#/components/schemas/"
+)
+
+var (
+	// openAPIParam matches the parameters in the paths of the spec, e.g.
+	// {id}, which are :id in routes.
+	openAPIParam = regexp.MustCompile(`\{([A-Za-z_]+)\}`)
+
+	// openAPISchemas are the types described in the components of the spec.
+	openAPISchemas = []struct {
+		name string
+		v    interface{}
+	}{
+		{"Note", Note{}},
+		{"CreateNoteRequest", createNoteReq{}},
+		{"UpdateNoteRequest", updateNoteReq{}},
+		{"ShareNoteRequest", shareNoteReq{}},
+		{"JSONPatchOperation", jsonPatchOp{}},
+		{"BatchRequest", batchReq{}},
+		{"BatchOperation", batchOpReq{}},
+		{"BatchResponse", batchResp{}},
+		{"BatchResult", batchOpResult{}},
+		{"SyncResponse", syncResp{}},
+		{"SyncRequest", syncReq{}},
+		{"SyncChange", syncChangeReq{}},
+		{"ImportResult", importResult{}},
+		{"Problem", Problem{}},
+		{"FieldError", FieldError{}},
+		{"AppInfo", appInfo{}},
+		{"GraphQLRequest", gqlRequest{}},
+		{"NoteEvent", NoteEvent{}},
+		{"CreateWebhookRequest", createWebhookReq{}},
+		{"Webhook", Webhook{}},
+		{"WebhookDelivery", WebhookDelivery{}},
+		{"CreateAPIKeyRequest", createAPIKeyReq{}},
+		{"APIKey", APIKey{}},
+		{"CreateTenantRequest", createTenantReq{}},
+		{"Tenant", Tenant{}},
+		{"TenantUsage", TenantUsage{}},
+		{"CreateShareLinkRequest", createShareLinkReq{}},
+		{"ShareLink", ShareLink{}},
+		{"SharedNote", sharedNoteResp{}},
+	}
+
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+type schema map[string]interface{}
+
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]schema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary"`
+	OperationID string                      `json:"operationId"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Schema      schema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema schema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+// openAPIRoute is an operation at a path in the spec.
+type openAPIRoute struct {
+	method string
+	path   string
+	op     *openAPIOperation
+}
+
+// openAPI describes every route of the app as an OpenAPI 3 document.
+func (a *App) openAPI() *openAPIDoc {
+	doc := &openAPIDoc{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:   "Omniscient",
+			Version: revision,
+		},
+		Paths: map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: map[string]schema{},
+		},
+	}
+	if doc.Info.Version == "" {
+		doc.Info.Version = "dev"
+	}
+
+	names := map[reflect.Type]string{}
+	for _, s := range openAPISchemas {
+		names[reflect.TypeOf(s.v)] = s.name
+	}
+	for _, s := range openAPISchemas {
+		doc.Components.Schemas[s.name] = typeSchema(reflect.TypeOf(s.v), names, false)
+	}
+
+	add := func(r openAPIRoute) {
+		if doc.Paths[r.path] == nil {
+			doc.Paths[r.path] = map[string]*openAPIOperation{}
+		}
+		doc.Paths[r.path][strings.ToLower(r.method)] = r.op
+	}
+
+	for _, r := range v1OpenAPIRoutes() {
+		add(openAPIRoute{method: r.method, path: "/v1" + r.path, op: r.op})
+
+		if !legacyRoutes[r.method+" "+openAPIParam.ReplaceAllString(r.path, ":$1")] {
+			continue
+		}
+
+		legacy := *r.op
+		legacy.OperationID = "legacy" + strings.ToUpper(r.op.OperationID[:1]) + r.op.OperationID[1:]
+		legacy.Deprecated = true
+		add(openAPIRoute{method: r.method, path: r.path, op: &legacy})
+	}
+
+	for _, r := range appOpenAPIRoutes() {
+		add(r)
+	}
+
+	return doc
+}
+
+func v1OpenAPIRoutes() []openAPIRoute {
+	idParam := pathParam("id", "note id")
+	webhookParam := pathParam("id", "webhook id")
+	apiKeyParam := pathParam("id", "api key id")
+	tenantParam := pathParam("id", "tenant id")
+
+	return []openAPIRoute{
+		{"POST", "/notes", &openAPIOperation{
+			Summary:     "Create a note",
+			OperationID: "createNote",
+			Parameters: []openAPIParameter{
+				{Name: HeaderIdempotencyKey, In: "header", Description: "makes the request safe to retry", Schema: schema{"type": "string"}},
+			},
+			RequestBody: jsonBody(schemaRef("CreateNoteRequest")),
+			Responses:   responses(http.StatusCreated, jsonResponse("the created note", schemaRef("Note"))),
+		}},
+		{"GET", "/notes", &openAPIOperation{
+			Summary:     "List notes, optionally a page at a time",
+			OperationID: "listNotes",
+			Parameters: []openAPIParameter{
+				{Name: "limit", In: "query", Description: "number of notes in a page", Schema: schema{"type": "integer", "minimum": 1, "maximum": maxPageSize}},
+				{Name: "cursor", In: "query", Description: "where the page starts, from the next link of the previous page", Schema: schema{"type": "string"}},
+			},
+			Responses: responses(http.StatusOK, jsonResponse("every note", schema{"type": "array", "items": schemaRef("Note")})),
+		}},
+		{"GET", "/notes/watch", &openAPIOperation{
+			Summary:     "Watch changes to notes as server-sent events, or over a WebSocket",
+			OperationID: "watchNotes",
+			Parameters: []openAPIParameter{
+				{Name: HeaderLastEventID, In: "header", Description: "resume after this event", Schema: schema{"type": "integer", "minimum": 0}},
+				{Name: "last_event_id", In: "query", Description: "resume after this event, for clients which can't set headers", Schema: schema{"type": "integer", "minimum": 0}},
+			},
+			Responses: responses(http.StatusOK, &openAPIResponse{
+				Description: "an event for each change, with the event type as its name",
+				Content:     map[string]openAPIMediaType{mimeEventStream: {Schema: schemaRef("NoteEvent")}},
+			}),
+		}},
+		{"GET", "/notes/{id}", &openAPIOperation{
+			Summary:     "Retrieve a note",
+			OperationID: "getNote",
+			Parameters:  []openAPIParameter{idParam},
+			Responses:   responses(http.StatusOK, jsonResponse("the note", schemaRef("Note"))),
+		}},
+		{"GET", "/notes/by-slug/{slug}", &openAPIOperation{
+			Summary:     "Retrieve a note by its slug",
+			OperationID: "getNoteBySlug",
+			Parameters:  []openAPIParameter{pathParam("slug", "note slug")},
+			Responses:   responses(http.StatusOK, jsonResponse("the note", schemaRef("Note"))),
+		}},
+		{"PUT", "/notes/{id}", &openAPIOperation{
+			Summary:     "Update a note, or create it with the given id",
+			OperationID: "updateNote",
+			Parameters:  []openAPIParameter{idParam},
+			RequestBody: jsonBody(schemaRef("UpdateNoteRequest")),
+			Responses: responses(
+				http.StatusOK, jsonResponse("the updated note", schemaRef("Note")),
+				http.StatusCreated, jsonResponse("the created note", schemaRef("Note"))),
+		}},
+		{"PATCH", "/notes/{id}", &openAPIOperation{
+			Summary:     "Patch a note with a JSON Merge Patch or a JSON Patch",
+			OperationID: "patchNote",
+			Parameters:  []openAPIParameter{idParam},
+			RequestBody: &openAPIRequestBody{
+				Required: true,
+				Content: map[string]openAPIMediaType{
+					mimeMergePatch: {Schema: schema{"type": "object"}},
+					mimeJSONPatch:  {Schema: schema{"type": "array", "items": schemaRef("JSONPatchOperation")}},
+				},
+			},
+			Responses: responses(http.StatusOK, jsonResponse("the patched note", schemaRef("Note"))),
+		}},
+		{"DELETE", "/notes/{id}", &openAPIOperation{
+			Summary:     "Delete a note",
+			OperationID: "deleteNote",
+			Parameters:  []openAPIParameter{idParam},
+			Responses:   responses(http.StatusNoContent, &openAPIResponse{Description: "the note was deleted"}),
+		}},
+		{"PUT", "/notes/{id}/shares", &openAPIOperation{
+			Summary:     "Set who a note is shared with, as reader or editor",
+			OperationID: "shareNote",
+			Parameters:  []openAPIParameter{idParam},
+			RequestBody: jsonBody(schemaRef("ShareNoteRequest")),
+			Responses:   responses(http.StatusOK, jsonResponse("the shared note", schemaRef("Note"))),
+		}},
+		{"POST", "/notes/{id}/share", &openAPIOperation{
+			Summary:     "Create a read-only public link to a note",
+			OperationID: "createShareLink",
+			Parameters:  []openAPIParameter{idParam},
+			RequestBody: jsonBody(schemaRef("CreateShareLinkRequest")),
+			Responses:   responses(http.StatusCreated, jsonResponse("the link, with its url", schemaRef("ShareLink"))),
+		}},
+		{"GET", "/notes/{id}/share", &openAPIOperation{
+			Summary:     "List the public links to a note",
+			OperationID: "listShareLinks",
+			Parameters:  []openAPIParameter{idParam},
+			Responses:   responses(http.StatusOK, jsonResponse("the links, oldest first", schema{"type": "array", "items": schemaRef("ShareLink")})),
+		}},
+		{"DELETE", "/notes/{id}/share", &openAPIOperation{
+			Summary:     "Revoke every public link to a note",
+			OperationID: "revokeShareLinks",
+			Parameters:  []openAPIParameter{idParam},
+			Responses:   responses(http.StatusNoContent, &openAPIResponse{Description: "the links were revoked"}),
+		}},
+		{"DELETE", "/notes/{id}/share/{link}", &openAPIOperation{
+			Summary:     "Revoke a public link to a note",
+			OperationID: "revokeShareLink",
+			Parameters:  []openAPIParameter{idParam, pathParam("link", "share link id")},
+			Responses:   responses(http.StatusNoContent, &openAPIResponse{Description: "the link was revoked"}),
+		}},
+		{"POST", "/notes:import", &openAPIOperation{
+			Summary:     "Import notes as NDJSON",
+			OperationID: "importNotes",
+			Parameters: []openAPIParameter{
+				{Name: "preserve_ids", In: "query", Description: "keep the ids of imported notes", Schema: schema{"type": "boolean"}},
+				{Name: "mode", In: "query", Description: "create or upsert", Schema: schema{"type": "string", "enum": []string{importModeCreate, importModeUpsert}}},
+			},
+			RequestBody: &openAPIRequestBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{mimeNDJSON: {Schema: schemaRef("Note")}},
+			},
+			Responses: responses(http.StatusOK, &openAPIResponse{
+				Description: "a result for each imported line",
+				Content:     map[string]openAPIMediaType{mimeNDJSON: {Schema: schemaRef("ImportResult")}},
+			}),
+		}},
+		{"GET", "/notes:export", &openAPIOperation{
+			Summary:     "Export every note as NDJSON",
+			OperationID: "exportNotes",
+			Responses: responses(http.StatusOK, &openAPIResponse{
+				Description: "a note on each line",
+				Content:     map[string]openAPIMediaType{mimeNDJSON: {Schema: schemaRef("Note")}},
+			}),
+		}},
+		{"POST", "/batch", &openAPIOperation{
+			Summary:     "Run multiple note operations",
+			OperationID: "batch",
+			RequestBody: jsonBody(schemaRef("BatchRequest")),
+			Responses:   responses(http.StatusOK, jsonResponse("a result for each operation", schemaRef("BatchResponse"))),
+		}},
+		{"GET", "/sync", &openAPIOperation{
+			Summary:     "Fetch the notes changed since a sync token, or every note without one",
+			OperationID: "syncNotes",
+			Parameters: []openAPIParameter{
+				{Name: "since", In: "query", Description: "the token from the previous sync", Schema: schema{"type": "string"}},
+				{Name: "limit", In: "query", Description: "number of notes and deletions in a response", Schema: schema{"type": "integer", "minimum": 1, "maximum": maxPageSize}},
+			},
+			Responses: responses(http.StatusOK, jsonResponse("the changed notes, the ids of deleted notes and the next token", schemaRef("SyncResponse"))),
+		}},
+		{"POST", "/sync", &openAPIOperation{
+			Summary:     "Apply changes made by a client, reporting conflicts with newer versions",
+			OperationID: "pushChanges",
+			RequestBody: jsonBody(schemaRef("SyncRequest")),
+			Responses:   responses(http.StatusOK, jsonResponse("a result for each change", schemaRef("BatchResponse"))),
+		}},
+		{"POST", "/webhooks", &openAPIOperation{
+			Summary:     "Create a webhook for note events",
+			OperationID: "createWebhook",
+			RequestBody: jsonBody(schemaRef("CreateWebhookRequest")),
+			Responses:   responses(http.StatusCreated, jsonResponse("the created webhook, with its secret", schemaRef("Webhook"))),
+		}},
+		{"GET", "/webhooks", &openAPIOperation{
+			Summary:     "List webhooks",
+			OperationID: "listWebhooks",
+			Responses:   responses(http.StatusOK, jsonResponse("every webhook", schema{"type": "array", "items": schemaRef("Webhook")})),
+		}},
+		{"GET", "/webhooks/{id}", &openAPIOperation{
+			Summary:     "Retrieve a webhook",
+			OperationID: "getWebhook",
+			Parameters:  []openAPIParameter{webhookParam},
+			Responses:   responses(http.StatusOK, jsonResponse("the webhook", schemaRef("Webhook"))),
+		}},
+		{"DELETE", "/webhooks/{id}", &openAPIOperation{
+			Summary:     "Delete a webhook",
+			OperationID: "deleteWebhook",
+			Parameters:  []openAPIParameter{webhookParam},
+			Responses:   responses(http.StatusNoContent, &openAPIResponse{Description: "the webhook was deleted"}),
+		}},
+		{"GET", "/webhooks/{id}/deliveries", &openAPIOperation{
+			Summary:     "List the most recent deliveries to a webhook",
+			OperationID: "listWebhookDeliveries",
+			Parameters:  []openAPIParameter{webhookParam},
+			Responses:   responses(http.StatusOK, jsonResponse("the deliveries, newest first", schema{"type": "array", "items": schemaRef("WebhookDelivery")})),
+		}},
+		{"POST", "/webhooks/{id}/deliveries/{delivery}/redeliver", &openAPIOperation{
+			Summary:     "Attempt a delivery again",
+			OperationID: "redeliverWebhook",
+			Parameters:  []openAPIParameter{webhookParam, pathParam("delivery", "delivery id")},
+			Responses:   responses(http.StatusAccepted, jsonResponse("the rescheduled delivery", schemaRef("WebhookDelivery"))),
+		}},
+		{"POST", "/api-keys", &openAPIOperation{
+			Summary:     "Create an API key",
+			OperationID: "createAPIKey",
+			RequestBody: jsonBody(schemaRef("CreateAPIKeyRequest")),
+			Responses:   responses(http.StatusCreated, jsonResponse("the created key, with the key itself", schemaRef("APIKey"))),
+		}},
+		{"GET", "/api-keys", &openAPIOperation{
+			Summary:     "List API keys",
+			OperationID: "listAPIKeys",
+			Responses:   responses(http.StatusOK, jsonResponse("every key", schema{"type": "array", "items": schemaRef("APIKey")})),
+		}},
+		{"GET", "/api-keys/{id}", &openAPIOperation{
+			Summary:     "Retrieve an API key",
+			OperationID: "getAPIKey",
+			Parameters:  []openAPIParameter{apiKeyParam},
+			Responses:   responses(http.StatusOK, jsonResponse("the key", schemaRef("APIKey"))),
+		}},
+		{"DELETE", "/api-keys/{id}", &openAPIOperation{
+			Summary:     "Revoke an API key",
+			OperationID: "deleteAPIKey",
+			Parameters:  []openAPIParameter{apiKeyParam},
+			Responses:   responses(http.StatusNoContent, &openAPIResponse{Description: "the key was revoked"}),
+		}},
+		{"POST", "/tenants", &openAPIOperation{
+			Summary:     "Create a tenant",
+			OperationID: "createTenant",
+			RequestBody: jsonBody(schemaRef("CreateTenantRequest")),
+			Responses:   responses(http.StatusCreated, jsonResponse("the created tenant", schemaRef("Tenant"))),
+		}},
+		{"GET", "/tenants", &openAPIOperation{
+			Summary:     "List tenants",
+			OperationID: "listTenants",
+			Responses:   responses(http.StatusOK, jsonResponse("every tenant", schema{"type": "array", "items": schemaRef("Tenant")})),
+		}},
+		{"GET", "/tenants/{id}", &openAPIOperation{
+			Summary:     "Retrieve a tenant with its usage",
+			OperationID: "getTenant",
+			Parameters:  []openAPIParameter{tenantParam},
+			Responses:   responses(http.StatusOK, jsonResponse("the tenant", schemaRef("Tenant"))),
+		}},
+		{"DELETE", "/tenants/{id}", &openAPIOperation{
+			Summary:     "Delete a tenant and all of its notes",
+			OperationID: "deleteTenant",
+			Parameters:  []openAPIParameter{tenantParam},
+			Responses:   responses(http.StatusNoContent, &openAPIResponse{Description: "the tenant was deleted"}),
+		}},
+	}
+}
+
+func appOpenAPIRoutes() []openAPIRoute {
+	text := func(desc string) *openAPIResponse {
+		return &openAPIResponse{
+			Description: desc,
+			Content:     map[string]openAPIMediaType{echo.MIMETextPlain: {Schema: schema{"type": "string"}}},
+		}
+	}
+
+	return []openAPIRoute{
+		{"GET", "/graphql", &openAPIOperation{
+			Summary:     "Run a GraphQL query",
+			OperationID: "graphQLQuery",
+			Parameters: []openAPIParameter{
+				{Name: "query", In: "query", Required: true, Description: "the GraphQL document", Schema: schema{"type": "string"}},
+				{Name: "operationName", In: "query", Description: "the operation to run, if the document has more than one", Schema: schema{"type": "string"}},
+				{Name: "variables", In: "query", Description: "the variables as a JSON object", Schema: schema{"type": "string"}},
+			},
+			Responses: responses(http.StatusOK, jsonResponse("a GraphQL response", schema{"type": "object"})),
+		}},
+		{"POST", "/graphql", &openAPIOperation{
+			Summary:     "Run a GraphQL query or mutation",
+			OperationID: "graphQL",
+			RequestBody: jsonBody(schemaRef("GraphQLRequest")),
+			Responses:   responses(http.StatusOK, jsonResponse("a GraphQL response", schema{"type": "object"})),
+		}},
+		{"GET", "/graphql/schema", &openAPIOperation{
+			Summary:     "The GraphQL schema",
+			OperationID: "graphQLSchema",
+			Responses:   responses(http.StatusOK, text("the schema in the GraphQL schema definition language")),
+		}},
+		{"GET", "/s/{token}", &openAPIOperation{
+			Summary:     "View a note through a public link, without authenticating",
+			OperationID: "viewShareLink",
+			Parameters:  []openAPIParameter{pathParam("token", "share link token")},
+			Responses: responses(http.StatusOK, &openAPIResponse{
+				Description: "the note as an HTML page, or as JSON if it is accepted",
+				Content: map[string]openAPIMediaType{
+					echo.MIMETextHTML:        {Schema: schema{"type": "string"}},
+					echo.MIMEApplicationJSON: {Schema: schemaRef("SharedNote")},
+				},
+			}),
+		}},
+		{"GET", "/healthz", &openAPIOperation{
+			Summary:     "Check the health of the service",
+			OperationID: "healthz",
+			Responses:   responses(http.StatusOK, text("the service is healthy")),
+		}},
+		{"GET", "/app/info", &openAPIOperation{
+			Summary:     "Describe the running service",
+			OperationID: "appInfo",
+			Responses:   responses(http.StatusOK, jsonResponse("the service revision", schemaRef("AppInfo"))),
+		}},
+		{"GET", "/slow", &openAPIOperation{
+			Summary:     "Respond slowly, for testing",
+			OperationID: "slow",
+			Responses:   responses(http.StatusOK, text("OK")),
+		}},
+		{"GET", "/fail", &openAPIOperation{
+			Summary:     "Fail, for testing error reporting",
+			OperationID: "fail",
+			Responses:   responses(http.StatusInternalServerError, text("ERROR")),
+		}},
+		{"GET", "/metrics", &openAPIOperation{
+			Summary:     "Prometheus metrics",
+			OperationID: "metrics",
+			Responses:   responses(http.StatusOK, text("metrics in the Prometheus text format")),
+		}},
+		{"GET", "/openapi.json", &openAPIOperation{
+			Summary:     "This document",
+			OperationID: "openAPI",
+			Responses:   responses(http.StatusOK, jsonResponse("the OpenAPI document", schema{"type": "object"})),
+		}},
+		{"GET", "/docs", &openAPIOperation{
+			Summary:     "Interactive API documentation",
+			OperationID: "docs",
+			Responses: responses(http.StatusOK, &openAPIResponse{
+				Description: "an HTML page",
+				Content:     map[string]openAPIMediaType{echo.MIMETextHTML: {Schema: schema{"type": "string"}}},
+			}),
+		}},
+	}
+}
+
+func schemaRef(name string) schema {
+	return schema{"$ref": schemaRefBase + name}
+}
+
+func pathParam(name, desc string) openAPIParameter {
+	return openAPIParameter{
+		Name:        name,
+		In:          "path",
+		Description: desc,
+		Required:    true,
+		Schema:      schema{"type": "string"},
+	}
+}
+
+func jsonBody(s schema) *openAPIRequestBody {
+	return &openAPIRequestBody{
+		Required: true,
+		Content:  map[string]openAPIMediaType{echo.MIMEApplicationJSON: {Schema: s}},
+	}
+}
+
+func jsonResponse(desc string, s schema) *openAPIResponse {
+	return &openAPIResponse{
+		Description: desc,
+		Content:     map[string]openAPIMediaType{echo.MIMEApplicationJSON: {Schema: s}},
+	}
+}
+
+// responses builds the responses of an operation from pairs of status and
+// response. Every operation can also fail with a problem.
+func responses(pairs ...interface{}) map[string]*openAPIResponse {
+	rs := map[string]*openAPIResponse{
+		"default": {
+			Description: "an error",
+			Content:     map[string]openAPIMediaType{mimeProblemJSON: {Schema: schemaRef("Problem")}},
+		},
+	}
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		rs[strconv.Itoa(pairs[i].(int))] = pairs[i+1].(*openAPIResponse)
+	}
+
+	return rs
+}
+
+// typeSchema derives a JSON schema from t. If ref is set, types named in names
+// are referenced rather than described inline.
+func typeSchema(t reflect.Type, names map[reflect.Type]string, ref bool) schema {
+	if name, ok := names[t]; ok && ref {
+		return schemaRef(name)
+	}
+
+	switch {
+	case t == timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := typeSchema(t.Elem(), names, true)
+		if _, isRef := s["$ref"]; !isRef {
+			s["nullable"] = true
+		}
+		return s
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": "array", "items": typeSchema(t.Elem(), names, true)}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": typeSchema(t.Elem(), names, true)}
+	case reflect.Struct:
+		s := schema{"type": "object"}
+		props := map[string]schema{}
+		var required []string
+		addStructFields(t, names, props, &required)
+		s["properties"] = props
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+
+	return schema{}
+}
+
+// addStructFields adds the JSON fields of t to props. Fields of embedded
+// structs are promoted, as they are by encoding/json.
+func addStructFields(t reflect.Type, names map[reflect.Type]string, props map[string]schema, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(f.Type, names, props, required)
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		props[name] = typeSchema(f.Type, names, true)
+
+		omitEmpty := len(parts) > 1 && parts[1] == "omitempty"
+		if !omitEmpty && f.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// serveOpenAPI serves the OpenAPI document for the app.
+func (a *App) serveOpenAPI() echo.HandlerFunc {
+	doc := a.openAPI()
+
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, doc)
+	}
+}
+
+// serveDocs serves a page for browsing and trying out the API. The page
+// loads nothing from other sites, and its Content-Security-Policy only lets
+// it run its own script.
+func (a *App) serveDocs() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Content-Security-Policy", docsPolicy)
+		return c.HTML(http.StatusOK, docsPage)
+	}
+}
+
+var docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Omniscient API</title>
+  <style>` + docsStyle + `</style>
+</head>
+<body>
+  <h1>Omniscient API</h1>
+  <label>API key or token <input id="token" type="password" autocomplete="off"></label>
+  <div id="docs"></div>
+  <script>` + docsScript + `</script>
+</body>
+</html>
+`
+
+// docsPolicy allows the docs page its inline style and script, by their
+// hashes, and requests to the API.
+var docsPolicy = fmt.Sprintf("default-src 'none'; connect-src 'self'; style-src '%s'; script-src '%s'",
+	cspHash(docsStyle), cspHash(docsScript))
+
+func cspHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+const docsStyle = `
+body { font-family: sans-serif; margin: 2em; }
+details { border: 1px solid #ccc; border-radius: 4px; margin: 0.5em 0; padding: 0.5em; }
+details.deprecated summary { text-decoration: line-through; }
+label { display: block; margin: 0.5em 0; }
+textarea { display: block; width: 100%; height: 8em; font-family: monospace; }
+pre { background: #f5f5f5; padding: 0.5em; white-space: pre-wrap; }
+`
+
+// docsScript lists the operations of the OpenAPI document, and sends
+// requests to them with the parameters and body filled in on the page.
+const docsScript = `
+(function () {
+  var root = document.getElementById("docs");
+  var token = document.getElementById("token");
+
+  function el(tag, text) {
+    var e = document.createElement(tag);
+    if (text) {
+      e.textContent = text;
+    }
+    return e;
+  }
+
+  function operation(method, path, op) {
+    var d = el("details");
+    if (op.deprecated) {
+      d.className = "deprecated";
+    }
+
+    var summary = el("summary");
+    summary.appendChild(el("b", method.toUpperCase() + " " + path));
+    summary.appendChild(document.createTextNode(" " + op.summary));
+    d.appendChild(summary);
+
+    var params = [];
+    (op.parameters || []).forEach(function (p) {
+      var label = el("label", p.name + " (" + p.in + (p.required ? ", required" : "") + ") ");
+      var input = el("input");
+      input.placeholder = p.description || "";
+      label.appendChild(input);
+      d.appendChild(label);
+      params.push({param: p, input: input});
+    });
+
+    var body, type;
+    if (op.requestBody) {
+      type = Object.keys(op.requestBody.content)[0];
+      body = el("textarea");
+      body.placeholder = type;
+      d.appendChild(body);
+    }
+
+    var send = el("button", "Send");
+    var out = el("pre");
+    send.onclick = function () {
+      var url = path, query = [], headers = {};
+      params.forEach(function (p) {
+        var v = p.input.value;
+        if (v === "") {
+          return;
+        }
+
+        switch (p.param.in) {
+        case "path":
+          url = url.replace("{" + p.param.name + "}", encodeURIComponent(v));
+          break;
+        case "query":
+          query.push(encodeURIComponent(p.param.name) + "=" + encodeURIComponent(v));
+          break;
+        case "header":
+          headers[p.param.name] = v;
+          break;
+        }
+      });
+      if (query.length) {
+        url += "?" + query.join("&");
+      }
+      if (token.value) {
+        headers.Authorization = "Bearer " + token.value;
+      }
+
+      var init = {method: method.toUpperCase(), headers: headers};
+      if (body && body.value) {
+        headers["Content-Type"] = type;
+        init.body = body.value;
+      }
+
+      out.textContent = "...";
+      fetch(url, init).then(function (res) {
+        return res.text().then(function (text) {
+          out.textContent = res.status + " " + res.statusText + "\n\n" + text;
+        });
+      }, function (err) {
+        out.textContent = String(err);
+      });
+    };
+    d.appendChild(send);
+    d.appendChild(out);
+
+    return d;
+  }
+
+  fetch("/openapi.json").then(function (res) {
+    return res.json();
+  }).then(function (doc) {
+    Object.keys(doc.paths).sort().forEach(function (path) {
+      Object.keys(doc.paths[path]).forEach(function (method) {
+        root.appendChild(operation(method, path, doc.paths[path][method]));
+      });
+    });
+  });
+})();
+`
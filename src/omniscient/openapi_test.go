@@ -0,0 +1,146 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var echoParam = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+func TestOpenAPIDescribesEveryRoute(t *testing.T) {
+	var app *App
+	captureApp := func(a *App) error {
+		app = a
+		return nil
+	}
+
+	withAppOptions(t, nil, []AppOption{captureApp}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {})
+
+	doc := app.openAPI()
+
+	for _, r := range app.router.Routes() {
+		if strings.HasSuffix(r.Path, "*") {
+			// catch all routes added by groups.
+			continue
+		}
+
+		method := strings.ToLower(r.Method)
+
+		if strings.HasSuffix(r.Path, ":method") {
+			// custom methods share a route, so any one of them will do.
+			prefix := strings.TrimSuffix(r.Path, "method")
+			found := false
+			for path, ops := range doc.Paths {
+				if strings.HasPrefix(path, prefix) && ops[method] != nil {
+					found = true
+				}
+			}
+			assert.True(t, found, "%s %s is not in the spec", r.Method, r.Path)
+			continue
+		}
+
+		path := echoParam.ReplaceAllString(r.Path, "{$1}")
+		ops, ok := doc.Paths[path]
+		if assert.True(t, ok, "%s is not in the spec", path) {
+			assert.NotNil(t, ops[method], "%s %s is not in the spec", r.Method, path)
+		}
+	}
+}
+
+func TestOpenAPILegacyRoutes(t *testing.T) {
+	var app *App
+	captureApp := func(a *App) error {
+		app = a
+		return nil
+	}
+
+	withAppOptions(t, nil, []AppOption{captureApp}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {})
+
+	routes := map[string]bool{}
+	for _, r := range app.router.Routes() {
+		routes[r.Method+" "+r.Path] = true
+	}
+
+	// only the routes which predate /v1 are served without it.
+	for route := range routes {
+		parts := strings.SplitN(route, " ", 2)
+		if routes[parts[0]+" /v1"+parts[1]] {
+			assert.True(t, legacyRoutes[route], "%s is not only served under /v1", route)
+		}
+	}
+
+	doc := app.openAPI()
+	for route := range legacyRoutes {
+		assert.True(t, routes[route], "%s is not served", route)
+
+		parts := strings.SplitN(route, " ", 2)
+		op := doc.Paths[echoParam.ReplaceAllString(parts[1], "{$1}")][strings.ToLower(parts[0])]
+		if assert.NotNil(t, op, "%s is not in the spec", route) {
+			assert.True(t, op.Deprecated, "%s is not deprecated", route)
+		}
+	}
+
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			if op.Deprecated {
+				route := strings.ToUpper(method) + " " + openAPIParam.ReplaceAllString(path, ":$1")
+				assert.True(t, legacyRoutes[route], "%s is deprecated but not a legacy route", route)
+			}
+		}
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	doc := (&App{}).openAPI()
+
+	note := doc.Components.Schemas["Note"]
+	assert.Equal(t, []string{"id", "content", "created_at", "updated_at"}, note["required"])
+
+	props := doc.Components.Schemas["CreateNoteRequest"]["properties"].(map[string]schema)
+	assert.Equal(t, schema{"type": "string"}, props["content"])
+	assert.Equal(t, schema{"type": "string", "format": "date-time", "nullable": true}, props["expires_at"])
+	assert.Contains(t, props, "ttl")
+	assert.Contains(t, props, "slug")
+
+	problem := doc.Components.Schemas["Problem"]["properties"].(map[string]schema)
+	assert.Equal(t, schema{"type": "array", "items": schemaRef("FieldError")}, problem["errors"])
+}
+
+func TestAppServesOpenAPI(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/openapi.json"
+		res, err := http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		defer res.Body.Close()
+		var doc map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&doc))
+		assert.Equal(t, openAPIVersion, doc["openapi"])
+
+		u.Path = "/docs"
+		res, err = http.Get(u.String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, res.Header.Get("Content-Type"), "text/html")
+
+		// the page loads nothing from other sites.
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(t, err)
+		assert.NotContains(t, string(b), "http://")
+		assert.NotContains(t, string(b), "https://")
+
+		policy := res.Header.Get("Content-Security-Policy")
+		assert.Contains(t, policy, "default-src 'none'")
+		assert.Contains(t, policy, cspHash(docsScript))
+		assert.Contains(t, string(b), "<script>"+docsScript+"</script>")
+	})
+}
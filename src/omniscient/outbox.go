@@ -0,0 +1,69 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"omniscient/events"
+)
+
+const defaultEventStreamMaxLen = 100000
+
+// NoteEventStream makes RedisNoteRepository append a domain event to the
+// Redis Stream stream for every change to a note, in the same transaction
+// as the change. The stream is trimmed to about maxLen entries. See package
+// events for reading the stream.
+func NoteEventStream(stream string, maxLen int64) RedisNoteRepositoryOption {
+	return func(rnr *RedisNoteRepository) error {
+		if stream == "" {
+			return errors.New("event stream name is required")
+		}
+
+		if maxLen < 1 {
+			maxLen = defaultEventStreamMaxLen
+		}
+
+		rnr.eventStream = stream
+		rnr.eventStreamMaxLen = maxLen
+		return nil
+	}
+}
+
+// appendEvent appends a domain event to the event stream, if there is one.
+// In a transaction, it is queued with the rest of the change.
+func (nr *RedisNoteRepository) appendEvent(typ events.Type, id string, before, after *Note) error {
+	if nr.eventStream == "" {
+		return nil
+	}
+
+	args := []interface{}{
+		"XADD", nr.eventStream, "MAXLEN", "~", nr.eventStreamMaxLen, "*",
+		events.FieldType, string(typ),
+		events.FieldNoteID, id,
+		events.FieldTime, time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	if nr.tenant != "" {
+		args = append(args, events.FieldTenant, nr.tenant)
+	}
+
+	for _, f := range []struct {
+		name string
+		note *Note
+	}{{events.FieldBefore, nr.withoutContent(before)}, {events.FieldAfter, nr.withoutContent(after)}} {
+		if f.note == nil {
+			continue
+		}
+
+		b, err := json.Marshal(f.note)
+		if err != nil {
+			return err
+		}
+
+		args = append(args, f.name, string(b))
+	}
+
+	_, err := nr.redisClient.Do(args...)
+	return err
+}
@@ -0,0 +1,162 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	mimeMergePatch = "application/merge-patch+json"
+	mimeJSONPatch  = "application/json-patch+json"
+)
+
+var (
+	// readOnlyNoteFields can't be changed by a patch. They can be left in
+	// the patched note as they are, so a note can be patched as it was
+	// retrieved.
+	readOnlyNoteFields = []string{
+		fieldNoteID, fieldNoteCreatedAt, fieldNoteUpdatedAt,
+		fieldNoteVersion, fieldNoteOwner, fieldNoteShares,
+	}
+)
+
+// patchFn applies a patch to the JSON representation of a note.
+type patchFn func(doc interface{}) (interface{}, error)
+
+// patchNote applies a JSON Merge Patch or a JSON Patch to a note, depending on
+// the content type of the request.
+func (a *App) patchNote() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+
+		body, err := ioutil.ReadAll(c.Request().Body())
+		if err != nil {
+			return err
+		}
+
+		ct, _, _ := mime.ParseMediaType(c.Request().Header().Get(echo.HeaderContentType))
+
+		var apply patchFn
+		switch ct {
+		case mimeMergePatch:
+			var patch interface{}
+			if err := json.Unmarshal(body, &patch); err != nil {
+				return NewProblem(CodeInvalidRequest, "invalid merge patch: %v", err)
+			}
+
+			apply = func(doc interface{}) (interface{}, error) {
+				return applyMergePatch(doc, patch), nil
+			}
+		case mimeJSONPatch:
+			var ops []jsonPatchOp
+			if err := json.Unmarshal(body, &ops); err != nil {
+				return NewProblem(CodeInvalidRequest, "invalid json patch: %v", err)
+			}
+
+			apply = func(doc interface{}) (interface{}, error) {
+				return applyJSONPatch(doc, ops)
+			}
+		default:
+			c.Response().Header().Set("Accept-Patch", mimeMergePatch+", "+mimeJSONPatch)
+			return NewProblem(CodeUnsupportedMediaType, "patch must be %s or %s", mimeMergePatch, mimeJSONPatch)
+		}
+
+		note, err := a.notes(c).Patch(id, func(n *Note) error {
+			return patchNoteDoc(n, apply, a.newValidation())
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, note)
+	}
+}
+
+// patchNoteDoc applies a patch to the JSON representation of n and copies the
+// patched content, slug and expiry back to n.
+func patchNoteDoc(n *Note, apply patchFn, v *validation) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	patched, err := apply(doc)
+	if err != nil {
+		return err
+	}
+
+	pm, ok := patched.(map[string]interface{})
+	if !ok {
+		return patchErrorf("patched note must be an object")
+	}
+
+	for k := range pm {
+		switch k {
+		case fieldNoteID, fieldNoteCreatedAt, fieldNoteUpdatedAt,
+			fieldNoteVersion, fieldNoteOwner, fieldNoteShares,
+			fieldNoteContent, fieldNoteSlug, fieldNoteExpiresAt:
+		default:
+			return patchErrorf("unknown field %q", k)
+		}
+	}
+
+	for _, k := range readOnlyNoteFields {
+		if !reflect.DeepEqual(doc[k], pm[k]) {
+			return patchErrorf("%s can't be changed", k)
+		}
+	}
+
+	if b, err = json.Marshal(pm); err != nil {
+		return err
+	}
+
+	var attrs struct {
+		Content   *string    `json:"content"`
+		Slug      string     `json:"slug"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(b, &attrs); err != nil {
+		return patchErrorf("invalid note: %v", err)
+	}
+
+	if attrs.Content == nil {
+		return patchErrorf("content is required")
+	}
+
+	v.content(fieldNoteContent, *attrs.Content)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	if attrs.Slug != "" && attrs.Slug != n.Slug {
+		if err := ValidateNoteSlug(attrs.Slug); err != nil {
+			return err
+		}
+	}
+
+	if attrs.ExpiresAt != nil && !reflect.DeepEqual(doc[fieldNoteExpiresAt], pm[fieldNoteExpiresAt]) {
+		if !attrs.ExpiresAt.After(v.now) {
+			return patchErrorf("expires_at must be in the future")
+		}
+
+		t := attrs.ExpiresAt.UTC()
+		attrs.ExpiresAt = &t
+	}
+
+	n.Content = *attrs.Content
+	n.Slug = attrs.Slug
+	n.ExpiresAt = attrs.ExpiresAt
+
+	return nil
+}
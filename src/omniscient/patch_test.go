@@ -0,0 +1,53 @@
+package omniscient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchNoteDocReadOnlyFields(t *testing.T) {
+	newNote := func() *Note {
+		return &Note{
+			ID:        "1",
+			Content:   "test",
+			CreatedAt: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			UpdatedAt: time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
+			Version:   1,
+			Owner:     "alice",
+			Shares:    map[string]NoteRole{"bob": NoteReader},
+		}
+	}
+
+	cases := []struct {
+		name    string
+		patch   string
+		content string
+		err     bool
+	}{
+		{name: "content", patch: `{"content":"patched"}`, content: "patched"},
+		{name: "unchanged read only fields", patch: `{"content":"patched","version":1,"owner":"alice","shares":{"bob":"reader"}}`, content: "patched"},
+		{name: "version", patch: `{"version":2}`, err: true},
+		{name: "owner", patch: `{"owner":"bob"}`, err: true},
+		{name: "shares", patch: `{"shares":null}`, err: true},
+	}
+
+	for _, tc := range cases {
+		n := newNote()
+		patch := decodeJSON(t, tc.patch)
+		err := patchNoteDoc(n, func(doc interface{}) (interface{}, error) {
+			return applyMergePatch(doc, patch), nil
+		}, &validation{now: time.Now(), maxContentLength: defaultMaxContentLength})
+
+		if tc.err {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.content, n.Content, tc.name)
+			assert.Equal(t, int64(1), n.Version, tc.name)
+		}
+	}
+}
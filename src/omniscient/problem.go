@@ -0,0 +1,239 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+const (
+	mimeProblemJSON = "application/problem+json"
+
+	// HeaderRequestID is the header carrying the id of a request.
+	HeaderRequestID = "X-Request-Id"
+
+	problemTypeBase = "urn:omniscient:error:"
+)
+
+// ErrorCode is a stable, machine readable code for an error.
+type ErrorCode string
+
+// Error codes returned in problem responses.
+const (
+	CodeInternal             ErrorCode = "internal_error"
+	CodeInvalidRequest       ErrorCode = "invalid_request"
+	CodeValidationFailed     ErrorCode = "validation_failed"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	CodeRequestTooLarge      ErrorCode = "request_too_large"
+	CodeConflict             ErrorCode = "conflict"
+	CodeUnauthorized         ErrorCode = "unauthorized"
+	CodeForbidden            ErrorCode = "forbidden"
+
+	CodeNoteNotFound    ErrorCode = "note_not_found"
+	CodeNoteExists      ErrorCode = "note_exists"
+	CodeNoteExpired     ErrorCode = "note_expired"
+	CodeInvalidNoteID   ErrorCode = "invalid_note_id"
+	CodeInvalidNoteSlug ErrorCode = "invalid_note_slug"
+	CodeNoteSlugTaken   ErrorCode = "note_slug_taken"
+	CodeVersionConflict ErrorCode = "note_version_conflict"
+
+	CodePatchFailed     ErrorCode = "patch_failed"
+	CodePatchTestFailed ErrorCode = "patch_test_failed"
+
+	CodeIdempotencyKeyReused     ErrorCode = "idempotency_key_reused"
+	CodeIdempotencyKeyInProgress ErrorCode = "idempotency_key_in_progress"
+
+	CodeWatchCursorExpired ErrorCode = "watch_cursor_expired"
+	CodeSyncTokenExpired   ErrorCode = "sync_token_expired"
+
+	CodeWebhookNotFound         ErrorCode = "webhook_not_found"
+	CodeWebhookDeliveryNotFound ErrorCode = "webhook_delivery_not_found"
+
+	CodeAPIKeyNotFound ErrorCode = "api_key_not_found"
+
+	CodeTenantNotFound ErrorCode = "tenant_not_found"
+	CodeTenantExists   ErrorCode = "tenant_exists"
+	CodeQuotaExceeded  ErrorCode = "tenant_quota_exceeded"
+
+	CodeShareLinkNotFound ErrorCode = "share_link_not_found"
+	CodeShareLinkExpired  ErrorCode = "share_link_expired"
+
+	CodeRateLimited ErrorCode = "rate_limited"
+)
+
+var (
+	errorCodeStatus = map[ErrorCode]int{
+		CodeInternal:                 http.StatusInternalServerError,
+		CodeInvalidRequest:           http.StatusBadRequest,
+		CodeValidationFailed:         http.StatusUnprocessableEntity,
+		CodeNotFound:                 http.StatusNotFound,
+		CodeMethodNotAllowed:         http.StatusMethodNotAllowed,
+		CodeUnsupportedMediaType:     http.StatusUnsupportedMediaType,
+		CodeRequestTooLarge:          http.StatusRequestEntityTooLarge,
+		CodeConflict:                 http.StatusConflict,
+		CodeUnauthorized:             http.StatusUnauthorized,
+		CodeForbidden:                http.StatusForbidden,
+		CodeNoteNotFound:             http.StatusNotFound,
+		CodeNoteExists:               http.StatusConflict,
+		CodeNoteExpired:              http.StatusUnprocessableEntity,
+		CodeInvalidNoteID:            http.StatusBadRequest,
+		CodeInvalidNoteSlug:          http.StatusBadRequest,
+		CodeNoteSlugTaken:            http.StatusConflict,
+		CodeVersionConflict:          http.StatusConflict,
+		CodePatchFailed:              http.StatusUnprocessableEntity,
+		CodePatchTestFailed:          http.StatusConflict,
+		CodeIdempotencyKeyReused:     http.StatusUnprocessableEntity,
+		CodeIdempotencyKeyInProgress: http.StatusConflict,
+		CodeWatchCursorExpired:       http.StatusGone,
+		CodeSyncTokenExpired:         http.StatusGone,
+		CodeWebhookNotFound:          http.StatusNotFound,
+		CodeWebhookDeliveryNotFound:  http.StatusNotFound,
+		CodeAPIKeyNotFound:           http.StatusNotFound,
+		CodeTenantNotFound:           http.StatusNotFound,
+		CodeTenantExists:             http.StatusConflict,
+		CodeQuotaExceeded:            http.StatusForbidden,
+		CodeShareLinkNotFound:        http.StatusNotFound,
+		CodeShareLinkExpired:         http.StatusGone,
+		CodeRateLimited:              http.StatusTooManyRequests,
+	}
+)
+
+// NoteError is an error returned by a NoteRepository.
+type NoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *NoteError) Error() string {
+	return e.Message
+}
+
+// FieldError describes why a field of a request is not valid.
+type FieldError struct {
+	Field   string    `json:"field"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Problem is an RFC 7807 problem details object. Handlers return it as an
+// error and the app's error handler renders it.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      ErrorCode    `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// NewProblem creates a Problem for code. The status is derived from code.
+func NewProblem(code ErrorCode, format string, args ...interface{}) *Problem {
+	status, ok := errorCodeStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	return &Problem{
+		Type:   problemTypeBase + string(code),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+		Code:   code,
+	}
+}
+
+// fieldProblem creates a Problem for a single field which is not valid.
+func fieldProblem(field string, code ErrorCode, msg string) *Problem {
+	p := NewProblem(code, "%s", msg)
+	p.Errors = []FieldError{{Field: field, Code: code, Message: msg}}
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+
+	return p.Title
+}
+
+// problemFor converts err to a Problem. Errors which aren't known are
+// reported as internal errors without any detail.
+func problemFor(err error) *Problem {
+	switch e := err.(type) {
+	case *Problem:
+		return e
+	case *NoteError:
+		return NewProblem(e.Code, "%s", e.Message)
+	case *patchError:
+		return NewProblem(CodePatchFailed, "%s", e.msg)
+	case *echo.HTTPError:
+		return NewProblem(httpStatusCode(e.Code), "%s", e.Message)
+	}
+
+	if err == ErrTxConflict {
+		return NewProblem(CodeConflict, "%s", err.Error())
+	}
+
+	return NewProblem(CodeInternal, "")
+}
+
+// httpStatusCode picks an error code for an error raised by echo itself.
+func httpStatusCode(status int) ErrorCode {
+	switch status {
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	case http.StatusRequestEntityTooLarge:
+		return CodeRequestTooLarge
+	}
+
+	if status >= http.StatusBadRequest && status < http.StatusInternalServerError {
+		return CodeInvalidRequest
+	}
+
+	return CodeInternal
+}
+
+// noteErrorStatus maps an error from a NoteRepository to an HTTP status.
+func noteErrorStatus(err error) int {
+	return problemFor(err).Status
+}
+
+// handleError renders err as an application/problem+json response.
+func handleError(err error, c echo.Context) {
+	p := *problemFor(err)
+	p.Instance = c.Request().URL().Path()
+	p.RequestID = c.Request().Header().Get(HeaderRequestID)
+
+	if p.Status >= http.StatusInternalServerError {
+		requestLog(c).WithError(err).Error("request failed")
+	}
+
+	res := c.Response()
+	if res.Committed() {
+		return
+	}
+
+	b, err := json.Marshal(&p)
+	if err != nil {
+		log.WithError(err).Error("unable to encode problem")
+		return
+	}
+
+	res.Header().Set(echo.HeaderContentType, mimeProblemJSON)
+	res.WriteHeader(p.Status)
+	if _, err := res.Write(b); err != nil {
+		log.WithError(err).Warning("unable to write problem")
+	}
+}
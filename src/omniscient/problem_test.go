@@ -0,0 +1,85 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemFor(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   ErrorCode
+		detail string
+	}{
+		{ErrNoteNotFound, http.StatusNotFound, CodeNoteNotFound, "note not found"},
+		{ErrNoteSlugTaken, http.StatusConflict, CodeNoteSlugTaken, "note slug is already taken"},
+		{ErrTxConflict, http.StatusConflict, CodeConflict, ErrTxConflict.Error()},
+		{patchErrorf("bad patch"), http.StatusUnprocessableEntity, CodePatchFailed, "bad patch"},
+		{errors.New("redis is down"), http.StatusInternalServerError, CodeInternal, ""},
+	}
+
+	for _, tc := range cases {
+		p := problemFor(tc.err)
+		assert.Equal(t, tc.status, p.Status, tc.err.Error())
+		assert.Equal(t, tc.code, p.Code, tc.err.Error())
+		assert.Equal(t, tc.detail, p.Detail, tc.err.Error())
+		assert.Equal(t, problemTypeBase+string(tc.code), p.Type, tc.err.Error())
+	}
+}
+
+func doProblemRequest(t *testing.T, method, u, body string) *Problem {
+	req, err := http.NewRequest(method, u, bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderRequestID, "req-1")
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "req-1", res.Header.Get(HeaderRequestID))
+
+	return decodeProblem(t, res)
+}
+
+func decodeProblem(t *testing.T, res *http.Response) *Problem {
+	defer res.Body.Close()
+
+	assert.Equal(t, mimeProblemJSON, res.Header.Get("Content-Type"))
+
+	var p Problem
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&p))
+	assert.Equal(t, res.StatusCode, p.Status)
+	return &p
+}
+
+func TestAppProblemResponses(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "missing").Return(nil, ErrNoteNotFound)
+
+		u.Path = "/notes/missing"
+		p := doProblemRequest(t, "GET", u.String(), "")
+		assert.Equal(t, CodeNoteNotFound, p.Code)
+		assert.Equal(t, "/notes/missing", p.Instance)
+		assert.Equal(t, "req-1", p.RequestID)
+
+		u.Path = "/notes"
+		p = doProblemRequest(t, "POST", u.String(), `{"content":`)
+		assert.Equal(t, CodeInvalidRequest, p.Code)
+
+		p = doProblemRequest(t, "POST", u.String(), `{"content":"x","ttl":-1}`)
+		assert.Equal(t, CodeValidationFailed, p.Code)
+		assert.Equal(t, []FieldError{
+			{Field: "ttl", Code: CodeInvalidValue, Message: "ttl must be positive"},
+		}, p.Errors)
+
+		u.Path = "/missing"
+		p = doProblemRequest(t, "GET", u.String(), "")
+		assert.Equal(t, CodeNotFound, p.Code)
+	})
+}
@@ -0,0 +1,496 @@
+package omniscient
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/engine"
+	"github.com/labstack/echo/engine/standard"
+)
+
+const (
+	// HeaderRateLimitLimit is how many requests a client can make to a
+	// route in a window.
+	HeaderRateLimitLimit = "RateLimit-Limit"
+	// HeaderRateLimitRemaining is how many more requests the client can make
+	// to the route right now.
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	// HeaderRateLimitReset is how many seconds until the client can make a
+	// request again, if it can't, or until the window ends.
+	HeaderRateLimitReset = "RateLimit-Reset"
+	// HeaderRateLimitPolicy describes the limit, e.g. 100;w=60.
+	HeaderRateLimitPolicy = "RateLimit-Policy"
+
+	// memoryRateLimitPruneInterval is how often windows which ended are
+	// removed from the in-memory fallback.
+	memoryRateLimitPruneInterval = time.Minute
+)
+
+// ErrRateLimited is returned when a client has made too many requests to a
+// route.
+var ErrRateLimited = &NoteError{Code: CodeRateLimited, Message: "too many requests, try again later"}
+
+// takeRateLimitScript counts a request in the current window of a sliding
+// window limit, unless the requests in the last window, weighing the
+// previous window by how much of it overlaps, reach the limit. It returns
+// whether the request was counted and the count of both windows before it.
+var takeRateLimitScript = `
+local prev = tonumber(redis.call("GET", KEYS[2]) or 0)
+local cur = tonumber(redis.call("GET", KEYS[1]) or 0)
+local window = tonumber(ARGV[2])
+if math.floor(prev * tonumber(ARGV[3]) / window) + cur >= tonumber(ARGV[1]) then
+  return {0, prev, cur}
+end
+redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], 2 * window)
+return {1, prev, cur}
+`
+
+// RateLimit is how many requests can be made in a window of time.
+type RateLimit struct {
+	Requests int64
+	Window   time.Duration
+}
+
+// ParseRateLimit parses a limit written as requests/window, e.g. 100/1m.
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("rate limit %q is not requests/window", s)
+	}
+
+	n, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("rate limit %q has invalid requests: %v", s, err)
+	}
+
+	window, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("rate limit %q has invalid window: %v", s, err)
+	}
+
+	rl := RateLimit{Requests: n, Window: window}
+	return rl, rl.valid()
+}
+
+func (rl RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", rl.Requests, rl.Window)
+}
+
+func (rl RateLimit) valid() error {
+	if rl.Requests < 1 {
+		return errors.New("rate limit must allow at least 1 request")
+	}
+
+	if rl.Window < time.Millisecond {
+		return errors.New("rate limit window must be at least a millisecond")
+	}
+
+	return nil
+}
+
+// weighed is the number of requests in the last window when left of the
+// current window is left: all of the current window's, and as many of the
+// previous window's as overlap.
+func (rl RateLimit) weighed(prev, cur int64, left time.Duration) int64 {
+	return prev*int64(left/time.Millisecond)/int64(rl.Window/time.Millisecond) + cur
+}
+
+// rateLimitDecision is whether a request can be made, and when it or the
+// next one can.
+type rateLimitDecision struct {
+	Allowed   bool
+	Limit     RateLimit
+	Remaining int64
+	// Reset is when a request can be made again if it can't now, otherwise
+	// when the current window ends.
+	Reset time.Duration
+}
+
+// decide decides a request given the counts of the previous and current
+// windows before it, when left of the current window is left.
+func (rl RateLimit) decide(allowed bool, prev, cur int64, left time.Duration) *rateLimitDecision {
+	d := &rateLimitDecision{Allowed: allowed, Limit: rl, Reset: left}
+
+	if allowed {
+		d.Remaining = rl.Requests - rl.weighed(prev, cur, left) - 1
+		if d.Remaining < 0 {
+			d.Remaining = 0
+		}
+		return d
+	}
+
+	// wait until enough of the previous window's requests no longer
+	// overlap, or if the current window has used up the limit, enough of
+	// its requests once it is the previous window.
+	window := float64(rl.Window)
+	var wait float64
+	if cur >= rl.Requests {
+		wait = float64(left) + window - float64(rl.Requests)*window/float64(cur)
+	} else {
+		wait = float64(left) - float64(rl.Requests-cur)*window/float64(prev)
+	}
+
+	d.Reset = time.Duration(math.Max(wait, 0))
+	return d
+}
+
+// rateLimitStore counts requests in fixed windows. key identifies the client
+// and route, and window the window the request was made in.
+type rateLimitStore interface {
+	take(key string, window int64, rl RateLimit, left time.Duration) (allowed bool, prev, cur int64, err error)
+}
+
+type redisRateLimitStore struct {
+	redisClient RedisClient
+	base        string
+}
+
+func (s *redisRateLimitStore) take(key string, window int64, rl RateLimit, left time.Duration) (bool, int64, int64, error) {
+	keys := []string{
+		fmt.Sprintf("%s:%s:%d", s.base, key, window),
+		fmt.Sprintf("%s:%s:%d", s.base, key, window-1),
+	}
+	args := []string{
+		strconv.FormatInt(rl.Requests, 10),
+		strconv.FormatInt(int64(rl.Window/time.Millisecond), 10),
+		strconv.FormatInt(int64(left/time.Millisecond), 10),
+	}
+
+	reply, err := s.redisClient.Eval(takeRateLimitScript, keys, args)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	vals, ok := reply.([]interface{})
+	if !ok || len(vals) != 3 {
+		return false, 0, 0, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+
+	allowed, _ := vals[0].(int64)
+	prev, _ := vals[1].(int64)
+	cur, _ := vals[2].(int64)
+	return allowed == 1, prev, cur, nil
+}
+
+// memoryRateLimitStore counts requests in this process. It is used while
+// Redis can't be reached, so each replica enforces the limits on its own
+// until it can be again.
+type memoryRateLimitStore struct {
+	mu         sync.Mutex
+	windows    map[string]*memoryRateLimitWindow
+	lastPruned time.Time
+}
+
+type memoryRateLimitWindow struct {
+	window    int64
+	length    time.Duration
+	prev, cur int64
+	ends      time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{windows: map[string]*memoryRateLimitWindow{}}
+}
+
+func (s *memoryRateLimitStore) take(key string, window int64, rl RateLimit, left time.Duration) (bool, int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPruned) > memoryRateLimitPruneInterval {
+		for k, w := range s.windows {
+			// the window ended, as did the one after it.
+			if now.After(w.ends.Add(w.length)) {
+				delete(s.windows, k)
+			}
+		}
+		s.lastPruned = now
+	}
+
+	w, ok := s.windows[key]
+	switch {
+	case !ok || w.window < window-1:
+		w = &memoryRateLimitWindow{window: window, length: rl.Window}
+		s.windows[key] = w
+	case w.window == window-1:
+		w.window, w.prev, w.cur = window, w.cur, 0
+	}
+	w.ends = now.Add(left)
+
+	if rl.weighed(w.prev, w.cur, left) >= rl.Requests {
+		return false, w.prev, w.cur, nil
+	}
+
+	w.cur++
+	return true, w.prev, w.cur - 1, nil
+}
+
+// RateLimiter limits how many requests each client can make to each route,
+// with a sliding window. Requests are counted in Redis, so the limits apply
+// across every replica. If Redis can't be reached, requests are counted in
+// memory until it can be again.
+type RateLimiter struct {
+	redisClient RedisClient
+	base        string
+	store       rateLimitStore
+	fallback    rateLimitStore
+
+	limit          RateLimit
+	routes         map[string]RateLimit
+	clients        map[string]RateLimit
+	trustedProxies int
+
+	mu       sync.Mutex
+	degraded bool
+
+	now func() time.Time
+}
+
+// RateLimiterOption is an option for configuring RateLimiter.
+type RateLimiterOption func(*RateLimiter) error
+
+// NewRateLimiter creates an instance of RateLimiter, which allows each client
+// limit requests to each route unless configured otherwise.
+func NewRateLimiter(rc RedisClient, limit RateLimit, opts ...RateLimiterOption) (*RateLimiter, error) {
+	if err := limit.valid(); err != nil {
+		return nil, err
+	}
+
+	rl := &RateLimiter{
+		redisClient: rc,
+		base:        "ratelimit",
+		fallback:    newMemoryRateLimitStore(),
+		limit:       limit,
+		routes:      map[string]RateLimit{},
+		clients:     map[string]RateLimit{},
+		now:         time.Now,
+	}
+
+	for _, opt := range opts {
+		if err := opt(rl); err != nil {
+			return nil, err
+		}
+	}
+
+	rl.store = &redisRateLimitStore{redisClient: rl.redisClient, base: rl.base}
+	return rl, nil
+}
+
+// RateLimiterBase sets the base string for the rate limit keys.
+func RateLimiterBase(base string) RateLimiterOption {
+	return func(rl *RateLimiter) error {
+		rl.base = base
+		return nil
+	}
+}
+
+// RateLimitRoute sets the limit of the route with method and path, as it is
+// registered under /v1, e.g. POST /notes or GET /notes/:id. It applies to
+// the unversioned alias of the route too.
+func RateLimitRoute(method, path string, limit RateLimit) RateLimiterOption {
+	return func(rl *RateLimiter) error {
+		if err := limit.valid(); err != nil {
+			return err
+		}
+
+		rl.routes[routeName(method, path)] = limit
+		return nil
+	}
+}
+
+// RateLimitClient sets the limit of the client with id, which is either the
+// id of a principal or an IP address. It is used instead of the limit of
+// each route, and requests to each route are still counted separately.
+func RateLimitClient(id string, limit RateLimit) RateLimiterOption {
+	return func(rl *RateLimiter) error {
+		if err := limit.valid(); err != nil {
+			return err
+		}
+
+		rl.clients[id] = limit
+		return nil
+	}
+}
+
+// RateLimitTrustedProxies identifies clients limited by their address by
+// the X-Forwarded-For header, when requests come through n proxies which
+// each add the address they received the request from to it. The client is
+// the address added by the first of them, n entries from the end; entries
+// before it were sent by the client, which can put anything there. Requests
+// with fewer entries are identified by the address they came from.
+func RateLimitTrustedProxies(n int) RateLimiterOption {
+	return func(rl *RateLimiter) error {
+		if n < 0 {
+			return errors.New("trusted proxies can't be negative")
+		}
+
+		rl.trustedProxies = n
+		return nil
+	}
+}
+
+// Take counts a request by client to route, and decides whether it can be
+// made.
+func (rl *RateLimiter) Take(client, route string) (*rateLimitDecision, error) {
+	limit, ok := rl.clients[client]
+	if !ok {
+		if limit, ok = rl.routes[route]; !ok {
+			limit = rl.limit
+		}
+	}
+
+	now := rl.now()
+	window := now.UnixNano() / int64(limit.Window)
+	left := time.Duration((window+1)*int64(limit.Window) - now.UnixNano())
+	key := route + ":" + client
+
+	allowed, prev, cur, err := rl.store.take(key, window, limit, left)
+	rl.degrade(err)
+	if err != nil {
+		if allowed, prev, cur, err = rl.fallback.take(key, window, limit, left); err != nil {
+			return nil, err
+		}
+	}
+
+	return limit.decide(allowed, prev, cur, left), nil
+}
+
+// degrade logs when the limiter starts and stops falling back to counting
+// requests in memory.
+func (rl *RateLimiter) degrade(err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	switch {
+	case err != nil && !rl.degraded:
+		log.WithError(err).Warning("unable to count requests in redis; rate limiting in memory")
+		rateLimitFallbackCounter.Inc()
+	case err == nil && rl.degraded:
+		log.Info("rate limiting in redis again")
+	}
+
+	rl.degraded = err != nil
+}
+
+// client identifies who made a request: its principal if it was
+// authenticated, otherwise its address.
+func (rl *RateLimiter) client(c echo.Context) string {
+	if p := principalFor(c); p != nil {
+		return p.ID
+	}
+
+	return rl.address(c)
+}
+
+// address is the address a request was made from.
+func (rl *RateLimiter) address(c echo.Context) string {
+	if rl.trustedProxies > 0 {
+		entries := forwardedFor(c.Request())
+		if i := len(entries) - rl.trustedProxies; i >= 0 {
+			return entries[i]
+		}
+	}
+
+	addr := c.Request().RemoteAddress()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// forwardedFor returns the entries of every X-Forwarded-For header of req,
+// in order.
+func forwardedFor(req engine.Request) []string {
+	values := []string{req.Header().Get(echo.HeaderXForwardedFor)}
+	if r, ok := req.(*standard.Request); ok {
+		values = r.Request.Header[echo.HeaderXForwardedFor]
+	}
+
+	var entries []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	return entries
+}
+
+// routeName names a route by its method and path, without the version
+// prefix.
+func routeName(method, path string) string {
+	return method + " " + strings.TrimPrefix(path, "/v1")
+}
+
+// rateLimit rejects requests once their client has made too many to the
+// route, and tells clients how many they have left. Requests are allowed if
+// rate limiting is not configured.
+func (a *App) rateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.rateLimiter == nil {
+			return next(c)
+		}
+
+		if err := a.takeRateLimit(c, a.rateLimiter.client(c)); err != nil {
+			return err
+		}
+
+		return next(c)
+	}
+}
+
+// rateLimitAddress counts a request by the address it was made from, before
+// it is authenticated, so requests with bad credentials are limited too.
+func (a *App) rateLimitAddress(c echo.Context) error {
+	if a.rateLimiter == nil {
+		return nil
+	}
+
+	return a.takeRateLimit(c, a.rateLimiter.address(c))
+}
+
+// takeRateLimit counts a request by client to its route. The response
+// describes the limit with the fewest requests remaining when a request is
+// counted more than once.
+func (a *App) takeRateLimit(c echo.Context, client string) error {
+	route := routeName(c.Request().Method(), c.Path())
+	d, err := a.rateLimiter.Take(client, route)
+	if err != nil {
+		return err
+	}
+
+	secs := int64(math.Ceil(d.Reset.Seconds()))
+	if !d.Allowed && secs < 1 {
+		secs = 1
+	}
+	reset := strconv.FormatInt(secs, 10)
+
+	h := c.Response().Header()
+	if prev, err := strconv.ParseInt(h.Get(HeaderRateLimitRemaining), 10, 64); err != nil || d.Remaining <= prev || !d.Allowed {
+		h.Set(HeaderRateLimitLimit, strconv.FormatInt(d.Limit.Requests, 10))
+		h.Set(HeaderRateLimitRemaining, strconv.FormatInt(d.Remaining, 10))
+		h.Set(HeaderRateLimitReset, reset)
+		h.Set(HeaderRateLimitPolicy, fmt.Sprintf("%d;w=%d", d.Limit.Requests, int64(math.Ceil(d.Limit.Window.Seconds()))))
+	}
+
+	if !d.Allowed {
+		h.Set("Retry-After", reset)
+		rateLimitedCounter.WithLabelValues(route).Inc()
+		requestLog(c).WithField("route", route).Info("request rate limited")
+		return ErrRateLimited
+	}
+
+	return nil
+}
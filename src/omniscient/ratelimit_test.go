@@ -0,0 +1,277 @@
+package omniscient
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	rl, err := ParseRateLimit("100/1m")
+	if assert.NoError(t, err) {
+		assert.Equal(t, RateLimit{Requests: 100, Window: time.Minute}, rl)
+		assert.Equal(t, "100/1m0s", rl.String())
+	}
+
+	for _, s := range []string{"100", "a/1m", "100/minute", "0/1m", "1/0s"} {
+		_, err := ParseRateLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRateLimitDecide(t *testing.T) {
+	rl := RateLimit{Requests: 10, Window: 10 * time.Second}
+
+	d := rl.decide(true, 10, 2, 5*time.Second)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, int64(10-5-2-1), d.Remaining)
+	assert.Equal(t, 5*time.Second, d.Reset)
+
+	// half of the previous window's requests have to stop overlapping.
+	d = rl.decide(false, 10, 5, 8*time.Second)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, int64(0), d.Remaining)
+	assert.Equal(t, 3*time.Second, d.Reset)
+
+	// the current window is used up, so the next one has to be half over.
+	d = rl.decide(false, 0, 20, 2*time.Second)
+	assert.Equal(t, 7*time.Second, d.Reset)
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	rl := RateLimit{Requests: 4, Window: time.Second}
+	s := newMemoryRateLimitStore()
+
+	for i := int64(0); i < 4; i++ {
+		allowed, prev, cur, err := s.take("k", 1, rl, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, int64(0), prev)
+		assert.Equal(t, i, cur)
+	}
+
+	allowed, _, _, _ := s.take("k", 1, rl, time.Second)
+	assert.False(t, allowed)
+
+	allowed, _, _, _ = s.take("other", 1, rl, time.Second)
+	assert.True(t, allowed)
+
+	// the previous window still counts for as long as it overlaps.
+	allowed, prev, _, _ := s.take("k", 2, rl, 800*time.Millisecond)
+	assert.True(t, allowed)
+	assert.Equal(t, int64(4), prev)
+
+	allowed, _, _, _ = s.take("k", 2, rl, 800*time.Millisecond)
+	assert.False(t, allowed)
+
+	allowed, _, _, _ = s.take("k", 2, rl, 200*time.Millisecond)
+	assert.True(t, allowed)
+
+	allowed, prev, cur, _ := s.take("k", 4, rl, time.Second)
+	assert.True(t, allowed)
+	assert.Equal(t, int64(0), prev)
+	assert.Equal(t, int64(0), cur)
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	now := time.Unix(1000, 500*int64(time.Millisecond))
+	window := []string{"ratelimit:GET /notes:alice:1000", "ratelimit:GET /notes:alice:999"}
+
+	mrc := &MockRedisClient{}
+	mrc.On("Eval", takeRateLimitScript, window, []string{"2", "1000", "500"}).
+		Return([]interface{}{int64(1), int64(0), int64(1)}, nil).Once()
+	mrc.On("Eval", takeRateLimitScript, []string{"ratelimit:POST /notes:alice:100", "ratelimit:POST /notes:alice:99"},
+		[]string{"1", "10000", "9500"}).
+		Return([]interface{}{int64(0), int64(0), int64(1)}, nil).Once()
+
+	limiter, err := NewRateLimiter(mrc, RateLimit{Requests: 2, Window: time.Second},
+		RateLimitRoute("POST", "/notes", RateLimit{Requests: 1, Window: 10 * time.Second}),
+		RateLimitClient("bob", RateLimit{Requests: 1, Window: time.Second}))
+	assert.NoError(t, err)
+	limiter.now = func() time.Time { return now }
+
+	d, err := limiter.Take("alice", "GET /notes")
+	if assert.NoError(t, err) {
+		assert.True(t, d.Allowed)
+		assert.Equal(t, int64(0), d.Remaining)
+	}
+
+	d, err = limiter.Take("alice", "POST /notes")
+	if assert.NoError(t, err) {
+		assert.False(t, d.Allowed)
+		assert.Equal(t, 9500*time.Millisecond, d.Reset)
+	}
+
+	// requests are counted in memory while redis is down.
+	mrc.On("Eval", takeRateLimitScript, mock.Anything, mock.Anything).Return(nil, errors.New("down"))
+
+	d, err = limiter.Take("bob", "GET /notes")
+	if assert.NoError(t, err) {
+		assert.True(t, d.Allowed)
+	}
+
+	// bob's limit is used instead of the route's.
+	d, err = limiter.Take("bob", "POST /notes")
+	if assert.NoError(t, err) {
+		assert.True(t, d.Allowed)
+		assert.Equal(t, RateLimit{Requests: 1, Window: time.Second}, d.Limit)
+	}
+
+	d, err = limiter.Take("bob", "GET /notes")
+	if assert.NoError(t, err) {
+		assert.False(t, d.Allowed)
+	}
+
+	mrc.AssertExpectations(t)
+}
+
+func TestAppRateLimit(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("Eval", takeRateLimitScript, mock.Anything, mock.Anything).
+		Return([]interface{}{int64(1), int64(0), int64(0)}, nil).Once()
+	mrc.On("Eval", takeRateLimitScript, mock.Anything, mock.Anything).
+		Return([]interface{}{int64(0), int64(0), int64(1)}, nil).Once()
+
+	limiter, err := NewRateLimiter(mrc, RateLimit{Requests: 1, Window: time.Hour})
+	assert.NoError(t, err)
+
+	withAppOptions(t, nil, []AppOption{AppRateLimiter(limiter)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(&Note{ID: "1"}, nil)
+
+		u.Path = "/v1/notes/1"
+		res, err := http.Get(u.String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "1", res.Header.Get(HeaderRateLimitLimit))
+		assert.Equal(t, "0", res.Header.Get(HeaderRateLimitRemaining))
+		assert.Equal(t, "1;w=3600", res.Header.Get(HeaderRateLimitPolicy))
+		assert.Empty(t, res.Header.Get("Retry-After"))
+
+		res, err = http.Get(u.String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+		assert.Equal(t, res.Header.Get(HeaderRateLimitReset), res.Header.Get("Retry-After"))
+		assert.NotEqual(t, "0", res.Header.Get("Retry-After"))
+
+		// routes which aren't part of the api aren't limited.
+		u.Path = "/healthz"
+		res, err = http.Get(u.String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Empty(t, res.Header.Get(HeaderRateLimitLimit))
+
+		mrc.AssertExpectations(t)
+	})
+}
+
+func TestAppRateLimitAuthentication(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expectAPIKey(mrc, "reader", ScopeNotesRead)
+	mrc.On("HGet", "apikeys:hashes", hashAPIKey(apiKeyPrefix+"revoked")).Return("", ErrKeyNotFound)
+
+	ak, err := NewAPIKeys(mrc)
+	assert.NoError(t, err)
+
+	// requests are counted in memory.
+	lrc := &MockRedisClient{}
+	lrc.On("Eval", takeRateLimitScript, mock.Anything, mock.Anything).Return(nil, errors.New("down"))
+
+	limiter, err := NewRateLimiter(lrc, RateLimit{Requests: 1, Window: time.Hour},
+		RateLimitClient("127.0.0.1", RateLimit{Requests: 3, Window: time.Hour}))
+	assert.NoError(t, err)
+
+	opts := []AppOption{AppAPIKeys(ak), AppRateLimiter(limiter)}
+	withAppOptions(t, nil, opts, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(&Note{ID: "1", Owner: "reader"}, nil)
+
+		get := func(path, key string) *http.Response {
+			u.Path = path
+			req, err := http.NewRequest("GET", u.String(), nil)
+			assert.NoError(t, err)
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+apiKeyPrefix+key)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			return res
+		}
+
+		// requests which fail to authenticate are counted by address.
+		res := get("/v1/notes/1", "revoked")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		assert.Equal(t, "2", res.Header.Get(HeaderRateLimitRemaining))
+
+		// the principal's limit has fewer requests remaining.
+		res = get("/v1/notes/1", "reader")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "1", res.Header.Get(HeaderRateLimitLimit))
+		assert.Equal(t, "0", res.Header.Get(HeaderRateLimitRemaining))
+
+		res = get("/v1/notes/1", "reader")
+		assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+		res = get("/v1/notes/1", "revoked")
+		assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+		// the documentation is limited too.
+		for _, path := range []string{"/graphql/schema", "/openapi.json", "/docs"} {
+			res = get(path, "")
+			assert.Equal(t, http.StatusOK, res.StatusCode, path)
+			assert.Equal(t, "3", res.Header.Get(HeaderRateLimitLimit), path)
+		}
+	})
+}
+
+func TestAppRateLimitForwardedFor(t *testing.T) {
+	// requests are counted in memory.
+	lrc := &MockRedisClient{}
+	lrc.On("Eval", takeRateLimitScript, mock.Anything, mock.Anything).Return(nil, errors.New("down"))
+
+	limiter, err := NewRateLimiter(lrc, RateLimit{Requests: 1, Window: time.Hour},
+		RateLimitTrustedProxies(1))
+	assert.NoError(t, err)
+
+	withAppOptions(t, nil, []AppOption{AppRateLimiter(limiter)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/openapi.json"
+
+		get := func(xff ...string) int {
+			req, err := http.NewRequest("GET", u.String(), nil)
+			assert.NoError(t, err)
+			for _, v := range xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		assert.Equal(t, http.StatusOK, get("10.0.0.1"))
+		assert.Equal(t, http.StatusTooManyRequests, get("10.0.0.1"))
+
+		// the proxy adds the address to whatever the client sent.
+		assert.Equal(t, http.StatusTooManyRequests, get("192.0.2.1, 10.0.0.1"))
+		assert.Equal(t, http.StatusTooManyRequests, get("192.0.2.1", "10.0.0.1"))
+
+		assert.Equal(t, http.StatusOK, get("10.0.0.2"))
+
+		// requests which didn't come through the proxy.
+		assert.Equal(t, http.StatusOK, get())
+	})
+}
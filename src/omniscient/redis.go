@@ -1,6 +1,7 @@
 package omniscient
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -14,21 +15,99 @@ import (
 // RedisClient is an interface which can interfact with a redis server.
 type RedisClient interface {
 	Delete(keys ...string) (int64, error)
+	// Do runs a command the client has no method for, e.g. a stream
+	// command.
+	Do(args ...interface{}) (interface{}, error)
+	Eval(script string, keys []string, args []string) (interface{}, error)
+	Exists(key string) (bool, error)
+	ExpireAt(key string, tm time.Time) (bool, error)
+	Get(key string) (string, error)
+	HDel(key string, fields ...string) (int64, error)
+	HGet(key, field string) (string, error)
 	HGetAllMap(key string) (map[string]string, error)
 	HMSet(key, field, value string, pairs ...string) (string, error)
+	HSet(key, field, value string) (bool, error)
+	HSetNX(key, field, value string) (bool, error)
 	LPush(key string, values ...string) (int64, error)
 	LRange(key string, start, stop int64) ([]string, error)
 	LRem(key string, count int64, value interface{}) (int64, error)
+	Persist(key string) (bool, error)
 	Ping() (string, error)
 	Set(key string, value interface{}, expiration time.Duration) (string, error)
+	SetNX(key string, value interface{}, expiration time.Duration) (bool, error)
+	Subscribe(channels ...string) (RedisSubscription, error)
+	ZAdd(key string, score float64, member string) (int64, error)
+	ZRangeByScore(key, min, max string) ([]string, error)
+	ZRem(key string, members ...string) (int64, error)
+	Watch(fn func(tx RedisTx) error, keys ...string) error
+}
+
+// RedisSubscription is a subscription to Redis pub/sub channels started by
+// RedisClient.Subscribe.
+type RedisSubscription interface {
+	// ReceiveMessage waits for the next message published to a subscribed
+	// channel, and returns its payload. Dropped connections are retried, so
+	// an error means the subscription can not be used anymore.
+	ReceiveMessage() (string, error)
+	Close() error
+}
+
+// RedisTx is a Redis transaction started by RedisClient.Watch. Commands are
+// run immediately, except the ones run by the function passed to Exec, which
+// are queued and then executed atomically.
+type RedisTx interface {
+	RedisClient
+	Exec(fn func() error) error
+}
+
+var (
+	// ErrKeyNotFound is returned when a key does not exist.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrTxConflict is returned when a key watched by a transaction was
+	// modified before the transaction was executed.
+	ErrTxConflict = errors.New("transaction conflicted with a concurrent change")
+)
+
+// redisCmdable is the set of commands shared by redis clients and
+// transactions.
+type redisCmdable interface {
+	Del(keys ...string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	Exists(key string) *redis.BoolCmd
+	ExpireAt(key string, tm time.Time) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	HGet(key, field string) *redis.StringCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HMSet(key, field, value string, pairs ...string) *redis.StatusCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	HSetNX(key, field, value string) *redis.BoolCmd
+	LPush(key string, values ...string) *redis.IntCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	LRem(key string, count int64, value interface{}) *redis.IntCmd
+	Persist(key string) *redis.BoolCmd
+	Ping() *redis.StatusCmd
+	Process(cmd redis.Cmder)
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZRangeByScore(key string, opt redis.ZRangeByScore) *redis.StringSliceCmd
+	ZRem(key string, members ...string) *redis.IntCmd
 }
 
 type redisClient struct {
-	client *redis.Client
+	client redisCmdable
 }
 
 var _ RedisClient = (*redisClient)(nil)
 
+type redisTx struct {
+	redisClient
+	multi *redis.Multi
+}
+
+var _ RedisTx = (*redisTx)(nil)
+
 // NewRedisClient creates an instance of RedisClient. It will attempt multiple times
 // using a backoff policy.
 func NewRedisClient(addr string) (RedisClient, error) {
@@ -76,6 +155,62 @@ func (rc *redisClient) Delete(keys ...string) (int64, error) {
 	return cmd.Result()
 }
 
+func (rc *redisClient) Do(args ...interface{}) (interface{}, error) {
+	cmd := redis.NewCmd(args...)
+	rc.client.Process(cmd)
+	v, err := cmd.Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	return v, err
+}
+
+func (rc *redisClient) Eval(script string, keys []string, args []string) (interface{}, error) {
+	cmd := rc.client.Eval(script, keys, args)
+	v, err := cmd.Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	return v, err
+}
+
+func (rc *redisClient) Exists(key string) (bool, error) {
+	cmd := rc.client.Exists(key)
+	return cmd.Result()
+}
+
+func (rc *redisClient) ExpireAt(key string, tm time.Time) (bool, error) {
+	cmd := rc.client.ExpireAt(key, tm)
+	return cmd.Result()
+}
+
+func (rc *redisClient) Get(key string) (string, error) {
+	cmd := rc.client.Get(key)
+	s, err := cmd.Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+
+	return s, err
+}
+
+func (rc *redisClient) HDel(key string, fields ...string) (int64, error) {
+	cmd := rc.client.HDel(key, fields...)
+	return cmd.Result()
+}
+
+func (rc *redisClient) HGet(key, field string) (string, error) {
+	cmd := rc.client.HGet(key, field)
+	s, err := cmd.Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+
+	return s, err
+}
+
 func (rc *redisClient) HGetAllMap(key string) (map[string]string, error) {
 	cmd := rc.client.HGetAllMap(key)
 	return cmd.Result()
@@ -86,6 +221,16 @@ func (rc *redisClient) HMSet(key, field, value string, pairs ...string) (string,
 	return cmd.Result()
 }
 
+func (rc *redisClient) HSet(key, field, value string) (bool, error) {
+	cmd := rc.client.HSet(key, field, value)
+	return cmd.Result()
+}
+
+func (rc *redisClient) HSetNX(key, field, value string) (bool, error) {
+	cmd := rc.client.HSetNX(key, field, value)
+	return cmd.Result()
+}
+
 func (rc *redisClient) LPush(key string, values ...string) (int64, error) {
 	cmd := rc.client.LPush(key, values...)
 	return cmd.Result()
@@ -101,6 +246,11 @@ func (rc *redisClient) LRem(key string, count int64, value interface{}) (int64,
 	return cmd.Result()
 }
 
+func (rc *redisClient) Persist(key string) (bool, error) {
+	cmd := rc.client.Persist(key)
+	return cmd.Result()
+}
+
 func (rc *redisClient) Ping() (string, error) {
 	cmd := rc.client.Ping()
 	return cmd.Result()
@@ -110,3 +260,83 @@ func (rc *redisClient) Set(key string, value interface{}, expiration time.Durati
 	cmd := rc.client.Set(key, value, expiration)
 	return cmd.Result()
 }
+
+func (rc *redisClient) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	cmd := rc.client.SetNX(key, value, expiration)
+	return cmd.Result()
+}
+
+func (rc *redisClient) Subscribe(channels ...string) (RedisSubscription, error) {
+	client, ok := rc.client.(*redis.Client)
+	if !ok {
+		return nil, errors.New("can not subscribe in a transaction")
+	}
+
+	pubsub, err := client.Subscribe(channels...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisSubscription{pubsub: pubsub}, nil
+}
+
+func (rc *redisClient) ZAdd(key string, score float64, member string) (int64, error) {
+	cmd := rc.client.ZAdd(key, redis.Z{Score: score, Member: member})
+	return cmd.Result()
+}
+
+func (rc *redisClient) ZRangeByScore(key, min, max string) ([]string, error) {
+	cmd := rc.client.ZRangeByScore(key, redis.ZRangeByScore{Min: min, Max: max})
+	return cmd.Result()
+}
+
+func (rc *redisClient) ZRem(key string, members ...string) (int64, error) {
+	cmd := rc.client.ZRem(key, members...)
+	return cmd.Result()
+}
+
+func (rc *redisClient) Watch(fn func(tx RedisTx) error, keys ...string) error {
+	client, ok := rc.client.(*redis.Client)
+	if !ok {
+		return errors.New("transactions can not be nested")
+	}
+
+	multi, err := client.Watch(keys...)
+	if err != nil {
+		return err
+	}
+	defer multi.Close()
+
+	tx := &redisTx{
+		redisClient: redisClient{client: multi},
+		multi:       multi,
+	}
+
+	return fn(tx)
+}
+
+func (tx *redisTx) Exec(fn func() error) error {
+	_, err := tx.multi.Exec(fn)
+	if err == redis.TxFailedErr {
+		return ErrTxConflict
+	}
+
+	return err
+}
+
+type redisSubscription struct {
+	pubsub *redis.PubSub
+}
+
+func (rs *redisSubscription) ReceiveMessage() (string, error) {
+	msg, err := rs.pubsub.ReceiveMessage()
+	if err != nil {
+		return "", err
+	}
+
+	return msg.Payload, nil
+}
+
+func (rs *redisSubscription) Close() error {
+	return rs.pubsub.Close()
+}
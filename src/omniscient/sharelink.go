@@ -0,0 +1,328 @@
+package omniscient
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	shareLinksLinksKey = "links"
+	shareLinksNotesKey = "notes"
+	shareLinksViewsKey = "views"
+
+	// shareLinkIDSize is how many random bytes a share link id has, so ids
+	// can't be guessed.
+	shareLinkIDSize = 16
+	// minShareLinkSecretSize is the smallest secret share link tokens can be
+	// signed with.
+	minShareLinkSecretSize = 32
+)
+
+var (
+	// ErrShareLinkNotFound is returned when a share link does not exist, or
+	// its token is not valid.
+	ErrShareLinkNotFound = &NoteError{Code: CodeShareLinkNotFound, Message: "share link not found"}
+	// ErrShareLinkExpired is returned when a share link has expired, or has
+	// been viewed as many times as it allows.
+	ErrShareLinkExpired = &NoteError{Code: CodeShareLinkExpired, Message: "share link has expired"}
+)
+
+// ShareLink is a read-only public link to a note. Anyone with its token can
+// view the note without authenticating, until it expires, runs out of views
+// or is revoked.
+type ShareLink struct {
+	ID     string `json:"id"`
+	NoteID string `json:"note_id"`
+	// NoteCreatedAt is when the note was created, so the link can't be used
+	// for another note given the same id once the note is deleted.
+	NoteCreatedAt time.Time `json:"note_created_at"`
+	// Tenant is the tenant the note belongs to, if any.
+	Tenant string `json:"tenant,omitempty"`
+	// CreatedBy is the id of the principal which created the link.
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// MaxViews is how many times the note can be viewed through the link.
+	// Zero is unlimited.
+	MaxViews int64 `json:"max_views,omitempty"`
+	Views    int64 `json:"views"`
+	// Token is what the link is viewed with. It is signed, so tokens can't be
+	// made up.
+	Token string `json:"token,omitempty"`
+	// URL is where the note can be viewed.
+	URL string `json:"url,omitempty"`
+}
+
+// IsExpired returns true if the link can't be used at t anymore.
+func (l *ShareLink) IsExpired(t time.Time) bool {
+	return l.ExpiresAt != nil && !l.ExpiresAt.After(t)
+}
+
+// ShareLinks stores share links in Redis.
+type ShareLinks struct {
+	redisClient RedisClient
+	base        string
+	secret      []byte
+	idGen       idGenFn
+	now         func() time.Time
+}
+
+// ShareLinksOption is an option for configuring ShareLinks.
+type ShareLinksOption func(*ShareLinks) error
+
+// NewShareLinks creates an instance of ShareLinks, which signs tokens with
+// secret.
+func NewShareLinks(rc RedisClient, secret []byte, opts ...ShareLinksOption) (*ShareLinks, error) {
+	if len(secret) < minShareLinkSecretSize {
+		return nil, errors.New("share link secret must be at least 32 bytes")
+	}
+
+	sl := &ShareLinks{
+		redisClient: rc,
+		base:        "sharelinks",
+		secret:      secret,
+		idGen:       newShareLinkID,
+		now:         time.Now,
+	}
+
+	for _, opt := range opts {
+		if err := opt(sl); err != nil {
+			return nil, err
+		}
+	}
+
+	return sl, nil
+}
+
+// ShareLinksBase sets the base string for the share link keys.
+func ShareLinksBase(base string) ShareLinksOption {
+	return func(sl *ShareLinks) error {
+		sl.base = base
+		return nil
+	}
+}
+
+func newShareLinkID() string {
+	b := make([]byte, shareLinkIDSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Create creates a link to the note with noteID in tenant, which was
+// created at noteCreatedAt. The link expires at expiresAt if it is set, and
+// allows maxViews views if it is positive.
+func (sl *ShareLinks) Create(tenant, noteID string, noteCreatedAt time.Time, createdBy string, expiresAt *time.Time, maxViews int64) (*ShareLink, error) {
+	l := &ShareLink{
+		ID:            sl.idGen(),
+		NoteID:        noteID,
+		NoteCreatedAt: noteCreatedAt,
+		Tenant:        tenant,
+		CreatedBy:     createdBy,
+		CreatedAt:     sl.now().UTC(),
+		ExpiresAt:     expiresAt,
+		MaxViews:      maxViews,
+	}
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := sl.redisClient.HSet(sl.key(shareLinksLinksKey), l.ID, string(b)); err != nil {
+		return nil, err
+	}
+
+	if _, err := sl.redisClient.HSet(sl.noteKey(tenant, noteID), l.ID, ""); err != nil {
+		return nil, err
+	}
+
+	l.Token = sl.token(l.ID)
+	return l, nil
+}
+
+// List lists the links to the note with id in tenant, oldest first.
+func (sl *ShareLinks) List(tenant, noteID string) ([]*ShareLink, error) {
+	ids, err := sl.redisClient.HGetAllMap(sl.noteKey(tenant, noteID))
+	if err != nil {
+		return nil, err
+	}
+
+	links := []*ShareLink{}
+	for id := range ids {
+		l, err := sl.load(id)
+		if err == ErrShareLinkNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, l)
+	}
+
+	sort.Sort(shareLinksByCreation(links))
+	return links, nil
+}
+
+// Revoke revokes the link with id to the note with noteID in tenant.
+func (sl *ShareLinks) Revoke(tenant, noteID, id string) error {
+	l, err := sl.load(id)
+	if err != nil {
+		return err
+	}
+
+	// links to other notes are not found, so they can't be revoked by
+	// someone who can only change this one.
+	if l.Tenant != tenant || l.NoteID != noteID {
+		return ErrShareLinkNotFound
+	}
+
+	return sl.remove(l)
+}
+
+// RevokeAll revokes every link to the note with id in tenant. It returns the
+// number of links revoked.
+func (sl *ShareLinks) RevokeAll(tenant, noteID string) (int, error) {
+	links, err := sl.List(tenant, noteID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, l := range links {
+		if err := sl.remove(l); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := sl.redisClient.Delete(sl.noteKey(tenant, noteID)); err != nil {
+		return 0, err
+	}
+
+	return len(links), nil
+}
+
+// View returns the link token is for, and counts a view of it. Tokens which
+// aren't signed with the secret are rejected without looking them up.
+func (sl *ShareLinks) View(token string) (*ShareLink, error) {
+	id, ok := sl.verify(token)
+	if !ok {
+		return nil, ErrShareLinkNotFound
+	}
+
+	l, err := sl.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.IsExpired(sl.now()) {
+		return nil, ErrShareLinkExpired
+	}
+
+	reply, err := sl.redisClient.Do("HINCRBY", sl.key(shareLinksViewsKey), id, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	views, _ := reply.(int64)
+	if l.MaxViews > 0 && views > l.MaxViews {
+		return nil, ErrShareLinkExpired
+	}
+
+	l.Views = views
+	return l, nil
+}
+
+// token returns the token for the link with id: the id and its signature.
+func (sl *ShareLinks) token(id string) string {
+	return id + "." + base64.RawURLEncoding.EncodeToString(sl.sign(id))
+}
+
+// verify returns the link id of token if it was signed with the secret.
+func (sl *ShareLinks) verify(token string) (string, bool) {
+	i := strings.IndexByte(token, '.')
+	if i < 1 {
+		return "", false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return "", false
+	}
+
+	id := token[:i]
+	return id, hmac.Equal(sig, sl.sign(id))
+}
+
+func (sl *ShareLinks) sign(id string) []byte {
+	mac := hmac.New(sha256.New, sl.secret)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+func (sl *ShareLinks) load(id string) (*ShareLink, error) {
+	s, err := sl.redisClient.HGet(sl.key(shareLinksLinksKey), id)
+	if err == ErrKeyNotFound {
+		return nil, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var l ShareLink
+	if err := json.Unmarshal([]byte(s), &l); err != nil {
+		return nil, err
+	}
+
+	views, err := sl.redisClient.HGet(sl.key(shareLinksViewsKey), id)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	l.Views, _ = strconv.ParseInt(views, 10, 64)
+
+	l.Token = sl.token(id)
+	return &l, nil
+}
+
+func (sl *ShareLinks) remove(l *ShareLink) error {
+	if _, err := sl.redisClient.HDel(sl.key(shareLinksLinksKey), l.ID); err != nil {
+		return err
+	}
+
+	if _, err := sl.redisClient.HDel(sl.key(shareLinksViewsKey), l.ID); err != nil {
+		return err
+	}
+
+	_, err := sl.redisClient.HDel(sl.noteKey(l.Tenant, l.NoteID), l.ID)
+	return err
+}
+
+func (sl *ShareLinks) key(name string) string {
+	return sl.base + ":" + name
+}
+
+// noteKey is the key of the index of links to a note. Note ids can't have a
+// ':', so the keys of notes in a tenant can't be mistaken for others.
+func (sl *ShareLinks) noteKey(tenant, noteID string) string {
+	if tenant == "" {
+		return strings.Join([]string{sl.base, shareLinksNotesKey, noteID}, ":")
+	}
+
+	return strings.Join([]string{sl.base, shareLinksNotesKey, tenant, noteID}, ":")
+}
+
+type shareLinksByCreation []*ShareLink
+
+func (s shareLinksByCreation) Len() int           { return len(s) }
+func (s shareLinksByCreation) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
+func (s shareLinksByCreation) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,230 @@
+package omniscient
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type createShareLinkReq struct {
+	// MaxViews is how many times the note can be viewed through the link.
+	// Zero is unlimited.
+	MaxViews int64 `json:"max_views,omitempty"`
+	noteExpiry
+}
+
+func (cslr *createShareLinkReq) validate(v *validation, prefix string) {
+	cslr.noteExpiry.validate(v, prefix)
+
+	if cslr.MaxViews < 0 {
+		v.add(fieldName(prefix, "max_views"), CodeInvalidValue, "max_views can't be negative")
+	}
+}
+
+// sharedNoteResp is a note as it is shown through a share link, without
+// who it belongs to or is shared with.
+type sharedNoteResp struct {
+	Content   string     `json:"content"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// shareLinksEnabled rejects requests to the share link routes if share
+// links aren't configured.
+func (a *App) shareLinksEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.shareLinks == nil {
+			return NewProblem(CodeNotFound, "share links are not enabled")
+		}
+
+		return next(c)
+	}
+}
+
+// linkedNote returns the note with id if the request can manage its share
+// links. Only the owner of a note can make it public.
+func (a *App) linkedNote(c echo.Context, id string) (*Note, error) {
+	n, err := a.notes(c).Retrieve(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if p := principalFor(c); p != nil && accessTo(p, n) < noteAccessOwn {
+		return nil, ErrNoteForbidden
+	}
+
+	return n, nil
+}
+
+func (a *App) createShareLink() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cslr := &createShareLinkReq{}
+		if err := a.bind(c, cslr); err != nil {
+			return err
+		}
+
+		n, err := a.linkedNote(c, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		createdBy := ""
+		if p := principalFor(c); p != nil {
+			createdBy = p.ID
+		}
+
+		l, err := a.shareLinks.Create(requestTenant(c), n.ID, n.CreatedAt, createdBy,
+			cslr.at(time.Now().UTC()), cslr.MaxViews)
+		if err != nil {
+			return err
+		}
+
+		l.URL = shareLinkURL(c, l)
+		return c.JSON(http.StatusCreated, l)
+	}
+}
+
+func (a *App) listShareLinks() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		n, err := a.linkedNote(c, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		links, err := a.shareLinks.List(requestTenant(c), n.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range links {
+			l.URL = shareLinkURL(c, l)
+		}
+
+		return c.JSON(http.StatusOK, links)
+	}
+}
+
+func (a *App) revokeShareLink() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		n, err := a.linkedNote(c, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		if err := a.shareLinks.Revoke(requestTenant(c), n.ID, c.Param("link")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func (a *App) revokeShareLinks() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		n, err := a.linkedNote(c, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		if _, err := a.shareLinks.RevokeAll(requestTenant(c), n.ID); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// viewShareLink shows the note a share link is for to anyone with its
+// token. The note is rendered as HTML, or as JSON if that is what the
+// client accepts. Links to notes which are gone are not found, whatever
+// the reason.
+func (a *App) viewShareLink() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l, err := a.shareLinks.View(c.Param("token"))
+		if err != nil {
+			return err
+		}
+
+		n, err := a.shareLinkNote(l)
+		if err != nil {
+			return err
+		}
+
+		h := c.Response().Header()
+		h.Set("Cache-Control", "no-store")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("X-Robots-Tag", "noindex")
+
+		resp := &sharedNoteResp{Content: n.Content, UpdatedAt: n.UpdatedAt, ExpiresAt: n.ExpiresAt}
+		if strings.Contains(c.Request().Header().Get("Accept"), echo.MIMEApplicationJSON) {
+			return c.JSON(http.StatusOK, resp)
+		}
+
+		var buf bytes.Buffer
+		if err := sharedNotePage.Execute(&buf, resp); err != nil {
+			return err
+		}
+
+		return c.HTML(http.StatusOK, buf.String())
+	}
+}
+
+// shareLinkNote returns the note l is for, as long as it is still the note
+// the link was created for.
+func (a *App) shareLinkNote(l *ShareLink) (*Note, error) {
+	nr := a.noteRepo
+	if l.Tenant != "" {
+		if a.tenants == nil {
+			return nil, ErrShareLinkNotFound
+		}
+
+		t, err := a.tenants.Retrieve(l.Tenant)
+		if err == ErrTenantNotFound {
+			return nil, ErrShareLinkNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		nr = a.noteRepo.(TenantNoteRepository).ForTenant(t)
+	}
+
+	n, err := nr.Retrieve(l.NoteID)
+	if err == ErrNoteNotFound {
+		return nil, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a note created with the same id after the linked one was deleted.
+	if !n.CreatedAt.Equal(l.NoteCreatedAt) {
+		return nil, ErrShareLinkNotFound
+	}
+
+	return n, nil
+}
+
+// shareLinkURL returns where l can be viewed, on the host the request was
+// made to.
+func shareLinkURL(c echo.Context, l *ShareLink) string {
+	return c.Request().Scheme() + "://" + c.Request().Host() + "/s/" + l.Token
+}
+
+var sharedNotePage = template.Must(template.New("note").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="robots" content="noindex">
+  <title>Shared note</title>
+</head>
+<body>
+  <pre>{{.Content}}</pre>
+  <p><small>Updated {{.UpdatedAt.Format "2006-01-02 15:04 MST"}}</small></p>
+</body>
+</html>
+`))
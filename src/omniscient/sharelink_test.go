@@ -0,0 +1,145 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var testShareLinkSecret = []byte(strings.Repeat("s", minShareLinkSecretSize))
+
+// expectShareLink expects l to be loaded, and to have been viewed views
+// times before.
+func expectShareLink(mrc *MockRedisClient, l *ShareLink, views int64) {
+	b, _ := json.Marshal(l)
+	mrc.On("HGet", "sharelinks:links", l.ID).Return(string(b), nil)
+	mrc.On("HGet", "sharelinks:views", l.ID).Return("", ErrKeyNotFound)
+	mrc.On("Do", []interface{}{"HINCRBY", "sharelinks:views", l.ID, 1}).Return(views+1, nil)
+}
+
+func TestNewShareLinksNeedsSecret(t *testing.T) {
+	_, err := NewShareLinks(&MockRedisClient{}, []byte("short"))
+	assert.Error(t, err)
+}
+
+func TestShareLinksView(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+
+	mrc := &MockRedisClient{}
+	expectShareLink(mrc, &ShareLink{ID: "open", NoteID: "1"}, 5)
+	expectShareLink(mrc, &ShareLink{ID: "once", NoteID: "1", MaxViews: 1}, 1)
+	expectShareLink(mrc, &ShareLink{ID: "expired", NoteID: "1", ExpiresAt: &past}, 0)
+
+	sl, err := NewShareLinks(mrc, testShareLinkSecret)
+	assert.NoError(t, err)
+
+	l, err := sl.View(sl.token("open"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1", l.NoteID)
+		assert.Equal(t, int64(6), l.Views)
+	}
+
+	_, err = sl.View(sl.token("once"))
+	assert.Equal(t, ErrShareLinkExpired, err)
+
+	_, err = sl.View(sl.token("expired"))
+	assert.Equal(t, ErrShareLinkExpired, err)
+
+	// tokens which weren't signed are never looked up.
+	for _, token := range []string{"open", "open.", "open.sig", "other" + sl.token("open")[4:]} {
+		_, err = sl.View(token)
+		assert.Equal(t, ErrShareLinkNotFound, err, token)
+	}
+	// expired links aren't counted as viewed.
+	mrc.AssertNumberOfCalls(t, "Do", 2)
+}
+
+func TestShareLinksRevoke(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expectShareLink(mrc, &ShareLink{ID: "l1", NoteID: "1"}, 0)
+	mrc.On("HDel", "sharelinks:links", []string{"l1"}).Return(int64(1), nil)
+	mrc.On("HDel", "sharelinks:views", []string{"l1"}).Return(int64(1), nil)
+	mrc.On("HDel", "sharelinks:notes:1", []string{"l1"}).Return(int64(1), nil)
+
+	sl, err := NewShareLinks(mrc, testShareLinkSecret)
+	assert.NoError(t, err)
+
+	// a link can only be revoked through the note it is for.
+	assert.Equal(t, ErrShareLinkNotFound, sl.Revoke("", "2", "l1"))
+	assert.Equal(t, ErrShareLinkNotFound, sl.Revoke("acme", "1", "l1"))
+	assert.NoError(t, sl.Revoke("", "1", "l1"))
+
+	mrc.AssertNumberOfCalls(t, "HDel", 3)
+}
+
+func TestAppShareLink(t *testing.T) {
+	created := time.Now().UTC().Truncate(time.Second)
+	note := &Note{ID: "1", Content: "<b>secret</b>", CreatedAt: created}
+
+	var stored string
+	mrc := &MockRedisClient{}
+	mrc.On("HSet", "sharelinks:links", "l1", mock.AnythingOfType("string")).
+		Run(func(args mock.Arguments) { stored = args.String(2) }).Return(true, nil)
+	mrc.On("HSet", "sharelinks:notes:1", "l1", "").Return(true, nil)
+	mrc.On("HGet", "sharelinks:links", "l1").Return(func(string, string) string { return stored }, nil)
+	mrc.On("HGet", "sharelinks:views", "l1").Return("", ErrKeyNotFound)
+	mrc.On("Do", []interface{}{"HINCRBY", "sharelinks:views", "l1", 1}).Return(int64(1), nil)
+
+	sl, err := NewShareLinks(mrc, testShareLinkSecret)
+	assert.NoError(t, err)
+	sl.idGen = func() string { return "l1" }
+
+	withAppOptions(t, nil, []AppOption{AppShareLinks(sl)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Retrieve", "1").Return(note, nil)
+
+		u.Path = "/v1/notes/1/share"
+		res, err := http.Post(u.String(), "application/json", strings.NewReader(`{"ttl": 3600}`))
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+		var l ShareLink
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&l))
+		assert.Equal(t, u.Scheme+"://"+u.Host+"/s/"+l.Token, l.URL)
+		if assert.NotNil(t, l.ExpiresAt) {
+			assert.True(t, l.ExpiresAt.After(time.Now().Add(59*time.Minute)))
+		}
+
+		res, err = http.Get(l.URL)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+		assert.Contains(t, string(body), "&lt;b&gt;secret&lt;/b&gt;")
+
+		res, err = http.Get(l.URL + "x")
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+		// a note created with the same id doesn't inherit the link.
+		mnr.ExpectedCalls = nil
+		mnr.On("Retrieve", "1").Return(&Note{ID: "1", CreatedAt: created.Add(time.Hour)}, nil)
+
+		res, err = http.Get(l.URL)
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
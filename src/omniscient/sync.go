@@ -0,0 +1,366 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	changesKey     = "changes"
+	changeSeqKey   = "changeseq"
+	tombstonesKey  = "tombstones"
+	changeFloorKey = "changefloor"
+	listingsKey    = "listings"
+	// changeReadersKey has two parts, so it can't be taken by a note id.
+	changeReadersKey = "changes:readers"
+
+	defaultTombstoneTTL = 30 * 24 * time.Hour
+
+	// listingTTL is how long a listing's snapshot of the catalog is kept
+	// after its last page was fetched.
+	listingTTL = time.Hour
+)
+
+// ErrSyncTokenExpired is returned when syncing from a token older than the
+// oldest kept deletion, so deletions since the token may have been missed.
+var ErrSyncTokenExpired = &NoteError{Code: CodeSyncTokenExpired, Message: "sync token has expired; sync again without a token"}
+
+// recordChangeScript numbers a change to a note and records it as the
+// note's latest change. Deleted notes are kept as tombstones, by the time
+// they were deleted, until they are pruned. The principals in ARGV[4:] are
+// added to the ones who have been able to read the note.
+const recordChangeScript = `
+local seq = redis.call('INCR', KEYS[2])
+redis.call('ZADD', KEYS[1], seq, ARGV[1])
+if ARGV[2] == '1' then
+  redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+else
+  redis.call('ZREM', KEYS[3], ARGV[1])
+end
+if #ARGV > 3 then
+  local known = redis.call('HGET', KEYS[4], ARGV[1])
+  local readers = {}
+  local seen = {}
+  if known then
+    readers = cjson.decode(known)
+    for _, p in ipairs(readers) do
+      seen[p] = true
+    end
+  end
+  local added = false
+  for i = 4, #ARGV do
+    if not seen[ARGV[i]] then
+      seen[ARGV[i]] = true
+      table.insert(readers, ARGV[i])
+      added = true
+    end
+  end
+  if added then
+    redis.call('HSET', KEYS[4], ARGV[1], cjson.encode(readers))
+  end
+end
+return seq
+`
+
+// pruneTombstonesScript forgets notes deleted at or before ARGV[1], and
+// who could read them, and raises the floor to the latest change
+// forgotten, so older sync tokens are expired rather than missing the
+// deletions.
+const pruneTombstonesScript = `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+local floor = tonumber(redis.call('GET', KEYS[3]) or '0')
+for _, id in ipairs(ids) do
+  local seq = tonumber(redis.call('ZSCORE', KEYS[1], id) or '0')
+  if seq > floor then
+    floor = seq
+  end
+  redis.call('ZREM', KEYS[1], id)
+  redis.call('ZREM', KEYS[2], id)
+  redis.call('HDEL', KEYS[4], id)
+end
+if #ids > 0 then
+  redis.call('SET', KEYS[3], floor)
+end
+return #ids
+`
+
+// snapshotListScript copies the catalog to a snapshot for a listing, and
+// returns how many notes are in it. Nothing is stored if there are none.
+const snapshotListScript = `
+local n = redis.call('SORT', KEYS[1], 'BY', 'nosort', 'STORE', KEYS[2])
+if n > 0 then
+  redis.call('EXPIRE', KEYS[2], ARGV[1])
+end
+return n
+`
+
+// NoteChanges are the notes changed after a point in the change sequence.
+type NoteChanges struct {
+	// Notes are the notes which were created or updated.
+	Notes []Note
+	// Deleted are the ids of the notes which were deleted or have expired.
+	Deleted []string
+	// Seq is the point in the change sequence to ask for the next changes
+	// from.
+	Seq int64
+	// More is true if there are more changes after Seq.
+	More bool
+}
+
+// NoteTombstoneTTL sets how long deleted notes are remembered for clients
+// syncing changes. Clients which haven't synced for longer have to sync
+// again from the start.
+func NoteTombstoneTTL(d time.Duration) RedisNoteRepositoryOption {
+	return func(rnr *RedisNoteRepository) error {
+		if d < time.Minute {
+			return errors.New("tombstone ttl must be at least a minute")
+		}
+
+		rnr.tombstoneTTL = d
+		return nil
+	}
+}
+
+// recordChange records a change to the note with id for clients syncing
+// changes. n is the note after the change, or nil if it was deleted, and
+// the principals who can read it are remembered, so they are told when
+// they lose it. In a transaction, it is queued with the rest of the change.
+func (nr *RedisNoteRepository) recordChange(id string, n *Note) error {
+	flag := "0"
+	if n == nil {
+		flag = "1"
+	}
+
+	args := append([]string{id, flag, strconv.FormatInt(time.Now().Unix(), 10)}, noteReaders(n)...)
+	_, err := nr.redisClient.Eval(recordChangeScript,
+		[]string{nr.keyForID(changesKey), nr.keyForID(changeSeqKey), nr.keyForID(tombstonesKey),
+			nr.keyForID(changeReadersKey)},
+		args)
+	return err
+}
+
+// noteReaders returns the principals who can read n, besides admins.
+func noteReaders(n *Note) []string {
+	if n == nil {
+		return nil
+	}
+
+	var readers []string
+	if n.Owner != "" {
+		readers = append(readers, n.Owner)
+	}
+
+	shared := make([]string, 0, len(n.Shares))
+	for id := range n.Shares {
+		if id != n.Owner {
+			shared = append(shared, id)
+		}
+	}
+	sort.Strings(shared)
+
+	return append(readers, shared...)
+}
+
+// Readers returns, for each of ids, the principals who have been able to
+// read the note while its changes are kept for syncing, besides admins.
+// They are told about the note being deleted, or about losing access to
+// it, when syncing or watching changes.
+func (nr *RedisNoteRepository) Readers(ids []string) ([][]string, error) {
+	readers := make([][]string, len(ids))
+	if len(ids) == 0 {
+		return readers, nil
+	}
+
+	args := []interface{}{"HMGET", nr.keyForID(changeReadersKey)}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	v, err := nr.redisClient.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, _ := v.([]interface{})
+	for i := range ids {
+		if i >= len(reply) {
+			break
+		}
+
+		s, ok := reply[i].(string)
+		if !ok {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(s), &readers[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return readers, nil
+}
+
+// ChangeSeq returns the latest point in the change sequence.
+func (nr *RedisNoteRepository) ChangeSeq() (int64, error) {
+	s, err := nr.redisClient.Get(nr.keyForID(changeSeqKey))
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Changes returns up to limit notes changed after since in the change
+// sequence, oldest change first. A note changed more than once is only
+// returned for its latest change. ErrSyncTokenExpired is returned if
+// deletions after since have been forgotten.
+func (nr *RedisNoteRepository) Changes(since, limit int64) (*NoteChanges, error) {
+	// fetch one extra change to find out if there are more.
+	v, err := nr.redisClient.Do("ZRANGEBYSCORE", nr.keyForID(changesKey),
+		"("+strconv.FormatInt(since, 10), "+inf", "WITHSCORES", "LIMIT", 0, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	// the floor is checked after reading, so changes pruned while reading
+	// are noticed.
+	floor, err := nr.changeFloor()
+	if err != nil {
+		return nil, err
+	}
+
+	if since < floor {
+		return nil, ErrSyncTokenExpired
+	}
+
+	reply, _ := v.([]interface{})
+	changes := &NoteChanges{Notes: []Note{}, Deleted: []string{}, Seq: since}
+
+	var ids []string
+	for i := 0; i+1 < len(reply) && int64(len(ids)) < limit; i += 2 {
+		id, _ := reply[i].(string)
+		score, _ := reply[i+1].(string)
+
+		seq, err := strconv.ParseInt(score, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+		changes.Seq = seq
+	}
+
+	changes.More = int64(len(reply)/2) > limit
+
+	notes, err := nr.RetrieveMany(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range notes {
+		if n == nil {
+			changes.Deleted = append(changes.Deleted, ids[i])
+			continue
+		}
+
+		changes.Notes = append(changes.Notes, *n)
+	}
+
+	return changes, nil
+}
+
+// SnapshotList snapshots the catalog for listing every note, so notes
+// created or deleted while the listing is paged through can't shift it. It
+// returns the id of the snapshot to page through with ListSnapshot, or ""
+// if there are no notes.
+func (nr *RedisNoteRepository) SnapshotList() (string, error) {
+	id := nr.idGen()
+
+	v, err := nr.redisClient.Eval(snapshotListScript,
+		[]string{nr.keyForID(catalogKey), nr.listingKey(id)},
+		[]string{strconv.FormatInt(int64(listingTTL/time.Second), 10)})
+	if err != nil {
+		return "", err
+	}
+
+	if n, _ := v.(int64); n == 0 {
+		return "", nil
+	}
+
+	return id, nil
+}
+
+// ListSnapshot lists up to limit notes, starting at offset in the snapshot
+// made by SnapshotList. It also returns whether there are more notes after
+// the page. Notes deleted since the snapshot was made are left out.
+// ErrSyncTokenExpired is returned if the snapshot is no longer kept.
+func (nr *RedisNoteRepository) ListSnapshot(snapshot string, offset, limit int64) ([]Note, bool, error) {
+	key := nr.listingKey(snapshot)
+
+	// fetch one extra id to find out if there is another page.
+	ids, err := nr.redisClient.LRange(key, offset, offset+limit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// snapshots are never empty, and pages past their end aren't listed.
+	if len(ids) == 0 {
+		return nil, false, ErrSyncTokenExpired
+	}
+
+	more := int64(len(ids)) > limit
+	if more {
+		ids = ids[:limit]
+		_, err = nr.redisClient.ExpireAt(key, time.Now().Add(listingTTL))
+	} else {
+		_, err = nr.redisClient.Delete(key)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	notes, err := nr.RetrieveMany(ids)
+	if err != nil {
+		return nil, false, err
+	}
+
+	page := []Note{}
+	for _, n := range notes {
+		if n != nil {
+			page = append(page, *n)
+		}
+	}
+
+	return page, more, nil
+}
+
+func (nr *RedisNoteRepository) listingKey(snapshot string) string {
+	return nr.keyForID(listingsKey + ":" + snapshot)
+}
+
+func (nr *RedisNoteRepository) changeFloor() (int64, error) {
+	s, err := nr.redisClient.Get(nr.keyForID(changeFloorKey))
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// pruneTombstones forgets notes deleted more than the tombstone ttl before t.
+func (nr *RedisNoteRepository) pruneTombstones(t time.Time) error {
+	_, err := nr.redisClient.Eval(pruneTombstonesScript,
+		[]string{nr.keyForID(changesKey), nr.keyForID(tombstonesKey), nr.keyForID(changeFloorKey),
+			nr.keyForID(changeReadersKey)},
+		[]string{strconv.FormatInt(t.Add(-nr.tombstoneTTL).Unix(), 10)})
+	return err
+}
@@ -0,0 +1,284 @@
+package omniscient
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// syncToken is where a client is in syncing notes. A client without a token
+// first lists every note, a page at a time, and then follows the changes
+// made since the listing started.
+type syncToken struct {
+	// Seq is the point in the change sequence the client has synced to.
+	Seq int64
+	// Listing is set while the client is listing every note. The listing
+	// pages through Snapshot, a snapshot of the catalog made when it
+	// started, and Offset is where its next page starts.
+	Listing  bool
+	Snapshot string
+	Offset   int64
+}
+
+func (st syncToken) String() string {
+	s := "c:" + strconv.FormatInt(st.Seq, 10)
+	if st.Listing {
+		s = fmt.Sprintf("l:%d:%s:%d", st.Seq, st.Snapshot, st.Offset)
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseSyncToken(s string) (syncToken, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return syncToken{}, false
+	}
+
+	var st syncToken
+	if _, err := fmt.Sscanf(string(b), "c:%d", &st.Seq); err == nil && st.String() == s {
+		return st, st.Seq >= 0
+	}
+
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 4 || parts[0] != "l" || ValidateNoteID(parts[2]) != nil {
+		return syncToken{}, false
+	}
+
+	st = syncToken{Listing: true, Snapshot: parts[2]}
+	if st.Seq, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return syncToken{}, false
+	}
+	if st.Offset, err = strconv.ParseInt(parts[3], 10, 64); err != nil {
+		return syncToken{}, false
+	}
+
+	return st, st.String() == s && st.Seq >= 0 && st.Offset >= 0
+}
+
+type syncResp struct {
+	Notes []Note `json:"notes"`
+	// Deleted are the ids of the notes deleted since the token, or which the
+	// client can no longer read.
+	Deleted []string `json:"deleted"`
+	// Token is the token to sync from next time.
+	Token string `json:"token"`
+	// HasMore is set if there are more changes to fetch now with Token.
+	HasMore bool `json:"has_more"`
+}
+
+// syncNotes returns the notes changed since the sync token in since, and the
+// token to sync from next. Without a token, every note is returned.
+func (a *App) syncNotes() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		v := a.newValidation()
+
+		limit := int64(defaultPageSize)
+		if limitParam := c.QueryParam("limit"); limitParam != "" {
+			n, err := strconv.ParseInt(limitParam, 10, 64)
+			if err != nil || n < 1 || n > maxPageSize {
+				v.add("limit", CodeInvalidValue, "limit must be between 1 and %d", maxPageSize)
+			}
+			limit = n
+		}
+
+		var st syncToken
+		since := c.QueryParam("since")
+		if since != "" {
+			var ok bool
+			if st, ok = parseSyncToken(since); !ok {
+				v.add("since", CodeInvalidValue, "since is not a valid sync token")
+			}
+		}
+
+		if err := v.err(); err != nil {
+			return err
+		}
+
+		if since == "" {
+			// changes made while listing are synced after the listing, so
+			// the sequence is read before the catalog is snapshotted.
+			seq, err := a.notes(c).ChangeSeq()
+			if err != nil {
+				return err
+			}
+
+			snapshot, err := a.notes(c).SnapshotList()
+			if err != nil {
+				return err
+			}
+
+			// without any notes, there are only changes to follow.
+			st = syncToken{Seq: seq, Listing: snapshot != "", Snapshot: snapshot}
+		}
+
+		resp := syncResp{Deleted: []string{}}
+
+		if st.Listing {
+			notes, more, err := a.notes(c).ListSnapshot(st.Snapshot, st.Offset, limit)
+			if err != nil {
+				return err
+			}
+
+			resp.Notes = notes
+			resp.HasMore = more
+
+			next := syncToken{Seq: st.Seq}
+			if more {
+				next = syncToken{Seq: st.Seq, Listing: true, Snapshot: st.Snapshot, Offset: st.Offset + limit}
+			}
+			resp.Token = next.String()
+
+			return c.JSON(http.StatusOK, resp)
+		}
+
+		changes, err := a.notes(c).Changes(st.Seq, limit)
+		if err != nil {
+			return err
+		}
+
+		resp.Notes = changes.Notes
+		resp.Deleted = changes.Deleted
+		resp.HasMore = changes.More
+		resp.Token = syncToken{Seq: changes.Seq}.String()
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+type syncChangeReq struct {
+	Op NoteOpKind `json:"op"`
+	ID string     `json:"id,omitempty"`
+	// Version is the version of the note the client changed.
+	Version int64  `json:"version,omitempty"`
+	Content string `json:"content,omitempty"`
+	noteExpiry
+}
+
+func (scr *syncChangeReq) validate(v *validation, prefix string) {
+	switch scr.Op {
+	case NoteOpCreate:
+		if scr.ID != "" {
+			if err := ValidateNoteID(scr.ID); err != nil {
+				v.add(fieldName(prefix, "id"), CodeInvalidValue, "%s", err)
+			}
+		}
+	case NoteOpUpdate, NoteOpDelete:
+		if scr.ID == "" {
+			v.add(fieldName(prefix, "id"), CodeRequired, "id is required")
+		}
+		if scr.Version < 1 {
+			v.add(fieldName(prefix, "version"), CodeRequired, "version is required")
+		}
+	default:
+		v.add(fieldName(prefix, "op"), CodeInvalidValue, "op must be one of create, update or delete")
+	}
+
+	if scr.Op == NoteOpCreate || scr.Op == NoteOpUpdate {
+		v.content(fieldName(prefix, "content"), scr.Content)
+		scr.noteExpiry.validate(v, prefix)
+	}
+}
+
+type syncReq struct {
+	Changes []syncChangeReq `json:"changes"`
+}
+
+func (sr *syncReq) validate(v *validation, prefix string) {
+	for i := range sr.Changes {
+		sr.Changes[i].validate(v, fmt.Sprintf("%s[%d]", fieldName(prefix, "changes"), i))
+	}
+}
+
+// pushChanges applies changes made by a client while it was offline. Each
+// change is applied on its own. Updates and deletes are only applied to
+// the version of the note the client changed; otherwise the change fails
+// with a conflict, and the result has the note as it is now.
+func (a *App) pushChanges() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sr := &syncReq{}
+		if err := c.Bind(sr); err != nil {
+			return err
+		}
+
+		if len(sr.Changes) == 0 {
+			return NewProblem(CodeInvalidRequest, "sync has no changes")
+		}
+
+		if len(sr.Changes) > a.maxBatchSize {
+			return NewProblem(CodeRequestTooLarge, "sync has more than %d changes", a.maxBatchSize)
+		}
+
+		v := a.newValidation()
+		sr.validate(v, "")
+		if err := v.err(); err != nil {
+			return err
+		}
+
+		nr := a.notes(c)
+		resp := batchResp{}
+		for _, scr := range sr.Changes {
+			resp.Results = append(resp.Results, applyChange(nr, scr, v.now))
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+func applyChange(nr NoteRepository, scr syncChangeReq, now time.Time) batchOpResult {
+	opts := scr.options(now)
+
+	if scr.Op == NoteOpCreate {
+		if scr.ID != "" {
+			opts = append(opts, NoteID(scr.ID))
+		}
+
+		note, err := nr.Create(scr.Content, opts...)
+		if err != nil {
+			return conflictResult(nr, scr.ID, err)
+		}
+
+		return batchOpResult{Status: http.StatusCreated, Note: note}
+	}
+
+	notes, err := nr.Transact([]NoteOp{{
+		Kind:    scr.Op,
+		ID:      scr.ID,
+		Content: scr.Content,
+		Options: opts,
+		Version: scr.Version,
+	}})
+	if oe, ok := err.(*OpError); ok {
+		err = oe.Err
+	}
+
+	switch {
+	case err == ErrNoteNotFound && scr.Op == NoteOpDelete:
+		// the note is already gone, which is what the client wanted.
+		return batchOpResult{Status: http.StatusNoContent}
+	case err != nil:
+		return conflictResult(nr, scr.ID, err)
+	}
+
+	return batchOpResult{Status: noteOpStatus(scr.Op), Note: notes[0]}
+}
+
+// conflictResult is the result of a change which failed with err. If the
+// change conflicted with the note as it is now, the note is included so
+// the client can resolve the conflict.
+func conflictResult(nr NoteRepository, id string, err error) batchOpResult {
+	result := opErrorResult(err)
+
+	if err == ErrVersionConflict || err == ErrNoteExists {
+		if note, err := nr.Retrieve(id); err == nil {
+			result.Note = note
+		}
+	}
+
+	return result
+}
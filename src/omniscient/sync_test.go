@@ -0,0 +1,226 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// expectRecordChange expects a change to the note with id to be recorded
+// for syncing, on a mock Redis client or transaction.
+func expectRecordChange(m *mock.Mock, id string, deleted bool) *mock.Call {
+	flag := "0"
+	if deleted {
+		flag = "1"
+	}
+
+	return m.On("Eval", recordChangeScript,
+		[]string{"notes:changes", "notes:changeseq", "notes:tombstones", "notes:changes:readers"},
+		mock.MatchedBy(func(args []string) bool {
+			return args[0] == id && args[1] == flag
+		})).Return(int64(1), nil)
+}
+
+func TestRedisNoteRepoChanges(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("Do", []interface{}{"ZRANGEBYSCORE", "notes:changes", "(4", "+inf", "WITHSCORES", "LIMIT", 0, int64(3)}).
+		Return([]interface{}{"1", "5", "2", "6", "3", "8"}, nil)
+	mrc.On("Get", "notes:changefloor").Return("", ErrKeyNotFound).Once()
+	mrc.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1", fieldNoteVersion: "2"}, nil)
+	mrc.On("HGetAllMap", "notes:2").Return(map[string]string{}, nil)
+
+	rnr, err := NewRedisNoteRepository(RedisClientOption(mrc))
+	assert.NoError(t, err)
+
+	changes, err := rnr.Changes(4, 2)
+	assert.NoError(t, err)
+	assert.Len(t, changes.Notes, 1)
+	assert.Equal(t, int64(2), changes.Notes[0].Version)
+	assert.Equal(t, []string{"2"}, changes.Deleted)
+	assert.Equal(t, int64(6), changes.Seq)
+	assert.True(t, changes.More)
+
+	// deletions after 4 have been forgotten.
+	mrc.On("Get", "notes:changefloor").Return("5", nil)
+	_, err = rnr.Changes(4, 2)
+	assert.Equal(t, ErrSyncTokenExpired, err)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoRecordChangeReaders(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("Eval", recordChangeScript, mock.Anything,
+		mock.MatchedBy(func(args []string) bool { return args[0] == "1" })).
+		Run(func(args mock.Arguments) {
+			assert.Equal(t, []string{"owner", "editor", "reader"}, args.Get(2).([]string)[3:])
+		}).Return(int64(1), nil)
+	mrc.On("Eval", recordChangeScript, mock.Anything,
+		mock.MatchedBy(func(args []string) bool { return args[0] == "2" })).
+		Run(func(args mock.Arguments) {
+			assert.Equal(t, "1", args.Get(2).([]string)[1])
+			assert.Len(t, args.Get(2).([]string), 3)
+		}).Return(int64(2), nil)
+	mrc.On("Do", []interface{}{"HMGET", "notes:changes:readers", "1", "2"}).
+		Return([]interface{}{`["owner","reader"]`, nil}, nil)
+
+	rnr, err := NewRedisNoteRepository(RedisClientOption(mrc))
+	assert.NoError(t, err)
+
+	assert.NoError(t, rnr.recordChange("1", sharedNote("1")))
+	assert.NoError(t, rnr.recordChange("2", nil))
+
+	readers, err := rnr.Readers([]string{"1", "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"owner", "reader"}, nil}, readers)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestRedisNoteRepoListSnapshot(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("Eval", snapshotListScript, []string{"notes:catalog", "notes:listings:snap"}, []string{"3600"}).
+		Return(int64(3), nil).Once()
+	mrc.On("LRange", "notes:listings:snap", int64(0), int64(2)).Return([]string{"3", "2", "1"}, nil)
+	mrc.On("LRange", "notes:listings:snap", int64(2), int64(4)).Return([]string{"1"}, nil)
+	mrc.On("LRange", "notes:listings:gone", int64(0), int64(2)).Return([]string{}, nil)
+	mrc.On("ExpireAt", "notes:listings:snap", mock.AnythingOfType("time.Time")).Return(true, nil)
+	mrc.On("Delete", []string{"notes:listings:snap"}).Return(int64(1), nil)
+	mrc.On("HGetAllMap", "notes:3").Return(map[string]string{fieldNoteID: "3"}, nil)
+	mrc.On("HGetAllMap", "notes:2").Return(map[string]string{}, nil)
+	mrc.On("HGetAllMap", "notes:1").Return(map[string]string{fieldNoteID: "1"}, nil)
+
+	rnr, err := NewRedisNoteRepository(RedisClientOption(mrc), NoteIDGenFn(func() string { return "snap" }))
+	assert.NoError(t, err)
+
+	snapshot, err := rnr.SnapshotList()
+	assert.NoError(t, err)
+	assert.Equal(t, "snap", snapshot)
+
+	// note 2 was deleted after the snapshot, and nothing shifts into its
+	// place.
+	notes, more, err := rnr.ListSnapshot(snapshot, 0, 2)
+	assert.NoError(t, err)
+	assert.True(t, more)
+	assert.Equal(t, []Note{{ID: "3"}}, notes)
+
+	notes, more, err = rnr.ListSnapshot(snapshot, 2, 2)
+	assert.NoError(t, err)
+	assert.False(t, more)
+	assert.Equal(t, []Note{{ID: "1"}}, notes)
+
+	_, _, err = rnr.ListSnapshot("gone", 0, 2)
+	assert.Equal(t, ErrSyncTokenExpired, err)
+
+	// there is nothing to list without notes.
+	mrc.On("Eval", snapshotListScript, mock.Anything, mock.Anything).Return(int64(0), nil)
+	snapshot, err = rnr.SnapshotList()
+	assert.NoError(t, err)
+	assert.Empty(t, snapshot)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestSyncToken(t *testing.T) {
+	for _, st := range []syncToken{
+		{Seq: 7},
+		{Seq: 7, Listing: true, Snapshot: "01ARZ3NDEKTSV4RRFFQ69G5FAV", Offset: 100},
+	} {
+		got, ok := parseSyncToken(st.String())
+		assert.True(t, ok)
+		assert.Equal(t, st, got)
+	}
+
+	for _, s := range []string{"7", "Yzot", "bDo3", "bDo3OjEwMA", "bDo3OmE6YjoxMDA", "!!"} {
+		_, ok := parseSyncToken(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func getSync(t *testing.T, u *url.URL, since string) syncResp {
+	u.Path = "/v1/sync"
+	u.RawQuery = url.Values{"since": {since}, "limit": {"2"}}.Encode()
+
+	res, err := http.Get(u.String())
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var resp syncResp
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+	return resp
+}
+
+func TestAppSyncNotes(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("ChangeSeq").Return(int64(7), nil)
+		mnr.On("SnapshotList").Return("snap", nil)
+		mnr.On("ListSnapshot", "snap", int64(0), int64(2)).Return([]Note{{ID: "1"}, {ID: "2"}}, true, nil)
+		mnr.On("ListSnapshot", "snap", int64(2), int64(2)).Return([]Note{{ID: "3"}}, false, nil)
+		mnr.On("Changes", int64(7), int64(2)).
+			Return(&NoteChanges{Notes: []Note{{ID: "1", Version: 2}}, Deleted: []string{"2"}, Seq: 9}, nil)
+
+		// without a token, every note is listed.
+		resp := getSync(t, u, "")
+		assert.Len(t, resp.Notes, 2)
+		assert.True(t, resp.HasMore)
+
+		resp = getSync(t, u, resp.Token)
+		assert.Equal(t, "3", resp.Notes[0].ID)
+		assert.False(t, resp.HasMore)
+
+		// and then the changes made since the listing started.
+		resp = getSync(t, u, resp.Token)
+		assert.Equal(t, int64(2), resp.Notes[0].Version)
+		assert.Equal(t, []string{"2"}, resp.Deleted)
+		assert.Equal(t, syncToken{Seq: 9}.String(), resp.Token)
+
+		u.RawQuery = "since=nope"
+		p := doProblemRequest(t, "GET", u.String(), "")
+		assert.Equal(t, CodeValidationFailed, p.Code)
+
+		mnr.On("Changes", int64(1), int64(defaultPageSize)).Return(nil, ErrSyncTokenExpired)
+		u.RawQuery = "since=" + syncToken{Seq: 1}.String()
+		p = doProblemRequest(t, "GET", u.String(), "")
+		assert.Equal(t, CodeSyncTokenExpired, p.Code)
+	})
+}
+
+func TestAppPushChanges(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		mnr.On("Create", "new", mock.AnythingOfType("[]omniscient.NoteOption")).Return(&Note{ID: "a", Version: 1}, nil)
+		mnr.On("Transact", []NoteOp{{Kind: NoteOpUpdate, ID: "b", Content: "mine", Version: 1}}).
+			Return(nil, &OpError{Err: ErrVersionConflict})
+		mnr.On("Retrieve", "b").Return(&Note{ID: "b", Content: "theirs", Version: 2}, nil)
+		mnr.On("Transact", []NoteOp{{Kind: NoteOpDelete, ID: "c", Version: 3}}).
+			Return(nil, &OpError{Err: ErrNoteNotFound})
+
+		u.Path = "/v1/sync"
+		res, err := http.Post(u.String(), "application/json", bytes.NewBufferString(`{"changes": [
+			{"op": "create", "id": "a", "content": "new"},
+			{"op": "update", "id": "b", "version": 1, "content": "mine"},
+			{"op": "delete", "id": "c", "version": 3}
+		]}`))
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		var resp batchResp
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		assert.Len(t, resp.Results, 3)
+		assert.Equal(t, http.StatusCreated, resp.Results[0].Status)
+		assert.Equal(t, http.StatusConflict, resp.Results[1].Status)
+		assert.Equal(t, CodeVersionConflict, resp.Results[1].Code)
+		assert.Equal(t, "theirs", resp.Results[1].Note.Content)
+		// the note was already deleted.
+		assert.Equal(t, http.StatusNoContent, resp.Results[2].Status)
+
+		p := doProblemRequest(t, "POST", u.String(), `{"changes": [{"op": "update", "id": "b", "content": "mine"}]}`)
+		assert.Equal(t, CodeValidationFailed, p.Code)
+	})
+}
@@ -0,0 +1,428 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// HeaderTenant chooses the tenant a request is made in, for principals
+	// which aren't tied to one.
+	HeaderTenant = "X-Tenant"
+
+	tenantContextKey = "tenant"
+
+	tenantsKey    = "tenants"
+	tenantsAllKey = "all"
+
+	// the usage keys have two parts, so they can't be taken by a note id.
+	tenantUsageKey = "quota:usage"
+	tenantSizesKey = "quota:sizes"
+
+	fieldUsageNotes = "notes"
+	fieldUsageBytes = "bytes"
+
+	// tenantScanCount is how many keys are asked for at a time when deleting
+	// the notes of a tenant.
+	tenantScanCount = 500
+)
+
+// trackUsageScript keeps the size of each note of a tenant, and the number
+// of notes and bytes of content they add up to. ARGV[2] is the size of the
+// note after the change, or -1 if it was deleted.
+const trackUsageScript = `
+local old = redis.call('HGET', KEYS[1], ARGV[1])
+local size = tonumber(ARGV[2])
+if size < 0 then
+	if old then
+		redis.call('HDEL', KEYS[1], ARGV[1])
+		redis.call('HINCRBY', KEYS[2], 'notes', -1)
+		redis.call('HINCRBY', KEYS[2], 'bytes', -tonumber(old))
+	end
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], size)
+if old then
+	redis.call('HINCRBY', KEYS[2], 'bytes', size - tonumber(old))
+else
+	redis.call('HINCRBY', KEYS[2], 'notes', 1)
+	redis.call('HINCRBY', KEYS[2], 'bytes', size)
+end
+return 0
+`
+
+var (
+	// ErrTenantNotFound is returned when a tenant does not exist.
+	ErrTenantNotFound = &NoteError{Code: CodeTenantNotFound, Message: "tenant not found"}
+	// ErrTenantExists is returned when creating a tenant with an id which is
+	// already in use.
+	ErrTenantExists = &NoteError{Code: CodeTenantExists, Message: "tenant already exists"}
+	// ErrInvalidTenantID is returned when a tenant id is not valid.
+	ErrInvalidTenantID = &NoteError{Code: CodeInvalidRequest, Message: "tenant id must be 1-64 letters, digits, '-' or '_'"}
+	// ErrQuotaExceeded is returned when a change would take a tenant over
+	// its quota.
+	ErrQuotaExceeded = &NoteError{Code: CodeQuotaExceeded, Message: "tenant quota exceeded"}
+)
+
+// Tenant is an isolated namespace of notes, with its own quota.
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// MaxNotes is how many notes the tenant can have. Zero is unlimited.
+	MaxNotes int64 `json:"max_notes,omitempty"`
+	// MaxBytes is how many bytes of content the notes of the tenant can add
+	// up to. Zero is unlimited.
+	MaxBytes  int64     `json:"max_bytes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Usage is what the tenant is using of its quota.
+	Usage *TenantUsage `json:"usage,omitempty"`
+}
+
+// TenantUsage is how many notes a tenant has, and how many bytes of content
+// they add up to.
+type TenantUsage struct {
+	Notes int64 `json:"notes"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ValidateTenantID checks that id can be used as a tenant id.
+func ValidateTenantID(id string) error {
+	if len(id) > 64 || !validNoteID.MatchString(id) {
+		return ErrInvalidTenantID
+	}
+
+	return nil
+}
+
+// TenantNoteRepository is a NoteRepository which keeps the notes of each
+// tenant apart from the others.
+type TenantNoteRepository interface {
+	NoteRepository
+	// ForTenant returns the notes of t, kept within its quota.
+	ForTenant(t *Tenant) NoteRepository
+	// TenantUsage returns what the tenant with id is using of its quota.
+	TenantUsage(id string) (*TenantUsage, error)
+	// DeleteTenant deletes every note of the tenant with id.
+	DeleteTenant(id string) error
+}
+
+// Tenants stores the tenants in Redis.
+type Tenants struct {
+	redisClient RedisClient
+	base        string
+}
+
+// TenantsOption is an option for configuring Tenants.
+type TenantsOption func(*Tenants) error
+
+// NewTenants creates an instance of Tenants.
+func NewTenants(rc RedisClient, opts ...TenantsOption) (*Tenants, error) {
+	ts := &Tenants{
+		redisClient: rc,
+		base:        tenantsKey,
+	}
+
+	for _, opt := range opts {
+		if err := opt(ts); err != nil {
+			return nil, err
+		}
+	}
+
+	return ts, nil
+}
+
+// TenantsBase sets the base string for the tenant keys.
+func TenantsBase(base string) TenantsOption {
+	return func(ts *Tenants) error {
+		ts.base = base
+		return nil
+	}
+}
+
+// Create creates a tenant.
+func (ts *Tenants) Create(t *Tenant) (*Tenant, error) {
+	if err := ValidateTenantID(t.ID); err != nil {
+		return nil, err
+	}
+
+	created := *t
+	created.CreatedAt = time.Now().UTC()
+	created.Usage = nil
+
+	b, err := json.Marshal(&created)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := ts.redisClient.HSetNX(ts.key(), created.ID, string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrTenantExists
+	}
+
+	return &created, nil
+}
+
+// Retrieve retrieves a tenant.
+func (ts *Tenants) Retrieve(id string) (*Tenant, error) {
+	s, err := ts.redisClient.HGet(ts.key(), id)
+	if err == ErrKeyNotFound {
+		return nil, ErrTenantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var t Tenant
+	if err := json.Unmarshal([]byte(s), &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// List lists the tenants by id.
+func (ts *Tenants) List() ([]*Tenant, error) {
+	m, err := ts.redisClient.HGetAllMap(ts.key())
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tenants := make([]*Tenant, 0, len(ids))
+	for _, id := range ids {
+		var t Tenant
+		if err := json.Unmarshal([]byte(m[id]), &t); err != nil {
+			return nil, err
+		}
+
+		tenants = append(tenants, &t)
+	}
+
+	return tenants, nil
+}
+
+// Delete deletes a tenant. Its notes are deleted with
+// TenantNoteRepository.DeleteTenant.
+func (ts *Tenants) Delete(id string) error {
+	n, err := ts.redisClient.HDel(ts.key(), id)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrTenantNotFound
+	}
+
+	return nil
+}
+
+func (ts *Tenants) key() string {
+	return ts.base + ":" + tenantsAllKey
+}
+
+// ForTenant returns the notes of t. They are kept under their own base, so
+// they can't be reached from any other tenant.
+func (nr *RedisNoteRepository) ForTenant(t *Tenant) NoteRepository {
+	tnr := *nr
+	tnr.base = nr.tenantBase(t.ID)
+	tnr.tenant = t.ID
+	tnr.maxNotes = t.MaxNotes
+	tnr.maxBytes = t.MaxBytes
+	return &tnr
+}
+
+// TenantUsage returns what the tenant with id is using of its quota.
+func (nr *RedisNoteRepository) TenantUsage(id string) (*TenantUsage, error) {
+	tnr := *nr
+	tnr.base = nr.tenantBase(id)
+	tnr.tenant = id
+	return tnr.usage()
+}
+
+// DeleteTenant deletes every key under the base of the tenant with id.
+func (nr *RedisNoteRepository) DeleteTenant(id string) error {
+	match := nr.tenantBase(id) + ":*"
+	cursor := "0"
+
+	for {
+		reply, err := nr.redisClient.Do("SCAN", cursor, "MATCH", match, "COUNT", tenantScanCount)
+		if err != nil {
+			return err
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("unexpected scan reply %v", reply)
+		}
+
+		cursor, _ = parts[0].(string)
+		raw, _ := parts[1].([]interface{})
+
+		keys := make([]string, 0, len(raw))
+		for _, k := range raw {
+			if s, ok := k.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+
+		if len(keys) > 0 {
+			if _, err := nr.redisClient.Delete(keys...); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	tenantNotesGauge.DeleteLabelValues(id)
+	tenantBytesGauge.DeleteLabelValues(id)
+	return nil
+}
+
+func (nr *RedisNoteRepository) tenantBase(id string) string {
+	return strings.Join([]string{nr.base, tenantsKey, id}, ":")
+}
+
+// trackUsage records the size of n, or that the note with id was deleted if
+// n is nil, against the quota of the tenant. It does nothing outside a
+// tenant. In a transaction, it is queued with the rest of the change.
+func (nr *RedisNoteRepository) trackUsage(id string, n *Note) error {
+	if nr.tenant == "" {
+		return nil
+	}
+
+	size := int64(-1)
+	if n != nil {
+		size = int64(len(n.Content))
+	}
+
+	_, err := nr.redisClient.Eval(trackUsageScript,
+		[]string{nr.keyForID(tenantSizesKey), nr.keyForID(tenantUsageKey)},
+		[]string{id, strconv.FormatInt(size, 10)})
+	return err
+}
+
+// checkQuota returns ErrQuotaExceeded if adding notes and bytes would take
+// the tenant over its quota. Concurrent changes can each pass the check, so
+// a busy tenant can go slightly over.
+func (nr *RedisNoteRepository) checkQuota(notes, bytes int64) error {
+	if nr.maxNotes == 0 && nr.maxBytes == 0 {
+		return nil
+	}
+
+	if notes <= 0 && bytes <= 0 {
+		return nil
+	}
+
+	u, err := nr.usage()
+	if err != nil {
+		return err
+	}
+
+	if nr.maxNotes > 0 && notes > 0 && u.Notes+notes > nr.maxNotes {
+		return ErrQuotaExceeded
+	}
+
+	if nr.maxBytes > 0 && bytes > 0 && u.Bytes+bytes > nr.maxBytes {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+func (nr *RedisNoteRepository) usage() (*TenantUsage, error) {
+	m, err := nr.redisClient.HGetAllMap(nr.keyForID(tenantUsageKey))
+	if err != nil {
+		return nil, err
+	}
+
+	u := &TenantUsage{}
+	u.Notes, _ = strconv.ParseInt(m[fieldUsageNotes], 10, 64)
+	u.Bytes, _ = strconv.ParseInt(m[fieldUsageBytes], 10, 64)
+
+	tenantNotesGauge.WithLabelValues(nr.tenant).Set(float64(u.Notes))
+	tenantBytesGauge.WithLabelValues(nr.tenant).Set(float64(u.Bytes))
+
+	return u, nil
+}
+
+// contentDelta is how many bytes of content changing before into after adds.
+func contentDelta(before, after *Note) int64 {
+	return int64(len(after.Content) - len(before.Content))
+}
+
+// transactUsage returns how many notes and bytes of content the changes a
+// transaction makes add. Notes deleted without being loaded aren't known,
+// so they aren't counted.
+func transactUsage(changed []string, current map[string]*Note, created map[string]bool, original map[string]*Note) (int64, int64) {
+	var notes, bytes int64
+	for _, id := range changed {
+		n, before := current[id], original[id]
+		switch {
+		case created[id] && n != nil:
+			notes++
+			bytes += int64(len(n.Content))
+		case n == nil && before != nil:
+			notes--
+			bytes -= int64(len(before.Content))
+		case n != nil && before != nil:
+			bytes += contentDelta(before, n)
+		}
+	}
+
+	return notes, bytes
+}
+
+// tenantSweeper sweeps the expired notes of a repository, and of each of
+// its tenants.
+type tenantSweeper struct {
+	nr      *RedisNoteRepository
+	tenants *Tenants
+}
+
+// NewTenantSweeper creates a NoteSweeper which sweeps the notes of nr and
+// of every tenant in tenants.
+func NewTenantSweeper(nr *RedisNoteRepository, tenants *Tenants) NoteSweeper {
+	return &tenantSweeper{nr: nr, tenants: tenants}
+}
+
+// SweepExpired sweeps every tenant, even if sweeping one of them fails.
+// The first error is returned.
+func (ts *tenantSweeper) SweepExpired(t time.Time) (int, error) {
+	swept, firstErr := ts.nr.SweepExpired(t)
+
+	tenants, err := ts.tenants.List()
+	if err != nil {
+		return swept, err
+	}
+
+	for _, tenant := range tenants {
+		n, err := ts.nr.ForTenant(tenant).(*RedisNoteRepository).SweepExpired(t)
+		swept += n
+		if err != nil {
+			log.WithError(err).WithField("tenant", tenant.ID).Warning("unable to sweep tenant")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return swept, firstErr
+}
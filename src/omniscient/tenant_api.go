@@ -0,0 +1,116 @@
+package omniscient
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+const maxTenantNameLength = 100
+
+type createTenantReq struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// MaxNotes and MaxBytes are the quota of the tenant. Zero is unlimited.
+	MaxNotes int64 `json:"max_notes,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+func (ctr *createTenantReq) validate(v *validation, prefix string) {
+	switch {
+	case ctr.ID == "":
+		v.add(fieldName(prefix, "id"), CodeRequired, "id is required")
+	case ValidateTenantID(ctr.ID) != nil:
+		v.add(fieldName(prefix, "id"), CodeInvalidValue, "%s", ErrInvalidTenantID.Message)
+	}
+
+	if len(ctr.Name) > maxTenantNameLength {
+		v.add(fieldName(prefix, "name"), CodeTooLong, "name must be at most %d characters", maxTenantNameLength)
+	}
+
+	if ctr.MaxNotes < 0 {
+		v.add(fieldName(prefix, "max_notes"), CodeInvalidValue, "max_notes can't be negative")
+	}
+
+	if ctr.MaxBytes < 0 {
+		v.add(fieldName(prefix, "max_bytes"), CodeInvalidValue, "max_bytes can't be negative")
+	}
+}
+
+// tenantsEnabled rejects requests to the tenant routes if tenants aren't
+// configured.
+func (a *App) tenantsEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.tenants == nil {
+			return NewProblem(CodeNotFound, "tenants are not enabled")
+		}
+
+		return next(c)
+	}
+}
+
+func (a *App) createTenant() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctr := &createTenantReq{}
+		if err := a.bind(c, ctr); err != nil {
+			return err
+		}
+
+		t, err := a.tenants.Create(&Tenant{
+			ID:       ctr.ID,
+			Name:     ctr.Name,
+			MaxNotes: ctr.MaxNotes,
+			MaxBytes: ctr.MaxBytes,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, t)
+	}
+}
+
+func (a *App) listTenants() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenants, err := a.tenants.List()
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, tenants)
+	}
+}
+
+// retrieveTenant retrieves a tenant with what it is using of its quota.
+func (a *App) retrieveTenant() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t, err := a.tenants.Retrieve(c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		t.Usage, err = a.noteRepo.(TenantNoteRepository).TenantUsage(t.ID)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, t)
+	}
+}
+
+// deleteTenant deletes a tenant and all of its notes. The tenant is removed
+// first, so no more requests can be made in it while its notes are deleted.
+func (a *App) deleteTenant() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		if err := a.tenants.Delete(id); err != nil {
+			return err
+		}
+
+		if err := a.noteRepo.(TenantNoteRepository).DeleteTenant(id); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
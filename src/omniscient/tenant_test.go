@@ -0,0 +1,191 @@
+package omniscient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mockTenantNoteRepository is a TenantNoteRepository whose tenants all get
+// the same repository.
+type mockTenantNoteRepository struct {
+	MockNoteRepository
+	tenantRepo *MockNoteRepository
+	tenants    []string
+}
+
+func (m *mockTenantNoteRepository) ForTenant(t *Tenant) NoteRepository {
+	m.tenants = append(m.tenants, t.ID)
+	return m.tenantRepo
+}
+
+func (m *mockTenantNoteRepository) TenantUsage(id string) (*TenantUsage, error) {
+	return &TenantUsage{Notes: 2, Bytes: 10}, nil
+}
+
+func (m *mockTenantNoteRepository) DeleteTenant(id string) error {
+	return nil
+}
+
+// expectTenant expects the tenant with id to be looked up.
+func expectTenant(mrc *MockRedisClient, id string) {
+	b, _ := json.Marshal(&Tenant{ID: id})
+	mrc.On("HGet", "tenants:all", id).Return(string(b), nil)
+}
+
+func TestTenantsCreate(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("HSetNX", "tenants:all", "acme", mock.AnythingOfType("string")).Return(true, nil).Once()
+	mrc.On("HSetNX", "tenants:all", "acme", mock.AnythingOfType("string")).Return(false, nil).Once()
+
+	ts, err := NewTenants(mrc)
+	assert.NoError(t, err)
+
+	created, err := ts.Create(&Tenant{ID: "acme", MaxNotes: 10})
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(10), created.MaxNotes)
+		assert.False(t, created.CreatedAt.IsZero())
+	}
+
+	_, err = ts.Create(&Tenant{ID: "acme"})
+	assert.Equal(t, ErrTenantExists, err)
+
+	_, err = ts.Create(&Tenant{ID: "a:b"})
+	assert.Equal(t, ErrInvalidTenantID, err)
+}
+
+func TestTenantsRetrieve(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expectTenant(mrc, "acme")
+	mrc.On("HGet", "tenants:all", "missing").Return("", ErrKeyNotFound)
+
+	ts, err := NewTenants(mrc)
+	assert.NoError(t, err)
+
+	tenant, err := ts.Retrieve("acme")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "acme", tenant.ID)
+	}
+
+	_, err = ts.Retrieve("missing")
+	assert.Equal(t, ErrTenantNotFound, err)
+}
+
+func TestRedisNoteRepoForTenant(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("HGetAllMap", "notes:tenants:acme:quota:usage").
+		Return(map[string]string{"notes": "1", "bytes": "4"}, nil)
+	expectWatch(mrc, "notes:tenants:acme:1")
+	mrc.On("HMSet", "notes:tenants:acme:1", "id", "1", mock.AnythingOfType("[]string")).Return("", nil)
+	mrc.On("ZRem", "notes:tenants:acme:expiry", []string{"1"}).Return(int64(0), nil)
+	mrc.On("LPush", "notes:tenants:acme:catalog", []string{"1"}).Return(int64(1), nil)
+	mrc.On("Eval", recordChangeScript,
+		[]string{"notes:tenants:acme:changes", "notes:tenants:acme:changeseq", "notes:tenants:acme:tombstones",
+			"notes:tenants:acme:changes:readers"},
+		mock.Anything).Return(int64(1), nil)
+	mrc.On("Eval", trackUsageScript,
+		[]string{"notes:tenants:acme:quota:sizes", "notes:tenants:acme:quota:usage"},
+		[]string{"1", "4"}).Return(int64(0), nil)
+
+	rnr, err := NewRedisNoteRepository(
+		RedisClientOption(mrc),
+		NoteIDGenFn(func() string { return "1" }))
+	assert.NoError(t, err)
+
+	nr := rnr.ForTenant(&Tenant{ID: "acme", MaxNotes: 2, MaxBytes: 10})
+
+	_, err = nr.Create("test")
+	assert.NoError(t, err)
+
+	// the tenant would have 11 bytes of content.
+	_, err = nr.Create("content")
+	assert.Equal(t, ErrQuotaExceeded, err)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestTransactUsage(t *testing.T) {
+	notes, bytes := transactUsage(
+		[]string{"1", "2", "3"},
+		map[string]*Note{"1": {Content: "new"}, "2": nil, "3": {Content: "longer"}},
+		map[string]bool{"1": true},
+		map[string]*Note{"2": {Content: "gone"}, "3": {Content: "long"}})
+
+	assert.Equal(t, int64(0), notes)
+	assert.Equal(t, int64(3-4+2), bytes)
+}
+
+func TestAppTenants(t *testing.T) {
+	mrc := &MockRedisClient{}
+	expectAPIKey(mrc, "reader", ScopeNotesRead)
+	expectAPIKey(mrc, "admin", ScopeAdmin)
+	expectTenant(mrc, "acme")
+	mrc.On("HGet", "tenants:all", "missing").Return("", ErrKeyNotFound)
+
+	b, _ := json.Marshal(&storedAPIKey{
+		APIKey: APIKey{ID: "tenant", Name: "tenant", Scopes: []string{ScopeAdmin}, Tenant: "acme"},
+		Hash:   hashAPIKey(apiKeyPrefix + "tenant"),
+	})
+	mrc.On("HGet", "apikeys:hashes", hashAPIKey(apiKeyPrefix+"tenant")).Return("tenant", nil)
+	mrc.On("HGet", "apikeys:keys", "tenant").Return(string(b), nil)
+	mrc.On("HGet", "apikeys:lastused", "tenant").Return(time.Now().UTC().Format(time.RFC3339), nil)
+
+	ak, err := NewAPIKeys(mrc)
+	assert.NoError(t, err)
+
+	ts, err := NewTenants(mrc)
+	assert.NoError(t, err)
+
+	tnr := &mockTenantNoteRepository{tenantRepo: &MockNoteRepository{}}
+	tnr.On("Retrieve", "1").Return(&Note{ID: "1", Owner: "reader"}, nil)
+	tnr.tenantRepo.On("Retrieve", "1").Return(&Note{ID: "1", Owner: "tenant"}, nil)
+
+	opts := []AppOption{AppAPIKeys(ak), AppTenants(ts), AppNoteRepository(tnr)}
+	withAppOptions(t, nil, opts, func(u *url.URL, _ *MockNoteRepository, h *Health) {
+		do := func(path, key, tenant string) *http.Response {
+			u.Path = path
+			req, err := http.NewRequest("GET", u.String(), nil)
+			assert.NoError(t, err)
+			req.Header.Set(HeaderAPIKey, apiKeyPrefix+key)
+			if tenant != "" {
+				req.Header.Set(HeaderTenant, tenant)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			return res
+		}
+
+		res := do("/v1/notes/1", "reader", "")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		// only admins can choose a tenant.
+		res = do("/v1/notes/1", "reader", "acme")
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+		res = do("/v1/notes/1", "admin", "missing")
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+		res = do("/v1/notes/1", "admin", "acme")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		// keys tied to a tenant are always in it.
+		res = do("/v1/notes/1", "tenant", "")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		res = do("/v1/notes/1", "tenant", "other")
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+		res = do("/v1/tenants", "tenant", "")
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+		assert.Equal(t, []string{"acme", "acme"}, tnr.tenants)
+		tnr.AssertNumberOfCalls(t, "Retrieve", 1)
+	})
+}
@@ -0,0 +1,149 @@
+package omniscient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultMaxBodyBytes     = 1 << 20
+	defaultMaxContentLength = 64 * 1024
+)
+
+// Codes for field errors.
+const (
+	CodeRequired     ErrorCode = "required"
+	CodeTooLong      ErrorCode = "too_long"
+	CodeInvalidValue ErrorCode = "invalid_value"
+)
+
+var (
+	defaultContentTypes = []string{echo.MIMEApplicationJSON}
+)
+
+// validator is implemented by requests which can validate their own fields.
+// Field names are prefixed with prefix so nested requests can be reported.
+type validator interface {
+	validate(v *validation, prefix string)
+}
+
+// validation collects the field errors found while validating a request.
+type validation struct {
+	now              time.Time
+	maxContentLength int
+	errs             []FieldError
+}
+
+func (a *App) newValidation() *validation {
+	return &validation{
+		now:              time.Now(),
+		maxContentLength: a.maxContentLength,
+	}
+}
+
+func (v *validation) add(field string, code ErrorCode, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{
+		Field:   field,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// err returns a Problem listing the field errors, or nil if there are none.
+func (v *validation) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+
+	p := NewProblem(CodeValidationFailed, "%s", v.errs[0].Message)
+	if len(v.errs) > 1 {
+		p.Detail = fmt.Sprintf("request has %d invalid fields", len(v.errs))
+	}
+	p.Errors = v.errs
+	return p
+}
+
+func (v *validation) content(field, content string) {
+	switch {
+	case content == "":
+		v.add(field, CodeRequired, "content is required")
+	case !utf8.ValidString(content):
+		v.add(field, CodeInvalidValue, "content must be valid UTF-8")
+	case utf8.RuneCountInString(content) > v.maxContentLength:
+		v.add(field, CodeTooLong, "content must be at most %d characters", v.maxContentLength)
+	}
+}
+
+func fieldName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
+
+// bind binds the request body to req and validates it.
+func (a *App) bind(c echo.Context, req validator) error {
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	v := a.newValidation()
+	req.validate(v, "")
+	return v.err()
+}
+
+// limitBody rejects request bodies which are too large, aren't valid UTF-8 or,
+// if contentTypes is set, aren't one of contentTypes. Bodies are read before
+// the handler runs, so nothing is stored for a rejected request.
+func (a *App) limitBody(contentTypes []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+
+			if req.ContentLength() > a.maxBodyBytes {
+				return NewProblem(CodeRequestTooLarge, "request body must be at most %d bytes", a.maxBodyBytes)
+			}
+
+			if len(contentTypes) > 0 {
+				ct, _, _ := mime.ParseMediaType(req.Header().Get(echo.HeaderContentType))
+				if !containsString(contentTypes, ct) {
+					return NewProblem(CodeUnsupportedMediaType, "content type must be one of %v", contentTypes)
+				}
+			}
+
+			body, err := ioutil.ReadAll(io.LimitReader(req.Body(), a.maxBodyBytes+1))
+			if err != nil {
+				return err
+			}
+
+			if int64(len(body)) > a.maxBodyBytes {
+				return NewProblem(CodeRequestTooLarge, "request body must be at most %d bytes", a.maxBodyBytes)
+			}
+
+			if !utf8.Valid(body) {
+				return NewProblem(CodeValidationFailed, "request body must be valid UTF-8")
+			}
+
+			req.SetBody(bytes.NewReader(body))
+			return next(c)
+		}
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,134 @@
+package omniscient
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAppCreateValidation(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		code        ErrorCode
+		fields      []string
+	}{
+		{
+			name:        "empty content",
+			contentType: "application/json",
+			body:        `{"content":""}`,
+			status:      http.StatusUnprocessableEntity,
+			code:        CodeValidationFailed,
+			fields:      []string{"content"},
+		},
+		{
+			name:        "content too long",
+			contentType: "application/json",
+			body:        `{"content":"` + strings.Repeat("x", 11) + `"}`,
+			status:      http.StatusUnprocessableEntity,
+			code:        CodeValidationFailed,
+			fields:      []string{"content"},
+		},
+		{
+			name:        "multiple fields",
+			contentType: "application/json",
+			body:        `{"content":"","slug":"Not A Slug","ttl":-1}`,
+			status:      http.StatusUnprocessableEntity,
+			code:        CodeValidationFailed,
+			fields:      []string{"content", "ttl", "slug"},
+		},
+		{
+			name:        "body too large",
+			contentType: "application/json",
+			body:        `{"content":"` + strings.Repeat("x", 64) + `"}`,
+			status:      http.StatusRequestEntityTooLarge,
+			code:        CodeRequestTooLarge,
+		},
+		{
+			name:        "content type",
+			contentType: "text/plain",
+			body:        `{"content":"x"}`,
+			status:      http.StatusUnsupportedMediaType,
+			code:        CodeUnsupportedMediaType,
+		},
+		{
+			name:        "invalid utf-8",
+			contentType: "application/json",
+			body:        "{\"content\":\"\xff\"}",
+			status:      http.StatusUnprocessableEntity,
+			code:        CodeValidationFailed,
+		},
+	}
+
+	opts := []AppOption{AppMaxBodyBytes(64), AppMaxContentLength(10)}
+	withAppOptions(t, nil, opts, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/notes"
+
+		for _, tc := range cases {
+			req, err := http.NewRequest("POST", u.String(), bytes.NewBufferString(tc.body))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, res.StatusCode, tc.name)
+
+			p := decodeProblem(t, res)
+			assert.Equal(t, tc.code, p.Code, tc.name)
+
+			var fields []string
+			for _, fe := range p.Errors {
+				fields = append(fields, fe.Field)
+			}
+			assert.Equal(t, tc.fields, fields, tc.name)
+		}
+
+		mnr.AssertNotCalled(t, "Create", mock.Anything, mock.Anything)
+	})
+}
+
+func TestAppUpdateValidation(t *testing.T) {
+	withAppOptions(t, nil, []AppOption{AppMaxContentLength(10)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/notes/1"
+
+		body := `{"content":"` + strings.Repeat("é", 11) + `"}`
+		req, err := http.NewRequest("PUT", u.String(), bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+		p := decodeProblem(t, res)
+		assert.Equal(t, []FieldError{
+			{Field: "content", Code: CodeTooLong, Message: "content must be at most 10 characters"},
+		}, p.Errors)
+
+		mnr.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestAppBatchValidation(t *testing.T) {
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/v1/batch"
+
+		body := `{"operations":[{"op":"create","content":"x"},{"op":"update","content":""}]}`
+		res, err := http.Post(u.String(), "application/json", bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+		p := decodeProblem(t, res)
+		assert.Equal(t, []FieldError{
+			{Field: "operations[1].id", Code: CodeRequired, Message: "id is required"},
+			{Field: "operations[1].content", Code: CodeRequired, Message: "content is required"},
+		}, p.Errors)
+	})
+}
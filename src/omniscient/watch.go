@@ -0,0 +1,225 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/engine/standard"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// HeaderLastEventID is the header an EventSource sends when it
+	// reconnects, with the id of the last event it received.
+	HeaderLastEventID = "Last-Event-ID"
+
+	mimeEventStream = "text/event-stream"
+
+	// watchHeartbeat is how often a comment is sent on an idle event stream,
+	// so proxies don't close it.
+	watchHeartbeat = 15 * time.Second
+)
+
+// watchNotes streams changes to notes as server-sent events, or over a
+// WebSocket if the request asks to upgrade. Watching resumes after the
+// event in the Last-Event-ID header or the last_event_id query parameter,
+// and otherwise starts from now. Authenticated requests only see changes to
+// the notes they can read. Deletes are only seen by the principals who could
+// read the note, and a principal who can no longer read a note sees its
+// change as a delete.
+func (a *App) watchNotes() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.feed == nil {
+			return NewProblem(CodeNotFound, "watching notes is not enabled")
+		}
+
+		lastID := int64(-1)
+		s := c.Request().Header().Get(HeaderLastEventID)
+		if s == "" {
+			s = c.QueryParam("last_event_id")
+		}
+		if s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || id < 0 {
+				return fieldProblem("last_event_id", CodeInvalidRequest, "last_event_id must be a non-negative integer")
+			}
+			lastID = id
+		}
+
+		w, err := a.feed.Watch(lastID)
+		if err != nil {
+			return err
+		}
+		defer w.Stop()
+
+		acl, _ := a.notes(c).(*ACLNoteRepository)
+		visible := watchFilter(requestTenant(c), acl)
+
+		if strings.EqualFold(c.Request().Header().Get("Upgrade"), "websocket") {
+			return watchWebSocket(c, w, visible)
+		}
+
+		return watchEventStream(c, w, visible)
+	}
+}
+
+// watchFilter returns what a watcher in tenant sees of an event, or nil if
+// it doesn't see the event. acl is the watcher's view of the notes, or nil
+// if they are not authenticated.
+func watchFilter(tenant string, acl *ACLNoteRepository) func(*NoteEvent) *NoteEvent {
+	return func(e *NoteEvent) *NoteEvent {
+		switch {
+		case e.Tenant != tenant:
+			return nil
+		case acl == nil || acl.p.HasScope(ScopeAdmin):
+			return e
+		case e.Note != nil && acl.canRead(e.Note):
+			return e
+		}
+
+		lost, err := acl.lostAccess(e.NoteID)
+		if err != nil {
+			log.WithError(err).WithField("note", e.NoteID).Warning("unable to check who could read note")
+			return nil
+		}
+		if !lost {
+			return nil
+		}
+
+		gone := *e
+		gone.Type = NoteDeleted
+		gone.Note = nil
+		return &gone
+	}
+}
+
+func watchEventStream(c echo.Context, w *NoteWatch, visible func(*NoteEvent) *NoteEvent) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeEventStream)
+	res.Header().Set("Cache-Control", "no-cache")
+	// stops nginx from buffering the stream.
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	flusher, _ := res.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	var closed <-chan bool
+	if cn, ok := res.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	var buf bytes.Buffer
+	for {
+		buf.Reset()
+
+		select {
+		case e, ok := <-w.Events():
+			if !ok {
+				if err := w.Err(); err != nil {
+					writeServerSentEvent(&buf, "", "error", problemFor(err))
+					res.Write(buf.Bytes())
+					flush()
+				}
+				return nil
+			}
+
+			if e = visible(e); e == nil {
+				continue
+			}
+
+			writeServerSentEvent(&buf, strconv.FormatInt(e.ID, 10), string(e.Type), e)
+		case <-heartbeat.C:
+			buf.WriteString(": heartbeat\n\n")
+		case <-closed:
+			return nil
+		}
+
+		if _, err := res.Write(buf.Bytes()); err != nil {
+			return nil
+		}
+		flush()
+	}
+}
+
+// writeServerSentEvent writes an event with v as its JSON data. JSON has no
+// raw newlines, so the data fits on one line.
+func writeServerSentEvent(buf *bytes.Buffer, id, event string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.WithError(err).Error("unable to encode event")
+		return
+	}
+
+	if id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	buf.WriteString("event: " + event + "\n")
+	buf.WriteString("data: ")
+	buf.Write(b)
+	buf.WriteString("\n\n")
+}
+
+// watchWebSocket sends each event as a JSON message. If the watch fails,
+// its problem is sent before the connection is closed.
+func watchWebSocket(c echo.Context, w *NoteWatch, visible func(*NoteEvent) *NoteEvent) error {
+	res, ok := c.Response().(*standard.Response)
+	if !ok {
+		return NewProblem(CodeInvalidRequest, "websockets are not supported")
+	}
+	req := c.Request().(*standard.Request)
+
+	srv := websocket.Server{
+		// the API is not cookie authenticated, so any origin can watch.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			// the client only sends to close the connection.
+			closed := make(chan struct{})
+			go func() {
+				var msg []byte
+				for websocket.Message.Receive(ws, &msg) == nil {
+				}
+				close(closed)
+			}()
+
+			for {
+				select {
+				case e, ok := <-w.Events():
+					if !ok {
+						if err := w.Err(); err != nil {
+							websocket.JSON.Send(ws, problemFor(err))
+						}
+						return
+					}
+
+					if e = visible(e); e == nil {
+						continue
+					}
+
+					if err := websocket.JSON.Send(ws, e); err != nil {
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		},
+	}
+
+	srv.ServeHTTP(res.ResponseWriter, req.Request)
+	return nil
+}
@@ -0,0 +1,146 @@
+package omniscient
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func withWatchApp(t *testing.T, fn func(u *url.URL, sub *fakeSubscription)) {
+	sub := newFakeSubscription()
+
+	mrc := &MockRedisClient{}
+	mrc.On("Subscribe", []string{"feed:events"}).Return(sub, nil)
+	mrc.On("ZRangeByScore", "feed:log", "(1", "+inf").
+		Return([]string{eventJSON(2, NoteCreated, "1")}, nil)
+	mrc.On("ZRangeByScore", "feed:log", "(0", "+inf").
+		Return([]string{eventJSON(2, NoteCreated, "1")}, nil)
+
+	feed, err := NewNoteFeed(mrc)
+	assert.NoError(t, err)
+
+	withAppOptions(t, nil, []AppOption{AppNoteFeed(feed)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/v1/notes/watch"
+		fn(u, sub)
+	})
+}
+
+func TestAppWatchNotes(t *testing.T) {
+	withWatchApp(t, func(u *url.URL, sub *fakeSubscription) {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		assert.NoError(t, err)
+		req.Header.Set(HeaderLastEventID, "1")
+
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, mimeEventStream, res.Header.Get("Content-Type"))
+
+		r := bufio.NewReader(res.Body)
+		readEvent := func() []string {
+			var lines []string
+			for {
+				line, err := r.ReadString('\n')
+				if !assert.NoError(t, err) || line == "\n" {
+					return lines
+				}
+				lines = append(lines, line)
+			}
+		}
+
+		assert.Equal(t, []string{
+			"id: 2\n",
+			"event: created\n",
+			`data: {"id":2,"type":"created","note_id":"1","time":"2016-07-01T12:00:00Z"}` + "\n",
+		}, readEvent())
+
+		sub.msgs <- eventJSON(3, NoteDeleted, "1")
+		assert.Equal(t, "id: 3\n", readEvent()[0])
+	})
+}
+
+func TestAppWatchNotesWebSocket(t *testing.T) {
+	withWatchApp(t, func(u *url.URL, sub *fakeSubscription) {
+		u.Scheme = "ws"
+		u.RawQuery = "last_event_id=1"
+
+		ws, err := websocket.Dial(u.String(), "", "http://localhost/")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer ws.Close()
+
+		var e NoteEvent
+		assert.NoError(t, websocket.JSON.Receive(ws, &e))
+		assert.Equal(t, int64(2), e.ID)
+		assert.Equal(t, NoteCreated, e.Type)
+
+		sub.msgs <- eventJSON(3, NoteUpdated, "1")
+		assert.NoError(t, websocket.JSON.Receive(ws, &e))
+		assert.Equal(t, int64(3), e.ID)
+	})
+}
+
+func TestAppWatchNotesErrors(t *testing.T) {
+	withWatchApp(t, func(u *url.URL, sub *fakeSubscription) {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		assert.NoError(t, err)
+
+		req.Header.Set(HeaderLastEventID, "soon")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		p := decodeProblem(t, res)
+		assert.Equal(t, CodeInvalidRequest, p.Code)
+
+		// event 1 is no longer kept.
+		req.Header.Set(HeaderLastEventID, "0")
+		res, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		p = decodeProblem(t, res)
+		assert.Equal(t, CodeWatchCursorExpired, p.Code)
+		assert.Equal(t, http.StatusGone, p.Status)
+	})
+
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/v1/notes/watch"
+		p := doProblemRequest(t, "GET", u.String(), "")
+		assert.Equal(t, CodeNotFound, p.Code)
+	})
+}
+
+func TestWatchFilter(t *testing.T) {
+	mnr := &MockNoteRepository{}
+	mnr.On("Readers", []string{"2"}).Return([][]string{{"owner", "reader"}}, nil)
+	mnr.On("Readers", []string{"3"}).Return([][]string{{"owner"}}, nil)
+
+	unshared := sharedNote("2")
+	unshared.Shares = nil
+
+	visible := watchFilter("", NewACLNoteRepository(mnr, aclReader))
+
+	e := &NoteEvent{Type: NoteUpdated, NoteID: "1", Note: sharedNote("1")}
+	assert.Equal(t, e, visible(e))
+
+	assert.Nil(t, visible(&NoteEvent{Type: NoteUpdated, NoteID: "1", Tenant: "acme", Note: sharedNote("1")}))
+
+	// a note which is no longer shared with the watcher is gone for them.
+	gone := visible(&NoteEvent{ID: 7, Type: NoteUpdated, NoteID: "2", Note: unshared})
+	if assert.NotNil(t, gone) {
+		assert.Equal(t, NoteDeleted, gone.Type)
+		assert.Equal(t, int64(7), gone.ID)
+		assert.Nil(t, gone.Note)
+	}
+
+	// deletes are only seen by whoever could read the note.
+	assert.Nil(t, visible(&NoteEvent{Type: NoteDeleted, NoteID: "3"}))
+
+	e = &NoteEvent{Type: NoteDeleted, NoteID: "3"}
+	assert.Equal(t, e, watchFilter("", nil)(e))
+	assert.Equal(t, e, watchFilter("", NewACLNoteRepository(mnr, aclAdmin))(e))
+}
@@ -0,0 +1,738 @@
+package omniscient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"backoff"
+	"omniscient/events"
+)
+
+const (
+	// HeaderWebhookDelivery is the id of a webhook delivery. It stays the
+	// same when a delivery is retried.
+	HeaderWebhookDelivery = "X-Omniscient-Delivery"
+	// HeaderWebhookEvent is the type of the event being delivered.
+	HeaderWebhookEvent = "X-Omniscient-Event"
+	// HeaderWebhookTimestamp is when a delivery attempt was signed, in
+	// seconds since the Unix epoch.
+	HeaderWebhookTimestamp = "X-Omniscient-Timestamp"
+	// HeaderWebhookSignature is the signature of a delivery attempt. See
+	// SignWebhook.
+	HeaderWebhookSignature = "X-Omniscient-Signature"
+
+	// DeliveryPending is the status of a delivery which will be attempted.
+	DeliveryPending = "pending"
+	// DeliverySucceeded is the status of a delivery which was accepted.
+	DeliverySucceeded = "succeeded"
+	// DeliveryFailed is the status of a delivery which ran out of attempts.
+	DeliveryFailed = "failed"
+
+	defaultWebhookPollInterval = time.Second
+	defaultWebhookTimeout      = 10 * time.Second
+
+	// webhookLease is how long a claimed delivery is hidden from other
+	// workers. If a worker dies mid delivery, it is retried after that.
+	webhookLease = time.Minute
+	// webhookClaimSize is how many deliveries a worker claims at once.
+	webhookClaimSize = 10
+	// webhookLogSize is how many deliveries are kept in a webhook's log.
+	webhookLogSize = 100
+	// webhookDeliveryTTL is how long a delivery is kept after its last
+	// attempt.
+	webhookDeliveryTTL = 7 * 24 * time.Hour
+
+	webhookSecretBytes   = 32
+	minWebhookSecretSize = 16
+
+	webhooksKey         = "subscriptions"
+	webhookQueueKey     = "queue"
+	webhookDeliveryBase = "deliveries"
+	webhookLogBase      = "log"
+)
+
+var (
+	// DefaultWebhookBackoff is how long failed deliveries wait before they
+	// are retried. A delivery fails once it runs out of waits.
+	DefaultWebhookBackoff = backoff.Policy{
+		Millis: []int{10000, 60000, 300000, 1800000, 3600000, 6 * 3600000},
+	}
+
+	// ErrWebhookNotFound is returned when a webhook does not exist.
+	ErrWebhookNotFound = &NoteError{Code: CodeWebhookNotFound, Message: "webhook not found"}
+	// ErrWebhookDeliveryNotFound is returned when a delivery does not exist
+	// or is no longer kept.
+	ErrWebhookDeliveryNotFound = &NoteError{Code: CodeWebhookDeliveryNotFound, Message: "webhook delivery not found"}
+)
+
+// enqueueScript stores a delivery, adds it to its webhook's log and
+// schedules it, unless it has already been queued. KEYS are the delivery,
+// log and queue keys, and ARGV the delivery, its ttl in seconds, its id, the
+// log size and when to attempt it.
+const enqueueScript = `
+if not redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2], 'NX') then
+  return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[3])
+redis.call('LTRIM', KEYS[2], 0, tonumber(ARGV[4]) - 1)
+redis.call('ZADD', KEYS[3], ARGV[5], ARGV[3])
+return 1
+`
+
+// claimScript returns up to ARGV[3] deliveries due at ARGV[1], and hides
+// them from other workers until ARGV[2].
+const claimScript = `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, id in ipairs(ids) do
+  redis.call('ZADD', KEYS[1], ARGV[2], id)
+end
+return ids
+`
+
+// Webhook is a subscription to note events, which are delivered to URL.
+type Webhook struct {
+	ID     string          `json:"id"`
+	URL    string          `json:"url"`
+	Events []NoteEventType `json:"events"`
+	// Secret signs deliveries. It is only returned when the webhook is
+	// created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (wh *Webhook) subscribes(typ NoteEventType) bool {
+	for _, e := range wh.Events {
+		if e == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookDelivery is the delivery of an event to a webhook.
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Event     NoteEventType   `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	// ResponseStatus is the HTTP status of the last attempt, if it got a
+	// response.
+	ResponseStatus int        `json:"response_status,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// webhookPayload is the body of a delivery.
+type webhookPayload struct {
+	ID        string        `json:"id"`
+	WebhookID string        `json:"webhook_id"`
+	Type      NoteEventType `json:"type"`
+	NoteID    string        `json:"note_id"`
+	Tenant    string        `json:"tenant,omitempty"`
+	Note      *Note         `json:"note,omitempty"`
+	Time      time.Time     `json:"time"`
+}
+
+// SignWebhook returns the signature of a delivery body sent at timestamp,
+// as sent in the X-Omniscient-Signature header. It is "sha256=" followed by
+// the hex encoded HMAC-SHA256 of the timestamp, a '.' and the body, keyed
+// with the webhook's secret. Receivers should also check the timestamp is
+// recent, so old deliveries can't be replayed.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks stores webhooks, and delivers note events to them. Deliveries
+// are queued in Redis, so they survive restarts and are shared by every
+// replica running a worker.
+type Webhooks struct {
+	redisClient  RedisClient
+	base         string
+	httpClient   *http.Client
+	policy       backoff.Policy
+	pollInterval time.Duration
+	idGen        idGenFn
+
+	mu   sync.Mutex
+	quit chan struct{}
+	done chan struct{}
+}
+
+var _ TenantNotePublisher = (*Webhooks)(nil)
+
+// WebhooksOption is an option for configuring Webhooks.
+type WebhooksOption func(*Webhooks) error
+
+// NewWebhooks creates an instance of Webhooks.
+func NewWebhooks(rc RedisClient, opts ...WebhooksOption) (*Webhooks, error) {
+	wh := &Webhooks{
+		redisClient:  rc,
+		base:         "webhooks",
+		httpClient:   &http.Client{Timeout: defaultWebhookTimeout},
+		policy:       DefaultWebhookBackoff,
+		pollInterval: defaultWebhookPollInterval,
+		idGen:        newUUID,
+	}
+
+	for _, opt := range opts {
+		if err := opt(wh); err != nil {
+			return nil, err
+		}
+	}
+
+	return wh, nil
+}
+
+// WebhooksBase sets the base string for the webhook keys.
+func WebhooksBase(base string) WebhooksOption {
+	return func(wh *Webhooks) error {
+		wh.base = base
+		return nil
+	}
+}
+
+// WebhooksHTTPClient sets the client deliveries are sent with.
+func WebhooksHTTPClient(c *http.Client) WebhooksOption {
+	return func(wh *Webhooks) error {
+		wh.httpClient = c
+		return nil
+	}
+}
+
+// WebhooksBackoff sets how long failed deliveries wait before they are
+// retried.
+func WebhooksBackoff(p backoff.Policy) WebhooksOption {
+	return func(wh *Webhooks) error {
+		wh.policy = p
+		return nil
+	}
+}
+
+// WebhooksPollInterval sets how often the worker looks for due deliveries.
+func WebhooksPollInterval(d time.Duration) WebhooksOption {
+	return func(wh *Webhooks) error {
+		if d <= 0 {
+			return errors.New("webhook poll interval must be positive")
+		}
+
+		wh.pollInterval = d
+		return nil
+	}
+}
+
+// Create creates a webhook. If secret is empty, one is generated.
+func (wh *Webhooks) Create(url string, events []NoteEventType, secret string) (*Webhook, error) {
+	if secret == "" {
+		b := make([]byte, webhookSecretBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	w := &Webhook{
+		ID:        wh.idGen(),
+		URL:       url,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	b, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := wh.redisClient.HSet(wh.key(webhooksKey), w.ID, string(b)); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Retrieve retrieves a webhook, including its secret.
+func (wh *Webhooks) Retrieve(id string) (*Webhook, error) {
+	s, err := wh.redisClient.HGet(wh.key(webhooksKey), id)
+	if err == ErrKeyNotFound {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var w Webhook
+	if err := json.Unmarshal([]byte(s), &w); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// List lists the webhooks, oldest first.
+func (wh *Webhooks) List() ([]*Webhook, error) {
+	m, err := wh.redisClient.HGetAllMap(wh.key(webhooksKey))
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*Webhook, 0, len(m))
+	for _, s := range m {
+		var w Webhook
+		if err := json.Unmarshal([]byte(s), &w); err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &w)
+	}
+
+	sort.Sort(webhooksByCreated(webhooks))
+
+	return webhooks, nil
+}
+
+// Delete deletes a webhook. Its pending deliveries are dropped when they
+// are next attempted.
+func (wh *Webhooks) Delete(id string) error {
+	n, err := wh.redisClient.HDel(wh.key(webhooksKey), id)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// Publish queues a delivery of the event to every webhook subscribed to it.
+func (wh *Webhooks) Publish(typ NoteEventType, id string, n *Note) error {
+	return wh.PublishTenant("", typ, id, n)
+}
+
+// PublishTenant queues a delivery of the event for a note of tenant to every
+// webhook subscribed to it. Events published after a change has been made
+// are lost if the process stops in between; see HandleEvent.
+func (wh *Webhooks) PublishTenant(tenant string, typ NoteEventType, id string, n *Note) error {
+	return wh.queue(tenant, typ, id, n, func(*Webhook) string {
+		return wh.idGen()
+	})
+}
+
+// HandleEvent queues a delivery of a domain event read from the event
+// stream to every webhook subscribed to it. Events are appended to the
+// stream in the same transaction as the change, so feeding webhooks from it
+// with an events.Consumer, instead of publishing to them, means no
+// delivery is lost. Deliveries are named after the stream entry, so an
+// event handled again isn't delivered twice.
+func (wh *Webhooks) HandleEvent(ctx context.Context, e *events.Event) error {
+	var typ NoteEventType
+	switch e.Type {
+	case events.NoteCreated:
+		typ = NoteCreated
+	case events.NoteUpdated:
+		typ = NoteUpdated
+	case events.NoteDeleted:
+		typ = NoteDeleted
+	default:
+		return nil
+	}
+
+	var n *Note
+	if a := e.After; a != nil {
+		n = &Note{
+			ID:        a.ID,
+			Content:   a.Content,
+			CreatedAt: a.CreatedAt,
+			UpdatedAt: a.UpdatedAt,
+			ExpiresAt: a.ExpiresAt,
+			Slug:      a.Slug,
+			Version:   a.Version,
+		}
+	}
+
+	return wh.queue(e.Tenant, typ, e.NoteID, n, func(w *Webhook) string {
+		sum := sha256.Sum256([]byte(e.ID + ":" + w.ID))
+		return hex.EncodeToString(sum[:16])
+	})
+}
+
+// queue queues a delivery of the event to every webhook subscribed to it,
+// with the id deliveryID returns for the webhook.
+func (wh *Webhooks) queue(tenant string, typ NoteEventType, id string, n *Note, deliveryID func(*Webhook) string) error {
+	webhooks, err := wh.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, w := range webhooks {
+		if !w.subscribes(typ) {
+			continue
+		}
+
+		d := &WebhookDelivery{
+			ID:        deliveryID(w),
+			WebhookID: w.ID,
+			Event:     typ,
+			Status:    DeliveryPending,
+			CreatedAt: now,
+		}
+
+		d.Payload, err = json.Marshal(&webhookPayload{
+			ID:        d.ID,
+			WebhookID: w.ID,
+			Type:      typ,
+			NoteID:    id,
+			Tenant:    tenant,
+			Note:      n,
+			Time:      now,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := wh.enqueue(d, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (wh *Webhooks) enqueue(d *WebhookDelivery, at time.Time) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	_, err = wh.redisClient.Eval(enqueueScript,
+		[]string{wh.deliveryKey(d.ID), wh.logKey(d.WebhookID), wh.key(webhookQueueKey)},
+		[]string{
+			string(b),
+			strconv.FormatInt(int64(webhookDeliveryTTL/time.Second), 10),
+			d.ID,
+			strconv.Itoa(webhookLogSize),
+			queueScore(at),
+		})
+
+	return err
+}
+
+// Deliveries lists the most recent deliveries to a webhook, newest first.
+func (wh *Webhooks) Deliveries(webhookID string) ([]*WebhookDelivery, error) {
+	if _, err := wh.Retrieve(webhookID); err != nil {
+		return nil, err
+	}
+
+	ids, err := wh.redisClient.LRange(wh.logKey(webhookID), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []*WebhookDelivery{}
+	for _, id := range ids {
+		d, err := wh.delivery(id)
+		if err == ErrWebhookDeliveryNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+// Redeliver attempts a delivery again as soon as possible, even if it has
+// already succeeded or failed.
+func (wh *Webhooks) Redeliver(webhookID, deliveryID string) (*WebhookDelivery, error) {
+	if _, err := wh.Retrieve(webhookID); err != nil {
+		return nil, err
+	}
+
+	d, err := wh.delivery(deliveryID)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.WebhookID != webhookID {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+
+	now := time.Now().UTC()
+	d.Status = DeliveryPending
+	d.NextAttemptAt = &now
+
+	if err := wh.save(d); err != nil {
+		return nil, err
+	}
+
+	if err := wh.schedule(d.ID, now); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Start starts the worker which sends due deliveries.
+func (wh *Webhooks) Start() error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if wh.quit != nil {
+		return errors.New("webhook worker has already been started")
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	wh.quit = quit
+	wh.done = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(wh.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case t := <-ticker.C:
+				if _, err := wh.deliverDue(t); err != nil {
+					log.WithError(err).Warning("unable to send webhook deliveries")
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the worker, waiting for deliveries in progress.
+func (wh *Webhooks) Stop() error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if wh.quit == nil {
+		return errors.New("webhook worker has not previously been started")
+	}
+
+	close(wh.quit)
+	<-wh.done
+	wh.quit = nil
+	wh.done = nil
+
+	return nil
+}
+
+// deliverDue claims the deliveries due at t and attempts them. It returns
+// how many were claimed.
+func (wh *Webhooks) deliverDue(t time.Time) (int, error) {
+	v, err := wh.redisClient.Eval(claimScript,
+		[]string{wh.key(webhookQueueKey)},
+		[]string{queueScore(t), queueScore(t.Add(webhookLease)), strconv.Itoa(webhookClaimSize)})
+	if err != nil {
+		return 0, err
+	}
+
+	ids, _ := v.([]interface{})
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		id, ok := id.(string)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := wh.attempt(id); err != nil {
+				log.WithError(err).WithField("delivery", id).Warning("unable to attempt webhook delivery")
+			}
+		}()
+	}
+	wg.Wait()
+
+	return len(ids), nil
+}
+
+// attempt sends a delivery, and records the outcome. Deliveries which fail
+// are rescheduled until the backoff policy runs out.
+func (wh *Webhooks) attempt(id string) error {
+	d, err := wh.delivery(id)
+	if err == ErrWebhookDeliveryNotFound {
+		return wh.dequeue(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := wh.Retrieve(d.WebhookID)
+	if err == ErrWebhookNotFound {
+		d.Status = DeliveryFailed
+		d.Error = "webhook was deleted"
+		d.NextAttemptAt = nil
+		if err := wh.save(d); err != nil {
+			return err
+		}
+		return wh.dequeue(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	d.Attempts++
+	d.LastAttemptAt = &now
+	d.ResponseStatus, err = wh.send(w, d, now)
+	d.Error = ""
+
+	if err == nil {
+		d.Status = DeliverySucceeded
+		d.NextAttemptAt = nil
+		if err := wh.save(d); err != nil {
+			return err
+		}
+		return wh.dequeue(id)
+	}
+
+	d.Error = err.Error()
+
+	wait, perr := wh.policy.Duration(d.Attempts - 1)
+	if perr != nil {
+		d.Status = DeliveryFailed
+		d.NextAttemptAt = nil
+		if err := wh.save(d); err != nil {
+			return err
+		}
+		return wh.dequeue(id)
+	}
+
+	next := now.Add(wait)
+	d.Status = DeliveryPending
+	d.NextAttemptAt = &next
+	if err := wh.save(d); err != nil {
+		return err
+	}
+
+	return wh.schedule(id, next)
+}
+
+// send posts the payload of d to w, and returns the response status.
+// Responses other than 2xx are errors.
+func (wh *Webhooks) send(w *Webhook, d *WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	ts := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "omniscient-webhooks")
+	req.Header.Set(HeaderWebhookDelivery, d.ID)
+	req.Header.Set(HeaderWebhookEvent, string(d.Event))
+	req.Header.Set(HeaderWebhookTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderWebhookSignature, SignWebhook(w.Secret, ts, d.Payload))
+
+	res, err := wh.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+func (wh *Webhooks) delivery(id string) (*WebhookDelivery, error) {
+	s, err := wh.redisClient.Get(wh.deliveryKey(id))
+	if err == ErrKeyNotFound {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var d WebhookDelivery
+	if err := json.Unmarshal([]byte(s), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (wh *Webhooks) save(d *WebhookDelivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	_, err = wh.redisClient.Set(wh.deliveryKey(d.ID), string(b), webhookDeliveryTTL)
+	return err
+}
+
+func (wh *Webhooks) schedule(id string, t time.Time) error {
+	_, err := wh.redisClient.ZAdd(wh.key(webhookQueueKey), float64(t.UnixNano()/int64(time.Millisecond)), id)
+	return err
+}
+
+func (wh *Webhooks) dequeue(id string) error {
+	_, err := wh.redisClient.ZRem(wh.key(webhookQueueKey), id)
+	return err
+}
+
+func (wh *Webhooks) key(parts ...string) string {
+	return strings.Join(append([]string{wh.base}, parts...), ":")
+}
+
+func (wh *Webhooks) deliveryKey(id string) string {
+	return wh.key(webhookDeliveryBase, id)
+}
+
+func (wh *Webhooks) logKey(webhookID string) string {
+	return wh.key(webhookLogBase, webhookID)
+}
+
+// queueScore is the score of a delivery due at t, in milliseconds.
+func queueScore(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// webhooksByCreated sorts webhooks by when they were created.
+type webhooksByCreated []*Webhook
+
+func (s webhooksByCreated) Len() int           { return len(s) }
+func (s webhooksByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s webhooksByCreated) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
@@ -0,0 +1,141 @@
+package omniscient
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo"
+)
+
+var webhookEventTypes = []NoteEventType{NoteCreated, NoteUpdated, NoteDeleted}
+
+type createWebhookReq struct {
+	URL string `json:"url"`
+	// Events defaults to every event type.
+	Events []NoteEventType `json:"events,omitempty"`
+	// Secret is generated if it isn't set.
+	Secret string `json:"secret,omitempty"`
+}
+
+func (cwr *createWebhookReq) validate(v *validation, prefix string) {
+	u, err := url.Parse(cwr.URL)
+	switch {
+	case cwr.URL == "":
+		v.add(fieldName(prefix, "url"), CodeRequired, "url is required")
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		v.add(fieldName(prefix, "url"), CodeInvalidValue, "url must be an absolute http or https url")
+	}
+
+	for _, e := range cwr.Events {
+		if !containsEventType(webhookEventTypes, e) {
+			v.add(fieldName(prefix, "events"), CodeInvalidValue, "events must be one of %v", webhookEventTypes)
+			break
+		}
+	}
+
+	if cwr.Secret != "" && len(cwr.Secret) < minWebhookSecretSize {
+		v.add(fieldName(prefix, "secret"), CodeInvalidValue, "secret must be at least %d characters", minWebhookSecretSize)
+	}
+}
+
+func containsEventType(types []NoteEventType, typ NoteEventType) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// webhooksEnabled rejects requests to the webhook routes if webhooks aren't
+// configured.
+func (a *App) webhooksEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.webhooks == nil {
+			return NewProblem(CodeNotFound, "webhooks are not enabled")
+		}
+
+		return next(c)
+	}
+}
+
+func (a *App) createWebhook() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cwr := &createWebhookReq{}
+		if err := a.bind(c, cwr); err != nil {
+			return err
+		}
+
+		events := cwr.Events
+		if len(events) == 0 {
+			events = webhookEventTypes
+		}
+
+		w, err := a.webhooks.Create(cwr.URL, events, cwr.Secret)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, w)
+	}
+}
+
+func (a *App) listWebhooks() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		webhooks, err := a.webhooks.List()
+		if err != nil {
+			return err
+		}
+
+		for _, w := range webhooks {
+			w.Secret = ""
+		}
+
+		return c.JSON(http.StatusOK, webhooks)
+	}
+}
+
+func (a *App) retrieveWebhook() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		w, err := a.webhooks.Retrieve(c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		w.Secret = ""
+		return c.JSON(http.StatusOK, w)
+	}
+}
+
+func (a *App) deleteWebhook() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := a.webhooks.Delete(c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func (a *App) listWebhookDeliveries() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		deliveries, err := a.webhooks.Deliveries(c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+func (a *App) redeliverWebhook() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		d, err := a.webhooks.Redeliver(c.Param("id"), c.Param("delivery"))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusAccepted, d)
+	}
+}
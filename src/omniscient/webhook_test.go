@@ -0,0 +1,211 @@
+package omniscient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"backoff"
+	"omniscient/events"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+)
+
+func TestSignWebhook(t *testing.T) {
+	assert.Equal(t,
+		"sha256=d0d5cfbab7d58ff7138d4fa903764025b44a9d59d08ede499bdc037b1ded5293",
+		SignWebhook("secret", 1467374400, []byte(`{"a":1}`)))
+}
+
+func TestWebhooksPublish(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("HGetAllMap", "webhooks:subscriptions").Return(map[string]string{
+		"w1": `{"id":"w1","url":"http://example.com","events":["created","deleted"]}`,
+		"w2": `{"id":"w2","url":"http://example.com","events":["updated"]}`,
+	}, nil)
+	mrc.On("Eval", enqueueScript,
+		[]string{"webhooks:deliveries:d1", "webhooks:log:w1", "webhooks:queue"},
+		mock.MatchedBy(func(args []string) bool {
+			var d WebhookDelivery
+			if err := json.Unmarshal([]byte(args[0]), &d); err != nil {
+				return false
+			}
+
+			var p webhookPayload
+			if err := json.Unmarshal(d.Payload, &p); err != nil {
+				return false
+			}
+
+			return d.Status == DeliveryPending && p.ID == "d1" && p.NoteID == "1" &&
+				args[2] == "d1" && args[3] == "100"
+		})).Return(int64(1), nil).Once()
+
+	wh, err := NewWebhooks(mrc)
+	assert.NoError(t, err)
+	wh.idGen = func() string { return "d1" }
+
+	assert.NoError(t, wh.Publish(NoteCreated, "1", &Note{ID: "1"}))
+	mrc.AssertExpectations(t)
+}
+
+func TestWebhooksHandleEvent(t *testing.T) {
+	var ids []string
+
+	mrc := &MockRedisClient{}
+	mrc.On("HGetAllMap", "webhooks:subscriptions").Return(map[string]string{
+		"w1": `{"id":"w1","url":"http://example.com","events":["updated"]}`,
+	}, nil)
+	mrc.On("Eval", enqueueScript, mock.AnythingOfType("[]string"), mock.AnythingOfType("[]string")).
+		Run(func(args mock.Arguments) {
+			var d WebhookDelivery
+			assert.NoError(t, json.Unmarshal([]byte(args.Get(2).([]string)[0]), &d))
+
+			var p webhookPayload
+			assert.NoError(t, json.Unmarshal(d.Payload, &p))
+			assert.Equal(t, NoteUpdated, p.Type)
+			assert.Equal(t, "acme", p.Tenant)
+			assert.Equal(t, int64(2), p.Note.Version)
+
+			ids = append(ids, d.ID)
+		}).Return(int64(1), nil)
+
+	wh, err := NewWebhooks(mrc)
+	assert.NoError(t, err)
+	wh.idGen = func() string { return "random" }
+
+	e := &events.Event{ID: "1-0", Type: events.NoteUpdated, NoteID: "1", Tenant: "acme",
+		After: &events.Note{ID: "1", Version: 2}}
+	assert.NoError(t, wh.HandleEvent(context.Background(), e))
+
+	// an event handled again is queued under the same delivery.
+	assert.NoError(t, wh.HandleEvent(context.Background(), e))
+
+	e.ID = "2-0"
+	assert.NoError(t, wh.HandleEvent(context.Background(), e))
+
+	if assert.Len(t, ids, 3) {
+		assert.Equal(t, ids[0], ids[1])
+		assert.NotEqual(t, ids[0], ids[2])
+		assert.NotEqual(t, "random", ids[0])
+	}
+}
+
+func TestWebhooksDeliverDue(t *testing.T) {
+	var status int
+	var got *http.Request
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	var saved WebhookDelivery
+	mrc := &MockRedisClient{}
+	mrc.On("Eval", claimScript, []string{"webhooks:queue"}, mock.AnythingOfType("[]string")).
+		Return([]interface{}{"d1"}, nil)
+	mrc.On("Get", "webhooks:deliveries:d1").
+		Return(`{"id":"d1","webhook_id":"w1","event":"created","payload":{"id":"d1"},"status":"pending"}`, nil)
+	mrc.On("HGet", "webhooks:subscriptions", "w1").
+		Return(`{"id":"w1","url":"`+ts.URL+`","events":["created"],"secret":"secret"}`, nil)
+	mrc.On("Set", "webhooks:deliveries:d1", mock.AnythingOfType("string"), webhookDeliveryTTL).
+		Run(func(args mock.Arguments) {
+			saved = WebhookDelivery{}
+			assert.NoError(t, json.Unmarshal([]byte(args.String(1)), &saved))
+		}).Return("OK", nil)
+	mrc.On("ZAdd", "webhooks:queue", mock.AnythingOfType("float64"), "d1").Return(int64(0), nil).Once()
+	mrc.On("ZRem", "webhooks:queue", []string{"d1"}).Return(int64(1), nil)
+
+	wh, err := NewWebhooks(mrc, WebhooksBackoff(backoff.Policy{Millis: []int{1000}}))
+	assert.NoError(t, err)
+
+	// the first attempt fails, and is retried after a second.
+	status = http.StatusInternalServerError
+	n, err := wh.deliverDue(saved.CreatedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Equal(t, DeliveryPending, saved.Status)
+	assert.Equal(t, 1, saved.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, saved.ResponseStatus)
+	assert.NotNil(t, saved.NextAttemptAt)
+
+	ts64, err := strconv.ParseInt(got.Header.Get(HeaderWebhookTimestamp), 10, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"d1"}`, string(body))
+	assert.Equal(t, "d1", got.Header.Get(HeaderWebhookDelivery))
+	assert.Equal(t, "created", got.Header.Get(HeaderWebhookEvent))
+	assert.Equal(t, SignWebhook("secret", ts64, body), got.Header.Get(HeaderWebhookSignature))
+
+	status = http.StatusNoContent
+	_, err = wh.deliverDue(saved.CreatedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, DeliverySucceeded, saved.Status)
+	assert.Nil(t, saved.NextAttemptAt)
+
+	// without retries left, the delivery fails.
+	status = http.StatusGone
+	wh.policy = backoff.Policy{}
+	_, err = wh.deliverDue(saved.CreatedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, DeliveryFailed, saved.Status)
+	assert.Equal(t, "webhook responded with 410 Gone", saved.Error)
+
+	mrc.AssertExpectations(t)
+}
+
+func TestAppWebhooks(t *testing.T) {
+	mrc := &MockRedisClient{}
+	mrc.On("HSet", "webhooks:subscriptions", "w1", mock.AnythingOfType("string")).Return(true, nil)
+	mrc.On("HGetAllMap", "webhooks:subscriptions").Return(map[string]string{
+		"w1": `{"id":"w1","url":"http://example.com","events":["created"],"secret":"secret"}`,
+	}, nil)
+	mrc.On("HGet", "webhooks:subscriptions", "w2").Return("", ErrKeyNotFound)
+
+	wh, err := NewWebhooks(mrc)
+	assert.NoError(t, err)
+	wh.idGen = func() string { return "w1" }
+
+	withAppOptions(t, nil, []AppOption{AppWebhooks(wh)}, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/v1/webhooks"
+
+		p := doProblemRequest(t, "POST", u.String(), `{"url": "example.com", "events": ["viewed"], "secret": "short"}`)
+		assert.Equal(t, CodeValidationFailed, p.Code)
+		assert.Len(t, p.Errors, 3)
+
+		res, err := http.Post(u.String(), "application/json", bytes.NewBufferString(`{"url": "https://example.com/hook"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+		var created Webhook
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&created))
+		res.Body.Close()
+		assert.Equal(t, webhookEventTypes, created.Events)
+		assert.Len(t, created.Secret, 2*webhookSecretBytes)
+
+		res, err = http.Get(u.String())
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(t, err)
+		assert.JSONEq(t, `[{"id":"w1","url":"http://example.com","events":["created"],"created_at":"0001-01-01T00:00:00Z"}]`, string(b))
+
+		u.Path = "/v1/webhooks/w2/deliveries"
+		p = doProblemRequest(t, "GET", u.String(), "")
+		assert.Equal(t, CodeWebhookNotFound, p.Code)
+	})
+
+	withApp(t, nil, func(u *url.URL, mnr *MockNoteRepository, h *Health) {
+		u.Path = "/v1/webhooks"
+		p := doProblemRequest(t, "GET", u.String(), "")
+		assert.Equal(t, CodeNotFound, p.Code)
+	})
+}